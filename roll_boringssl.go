@@ -10,15 +10,298 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
+// Records the outcome of a roll. It is written as JSON if --manifest is given.
+type manifest struct {
+	Revision         string   `json:"revision"`
+	PreviousRevision string   `json:"previous_revision,omitempty"`
+	TreeUnchanged    bool     `json:"tree_unchanged,omitempty"` // Set if --no-op-if-identical-tree skipped the roll.
+	BindgenVersion   string   `json:"bindgen_version,omitempty"`
+	BuildFormats     []string `json:"build_formats,omitempty"`
+	Generator        string   `json:"generator,omitempty"` // Set if the generator was not upstream's.
+	FailedStep       string   `json:"failed_step,omitempty"`
+
+	// The details below are only gathered if --manifest or --report is given.
+	Commits             []manifestCommit  `json:"commits,omitempty"`
+	CommitCount         int               `json:"commit_count,omitempty"` // May exceed len(Commits) if the changelog was truncated.
+	DiffStat            *diffStat         `json:"diff_stat,omitempty"`    // nil if the upstream range was not diffed.
+	Added               []string          `json:"added,omitempty"`
+	Removed             []string          `json:"removed,omitempty"`
+	PreviousSourcesSize int64             `json:"previous_sources_size,omitempty"`
+	SourcesSize         int64             `json:"sources_size,omitempty"`
+	Steps               []stepTiming      `json:"steps,omitempty"`
+	Outputs             map[string]string `json:"outputs,omitempty"` // The SHA-256 of each file the steps wrote, other than in src.
+	GeneratorWarnings   []string          `json:"generator_warnings,omitempty"`
+	GeneratorBlob       string            `json:"generator_blob,omitempty"` // The git blob hash of the generator the build files were generated with.
+	Patches             []patchHealth     `json:"patches,omitempty"`
+	Advisories          []advisoryFinding `json:"advisories,omitempty"` // The advisories of --report-cves the roll fixes or is still affected by.
+	Licenses            *licenseScan      `json:"licenses,omitempty"`   // nil unless --license-scanner is given.
+}
+
+// An upstream commit rolled in, as recorded in the manifest.
+type manifestCommit struct {
+	SHA1     string `json:"sha1"`
+	Subject  string `json:"subject"`
+	Security bool   `json:"security,omitempty"`
+}
+
+// The volume of the upstream changes rolled in, as git diff --shortstat and --dirstat report it.
+type diffStat struct {
+	Files      int       `json:"files"`
+	Insertions int       `json:"insertions"`
+	Deletions  int       `json:"deletions"`
+	Dirs       []dirStat `json:"dirs,omitempty"`
+}
+
+// The share of the changed lines in a directory, as recorded in the manifest.
+type dirStat struct {
+	Percent float64 `json:"percent"`
+	Dir     string  `json:"dir"`
+}
+
+// How long a step of the roll took, as recorded in the manifest.
+type stepTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	Timeout string  `json:"timeout,omitempty"` // The timeout the step ran under and where it was set, if any.
+}
+
+// Options controlling a roll.
+type rollOptions struct {
+	commit                string
+	commitFallbacks       []string // Only the default commit falls back.
+	branches              []string
+	branchStrategy        string
+	upstreamURL           string
+	shallow               bool
+	minAge                time.Duration
+	asOf                  string // Roll to the last commit of --commit before this date, as git rev-list --before takes.
+	jobs                  int
+	timeout               time.Duration            // If positive, how long a step without a --step-timeout may run.
+	stepTimeouts          map[string]time.Duration // How long each named step may run.
+	heartbeatInterval     time.Duration            // If positive, how often to log that a step is still running.
+	maxRuntimeWarn        time.Duration            // If positive, how long a step without a --step-budget may run before a warning.
+	stepBudgets           map[string]time.Duration // How long each named step may run before a warning.
+	requireLinear         bool
+	requireSignedTags     bool
+	trustedKeys           []string // The fingerprints or key IDs --require-signed-tags accepts signatures from.
+	upstreamBranch        string   // The branch of src the target must be on, if set.
+	allowOffBranch        bool
+	validateHook          string
+	manifestPath          string
+	bindgenExpected       string
+	bindgenStrict         bool
+	checkBindgenHeaders   bool     // Set by --fail-on-deleted-referenced-header.
+	bindgenHeaders        string   // If set, a file listing more headers bindgen reads, relative to src.
+	bindgenFlags          []string // The flags bindgen.sh is expected to pass bindgen, set by --expected-bindgen-flag.
+	strictBindgenFlags    bool
+	resume                bool
+	sandbox               bool
+	sinceLastGreen        bool
+	excludes              []string
+	includeTests          []string
+	skip                  []string
+	subtree               string
+	mirrorDir             string // If set, a subset of src is mirrored to src in this directory.
+	mirrorSubtree         string
+	mirrorExcludes        []string
+	tarballURL            string
+	expectedSHA256        string
+	cargoUpdateDir        string // If set, the crate directory in which to cargo update boringssl-sys when the bindings change.
+	archiveFormat         string // The format of the --tarball-url archive, one of archiveFormats; tar.gz if empty.
+	preserveMtime         bool
+	ioBuffer              int
+	maxFileSize           int64
+	allowLargeFiles       bool
+	vcsMetadata           string
+	touchOnlyChanged      bool
+	stripComponents       int
+	downloadDir           string
+	downloadRateLimit     int64
+	cacheDir              string
+	cacheMaxEntries       int
+	cacheMaxSize          int64
+	fileMode, dirMode     os.FileMode
+	noExportIgnore        bool
+	writeChecksums        bool
+	checksumGenerated     bool // List the generated files in the checksums too, writing them after generation.
+	casDir                string
+	casManifest           string // Defaults to manifests/<revision> in casDir.
+	allowCaseCollisions   bool
+	buildFormats          []string
+	generator             string
+	generatorScript       string
+	generatorArtifacts    []string
+	generatorWarnings     []string // Regexps matching the lines of generator output that are warnings.
+	checkDeterminism      bool
+	asmArchs              []string
+	scopedGenerate        bool
+	onlyChangedFormats    bool
+	forceAllFormats       bool
+	compareGenerated      bool
+	explainDiff           bool
+	reportUpstreamGen     bool
+	reportDuplicates      bool
+	strictUTF8            bool
+	sourcesOnly           bool     // Run only the sources step, for a look at the upstream changes.
+	noOpIfIdenticalTree   bool     // Skip the steps after sources if the kept files did not change.
+	readmeIfIdenticalTree bool     // Still write the new revision to the README when they did not.
+	advisoryFeed          string   // The URL or file of the advisories --report-cves checks the roll against.
+	preGeneratePatches    string   // The directory of the patches to src applied before generating build files.
+	postGeneratePatches   string   // The directory of the patches to the boringssl directory applied after.
+	upstreamGenerated     []string // Globs of the upstream files upstream generates, such as test vectors.
+	licenseScanner        string   // A shell command printing the license of each file in src, given as $1.
+	allowedLicenses       []string // The SPDX identifiers the license scan may find.
+	allowAbsolutePaths    bool
+	forbiddenPatterns     []string // Regexps of what the generated build files must not contain.
+	goldenDir             string   // If set, where the golden copies of the generated build files are.
+	goldenFiles           []string // Globs of the generated build files to compare with goldens; all if empty.
+	updateGolden          bool
+	allowDanglingIncludes bool
+	dryRunNetwork         bool
+	noFetch               bool
+	keepGoing             bool // Set by --fail-fast=false.
+	referencedPaths       []string
+	referencedPathsFile   string
+	strictReferenced      bool
+	checkFIPS             bool
+	fipsFiles             []string
+	checkSymbols          bool
+	strictSymbols         bool
+	verifyClean           bool
+	cleanGenerated        bool
+	strictHistory         bool
+	versionHeader         bool
+	versionHeaderPath     string
+	diskHeadroom          uint64
+	changelogPath         string
+	changelogMaxCommits   int
+	changelogFormat       string
+	upstreamChangelogs    []string
+	compareURL            string
+	reportPath            string
+	envFilePath           string // Where to write ROLL_* variables for CI, even if the roll fails.
+	commitURL             string
+	securityKeywords      []string
+	changelogExcludes     []string // Regexps of the subjects of commits to leave out of the changelog.
+	autoCommit            bool
+	commitSubjectPrefix   string
+	bugs                  []string
+	signCommit            bool
+	commitPerStep         bool
+	useGitNotes           bool // Record the roll in a git note on its commit rather than in the README.
+	strictSecurity        bool
+	allowedAuthors        []string
+	reviewThreshold       int
+	changelogReviewed     bool
+	expectCommits         int
+
+	// If set, the roll is skipped when the sources are already at the resolved revision.
+	skipIfCurrent bool
+
+	// If set, the resolved roll and |planSettings| are written to this path instead of rolling.
+	planOut      string
+	planSettings map[string]interface{}
+
+	// If set, the roll is to the revision in this plan.
+	plan           *rollPlan
+	allowPlanDrift bool
+}
+
+// A flag that may be repeated, collecting each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func (f *stringsFlag) Get() interface{} {
+	return append([]string{}, *f...)
+}
+
+// A repeatable flag of step=duration settings. In a config file it is an object of step names to
+// durations.
+type stepDurationsFlag map[string]time.Duration
+
+func (f *stepDurationsFlag) String() string {
+	var settings []string
+	for name, d := range *f {
+		settings = append(settings, name+"="+d.String())
+	}
+	sort.Strings(settings)
+	return strings.Join(settings, ",")
+}
+
+func (f *stepDurationsFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("%q is not STEP=DURATION", v)
+	}
+	known := false
+	for _, name := range stepNames {
+		known = known || name == kv[0]
+	}
+	if !known {
+		return fmt.Errorf("unknown step %q; the steps are %s", kv[0], strings.Join(stepNames, ", "))
+	}
+	d, err := time.ParseDuration(kv[1])
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%q is not a positive duration like 20m", kv[1])
+	}
+	if *f == nil {
+		*f = make(stepDurationsFlag)
+	}
+	(*f)[kv[0]] = d
+	return nil
+}
+
+func (f *stepDurationsFlag) Get() interface{} {
+	settings := make(map[string]string)
+	for name, d := range *f {
+		settings[name] = d.String()
+	}
+	return settings
+}
+
 // Returns the path to the boringssl directory.
 func configure() string {
 	log.Println("Configuring...")
@@ -26,95 +309,10082 @@ func configure() string {
 	if !ok {
 		log.Fatal("failed to find current executable")
 	}
-	return filepath.Dir(file)
+	return filepath.Dir(file)
+}
+
+// Where the log and the output of subprocesses are written.
+var logOutput io.Writer = os.Stderr
+
+// The environment variables --clean-env keeps by default.
+var defaultEnvAllowlist = []string{"PATH", "HOME", "TMPDIR", "FUCHSIA_DIR"}
+
+// If not nil, the whole environment the generators and bindgen run with instead of ours, as set
+// by --clean-env.
+var toolEnviron []string
+
+// The variables --abort-on-generator-nondeterminism fixes in the generators' environment: the
+// timestamp reproducible builds embed instead of the time, and the seed of python's string hashing,
+// on which the order of sets and of dicts built from them depends.
+var deterministicGeneratorEnv = []string{"SOURCE_DATE_EPOCH=0", "PYTHONHASHSEED=0"}
+
+// The variables, in the form "NAME=value", added to the generators' environment; set to
+// deterministicGeneratorEnv by --abort-on-generator-nondeterminism.
+var generatorEnv []string
+
+// Limits on the resources of a command; zero for none.
+type resourceLimits struct {
+	memoryMiB int64         // Of virtual memory.
+	cpu       time.Duration // Of CPU time, rounded up to whole seconds.
+}
+
+// Returns |r| as --tool-memory-limit and --tool-cpu-limit would be given.
+func (r resourceLimits) String() string {
+	var limits []string
+	if r.memoryMiB > 0 {
+		limits = append(limits, fmt.Sprintf("%d MiB of memory", r.memoryMiB))
+	}
+	if r.cpu > 0 {
+		limits = append(limits, fmt.Sprintf("%s of CPU time", r.cpu))
+	}
+	return strings.Join(limits, " and ")
+}
+
+// The limits the generators and bindgen run under, set by --tool-memory-limit and --tool-cpu-limit.
+var toolLimits resourceLimits
+
+// Returns |cmd| run by sh under |limits|, which ulimit sets with setrlimit before exec'ing it, so
+// that a runaway command fails rather than exhausting the machine. Only the soft CPU time limit is
+// set, so that exceeding it raises SIGXCPU rather than SIGKILL. Without limits, or on Windows, which
+// has no rlimits, |cmd| is returned as it is.
+func limitResources(cmd *exec.Cmd, limits resourceLimits) *exec.Cmd {
+	if limits == (resourceLimits{}) || runtime.GOOS == "windows" {
+		return cmd
+	}
+	var script []string
+	if limits.memoryMiB > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", limits.memoryMiB<<10))
+	}
+	if limits.cpu > 0 {
+		script = append(script, fmt.Sprintf("ulimit -S -t %d", int64((limits.cpu+time.Second-1)/time.Second)))
+	}
+	script = append(script, `exec "$0" "$@"`)
+	limited := exec.Command("sh", append([]string{"-c", strings.Join(script, " && "), cmd.Args[0]}, cmd.Args[1:]...)...)
+	limited.Dir, limited.Env = cmd.Dir, cmd.Env
+	limited.Stdin, limited.Stdout, limited.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	return limited
+}
+
+// The container the generators and bindgen run in, set by --container and --container-runtime.
+type container struct {
+	runtime string // docker or podman, or another client taking the same arguments.
+	image   string // Empty to run on the host.
+}
+
+// The container the generators and bindgen run in.
+var toolContainer container
+
+// Returns the container runtime on the PATH, docker or else podman, or an error if there is neither.
+func detectContainerRuntime() (string, error) {
+	for _, name := range []string{"docker", "podman"} {
+		if _, err := lookPath(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", errors.New("found neither docker nor podman on the PATH; give one with --container-runtime")
+}
+
+// Returns |cmd| run by |c|'s runtime in a new container of |c|'s image, with |cmd|'s directory
+// bind-mounted at the same path, as is the target of a src symlink in it, so that paths mean the
+// same inside and out. The command runs as the invoking user, so that what it writes is theirs,
+// and is given the variables |cmd| adds to the roller's environment, and |limits|. Its output
+// streams to |cmd|'s.
+func containerCommand(cmd *exec.Cmd, c container, limits resourceLimits) *exec.Cmd {
+	args := []string{"run", "--rm"}
+	if cmd.Dir != "" {
+		dir, err := filepath.Abs(cmd.Dir)
+		if err != nil {
+			dir = cmd.Dir
+		}
+		args = append(args, "-v", dir+":"+dir, "-w", dir)
+		if src, err := filepath.EvalSymlinks(filepath.Join(dir, "src")); err == nil && !strings.HasPrefix(src, dir+string(filepath.Separator)) {
+			args = append(args, "-v", src+":"+src)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		args = append(args, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	host := map[string]bool{}
+	for _, kv := range os.Environ() {
+		host[kv] = true
+	}
+	for _, kv := range cmd.Env {
+		if !host[kv] {
+			args = append(args, "-e", kv)
+		}
+	}
+	if limits.memoryMiB > 0 {
+		args = append(args, fmt.Sprintf("--memory=%dm", limits.memoryMiB))
+	}
+	if limits.cpu > 0 {
+		secs := int64((limits.cpu + time.Second - 1) / time.Second)
+		args = append(args, fmt.Sprintf("--ulimit=cpu=%d:%d", secs, secs))
+	}
+	args = append(append(args, c.image), cmd.Args...)
+	contained := exec.Command(c.runtime, args...)
+	contained.Stdin, contained.Stdout, contained.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	return contained
+}
+
+// Returns |cmd| as it should run: in toolContainer if there is one, or else under toolLimits.
+func toolCommand(cmd *exec.Cmd) *exec.Cmd {
+	if toolContainer.image != "" {
+		return containerCommand(cmd, toolContainer, toolLimits)
+	}
+	return limitResources(cmd, toolLimits)
+}
+
+// Runs |cmd| in toolContainer or under toolLimits, explaining a failure the limits may have caused.
+func runLimited(cmd *exec.Cmd) error {
+	limited := toolCommand(cmd)
+	err := run(limited)
+	if err == nil || limited == cmd {
+		return err
+	}
+	if toolContainer.image != "" {
+		if toolLimits == (resourceLimits{}) {
+			return fmt.Errorf("%s: it ran in %s", err, toolContainer.image)
+		}
+		return fmt.Errorf("%s: it ran in %s limited to %s, which it may have exceeded", err, toolContainer.image, toolLimits)
+	}
+	if limited.ProcessState != nil {
+		if ws, ok := limited.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGXCPU {
+			return fmt.Errorf("%s: it exceeded its limit of %s of CPU time", err, toolLimits.cpu)
+		}
+	}
+	return fmt.Errorf("%s: it ran limited to %s, which it may have exceeded", err, toolLimits)
+}
+
+// Returns the variables of |environ|, in the form "NAME=value", that are named in |allow|.
+func cleanEnv(environ, allow []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, a := range allow {
+			if name == a {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+// Returns the environment for the generators and bindgen, with |extra| added.
+func toolEnv(extra ...string) []string {
+	env := toolEnviron
+	if env == nil {
+		env = os.Environ()
+	}
+	return append(append([]string{}, env...), extra...)
+}
+
+// Tees the log, as written to logOutput, to a new, timestamped file in |logDir|, returning the
+// file's path and a function that closes it. If the file cannot be created, a warning is logged
+// and the path is empty.
+func teeLog(logDir string) (string, func()) {
+	name := filepath.Join(logDir, time.Now().Format("roll-20060102-150405.log"))
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Printf("WARNING: failed to create %s; logging to the console only: %s", logDir, err)
+		return "", func() {}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		log.Printf("WARNING: failed to create %s; logging to the console only: %s", name, err)
+		return "", func() {}
+	}
+	console := logOutput
+	logOutput = io.MultiWriter(console, f)
+	log.SetOutput(logOutput)
+	return name, func() {
+		logOutput = console
+		log.SetOutput(logOutput)
+		if err := f.Close(); err != nil {
+			log.Printf("failed to close %s: %s", name, err)
+		}
+	}
+}
+
+// Sends the output of |cmd| to the writer of |l|, unless it is already redirected, and returns it.
+func withLog(l *log.Logger, cmd *exec.Cmd) *exec.Cmd {
+	if cmd.Stdout == nil {
+		cmd.Stdout = l.Writer()
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = l.Writer()
+	}
+	return cmd
+}
+
+// Set by --no-network, under which commands that may reach the network are refused before they run
+// and nothing is downloaded.
+var noNetwork bool
+
+// The client of every HTTP request the roller makes: tarball downloads, their --dry-run-network
+// checks, and the GitHub API. rollMain replaces it with one configured by the HTTP flags.
+var httpClient = http.DefaultClient
+
+// Returns the network to dial for |network|, with IPv4 forced if |forceIPv4| is set.
+func dialNetwork(network string, forceIPv4 bool) string {
+	if forceIPv4 && (network == "tcp" || network == "tcp6") {
+		return "tcp4"
+	}
+	return network
+}
+
+// Returns an HTTP client that connects through |proxy|, or the proxy $HTTPS_PROXY, $HTTP_PROXY and
+// $NO_PROXY choose if it is empty, only over IPv4 if |forceIPv4| is set. If |timeout| is positive,
+// each request, including reading its response, must complete within it.
+func newHTTPClient(proxy string, forceIPv4 bool, timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid --http-proxy %q; want a URL like http://proxy:3128", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, dialNetwork(network, forceIPv4), addr)
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// The git commands that may reach a remote repository.
+var networkGitCommands = map[string]bool{"clone": true, "fetch": true, "ls-remote": true, "pull": true, "push": true, "remote": true, "submodule": true}
+
+// Returns whether the git repository |url| is a local path rather than a remote.
+func isLocalRepo(url string) bool {
+	return filepath.IsAbs(url) || strings.HasPrefix(url, "file://") || strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../")
+}
+
+// With --no-network, returns an error if |cmd| is a git command that may reach a remote: one of
+// networkGitCommands whose repository is not a local path.
+func checkNetwork(cmd *exec.Cmd) error {
+	if !noNetwork || len(cmd.Args) == 0 || filepath.Base(cmd.Args[0]) != "git" {
+		return nil
+	}
+	args := cmd.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-C" || args[0] == "-c" {
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || !networkGitCommands[args[0]] {
+		return nil
+	}
+	for _, a := range args[1:] {
+		if !strings.HasPrefix(a, "-") {
+			if isLocalRepo(a) {
+				return nil
+			}
+			break
+		}
+	}
+	return fmt.Errorf("refusing to run %s: it may reach the network, which --no-network forbids", cmd.Args)
+}
+
+// Runs |cmd|, returning an error naming the command if it fails. Unless redirected, the
+// command's output goes to the log.
+func run(cmd *exec.Cmd) error {
+	if err := checkNetwork(cmd); err != nil {
+		return err
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = logOutput
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = logOutput
+	}
+	if err := startTracked(cmd); err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	if err := waitTracked(cmd); err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	return nil
+}
+
+// The commands started by run and output that have not yet exited, which a step that times out
+// kills.
+var running = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]bool
+}{cmds: make(map[*exec.Cmd]bool)}
+
+// Starts a command for run and output; replaced in tests.
+var startCommand = (*exec.Cmd).Start
+
+// Starts |cmd|, recording it as running until waitTracked.
+func startTracked(cmd *exec.Cmd) error {
+	running.Lock()
+	defer running.Unlock()
+	if err := startCommand(cmd); err != nil {
+		return err
+	}
+	running.cmds[cmd] = true
+	return nil
+}
+
+// Waits for |cmd|, started with startTracked, to exit.
+func waitTracked(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	running.Lock()
+	delete(running.cmds, cmd)
+	running.Unlock()
+	return err
+}
+
+// Kills the commands started with startTracked that are still running, returning how many.
+func killRunning() int {
+	running.Lock()
+	defer running.Unlock()
+	for cmd := range running.cmds {
+		cmd.Process.Kill()
+	}
+	return len(running.cmds)
+}
+
+// Runs |cmd| and returns its standard output with surrounding whitespace removed. Unless
+// redirected, the command's standard error goes to the log.
+func output(cmd *exec.Cmd) ([]byte, error) {
+	if err := checkNetwork(cmd); err != nil {
+		return nil, err
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = logOutput
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := startTracked(cmd); err != nil {
+		return nil, fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	if err := waitTracked(cmd); err != nil {
+		return nil, fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	return bytes.TrimSpace(out.Bytes()), nil
+}
+
+// The temporary files and directories and the locks a roll holds, so that --ensure-clean-exit can
+// report any it leaves behind.
+type resourceRegistry struct {
+	mu   sync.Mutex
+	held map[string]string // What each held path is.
+}
+
+var resources = &resourceRegistry{held: make(map[string]string)}
+
+// Records that |path|, a |kind| of resource, is held until released.
+func (r *resourceRegistry) acquire(kind, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held[path] = kind
+}
+
+func (r *resourceRegistry) release(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.held, path)
+}
+
+// Returns the resources that are held and still exist, sorted. One that was renamed into place
+// was handed off rather than leaked.
+func (r *resourceRegistry) leaks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var leaks []string
+	for path, kind := range r.held {
+		if _, err := os.Lstat(path); err == nil {
+			leaks = append(leaks, kind+" "+path)
+		}
+	}
+	sort.Strings(leaks)
+	return leaks
+}
+
+// Like ioutil.TempDir, but the directory is held in |resources| until removeTemp removes it.
+func tempDir(dir, pattern string) (string, error) {
+	tmp, err := ioutil.TempDir(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	resources.acquire("temporary directory", tmp)
+	return tmp, nil
+}
+
+// Removes the temporary file or directory |path| and releases it.
+func removeTemp(path string) error {
+	err := os.RemoveAll(path)
+	resources.release(path)
+	return err
+}
+
+// Logs a warning for each resource that is still held, and returns them.
+func reportLeaks() []string {
+	leaks := resources.leaks()
+	for _, l := range leaks {
+		log.Printf("WARNING: leaked %s", l)
+	}
+	return leaks
+}
+
+const lockName = ".roll.lock"
+
+// Takes the roll lock in |dir|, which serializes rolls. The returned function releases it.
+func lock(dir string) (func(), error) {
+	path := filepath.Join(dir, lockName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("another roll is in progress; remove %s if it is stale", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", path, err)
+	}
+	resources.acquire("lock", path)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close %s: %s", path, err)
+	}
+	return func() {
+		if err := os.Remove(path); err != nil {
+			log.Printf("failed to remove %s: %s", path, err)
+		}
+		resources.release(path)
+	}, nil
+}
+
+// The full hex SHA-1 of an upstream commit.
+type revision string
+
+var revisionRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Validates that |s| is a full, lowercase hex SHA-1.
+func parseRevision(s string) (revision, error) {
+	if !revisionRE.MatchString(s) {
+		return "", fmt.Errorf("%q is not a full commit SHA-1", s)
+	}
+	return revision(s), nil
+}
+
+// Returns the abbreviated form of the revision, for logging.
+func (r revision) short() string {
+	if len(r) < 12 {
+		return string(r)
+	}
+	return string(r[:12])
+}
+
+// Returns the commit that |commit| names in the git checkout in |dir|. Tags are peeled to the
+// commit they point at.
+func revParse(dir, commit string) (revision, error) {
+	out, err := output(exec.Command("git", "-C", dir, "rev-parse", "--verify", "--end-of-options", commit+"^{commit}"))
+	if err != nil {
+		return "", err
+	}
+	return parseRevision(string(out))
+}
+
+// The remote-tracking branches tried, in order, when the default commit-ish does not exist:
+// upstream renamed its branch to main, and some mirrors have no upstream/ prefix.
+var defaultCommitFallbacks = []string{"origin/upstream/main", "origin/master", "origin/main"}
+
+// Returns the revision that |commit| resolves to in the git checkout |dir|. If it does not
+// resolve, each of |fallbacks| is tried in turn and the first that does is used.
+func revParseFallback(dir, commit string, fallbacks []string) (revision, error) {
+	sha1, err := revParse(dir, commit)
+	if err == nil || len(fallbacks) == 0 {
+		return sha1, err
+	}
+	for _, ref := range fallbacks {
+		if sha1, err := revParse(dir, ref); err == nil {
+			log.Printf("%s does not exist; using %s", commit, ref)
+			return sha1, nil
+		}
+	}
+	tried := append([]string{commit}, fallbacks...)
+	return "", fmt.Errorf("none of %s exist in %s; name the upstream commit with --commit", strings.Join(tried, ", "), dir)
+}
+
+// A failure in one of the roll's steps. Each kind of step wraps this in its own error type, so
+// that failures can be classified with errors.As.
+type stepError struct {
+	step string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return e.step + ": " + e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// Returns the name of the step that failed.
+func (e *stepError) failedStep() string {
+	return e.step
+}
+
+type (
+	sourcesError  struct{ stepError }
+	generateError struct{ stepError }
+	bindgenError  struct{ stepError }
+	readmeError   struct{ stepError }
+)
+
+// Returns the name of the step |err| came from, or "" if it did not come from a step.
+func failedStep(err error) string {
+	var se interface{ failedStep() string }
+	if errors.As(err, &se) {
+		return se.failedStep()
+	}
+	return ""
+}
+
+// Returns the kind of step that failed with |err|: sources, generate, bindgen or readme, step for
+// any other step, or "" if it did not come from a step.
+func errorKind(err error) string {
+	var (
+		sources  *sourcesError
+		generate *generateError
+		bindgen  *bindgenError
+		readme   *readmeError
+	)
+	switch {
+	case errors.As(err, &sources):
+		return "sources"
+	case errors.As(err, &generate):
+		return "generate"
+	case errors.As(err, &bindgen):
+		return "bindgen"
+	case errors.As(err, &readme):
+		return "readme"
+	case failedStep(err) != "":
+		return "step"
+	}
+	return ""
+}
+
+// Returns the exit status for a roll that failed with |err|, which depends on the kind of step
+// that failed.
+func exitStatus(err error) int {
+	switch errorKind(err) {
+	case "sources":
+		return 2
+	case "generate":
+		return 3
+	case "bindgen":
+		return 4
+	case "readme":
+		return 5
+	}
+	return 1
+}
+
+// Fetches upstream and returns the revision that the commit-ish resolves to.
+//
+// If an upstream URL is given, only the commit-ish is fetched from it, optionally without any of
+// its history. Otherwise all remotes of the src checkout are fetched.
+func resolveCommit(dir string, opts *rollOptions) (sha1 revision, err error) {
+	defer func() {
+		if err != nil {
+			err = &sourcesError{stepError{"sources", err}}
+		}
+	}()
+	if opts.tarballURL != "" || opts.expectedSHA256 != "" {
+		if opts.tarballURL == "" || opts.expectedSHA256 == "" {
+			return "", fmt.Errorf("--tarball-url and --expected-sha256 must be given together")
+		}
+		if opts.archiveFormat != "" && opts.archiveFormat != "tar.gz" && opts.archiveFormat != "zip" {
+			return "", fmt.Errorf("unknown --archive-format %q; want %s", opts.archiveFormat, strings.Join(archiveFormats, " or "))
+		}
+		if opts.asOf != "" {
+			return "", fmt.Errorf("--as-of requires the upstream history, which --tarball-url does not fetch")
+		}
+		sha1, err := parseRevision(opts.commit)
+		if err != nil {
+			return "", fmt.Errorf("--tarball-url requires --commit to be a full revision: %s", err)
+		}
+		return sha1, nil
+	}
+	if !opts.noFetch {
+		log.Println("Fetching BoringSSL sources...")
+	}
+	dir = filepath.Join(dir, "src")
+	if opts.upstreamURL == "" {
+		if opts.shallow {
+			return "", fmt.Errorf("--shallow requires --upstream-url")
+		}
+		if opts.noFetch {
+			log.Println("Resolving the BoringSSL sources without fetching, because of --no-fetch")
+		} else if err := run(exec.Command("git", "-C", dir, "fetch", "--all", "--prune")); err != nil {
+			return "", err
+		}
+		if len(opts.branches) > 0 {
+			sha1, err = branchesCommit(dir, opts.branches, opts.branchStrategy)
+		} else {
+			sha1, err = revParseFallback(dir, opts.commit, opts.commitFallbacks)
+		}
+	} else {
+		if len(opts.branches) > 0 {
+			return "", fmt.Errorf("--branches reads the branches of the remotes of src and cannot be used with --upstream-url")
+		}
+		if opts.noFetch {
+			return "", fmt.Errorf("--no-fetch cannot be used with --upstream-url, which is only read by fetching")
+		}
+		args := []string{"-C", dir, "fetch"}
+		if opts.shallow {
+			args = append(args, "--depth=1")
+		}
+		if err := run(exec.Command("git", append(args, "--", opts.upstreamURL, opts.commit)...)); err != nil {
+			return "", err
+		}
+		sha1, err = revParse(dir, "FETCH_HEAD")
+	}
+	if err != nil {
+		return "", err
+	}
+	if opts.asOf != "" {
+		if opts.shallow {
+			return "", fmt.Errorf("--as-of requires the history that --shallow does not fetch")
+		}
+		if opts.minAge > 0 {
+			return "", fmt.Errorf("--as-of and --min-age cannot be used together")
+		}
+		return asOfCommit(dir, sha1, opts.asOf)
+	}
+	if opts.minAge <= 0 {
+		return sha1, nil
+	}
+	if opts.shallow {
+		return "", fmt.Errorf("--min-age requires the history that --shallow does not fetch")
+	}
+	return oldEnough(dir, sha1, opts.minAge)
+}
+
+const defaultBranchStrategy = "intersection"
+
+// Returns the commits that all of |revs| have in common, as the merge-base of them all, in the git
+// checkout in |dir|. The result is empty if they share no history.
+var mergeBase = func(dir string, revs []revision) (revision, error) {
+	args := []string{"-C", dir, "merge-base", "--octopus"}
+	for _, r := range revs {
+		args = append(args, string(r))
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = logOutput
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && len(bytes.TrimSpace(out)) == 0 {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	return parseRevision(string(bytes.TrimSpace(out)))
+}
+
+// Returns the commit to roll to given the tips of several upstream branches, |tips|, by
+// |strategy|. The "intersection" strategy picks the newest commit merged into all of them.
+func chooseBranchCommit(dir string, tips []revision, strategy string) (revision, error) {
+	if strategy != defaultBranchStrategy {
+		return "", fmt.Errorf("unknown --branch-strategy %q; the only strategy is %q", strategy, defaultBranchStrategy)
+	}
+	sha1, err := mergeBase(dir, tips)
+	if err != nil {
+		return "", err
+	}
+	if sha1 == "" {
+		return "", fmt.Errorf("the branches share no common history")
+	}
+	return sha1, nil
+}
+
+// Returns the commit that |branches| in the git checkout in |dir| resolve to together by |strategy|.
+func branchesCommit(dir string, branches []string, strategy string) (revision, error) {
+	var tips []revision
+	for _, b := range branches {
+		sha1, err := revParse(dir, b)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Branch %s is at %s", b, sha1.short())
+		tips = append(tips, sha1)
+	}
+	sha1, err := chooseBranchCommit(dir, tips, strategy)
+	if err != nil {
+		return "", fmt.Errorf("failed to choose a commit from %s: %s", strings.Join(branches, ", "), err)
+	}
+	log.Printf("Chose %s, the %s of %s", sha1.short(), strategy, strings.Join(branches, ", "))
+	return sha1, nil
+}
+
+// An upstream commit and when it was committed.
+type datedCommit struct {
+	sha1 revision
+	time time.Time
+}
+
+// Returns the tip of |branch| in the git checkout |src| and when it was committed; replaced in
+// tests.
+var branchTip = func(src, branch string) (datedCommit, error) {
+	out, err := output(exec.Command("git", "-C", src, "rev-list", "--max-count=1", "--timestamp", "--end-of-options", branch, "--"))
+	if err != nil {
+		return datedCommit{}, err
+	}
+	commits, err := parseTimestamps(string(out))
+	if err != nil {
+		return datedCommit{}, err
+	}
+	if len(commits) != 1 {
+		return datedCommit{}, fmt.Errorf("branch %s has no commits", branch)
+	}
+	return commits[0], nil
+}
+
+// How far an upstream branch is from the rolled revision, for --compare-branches.
+type branchDistance struct {
+	branch string
+	tip    datedCommit
+	ahead  int // The commits on the branch that the rolled revision lacks.
+	behind int // The commits in the rolled revision that the branch lacks.
+}
+
+// Returns how far each of |branches| in the git checkout |src| is from |current|.
+func compareBranches(src string, current revision, branches []string) ([]branchDistance, error) {
+	var distances []branchDistance
+	for _, b := range branches {
+		tip, err := branchTip(src, b)
+		if err != nil {
+			return nil, err
+		}
+		d := branchDistance{branch: b, tip: tip}
+		if d.ahead, err = countCommits(src, current, tip.sha1); err != nil {
+			return nil, err
+		}
+		if d.behind, err = countCommits(src, tip.sha1, current); err != nil {
+			return nil, err
+		}
+		distances = append(distances, d)
+	}
+	return distances, nil
+}
+
+// Writes the --compare-branches table of |distances| from |current| to |w|.
+func formatBranchDistances(w io.Writer, current revision, distances []branchDistance) {
+	width := len("BRANCH")
+	for _, d := range distances {
+		if len(d.branch) > width {
+			width = len(d.branch)
+		}
+	}
+	fmt.Fprintf(w, "Rolled revision: %s\n\n", current.short())
+	fmt.Fprintf(w, "%-*s  %-12s  %-10s  %6s  %6s\n", width, "BRANCH", "TIP", "DATE", "AHEAD", "BEHIND")
+	for _, d := range distances {
+		fmt.Fprintf(w, "%-*s  %-12s  %-10s  %6d  %6d\n", width, d.branch, d.tip.sha1.short(), d.tip.time.UTC().Format("2006-01-02"), d.ahead, d.behind)
+	}
+}
+
+// Fetches upstream, unless --no-fetch is given, and writes to |w| how far each of |branches| is
+// from the revision the sources in |dir| are at, without rolling.
+func printBranchDistances(w io.Writer, dir string, opts *rollOptions, branches []string) error {
+	src := filepath.Join(dir, "src")
+	if !opts.noFetch {
+		log.Println("Fetching BoringSSL sources...")
+		if err := run(exec.Command("git", "-C", src, "fetch", "--all", "--prune")); err != nil {
+			return err
+		}
+	}
+	current, err := sourcesRevision(dir, opts)
+	if err != nil {
+		return err
+	}
+	distances, err := compareBranches(src, current, branches)
+	if err != nil {
+		return err
+	}
+	formatBranchDistances(w, current, distances)
+	return nil
+}
+
+// Returns the newest commit in the history of |sha1| in the git checkout |src| committed before
+// |date|, in any format git rev-list --before accepts, and whether there is one; replaced in
+// tests.
+var commitBefore = func(src string, sha1 revision, date string) (datedCommit, bool, error) {
+	out, err := output(exec.Command("git", "-C", src, "rev-list", "--max-count=1", "--timestamp", "--before="+date, string(sha1), "--"))
+	if err != nil {
+		return datedCommit{}, false, err
+	}
+	commits, err := parseTimestamps(string(out))
+	if err != nil || len(commits) == 0 {
+		return datedCommit{}, false, err
+	}
+	return commits[0], true, nil
+}
+
+// Returns the commit upstream |sha1| in the git checkout |src| pointed to as of |date|, for --as-of.
+func asOfCommit(src string, sha1 revision, date string) (revision, error) {
+	c, ok, err := commitBefore(src, sha1, date)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("no commit in the history of %s was made before %s", sha1.short(), date)
+	}
+	log.Printf("Chose %s, committed %s, as the newest commit before %s", c.sha1.short(), c.time.UTC().Format(time.RFC3339), date)
+	return c.sha1, nil
+}
+
+// Returns the commits on the first-parent history of |sha1| in the git checkout in |dir|, newest
+// first.
+func firstParentHistory(dir string, sha1 revision) ([]datedCommit, error) {
+	out, err := output(exec.Command("git", "-C", dir, "rev-list", "--first-parent", "--timestamp", string(sha1), "--"))
+	if err != nil {
+		return nil, err
+	}
+	return parseTimestamps(string(out))
+}
+
+// Parses the output of git rev-list --timestamp, which is a line of the committer time and hash
+// of each commit.
+func parseTimestamps(out string) ([]datedCommit, error) {
+	var commits []datedCommit
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		var secs int64
+		var sha1 string
+		if _, err := fmt.Sscan(line, &secs, &sha1); err != nil {
+			return nil, fmt.Errorf("unexpected git rev-list output %q", line)
+		}
+		commits = append(commits, datedCommit{revision(sha1), time.Unix(secs, 0)})
+	}
+	return commits, nil
+}
+
+// Returns the newest of |commits|, which are newest first, that was committed at least |minAge|
+// before |now|.
+func newestOlderThan(commits []datedCommit, now time.Time, minAge time.Duration) (datedCommit, bool) {
+	for _, c := range commits {
+		if !c.time.After(now.Add(-minAge)) {
+			return c, true
+		}
+	}
+	return datedCommit{}, false
+}
+
+// Returns the newest commit on the first-parent history of |sha1| in the git checkout in |dir|
+// that is at least |minAge| old.
+func oldEnough(dir string, sha1 revision, minAge time.Duration) (revision, error) {
+	commits, err := firstParentHistory(dir, sha1)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	c, ok := newestOlderThan(commits, now, minAge)
+	if !ok {
+		return "", fmt.Errorf("no commit in the history of %s is at least %s old", sha1.short(), minAge)
+	}
+	log.Printf("Chose %s, committed %s ago, as the newest commit at least %s old", c.sha1.short(), now.Sub(c.time).Round(time.Second), minAge)
+	return c.sha1, nil
+}
+
+// Returns an error suggesting the first parent if |sha1|, whose parents are |parents|, is a merge.
+func checkLinear(sha1 revision, parents []revision) error {
+	if len(parents) > 1 {
+		return fmt.Errorf("%s is a merge of %d parents; roll to its first parent %s instead, or omit --require-linear", sha1.short(), len(parents), parents[0])
+	}
+	return nil
+}
+
+// Returns the machine-readable status output of `git verify-tag --raw` of the tag object |tag| in
+// the git checkout |src|, failing if its signature does not verify; replaced in tests.
+var verifyTag = func(src, tag string) (string, error) {
+	var status bytes.Buffer
+	cmd := exec.Command("git", "-C", src, "verify-tag", "--raw", tag)
+	cmd.Stderr = &status
+	if err := run(cmd); err != nil {
+		return status.String(), fmt.Errorf("%s: %s", err, strings.TrimSpace(status.String()))
+	}
+	return status.String(), nil
+}
+
+// Matches a VALIDSIG line of GnuPG status output, capturing the fingerprint of the signing key and
+// of its primary key.
+var validSigRE = regexp.MustCompile(`(?m)^\[GNUPG:\] VALIDSIG ([0-9A-Fa-f]+) .* ([0-9A-Fa-f]+)\s*$`)
+
+// For --require-signed-tags, checks that |commit|, if it names a tag in the git checkout |src|, is
+// an annotated tag with a good signature by one of the |trusted| keys, given as fingerprints or the
+// key IDs they end with. A |commit| that is not a tag is left to the other checks.
+func checkTagSignature(src, commit string, trusted []string) error {
+	tag := "refs/tags/" + strings.TrimPrefix(commit, "refs/tags/")
+	if _, err := output(exec.Command("git", "-C", src, "rev-parse", "--verify", "--quiet", tag)); err != nil {
+		log.Printf("%s is not a tag, so --require-signed-tags does not apply", commit)
+		return nil
+	}
+	kind, err := output(exec.Command("git", "-C", src, "cat-file", "-t", tag))
+	if err != nil {
+		return err
+	}
+	if string(kind) != "tag" {
+		return fmt.Errorf("%s is a lightweight tag, which cannot be signed; --require-signed-tags requires an annotated, signed tag", commit)
+	}
+	status, err := verifyTag(src, tag)
+	if err != nil {
+		return fmt.Errorf("the tag %s is not signed with a valid signature: %s", commit, err)
+	}
+	m := validSigRE.FindStringSubmatch(status)
+	if m == nil {
+		return fmt.Errorf("git verify-tag of %s reported no valid signature", commit)
+	}
+	for _, key := range trusted {
+		key = strings.ToUpper(strings.TrimPrefix(key, "0x"))
+		for _, fpr := range m[1:] {
+			if strings.HasSuffix(strings.ToUpper(fpr), key) {
+				log.Printf("The tag %s is signed by the trusted key %s", commit, fpr)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the tag %s is signed by %s, which is not one of --trusted-key %s", commit, m[1], strings.Join(trusted, ", "))
+}
+
+// For --upstream-branch, checks that |sha1| is on |branch| in the git checkout |src|, so that a
+// commit from some other branch that was fetched is not rolled to. With |allow|, a commit that is
+// not only draws a warning.
+func checkOnBranch(src string, sha1 revision, branch string, allow bool) error {
+	tip, err := branchTip(src, branch)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --upstream-branch %s: %s", branch, err)
+	}
+	ok, err := isAncestor(src, sha1, tip.sha1)
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Printf("%s is on %s", sha1.short(), branch)
+		return nil
+	}
+	if allow {
+		log.Printf("WARNING: %s is not on %s; rolling to it anyway because of --allow-offbranch", sha1.short(), branch)
+		return nil
+	}
+	return fmt.Errorf("%s is not on the upstream branch %s; roll to a commit on it, or pass --allow-offbranch", sha1.short(), branch)
+}
+
+// Returns the parents of |sha1| in the git checkout in |dir|.
+func parents(dir string, sha1 revision) ([]revision, error) {
+	out, err := output(exec.Command("git", "-C", dir, "rev-list", "--parents", "-n1", string(sha1), "--"))
+	if err != nil {
+		return nil, err
+	}
+	var parents []revision
+	for _, p := range strings.Fields(string(out))[1:] {
+		parents = append(parents, revision(p))
+	}
+	return parents, nil
+}
+
+// Returns the revision the BoringSSL sources in |dir| are at. Extracted sources are not a git
+// checkout, so their revision is the one recorded in the README.
+func sourcesRevision(dir string, opts *rollOptions) (revision, error) {
+	if opts.tarballURL != "" {
+		return readReadMeRevision(dir)
+	}
+	return currentRevision(dir)
+}
+
+// Returns the revision the BoringSSL sources are currently checked out at.
+func currentRevision(dir string) (revision, error) {
+	return revParse(filepath.Join(dir, "src"), "HEAD")
+}
+
+// Returns whether the slash-separated path |name|, or any directory containing it, matches the
+// glob |pattern|.
+func matchPath(pattern, name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Updates BoringSSL sources to the given revision.
+func updateSources(dir string, sha1 revision, opts *rollOptions) error {
+	_, err := checkoutSources(dir, sha1, opts, false)
+	return err
+}
+
+// Updates BoringSSL sources to the given revision, returning whether, with |keepIdentical| set,
+// the files it keeps were byte-identical to those already in src, in which case src keeps any
+// changes made to it since, such as the pre-generate patches.
+//
+// Files matching any of the excludes are left out of the checkout entirely using a sparse
+// checkout. Unless allowed, it is an error for two paths that would be checked out to differ only
+// in case, as one would clobber the other on a case-insensitive file system.
+func checkoutSources(dir string, sha1 revision, opts *rollOptions, keepIdentical bool) (identical bool, err error) {
+	defer func() {
+		if err != nil {
+			err = &sourcesError{stepError{"sources", err}}
+		}
+	}()
+	if err := checkDiskSpace(dir, opts.diskHeadroom<<20); err != nil {
+		return false, err
+	}
+	log.Println("Updating BoringSSL sources...")
+	if opts.tarballURL != "" {
+		return extractSources(dir, sha1, opts, keepIdentical)
+	}
+	dir = filepath.Join(dir, "src")
+	if keepIdentical {
+		if identical, err = sameKeptFiles(dir, sha1, opts); err != nil {
+			return false, err
+		}
+	}
+	// The pre-generate patches of the last roll leave src modified; discard them to apply afresh,
+	// unless the files are identical, when git carries them over to the new revision.
+	checkout := []string{"checkout", string(sha1)}
+	if names, _ := patchFiles(patchesDir(filepath.Dir(dir), opts.preGeneratePatches)); len(names) > 0 && !identical {
+		checkout = []string{"checkout", "--force", string(sha1)}
+	}
+	files, err := listTree(dir, sha1)
+	if err != nil {
+		return false, err
+	}
+	_, excluded, err := selectFiles(files, sha1, opts, false)
+	if err != nil {
+		return false, err
+	}
+	if err := sparseCheckout(dir, opts.subtree, excluded); err != nil {
+		return false, err
+	}
+	return identical, run(exec.Command("git", append([]string{"-C", dir}, checkout...)...))
+}
+
+// Returns the mode and object of each file of |rev| in the git checkout in |dir| that |opts| keeps
+// in src, by path.
+func keptObjects(dir string, rev revision, opts *rollOptions) (map[string]string, error) {
+	out, err := output(exec.Command("git", "-C", dir, "ls-tree", "-r", "-z", string(rev)))
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]string)
+	var files []string
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// Each entry is "<mode> <type> <object>\t<path>".
+		i := strings.IndexByte(entry, '\t')
+		if i < 0 || !inSubtree(opts.subtree, entry[i+1:]) {
+			continue
+		}
+		files = append(files, entry[i+1:])
+		objects[entry[i+1:]] = entry[:i]
+	}
+	_, excluded, err := excludeFiles(files, opts.excludes, opts.includeTests)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range excluded {
+		delete(objects, name)
+	}
+	return objects, nil
+}
+
+// Returns whether the files of |sha1| that |opts| keeps in the git checkout |src| are the same, with
+// the same modes and contents, as those of the revision it has checked out.
+func sameKeptFiles(src string, sha1 revision, opts *rollOptions) (bool, error) {
+	current, err := keptObjects(src, "HEAD", opts)
+	if err != nil {
+		return false, err
+	}
+	next, err := keptObjects(src, sha1, opts)
+	if err != nil || len(next) != len(current) {
+		return false, err
+	}
+	for name, object := range next {
+		if current[name] != object {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Returns the SHA-256 digest of the paths, executable bits and contents of the files under |root|,
+// less .git and the checksums the roll writes, so that two trees have the same digest only if the
+// files extracted into them are byte-identical.
+func treeDigest(root string) (string, error) {
+	files, err := walkFiles(root)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, name := range files {
+		if name == checksumsName || name == ".git" || strings.HasPrefix(name, ".git/") {
+			continue
+		}
+		p := filepath.Join(root, filepath.FromSlash(name))
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		var b []byte
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			b = []byte(target)
+		} else if b, err = ioutil.ReadFile(p); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", name, info.Mode()&(os.ModeSymlink|0111), len(b))
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Splits the upstream |files| of |sha1| into those to keep in src and those to leave out, as
+// |opts| requests. If |filtered| is set, the files were left out as they were extracted, so all
+// of |files| are kept. Unless allowed, it is an error for two kept paths to differ only in case.
+func selectFiles(files []string, sha1 revision, opts *rollOptions, filtered bool) (kept, excluded []string, err error) {
+	if opts.subtree != "" {
+		if files, err = subtreeFiles(files, opts.subtree); err != nil {
+			return nil, nil, fmt.Errorf("%s at %s (%s)", err, opts.commit, sha1.short())
+		}
+	}
+	if filtered {
+		kept = files
+	} else if kept, excluded, err = excludeFiles(files, opts.excludes, opts.includeTests); err != nil {
+		return nil, nil, err
+	}
+	if collisions := caseCollisions(kept); len(collisions) > 0 {
+		for _, c := range collisions {
+			log.Printf("Paths differ only in case: %s", strings.Join(c, ", "))
+		}
+		if !opts.allowCaseCollisions {
+			return nil, nil, fmt.Errorf("%d sets of paths differ only in case and would collide on case-insensitive file systems; use --allow-case-collisions to proceed", len(collisions))
+		}
+		log.Printf("WARNING: %d sets of paths differ only in case", len(collisions))
+	}
+	return kept, excluded, nil
+}
+
+// Replaces src in |dir| with the sources of |sha1| from the extractor |opts| selects, less the
+// files |opts| leaves out. The sources are extracted beside src and swapped in, so a failed
+// extraction leaves src as it was. With |keepIdentical| set, they are not swapped in if they are
+// byte-identical to src, and whether they were is returned.
+func extractSources(dir string, sha1 revision, opts *rollOptions, keepIdentical bool) (bool, error) {
+	src := filepath.Join(dir, "src")
+	tmp, err := tempDir(dir, ".src-")
+	if err != nil {
+		return false, err
+	}
+	defer removeTemp(tmp)
+	filter, err := newFileFilter(opts.excludes, opts.includeTests, opts.subtree)
+	if err != nil {
+		return false, err
+	}
+	if opts.subtree != "" && opts.tarballURL == "" {
+		// git archive fails on a missing subtree without saying what is missing.
+		typ, err := output(exec.Command("git", "-C", src, "cat-file", "-t", string(sha1)+":"+opts.subtree))
+		if err != nil {
+			return false, fmt.Errorf("subtree %q does not exist at %s (%s)", opts.subtree, opts.commit, sha1.short())
+		} else if string(typ) != "tree" {
+			return false, fmt.Errorf("subtree %q is a file, not a directory, at %s (%s)", opts.subtree, opts.commit, sha1.short())
+		}
+	}
+	var cache *treeCache
+	cached := false
+	key := extractionKey(sha1, opts)
+	if opts.cacheDir != "" {
+		cache = &treeCache{opts.cacheDir, opts.cacheMaxEntries, opts.cacheMaxSize << 20}
+		if cached, err = cache.get(key, tmp); err != nil {
+			return false, err
+		}
+	}
+	if !cached {
+		if err := newExtractor(dir, opts, filter).extract(sha1, tmp); err != nil {
+			return false, err
+		}
+		filter.logCounts()
+		if cache != nil {
+			if err := cache.put(key, tmp); err != nil {
+				log.Printf("WARNING: failed to cache the sources of %s: %s", sha1.short(), err)
+			}
+		}
+	} else if len(opts.excludes) > 0 {
+		log.Printf("The cached sources of %s already leave out the files matching %s", sha1.short(), strings.Join(opts.excludes, ", "))
+	}
+	if err := handleVCSMetadata(tmp, opts.vcsMetadata); err != nil {
+		return false, err
+	}
+	files, err := walkFiles(tmp)
+	if err != nil {
+		return false, err
+	}
+	kept, _, err := selectFiles(files, sha1, opts, true)
+	if err != nil {
+		return false, err
+	}
+	if keepIdentical {
+		current, err := treeDigest(src)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		extracted, err := treeDigest(tmp)
+		if err != nil {
+			return false, err
+		}
+		if current == extracted {
+			log.Printf("Extracted %d files of %s, identical to those in src; leaving src as it is", len(kept), sha1.short())
+			return true, nil
+		}
+	}
+	changed := len(kept)
+	if opts.touchOnlyChanged {
+		if changed, err = reuseUnchanged(src, tmp, kept); err != nil {
+			return false, err
+		}
+	}
+	if err := replaceDir(src, tmp); err != nil {
+		return false, err
+	}
+	if opts.touchOnlyChanged {
+		log.Printf("Extracted %d files of %s into src, of which %d changed", len(kept), sha1.short(), changed)
+	} else {
+		log.Printf("Extracted %d files of %s into src", len(kept), sha1.short())
+	}
+	return false, nil
+}
+
+// Replaces the directory |dst|, if it exists, with |tmp|, which is beside it.
+func replaceDir(dst, tmp string) error {
+	old := dst + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// Replaces src in |opts|.mirrorDir with the files of src in |dir|, which holds the sources of
+// |sha1|, that are in the mirror's subtree and not left out by its excludes. As with extraction,
+// the mirror is copied beside its src and swapped in, so a failed copy leaves it as it was.
+func mirrorSources(dir string, sha1 revision, opts *rollOptions) error {
+	if err := os.MkdirAll(opts.mirrorDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %s", opts.mirrorDir, err)
+	}
+	tmp, err := tempDir(opts.mirrorDir, ".src-")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmp)
+	if err := copyTree(filepath.Join(dir, "src"), tmp, false, func(name string) bool { return name == ".git" }); err != nil {
+		return err
+	}
+	files, err := walkFiles(tmp)
+	if err != nil {
+		return err
+	}
+	kept, _, err := selectFiles(files, sha1, &rollOptions{commit: opts.commit, subtree: opts.mirrorSubtree, excludes: opts.mirrorExcludes, allowCaseCollisions: opts.allowCaseCollisions}, false)
+	if err != nil {
+		return fmt.Errorf("failed to select the files to mirror: %s", err)
+	}
+	keep := make(map[string]bool)
+	for _, name := range kept {
+		keep[name] = true
+	}
+	// Those outside the subtree are not among the excluded files, so remove all that are not kept.
+	for _, name := range files {
+		if !keep[name] {
+			if err := os.Remove(filepath.Join(tmp, filepath.FromSlash(name))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := replaceDir(filepath.Join(opts.mirrorDir, "src"), tmp); err != nil {
+		return fmt.Errorf("failed to update the mirror in %s: %s", opts.mirrorDir, err)
+	}
+	log.Printf("Mirrored %d files of %s into %s", len(kept), sha1.short(), filepath.Join(opts.mirrorDir, "src"))
+	return nil
+}
+
+// Moves each of the |files| extracted to |tmp| that is the same in |src|, in contents and mode,
+// from |src| in place of the extracted copy, so that swapping |tmp| in for |src| leaves it and its
+// modification time untouched. Returns how many of |files| are new or differ.
+func reuseUnchanged(src, tmp string, files []string) (int, error) {
+	digest := func(path string) (os.FileInfo, [sha256.Size]byte, error) {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return info, [sha256.Size]byte{}, err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, [sha256.Size]byte{}, fmt.Errorf("failed to read %s: %s", path, err)
+		}
+		return info, sha256.Sum256(b), nil
+	}
+	changed := 0
+	for _, name := range files {
+		existing := filepath.Join(src, filepath.FromSlash(name))
+		extracted := filepath.Join(tmp, filepath.FromSlash(name))
+		oldInfo, oldSum, err := digest(existing)
+		if os.IsNotExist(err) {
+			changed++
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		newInfo, newSum, err := digest(extracted)
+		if err != nil {
+			return 0, err
+		}
+		if !oldInfo.Mode().IsRegular() || oldInfo.Mode() != newInfo.Mode() || oldSum != newSum {
+			changed++
+			continue
+		}
+		if err := os.Rename(existing, extracted); err != nil {
+			return 0, fmt.Errorf("failed to keep %s: %s", name, err)
+		}
+	}
+	return changed, nil
+}
+
+// The names of version control metadata, which must not be vendored in src.
+var vcsMetadataNames = map[string]bool{".git": true, ".gitmodules": true, ".hg": true, ".svn": true}
+
+// Returns the sorted, slash-separated paths relative to |root| of the version control metadata in
+// it. A metadata directory is listed once, without its contents.
+func findVCSMetadata(root string) ([]string, error) {
+	var found []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root || !vcsMetadataNames[info.Name()] {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		found = append(found, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return sortedPaths(found), err
+}
+
+// Checks the extracted tree in |root| for version control metadata, which an archive should not
+// hold but a tarball of a checkout or of submodules may. With |mode| "fail" any found is an error;
+// with "remove" it is deleted and reported. An empty |mode| is "fail".
+func handleVCSMetadata(root, mode string) error {
+	if mode != "" && mode != "fail" && mode != "remove" {
+		return fmt.Errorf("unknown --vcs-metadata %q; want fail or remove", mode)
+	}
+	found, err := findVCSMetadata(root)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	if mode != "remove" {
+		return fmt.Errorf("the sources hold version control metadata, which must not be committed (remove it with --vcs-metadata=remove): %s", strings.Join(found, ", "))
+	}
+	for _, name := range found {
+		if err := os.RemoveAll(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("failed to remove %s: %s", name, err)
+		}
+	}
+	log.Printf("WARNING: removed version control metadata from the sources: %s", strings.Join(found, ", "))
+	return nil
+}
+
+// The size in bytes assumed for the sources when no roll has recorded it.
+const defaultSourcesSize = 1 << 30
+
+// Returns file system statistics; replaced in tests.
+var statfs = syscall.Statfs
+
+// Returns the name under which the extraction of |sha1| with |opts| is cached: the revision and a
+// hash of every option that affects what is extracted.
+func extractionKey(sha1 revision, opts *rollOptions) string {
+	settings := fmt.Sprintf("%q %q %q %t %t %o %o %d %t %d", opts.tarballURL, strings.ToLower(opts.expectedSHA256), opts.subtree,
+		opts.noExportIgnore, opts.preserveMtime, opts.fileMode, opts.dirMode, opts.maxFileSize, opts.allowLargeFiles, opts.stripComponents)
+	if opts.archiveFormat != "" && opts.archiveFormat != "tar.gz" {
+		// Appended only for other formats, so the extractions cached before --archive-format remain valid.
+		settings += fmt.Sprintf(" %q", opts.archiveFormat)
+	}
+	if len(opts.excludes) > 0 || len(opts.includeTests) > 0 {
+		// The files these leave out are not extracted, so they are part of what is cached.
+		settings += fmt.Sprintf(" %q %q", opts.excludes, opts.includeTests)
+	}
+	sum := sha256.Sum256([]byte(settings))
+	return fmt.Sprintf("%s-%x", sha1, sum[:8])
+}
+
+// A directory of extracted source trees, for --cache-dir. Each entry is a directory named by
+// extractionKey, holding the tree and the checksums of its files as they were extracted. Entries
+// are evicted least recently used first.
+type treeCache struct {
+	dir        string
+	maxEntries int   // If positive, at most this many entries are kept.
+	maxSize    int64 // If positive, the bytes the entries may take up in all.
+}
+
+// If the cache has an intact entry for |key|, hardlinks or copies its tree into |dst|, an empty
+// directory, and returns true. An entry whose files no longer match its checksums is removed.
+func (c *treeCache) get(key, dst string) (bool, error) {
+	entry := filepath.Join(c.dir, key)
+	want, err := ioutil.ReadFile(filepath.Join(entry, checksumsName))
+	if os.IsNotExist(err) {
+		log.Printf("%s is not cached in %s", key, c.dir)
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read the cache: %s", err)
+	}
+	got, err := checksums(filepath.Join(entry, "tree"))
+	if err != nil || got != string(want) {
+		log.Printf("WARNING: the cached sources for %s are damaged; removing them", key)
+		return false, os.RemoveAll(entry)
+	}
+	now := time.Now()
+	if err := os.Chtimes(entry, now, now); err != nil {
+		return false, fmt.Errorf("failed to update the cache: %s", err)
+	}
+	if err := copyTree(filepath.Join(entry, "tree"), dst, true, func(string) bool { return false }); err != nil {
+		return false, err
+	}
+	log.Printf("Reused the sources for %s from %s", key, c.dir)
+	return true, nil
+}
+
+// Adds the tree |src| to the cache as the entry for |key|, replacing any there, then evicts entries
+// until the cache is within its limits.
+func (c *treeCache) put(key, src string) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	staging, err := tempDir(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(staging)
+	tree := filepath.Join(staging, "tree")
+	if err := os.Mkdir(tree, 0755); err != nil {
+		return err
+	}
+	if err := copyTree(src, tree, true, func(string) bool { return false }); err != nil {
+		return err
+	}
+	sums, err := checksums(tree)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, checksumsName), []byte(sums), 0644); err != nil {
+		return err
+	}
+	entry := filepath.Join(c.dir, key)
+	if err := os.RemoveAll(entry); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, entry); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// Removes the least recently used entries beyond the limits of the cache.
+func (c *treeCache) evict() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var entries []os.FileInfo
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().After(entries[j].ModTime()) })
+	var total int64
+	for i, e := range entries {
+		size, err := treeSize(filepath.Join(c.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		total += size
+		if (c.maxEntries > 0 && i >= c.maxEntries) || (c.maxSize > 0 && total > c.maxSize && i > 0) {
+			log.Printf("Evicting %s from %s", e.Name(), c.dir)
+			if err := os.RemoveAll(filepath.Join(c.dir, e.Name())); err != nil {
+				return err
+			}
+			total -= size
+		}
+	}
+	return nil
+}
+
+// Returns the total size in bytes of the files under |dir|, leaving out .git.
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Returns the size of the sources recorded by the last successful roll in |dir|, or a conservative
+// default.
+func estimateSourcesSize(dir string) int64 {
+	history, err := readHistory(dir)
+	if err != nil {
+		log.Printf("WARNING: %s", err)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if e := history[i]; e.Success && e.SourcesSize > 0 {
+			return e.SourcesSize
+		}
+	}
+	return defaultSourcesSize
+}
+
+// Checks that the volume holding the sources in |dir| has room for them plus |headroom| bytes, so
+// that the checkout does not run out of space part way through.
+func checkDiskSpace(dir string, headroom uint64) error {
+	var st syscall.Statfs_t
+	if err := statfs(filepath.Join(dir, "src"), &st); err != nil {
+		return fmt.Errorf("failed to get free space for src: %s", err)
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	need := uint64(estimateSourcesSize(dir)) + headroom
+	if free < need {
+		return fmt.Errorf("only %d MiB free for src, but the roll needs %d MiB; free up space (for example with `git -C src gc --prune=now`) or lower --disk-headroom", free>>20, need>>20)
+	}
+	return nil
+}
+
+// Returns the paths of the files in |sha1| in the git checkout in |dir|.
+func listTree(dir string, sha1 revision) ([]string, error) {
+	out, err := output(exec.Command("git", "-C", dir, "ls-tree", "-r", "--name-only", "-z", string(sha1)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// Returns whether the slash-separated path |name| is in the directory |subtree|, which is empty for
+// the whole tree.
+func inSubtree(subtree, name string) bool {
+	return subtree == "" || name == subtree || strings.HasPrefix(name, subtree+"/")
+}
+
+// Returns the |files| in the directory |subtree|, or an error if it is not a directory containing
+// any of them.
+func subtreeFiles(files []string, subtree string) ([]string, error) {
+	if subtree != path.Clean(subtree) || path.IsAbs(subtree) || subtree == "." || subtree == ".." || strings.HasPrefix(subtree, "../") {
+		return nil, fmt.Errorf("subtree %q is not a clean relative path", subtree)
+	}
+	var kept []string
+	for _, name := range files {
+		if name == subtree {
+			return nil, fmt.Errorf("subtree %q is a file, not a directory", subtree)
+		}
+		if inSubtree(subtree, name) {
+			kept = append(kept, name)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("subtree %q does not exist", subtree)
+	}
+	log.Printf("Keeping %d of %d files under %s", len(kept), len(files), subtree)
+	return kept, nil
+}
+
+// Returns whether |name| matches any of |patterns|.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a sorted copy of |paths|. Lists of paths are sorted before they are logged or written,
+// so that repeated runs report them identically.
+func sortedPaths(paths []string) []string {
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Decides which upstream files are left out: those matching any of its excludes but none of its
+// includes. It counts the files each pattern matches as it goes.
+type fileFilter struct {
+	excludes, includes []string
+	subtree            string // If set, files outside this directory are left out, uncounted.
+	counts             []int  // How many files each of excludes matched.
+	included           int    // How many files includes kept.
+}
+
+// Returns a filter leaving out the files outside |subtree| and those in it that match any of
+// |excludes| but none of |includes|, or an error if a pattern is invalid.
+func newFileFilter(excludes, includes []string, subtree string) (*fileFilter, error) {
+	for _, pattern := range excludes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %s", pattern, err)
+		}
+	}
+	for _, pattern := range includes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --include-tests pattern %q: %s", pattern, err)
+		}
+	}
+	return &fileFilter{excludes: excludes, includes: includes, subtree: subtree, counts: make([]int, len(excludes))}, nil
+}
+
+// Returns whether the file |name| is left out, counting the patterns it matches.
+func (f *fileFilter) excluded(name string) bool {
+	if !inSubtree(f.subtree, name) {
+		return true
+	}
+	if matchAny(f.includes, name) {
+		f.included++
+		return false
+	}
+	matched := false
+	for i, pattern := range f.excludes {
+		if matchPath(pattern, name) {
+			f.counts[i]++
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Logs how many files each pattern of |f| has matched.
+func (f *fileFilter) logCounts() {
+	for i, pattern := range f.excludes {
+		log.Printf("Excluding %d files matching %q", f.counts[i], pattern)
+	}
+	if len(f.includes) > 0 {
+		log.Printf("Keeping %d test files matching %s", f.included, strings.Join(f.includes, ", "))
+	}
+}
+
+// Splits |files| into those kept and those matching any of |excludes|, logging how many files
+// each pattern matched. Files matching any of |includes| are kept even if they are excluded.
+func excludeFiles(files, excludes, includes []string) (kept, excluded []string, err error) {
+	filter, err := newFileFilter(excludes, includes, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range files {
+		if filter.excluded(name) {
+			excluded = append(excluded, name)
+		} else {
+			kept = append(kept, name)
+		}
+	}
+	filter.logCounts()
+	return kept, excluded, nil
+}
+
+// Returns the sets of paths among |files| and their parent directories that are equal when
+// compared case-insensitively.
+func caseCollisions(files []string) [][]string {
+	seen := make(map[string]bool)
+	folded := make(map[string][]string)
+	var keys []string
+	for _, name := range files {
+		for p := name; p != "." && !seen[p]; p = path.Dir(p) {
+			seen[p] = true
+			key := strings.ToLower(p)
+			if folded[key] == nil {
+				keys = append(keys, key)
+			}
+			folded[key] = append(folded[key], p)
+		}
+	}
+	sort.Strings(keys)
+	var collisions [][]string
+	for _, key := range keys {
+		if paths := folded[key]; len(paths) > 1 {
+			sort.Strings(paths)
+			collisions = append(collisions, paths)
+		}
+	}
+	return collisions
+}
+
+var sparsePatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `!`, `\!`, `#`, `\#`)
+
+// Configures the git checkout in |dir| to include only the directory |subtree|, or every file if it
+// is empty, less the |excluded| files.
+func sparseCheckout(dir, subtree string, excluded []string) error {
+	if subtree == "" && len(excluded) == 0 {
+		out, _ := output(exec.Command("git", "-C", dir, "config", "--bool", "core.sparseCheckout"))
+		if string(out) != "true" {
+			return nil
+		}
+		return run(exec.Command("git", "-C", dir, "sparse-checkout", "disable"))
+	}
+	patterns := []string{"/*"}
+	if subtree != "" {
+		patterns = []string{"/" + sparsePatternEscaper.Replace(subtree) + "/"}
+	}
+	for _, name := range sortedPaths(excluded) {
+		patterns = append(patterns, "!/"+sparsePatternEscaper.Replace(name))
+	}
+	cmd := exec.Command("git", "-C", dir, "sparse-checkout", "set", "--no-cone", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(patterns, "\n") + "\n")
+	return run(cmd)
+}
+
+// The upstream path of the script that generates the build files.
+const defaultGenerator = "util/generate_build_files.py"
+
+// Returns the generator a roll with |opts| runs, as generatorCommand takes it, and whether it is
+// upstream's. The generator is upstream's unless --generator-script overrides it.
+func activeGenerator(opts *rollOptions) (string, bool) {
+	if opts.generatorScript != "" {
+		return opts.generatorScript, false
+	}
+	return opts.generator, true
+}
+
+// Validates the --generator-script override |script| and returns its absolute path.
+func checkGeneratorScript(script string) (string, error) {
+	abs, err := filepath.Abs(script)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve --generator-script %s: %s", script, err)
+	}
+	if err := checkGenerator("", abs); err != nil {
+		return "", err
+	}
+	return abs, nil
+}
+
+// The build file formats generate_build_files.py can emit that the roller supports.
+var buildFormats = []string{"gn", "android"}
+
+// Validates the requested build file formats.
+func checkBuildFormats(formats []string) error {
+	if len(formats) == 0 {
+		return fmt.Errorf("no build formats requested")
+	}
+	for _, f := range formats {
+		supported := false
+		for _, b := range buildFormats {
+			supported = supported || f == b
+		}
+		if !supported {
+			return fmt.Errorf("unsupported build format %q; supported formats are %s", f, strings.Join(buildFormats, ", "))
+		}
+	}
+	return nil
+}
+
+// Create the build files in each of |formats| for the current sources.
+func generateGN(l *log.Logger, dir, generator string, artifacts, formats []string, warnings *warningCollector) (err error) {
+	defer func() {
+		if err != nil {
+			err = &generateError{stepError{"gn", err}}
+		}
+	}()
+	if err := checkGenerator(dir, generator); err != nil {
+		return err
+	}
+	if err := cleanArtifacts(l, dir, artifacts); err != nil {
+		return err
+	}
+	l.Printf("Generating build files...")
+	cmd := generatorCommand(dir, generator, formats)
+	if warnings != nil {
+		cmd.Stdout = io.MultiWriter(l.Writer(), warnings)
+		cmd.Stderr = cmd.Stdout
+		defer warnings.flush()
+	}
+	if err := runLimited(withLog(l, cmd)); err != nil {
+		return err
+	}
+	for _, f := range formats {
+		switch f {
+		case "gn":
+			for _, name := range gnOutputs {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					return fmt.Errorf("generate_build_files.py gn did not write %s in %s", name, dir)
+				}
+			}
+		case "android":
+			if err := checkAndroidBlueprints(l, dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The patterns of the generator output lines that --generator-warning matches by default.
+var defaultGeneratorWarnings = []string{`(?i)warning:`, `(?i)\bskipping\b`}
+
+// Collects the distinct lines written to it that match any of its patterns, in the order first
+// written, so that warnings in the generator's output are not buried in it.
+type warningCollector struct {
+	patterns []*regexp.Regexp
+	seen     map[string]bool
+	warnings []string
+	buf      []byte
+}
+
+// Returns a warningCollector for the regexps |patterns|.
+func newWarningCollector(patterns []string) (*warningCollector, error) {
+	c := &warningCollector{seen: make(map[string]bool)}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --generator-warning %q: %s", p, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	return c, nil
+}
+
+func (c *warningCollector) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		c.add(string(c.buf[:i]))
+		c.buf = c.buf[i+1:]
+	}
+}
+
+// Collects any final partial line.
+func (c *warningCollector) flush() {
+	if len(c.buf) > 0 {
+		c.add(string(c.buf))
+		c.buf = nil
+	}
+}
+
+func (c *warningCollector) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || c.seen[line] {
+		return
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(line) {
+			c.seen[line] = true
+			c.warnings = append(c.warnings, line)
+			return
+		}
+	}
+}
+
+// Globs, relative to the boringssl directory, of the intermediate files generate_build_files.py
+// leaves behind. A failed run can leave them stale, so they are removed before each run.
+var defaultGeneratorArtifacts = []string{"src/util/__pycache__", "src/util/*.pyc"}
+
+// Removes the paths in |dir| matching any of |artifacts|, logging each one.
+func cleanArtifacts(l *log.Logger, dir string, artifacts []string) error {
+	for _, pattern := range artifacts {
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return fmt.Errorf("invalid generator artifact pattern %q: %s", pattern, err)
+		}
+		for _, m := range matches {
+			rel, _ := filepath.Rel(dir, m)
+			l.Printf("Removing stale generator artifact %s", filepath.ToSlash(rel))
+			if err := os.RemoveAll(m); err != nil {
+				return fmt.Errorf("failed to remove %s: %s", m, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The files generate_build_files.py gn writes.
+var gnOutputs = []string{"BUILD.generated.gni", "BUILD.generated_tests.gni"}
+
+// A path in src whose presence marks a build system upstream may have migrated to from its python
+// generator.
+type buildSystemSignature struct {
+	path string
+	desc string
+}
+
+// The build systems checkGenerator recognizes; --build-system-signature adds to them.
+var buildSystemSignatures = []buildSystemSignature{
+	{"gen/sources.json", "a JSON manifest of the source lists"},
+	{"build.json", "a JSON description of the build"},
+	{"util/pregenerate", "the Go pregenerate tool"},
+}
+
+// Parses a --build-system-signature, PATH=DESCRIPTION.
+func parseBuildSystemSignature(s string) (buildSystemSignature, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return buildSystemSignature{}, fmt.Errorf("invalid --build-system-signature %q; want PATH=DESCRIPTION", s)
+	}
+	return buildSystemSignature{kv[0], kv[1]}, nil
+}
+
+// Checks that the upstream |generator| exists in the sources in |dir|. If it does not, the error
+// says which of buildSystemSignatures upstream migrated to, or else suggests any script in the
+// same directory that looks like it was renamed from it.
+func checkGenerator(dir, generator string) error {
+	if filepath.IsAbs(generator) {
+		if info, err := os.Stat(generator); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("the generator script %s does not exist", generator)
+		}
+		return nil
+	}
+	src := filepath.Join(dir, "src")
+	if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(generator))); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var detected []string
+	for _, s := range buildSystemSignatures {
+		if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(s.path))); err == nil {
+			detected = append(detected, fmt.Sprintf("%s (src/%s)", s.desc, s.path))
+		}
+	}
+	if len(detected) > 0 {
+		return fmt.Errorf("upstream build system changed: src/%s does not exist, but src has %s; update the roller to generate the build files from it", generator, strings.Join(detected, " and "))
+	}
+	var candidates []string
+	infos, _ := ioutil.ReadDir(filepath.Join(src, filepath.FromSlash(path.Dir(generator))))
+	for _, info := range infos {
+		name := strings.ToLower(info.Name())
+		if !info.IsDir() && strings.HasSuffix(name, ".py") && (strings.Contains(name, "generate") || strings.Contains(name, "build")) {
+			candidates = append(candidates, path.Join(path.Dir(generator), info.Name()))
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("upstream generator moved: src/%s does not exist; pass its new path with --generator", generator)
+	}
+	return fmt.Errorf("upstream generator moved: src/%s does not exist, but src/%s may have replaced it; pass --generator=%s if so", generator, strings.Join(candidates, " or src/"), candidates[0])
+}
+
+// Returns the command that generates the build files in each of |formats| for the sources in |dir|
+// with |generator|, the upstream path of the generator in src or the absolute path of one to run in
+// its place. The generator writes into its working directory, so the command runs in |dir|, beside
+// src.
+func generatorCommand(dir, generator string, formats []string) *exec.Cmd {
+	script := generator
+	if !filepath.IsAbs(script) {
+		script = filepath.Join("src", filepath.FromSlash(generator))
+	}
+	args := append([]string{script}, formats...)
+	cmd := exec.Command("python", args...)
+	cmd.Dir = dir
+	cmd.Env = toolEnv(generatorEnv...)
+	return cmd
+}
+
+// Returns the SHA-256 digest of each build file generated in |dir| for |formats|, skipping any that
+// do not exist.
+func hashGenerated(dir string, formats []string) (map[string]string, error) {
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		hashes[name] = fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+	return hashes, nil
+}
+
+// Runs |generator| for |formats| in |dir| again, after it has just generated the build files
+// there, and checks that it generated the same files.
+func checkDeterministic(l *log.Logger, dir, generator string, artifacts, formats []string) error {
+	first, err := hashGenerated(dir, formats)
+	if err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	l.Printf("Generating the build files again to check that the generator is deterministic...")
+	if err := generateGN(l, dir, generator, artifacts, formats, nil); err != nil {
+		return err
+	}
+	second, err := hashGenerated(dir, formats)
+	if err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	var differ []string
+	for name, h := range first {
+		if second[name] != h {
+			differ = append(differ, name)
+		}
+	}
+	for name := range second {
+		if _, ok := first[name]; !ok {
+			differ = append(differ, name)
+		}
+	}
+	if len(differ) > 0 {
+		return &generateError{stepError{"gn", fmt.Errorf("the generator wrote different build files on a second run, even with %s: %s", strings.Join(deterministicGeneratorEnv, " "), strings.Join(sortedPaths(differ), ", "))}}
+	}
+	l.Printf("The generator wrote the same %d build files twice", len(first))
+	return nil
+}
+
+// A file that differs between two revisions.
+type fileChange struct {
+	status byte // 'A'dded, 'D'eleted, or 'M'odified, as reported by git diff --name-status.
+	path   string
+}
+
+// Returns the files that differ between |old| and |new| in the git checkout in |dir|, sorted by
+// path whatever order diff.orderFile may have git list them in.
+func diffTree(dir string, old, new revision) ([]fileChange, error) {
+	out, err := output(exec.Command("git", "-C", dir, "diff", "--name-status", "--no-renames", "-z", string(old), string(new), "--"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	var changes []fileChange
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, fileChange{fields[i][0], fields[i+1]})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes, nil
+}
+
+// Globs of upstream paths that generate_build_files.py does not read. generateChanged skips
+// generation if every changed file matches one of these.
+var nonGeneratorInputs = []string{"*.md", ".github", "codereview.settings", "LICENSE"}
+
+// Like generateGN, but skips generation if no file that differs between |old| and |new| can affect
+// the generated build files.
+//
+// generate_build_files.py cannot be scoped to part of the tree, so any change that can affect its
+// output falls back to generating everything. Afterwards, every added source file must be
+// referenced by the build files generated for |formats|.
+func generateChanged(l *log.Logger, dir, generator string, artifacts []string, old, new revision, formats []string, warnings *warningCollector) error {
+	changes, err := diffTree(filepath.Join(dir, "src"), old, new)
+	if err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	var inputs []fileChange
+	for _, c := range changes {
+		input := true
+		for _, pattern := range nonGeneratorInputs {
+			input = input && !matchPath(pattern, c.path)
+		}
+		if input {
+			inputs = append(inputs, c)
+		}
+	}
+	if len(inputs) == 0 {
+		l.Printf("Skipping build file generation; none of the %d changed files are generator inputs", len(changes))
+		return nil
+	}
+	l.Printf("%d of %d changed files are generator inputs", len(inputs), len(changes))
+	if err := generateGN(l, dir, generator, artifacts, formats, warnings); err != nil {
+		return err
+	}
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var generated []byte
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return &generateError{stepError{"gn", fmt.Errorf("failed to read %s: %s", name, err)}}
+		}
+		generated = append(generated, b...)
+	}
+	var unreferenced []string
+	for _, c := range inputs {
+		ext := path.Ext(c.path)
+		if c.status == 'A' && (ext == ".c" || ext == ".cc") && !bytes.Contains(generated, []byte(`"src/`+c.path+`"`)) {
+			unreferenced = append(unreferenced, c.path)
+		}
+	}
+	if len(unreferenced) > 0 {
+		return &generateError{stepError{"gn", fmt.Errorf("added sources missing from the generated %s: %s", strings.Join(names, ", "), strings.Join(sortedPaths(unreferenced), ", "))}}
+	}
+	return nil
+}
+
+// The file in the boringssl directory recording, for each build format, the hash of the inputs its
+// build files were last generated from.
+const formatInputsName = ".build_format_inputs.json"
+
+// Globs of upstream paths that are inputs of only the listed build formats. Files matching none of
+// these, nor nonGeneratorInputs, are inputs of every format.
+var formatOnlyInputs = map[string][]string{"*.bp": {"android"}, "*.mk": {"android"}, "*.gn": {"gn"}, "*.gni": {"gn"}}
+
+// Returns whether the upstream path |name| can affect the build files of |format|.
+func isFormatInput(format, name string) bool {
+	for _, pattern := range nonGeneratorInputs {
+		if matchPath(pattern, name) {
+			return false
+		}
+	}
+	for pattern, formats := range formatOnlyInputs {
+		if !matchPath(pattern, name) {
+			continue
+		}
+		for _, f := range formats {
+			if f == format {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Returns, for each of |formats|, a hash of |generator| and of the files in src in |dir| that are
+// inputs of that format. Files matching |artifacts| are left out, as the generator writes them.
+func formatInputHashes(dir, generator string, artifacts, formats []string) (map[string]string, error) {
+	sums, err := checksums(filepath.Join(dir, "src"))
+	if err != nil {
+		return nil, err
+	}
+	script := generator
+	if filepath.IsAbs(generator) {
+		b, err := ioutil.ReadFile(generator)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", generator, err)
+		}
+		script = fmt.Sprintf("%s %x", generator, sha256.Sum256(b))
+	}
+	hashes := make(map[string]string)
+	for _, f := range formats {
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\n", script)
+		for _, line := range strings.SplitAfter(sums, "\n") {
+			i := strings.Index(line, "  ")
+			if i < 0 {
+				continue
+			}
+			name := strings.TrimSuffix(line[i+2:], "\n")
+			if !isFormatInput(f, name) {
+				continue
+			}
+			artifact := false
+			for _, pattern := range artifacts {
+				artifact = artifact || matchPath(pattern, "src/"+name)
+			}
+			if !artifact {
+				io.WriteString(h, line)
+			}
+		}
+		hashes[f] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// Reads the input hashes recorded in |dir|. A missing record is empty.
+func readFormatInputs(dir string) (map[string]string, error) {
+	recorded := make(map[string]string)
+	b, err := ioutil.ReadFile(filepath.Join(dir, formatInputsName))
+	if os.IsNotExist(err) {
+		return recorded, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", formatInputsName, err)
+	}
+	if err := json.Unmarshal(b, &recorded); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", formatInputsName, err)
+	}
+	return recorded, nil
+}
+
+// Records in |dir| the input hashes of the formats in |hashes|, keeping those of other formats.
+func writeFormatInputs(dir string, hashes map[string]string) error {
+	recorded, err := readFormatInputs(dir)
+	if err != nil {
+		return err
+	}
+	for f, h := range hashes {
+		recorded[f] = h
+	}
+	b, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", formatInputsName, err)
+	}
+	return writeFileAtomic(filepath.Join(dir, formatInputsName), append(b, '\n'))
+}
+
+// Returns which of |formats| must be regenerated, for --only-changed-build-formats: those whose
+// inputs in |hashes| differ from the ones recorded in |dir|, or whose build files are missing. The
+// reason each other format is skipped is logged.
+func changedFormats(l *log.Logger, dir string, formats []string, hashes map[string]string) ([]string, error) {
+	recorded, err := readFormatInputs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, f := range formats {
+		names, err := generatedFiles(dir, []string{f})
+		if err != nil {
+			return nil, err
+		}
+		present := len(names) > 0
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				present = false
+			}
+		}
+		switch {
+		case recorded[f] == "":
+			l.Printf("Generating %s build files; no inputs are recorded for them", f)
+		case recorded[f] != hashes[f]:
+			l.Printf("Generating %s build files; their inputs changed", f)
+		case !present:
+			l.Printf("Generating %s build files; some are missing", f)
+		default:
+			l.Printf("Skipping %s build files; their inputs are unchanged since they were generated", f)
+			continue
+		}
+		changed = append(changed, f)
+	}
+	return changed, nil
+}
+
+// The directories of src, relative to it, where upstream may commit its own generated build files.
+var upstreamGeneratedDirs = []string{".", "gen"}
+
+// The result of comparing one of our generated build files with upstream's.
+type generatedComparison struct {
+	name     string // Our generated file, relative to the boringssl directory.
+	upstream string // Upstream's file of the same name, relative to src.
+	same     bool
+}
+
+// Compares each of the generated files |names| in |dir| with the file of the same name upstream
+// commits in src, if there is one.
+func compareGenerated(dir string, names []string) ([]generatedComparison, error) {
+	var results []generatedComparison
+	for _, name := range names {
+		ours, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		for _, d := range upstreamGeneratedDirs {
+			upstream := path.Join(d, name)
+			theirs, err := ioutil.ReadFile(filepath.Join(dir, "src", filepath.FromSlash(upstream)))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read src/%s: %s", upstream, err)
+			}
+			results = append(results, generatedComparison{name, upstream, bytes.Equal(ours, theirs)})
+			break
+		}
+	}
+	return results, nil
+}
+
+// Returns the build files generated in |dir| for |formats|, relative to it.
+func generatedFiles(dir string, formats []string) ([]string, error) {
+	var names []string
+	for _, f := range formats {
+		switch f {
+		case "gn":
+			names = append(names, gnOutputs...)
+		case "android":
+			bps, err := filepath.Glob(filepath.Join(dir, "*.bp"))
+			if err != nil {
+				return nil, err
+			}
+			for _, bp := range bps {
+				names = append(names, filepath.Base(bp))
+			}
+		}
+	}
+	return names, nil
+}
+
+// Logs how the build files generated in |dir| for |formats| compare with those upstream commits.
+// Differences are informational: upstream may generate its files differently for its own builds.
+func reportGeneratedDiffs(l *log.Logger, dir string, formats []string) error {
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return err
+	}
+	results, err := compareGenerated(dir, names)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		l.Printf("Upstream commits none of %s to compare with", strings.Join(names, ", "))
+		return nil
+	}
+	differ := 0
+	for _, r := range results {
+		if r.same {
+			l.Printf("%s matches src/%s", r.name, r.upstream)
+		} else {
+			l.Printf("NOTE: %s differs from src/%s", r.name, r.upstream)
+			differ++
+		}
+	}
+	l.Printf("%d of %d generated files differ from upstream's", differ, len(results))
+	return nil
+}
+
+// Matches a quoted absolute path in a generated build file: a single leading slash (GN labels like
+// "//crypto" are relative to the source root) or a Windows drive letter.
+var absolutePathRE = regexp.MustCompile(`"(?:/[^/"]|[A-Za-z]:[\\/])`)
+
+// The patterns the generated build files must not match, which --forbidden-pattern replaces: absolute
+// paths, URLs, which a hermetic build cannot fetch, and paths under the user's home directory.
+var defaultForbiddenPatterns = []string{absolutePathRE.String(), `"https?://`, `"(?:~|\$HOME|\$\{HOME\})/`}
+
+// A line of a generated build file that matches a forbidden pattern.
+type forbiddenMatch struct {
+	line    int
+	text    string
+	pattern string
+}
+
+// Returns the lines of the generated build file |content| that match one of |patterns| or contain
+// |dir|, the checkout the roll ran in, with the first pattern each matches.
+func forbiddenLines(content, dir string, patterns []*regexp.Regexp) []forbiddenMatch {
+	var found []forbiddenMatch
+	for i, line := range strings.Split(content, "\n") {
+		m := forbiddenMatch{line: i + 1, text: strings.TrimSpace(line)}
+		for _, re := range patterns {
+			if re.MatchString(line) {
+				m.pattern = re.String()
+				break
+			}
+		}
+		if m.pattern == "" && strings.Contains(line, dir) {
+			m.pattern = dir
+		}
+		if m.pattern != "" {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// The architectures BUILD.gn builds with the generator's assembly, which --asm-arch replaces.
+var defaultAsmArchs = []string{"x86_64", "aarch64"}
+
+// Checks that the generator wrote assembly in |dir| for each of |archs|, in one or more of the
+// per-platform directories it names like linux-x86_64.
+func checkAsmArchs(dir string, archs []string) error {
+	var missing []string
+	for _, arch := range archs {
+		dirs, err := filepath.Glob(filepath.Join(dir, "*-"+arch))
+		if err != nil {
+			return &generateError{stepError{"asm", err}}
+		}
+		found := false
+		for _, d := range dirs {
+			err := filepath.Walk(d, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && strings.EqualFold(filepath.Ext(p), ".S") {
+					found = true
+					return io.EOF
+				}
+				return nil
+			})
+			if err != nil && err != io.EOF {
+				return &generateError{stepError{"asm", fmt.Errorf("failed to read %s: %s", d, err)}}
+			}
+		}
+		if !found {
+			missing = append(missing, arch)
+		}
+	}
+	if len(missing) > 0 {
+		return &generateError{stepError{"asm", fmt.Errorf("the generator wrote no assembly for %s; pass --asm-arch for each architecture still required", strings.Join(missing, ", "))}}
+	}
+	log.Printf("Found the generated assembly for %s", strings.Join(archs, ", "))
+	return nil
+}
+
+// Returns the contents of the build files generated in |dir| for |formats|, skipping any that do
+// not exist.
+func readGenerated(dir string, formats []string) ([]byte, error) {
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return nil, err
+	}
+	var contents []byte
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		contents = append(contents, b...)
+	}
+	return contents, nil
+}
+
+// Splits the upstream |changes| into those to files our generated build files refer to, which
+// affect our build, and the rest. Added and modified files are looked up in |newBuild|, the build
+// files generated for the new sources, and deleted files in |oldBuild|, those generated before.
+func buildImpact(changes []fileChange, oldBuild, newBuild []byte) (affecting, other []fileChange) {
+	for _, c := range changes {
+		build := newBuild
+		if c.status == 'D' {
+			build = oldBuild
+		}
+		if bytes.Contains(build, []byte(`"src/`+c.path+`"`)) {
+			affecting = append(affecting, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	return affecting, other
+}
+
+// A titled list of upstream changes in a report.
+type changeGroup struct {
+	title   string
+	changes []fileChange
+}
+
+// Returns the lines listing each of |groups| under its title.
+func formatChangeGroups(groups []changeGroup) string {
+	var b strings.Builder
+	for _, group := range groups {
+		fmt.Fprintf(&b, "%s (%d):\n", group.title, len(group.changes))
+		for _, c := range group.changes {
+			fmt.Fprintf(&b, "  %c %s\n", c.status, c.path)
+		}
+	}
+	return b.String()
+}
+
+// Returns the summary --explain-diff logs of the |affecting| and |other| upstream changes.
+func formatBuildImpact(affecting, other []fileChange) string {
+	return formatChangeGroups([]changeGroup{
+		{"Changes to files our build uses", affecting},
+		{"Changes to files our build does not use", other},
+	})
+}
+
+// Globs of the files upstream generates and commits, such as the error data and test vectors,
+// whose diffs are large but mechanical.
+var defaultUpstreamGenerated = []string{"gen", "err_data.c", "*_tests.txt", "third_party/wycheproof_testvectors"}
+
+// Splits the upstream |changes| into those to files matching one of |patterns|, which upstream
+// generates, and the rest. A pattern containing no slash matches the base name of a file, as in
+// .gitignore; any other pattern matches its path or a directory containing it.
+func splitUpstreamGenerated(changes []fileChange, patterns []string) (generated, other []fileChange) {
+	for _, c := range changes {
+		match := false
+		for _, pattern := range patterns {
+			if strings.Contains(pattern, "/") {
+				match = match || matchPath(pattern, c.path)
+			} else {
+				ok, _ := path.Match(pattern, path.Base(c.path))
+				match = match || ok || matchPath(pattern, c.path)
+			}
+		}
+		if match {
+			generated = append(generated, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	return generated, other
+}
+
+// Logs which of the upstream files that differ between |old| and |new| in the git checkout |src|
+// upstream generates, as matched by |patterns|, apart from the hand-written ones.
+func reportUpstreamGenerated(l *log.Logger, src string, old, new revision, patterns []string) error {
+	if old == new {
+		l.Printf("No upstream files changed")
+		return nil
+	}
+	if !hasCommit(src, old) || !hasCommit(src, new) {
+		l.Printf("WARNING: the history from %s to %s is not available, so the changes upstream generated cannot be told apart", old.short(), new.short())
+		return nil
+	}
+	changes, err := diffTree(src, old, new)
+	if err != nil {
+		return err
+	}
+	generated, other := splitUpstreamGenerated(changes, patterns)
+	report := formatChangeGroups([]changeGroup{
+		{"Changes to files upstream generates", generated},
+		{"Changes to hand-written files", other},
+	})
+	for _, line := range strings.Split(strings.TrimSuffix(report, "\n"), "\n") {
+		l.Print(line)
+	}
+	return nil
+}
+
+// Logs which of the upstream files that differ between |old| and |new| the build files generated in
+// |dir| for |formats| refer to, given |previous|, the build files generated before the roll.
+func explainDiff(l *log.Logger, dir string, old, new revision, formats []string, previous []byte) error {
+	src := filepath.Join(dir, "src")
+	if old == new {
+		l.Printf("No upstream files changed")
+		return nil
+	}
+	if !hasCommit(src, old) || !hasCommit(src, new) {
+		l.Printf("WARNING: the history from %s to %s is not available, so the upstream changes cannot be explained", old.short(), new.short())
+		return nil
+	}
+	changes, err := diffTree(src, old, new)
+	if err != nil {
+		return err
+	}
+	current, err := readGenerated(dir, formats)
+	if err != nil {
+		return err
+	}
+	affecting, other := buildImpact(changes, previous, current)
+	for _, line := range strings.Split(strings.TrimSuffix(formatBuildImpact(affecting, other), "\n"), "\n") {
+		l.Print(line)
+	}
+	return nil
+}
+
+// Checks that the build files generated in |dir| for |formats| match none of |patterns|, such as
+// absolute paths, which would only work in this checkout, or URLs, which hermetic builds cannot
+// fetch.
+func checkForbiddenPatterns(l *log.Logger, dir string, formats, patterns []string) error {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return &generateError{stepError{"absolute-paths", fmt.Errorf("invalid --forbidden-pattern %q: %s", p, err)}}
+		}
+		res = append(res, re)
+	}
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return &generateError{stepError{"absolute-paths", err}}
+	}
+	found, first := 0, ""
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return &generateError{stepError{"absolute-paths", fmt.Errorf("failed to read %s: %s", name, err)}}
+		}
+		for _, m := range forbiddenLines(string(b), dir, res) {
+			l.Printf("%s:%d matches %s: %s", name, m.line, m.pattern, m.text)
+			if found == 0 {
+				first = fmt.Sprintf("%s:%d matches %s", name, m.line, m.pattern)
+			}
+			found++
+		}
+	}
+	if found > 0 {
+		return &generateError{stepError{"absolute-paths", fmt.Errorf("%d lines of the generated build files match forbidden patterns, the first being %s; generate them from the boringssl directory, or use --allow-absolute-paths", found, first)}}
+	}
+	return nil
+}
+
+// Compares the build files generated in |dir| for |formats| that match |patterns|, or all of them if
+// there are none, with their goldens in |goldenDir|, failing with the diff of any that differ. With
+// |update|, the goldens are replaced with the generated files instead.
+func checkGolden(l *log.Logger, dir, goldenDir string, formats, patterns []string, update bool) error {
+	if !filepath.IsAbs(goldenDir) {
+		goldenDir = filepath.Join(dir, goldenDir)
+	}
+	names, err := generatedFiles(dir, formats)
+	if err != nil {
+		return &generateError{stepError{"golden", err}}
+	}
+	var compared []string
+	for _, name := range names {
+		if len(patterns) == 0 || matchAny(patterns, name) {
+			compared = append(compared, name)
+		}
+	}
+	if update {
+		for _, name := range compared {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return &generateError{stepError{"golden", fmt.Errorf("failed to read %s: %s", name, err)}}
+			}
+			golden := filepath.Join(goldenDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+				return &generateError{stepError{"golden", err}}
+			}
+			if err := writeFileAtomic(golden, b); err != nil {
+				return &generateError{stepError{"golden", fmt.Errorf("failed to write %s: %s", golden, err)}}
+			}
+		}
+		l.Printf("Updated the goldens of %d generated files in %s", len(compared), goldenDir)
+		return nil
+	}
+	var differ []string
+	for _, name := range compared {
+		golden := filepath.Join(goldenDir, filepath.FromSlash(name))
+		if _, err := os.Stat(golden); os.IsNotExist(err) {
+			l.Printf("%s has no golden in %s", name, goldenDir)
+			differ = append(differ, name)
+			continue
+		}
+		diff, err := diffFiles(golden, filepath.Join(dir, name))
+		if err != nil {
+			return &generateError{stepError{"golden", err}}
+		}
+		if diff != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+				l.Print(line)
+			}
+			differ = append(differ, name)
+		}
+	}
+	if len(differ) > 0 {
+		return &generateError{stepError{"golden", fmt.Errorf("%d generated files differ from their goldens in %s: %s; if the change is intended, rerun with --update-golden", len(differ), goldenDir, strings.Join(differ, ", "))}}
+	}
+	l.Printf("%d generated files match their goldens", len(compared))
+	return nil
+}
+
+// Returns the diff from the file |old| to |new|, empty if they are the same.
+func diffFiles(old, new string) (string, error) {
+	// git diff --no-index exits with 1 when the files differ, which the diff itself shows.
+	var diff bytes.Buffer
+	cmd := exec.Command("git", "diff", "--no-index", "--no-color", "--", old, new)
+	cmd.Stdout = &diff
+	if err := run(cmd); err != nil && diff.Len() == 0 {
+		return "", err
+	}
+	return diff.String(), nil
+}
+
+// For --dry-run-generators, runs the generator on the sources in src in |dir| with |opts|, writing
+// into a temporary directory, and logs how its output differs from the build files in |dir|, which
+// are left untouched. Fails if regenerating would change any of them.
+func dryRunGenerators(l *log.Logger, dir string, opts *rollOptions) error {
+	unlock, err := lock(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	generator, _ := activeGenerator(opts)
+	if err := checkGenerator(dir, generator); err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	tmp, err := tempDir("", "roll_boringssl")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmp)
+	src, err := filepath.Abs(filepath.Join(dir, "src"))
+	if err != nil {
+		return err
+	}
+	// The generator writes into its working directory and reads the sources from src there.
+	if err := os.Symlink(src, filepath.Join(tmp, "src")); err != nil {
+		return fmt.Errorf("failed to link src into %s: %s", tmp, err)
+	}
+	l.Printf("Generating build files into %s...", tmp)
+	if err := runLimited(withLog(l, generatorCommand(tmp, generator, opts.buildFormats))); err != nil {
+		return &generateError{stepError{"gn", err}}
+	}
+	names, err := generatedFiles(tmp, opts.buildFormats)
+	if err != nil {
+		return err
+	}
+	current, err := generatedFiles(dir, opts.buildFormats)
+	if err != nil {
+		return err
+	}
+	var differ []string
+	prev := ""
+	for _, name := range sortedPaths(append(names, current...)) {
+		if name == prev {
+			continue
+		}
+		prev = name
+		_, oldErr := os.Stat(filepath.Join(dir, name))
+		_, newErr := os.Stat(filepath.Join(tmp, name))
+		switch {
+		case os.IsNotExist(oldErr) && os.IsNotExist(newErr):
+			continue
+		case os.IsNotExist(oldErr):
+			l.Printf("Regenerating would add %s", name)
+		case os.IsNotExist(newErr):
+			l.Printf("Regenerating would remove %s", name)
+		default:
+			diff, err := diffFiles(filepath.Join(dir, name), filepath.Join(tmp, name))
+			if err != nil {
+				return err
+			}
+			if diff == "" {
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+				l.Print(line)
+			}
+		}
+		differ = append(differ, name)
+	}
+	if len(differ) > 0 {
+		return &generateError{stepError{"gn", fmt.Errorf("regenerating the build files for src would change %d of them: %s", len(differ), strings.Join(differ, ", "))}}
+	}
+	l.Printf("Regenerating the build files for src would change none of them")
+	return nil
+}
+
+// Checks that the Android.bp files generated in |dir| parse, using bpfmt if it is installed.
+func checkAndroidBlueprints(l *log.Logger, dir string) error {
+	bps, err := filepath.Glob(filepath.Join(dir, "*.bp"))
+	if err != nil {
+		return err
+	}
+	if len(bps) == 0 {
+		return fmt.Errorf("generate_build_files.py android did not write any .bp files")
+	}
+	if _, err := exec.LookPath("bpfmt"); err != nil {
+		l.Printf("bpfmt not found; not checking %d .bp files", len(bps))
+		return nil
+	}
+	for _, bp := range bps {
+		if err := run(withLog(l, exec.Command("bpfmt", "-d", bp))); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", bp, err)
+		}
+	}
+	return nil
+}
+
+// The FIPS module files that --check-fips expects by default, relative to src.
+var defaultFIPSFiles = []string{"crypto/fipsmodule", "crypto/fipsmodule/bcm.c"}
+
+// Matches a named list of sources in the build files generated for each format: a GN variable, or
+// the srcs of an Android Blueprint module or defaults.
+var sourceListREs = map[string]*regexp.Regexp{
+	"gn":      regexp.MustCompile(`(?m)^(\w+) = \[([^\]]*)\]`),
+	"android": regexp.MustCompile(`name: "(\w+)",\s*srcs: \[([^\]]*)\]`),
+}
+
+// Checks that each of |files| exists in the sources, and that the build files generated in |dir|
+// for each of |formats| define a target, a list of sources, that builds every source file among
+// them.
+func checkFIPS(dir string, files, formats []string) error {
+	log.Printf("Checking FIPS module...")
+	var missing, sources []string
+	for _, f := range files {
+		if _, err := os.Stat(filepath.Join(dir, "src", filepath.FromSlash(f))); os.IsNotExist(err) {
+			missing = append(missing, f)
+		} else if err != nil {
+			return fmt.Errorf("failed to stat %s: %s", f, err)
+		} else if path.Ext(f) == ".c" {
+			sources = append(sources, f)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("FIPS module files missing from src: %s", strings.Join(sortedPaths(missing), ", "))
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	for _, format := range formats {
+		names, err := generatedFiles(dir, []string{format})
+		if err != nil {
+			return err
+		}
+		var targets []string
+		for _, name := range names {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			for _, list := range sourceListREs[format].FindAllSubmatch(b, -1) {
+				builds := true
+				for _, f := range sources {
+					builds = builds && bytes.Contains(list[2], []byte(`"src/`+f+`"`))
+				}
+				if builds {
+					targets = append(targets, name+":"+string(list[1]))
+				}
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("the generated %s build files define no FIPS target building %s", format, strings.Join(sortedPaths(sources), ", "))
+		}
+		log.Printf("The FIPS module is built by %s", strings.Join(targets, ", "))
+	}
+	return nil
+}
+
+// How many levels of #include directives danglingIncludes follows from the top-level headers.
+const maxIncludeDepth = 4
+
+var includeRE = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*([<"])([^>"\n]+)[>"]`)
+
+// Returns the #include directives of the headers in src/include/openssl, and of the headers they
+// include up to maxIncludeDepth levels down, that name a header missing from |src|, as "HEADER
+// includes NAME". Only quoted includes and <openssl/...> ones are checked, as the others are of
+// system headers.
+func danglingIncludes(src string) ([]string, error) {
+	top, err := filepath.Glob(filepath.Join(src, "include", "openssl", "*.h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the headers in %s: %s", src, err)
+	}
+	type header struct {
+		path  string
+		depth int
+	}
+	var queue []header
+	seen := make(map[string]bool)
+	for _, path := range top {
+		queue = append(queue, header{path, 0})
+		seen[path] = true
+	}
+	exists := func(path string) (bool, error) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("failed to stat %s: %s", path, err)
+		}
+		return true, nil
+	}
+	var dangling []string
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		b, err := ioutil.ReadFile(h.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", h.path, err)
+		}
+		for _, m := range includeRE.FindAllStringSubmatch(string(b), -1) {
+			name := filepath.FromSlash(m[2])
+			var candidates []string
+			if m[1] == `"` {
+				candidates = []string{filepath.Join(filepath.Dir(h.path), name), filepath.Join(src, "include", name)}
+			} else if strings.HasPrefix(m[2], "openssl/") {
+				candidates = []string{filepath.Join(src, "include", name)}
+			}
+			found := ""
+			for _, c := range candidates {
+				ok, err := exists(c)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					found = c
+					break
+				}
+			}
+			if found == "" && len(candidates) > 0 {
+				rel, _ := filepath.Rel(src, h.path)
+				dangling = append(dangling, fmt.Sprintf("%s includes %s", filepath.ToSlash(rel), m[2]))
+			} else if found != "" && !seen[found] && h.depth < maxIncludeDepth {
+				seen[found] = true
+				queue = append(queue, header{found, h.depth + 1})
+			}
+		}
+	}
+	sort.Strings(dangling)
+	return dangling, nil
+}
+
+// Checks that the public headers in the sources in |dir| include only headers that are in src, so
+// that an over-eager prune is caught before generation. Dangling includes are an error unless
+// |allow| is set, in which case they are warned about.
+func checkIncludes(l *log.Logger, dir string, allow bool) error {
+	dangling, err := danglingIncludes(filepath.Join(dir, "src"))
+	if err != nil {
+		return err
+	}
+	if len(dangling) == 0 {
+		l.Printf("The headers in src/include include no missing headers")
+		return nil
+	}
+	for _, d := range dangling {
+		l.Printf("Dangling include: %s", d)
+	}
+	msg := fmt.Sprintf("%d includes in src/include name headers missing from src", len(dangling))
+	if !allow {
+		return fmt.Errorf("%s; use --allow-dangling-includes to proceed", msg)
+	}
+	l.Printf("WARNING: %s", msg)
+	return nil
+}
+
+// Matches the name a declaration marked OPENSSL_EXPORT declares: the identifier before its
+// arguments, array bounds or end, which for a function returning a function pointer follows "(*".
+var exportRE = regexp.MustCompile(`\bOPENSSL_EXPORT\s+[^;()]*?(?:\(\s*\*\s*)?(\w+)\s*(?:\([^*]|\[|;)`)
+
+// Returns the symbols the headers in include in |src| declare with OPENSSL_EXPORT. Preprocessor
+// lines, such as the definition of OPENSSL_EXPORT itself, are ignored. A missing include directory
+// exports nothing.
+func exportedSymbols(src string) (map[string]bool, error) {
+	symbols := make(map[string]bool)
+	include := filepath.Join(src, "include")
+	err := filepath.Walk(include, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == include {
+			return nil
+		}
+		if err != nil || info.IsDir() || filepath.Ext(p) != ".h" {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var code strings.Builder
+		for _, line := range strings.Split(string(b), "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				code.WriteString(line + "\n")
+			}
+		}
+		for _, m := range exportRE.FindAllStringSubmatch(code.String(), -1) {
+			symbols[m[1]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the exported symbols: %s", err)
+	}
+	return symbols, nil
+}
+
+// Returns the sorted symbols in |new| but not |old|, and those in |old| but not |new|.
+func diffSymbols(old, new map[string]bool) (added, removed []string) {
+	for s := range new {
+		if !old[s] {
+			added = append(added, s)
+		}
+	}
+	for s := range old {
+		if !new[s] {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// Reports the symbols the sources in |dir| export that |previous|, those of the sources before
+// the roll, did not, and those they no longer export. Removals break the ABI of the shared
+// library, so they are warned about, or are an error if |strict| is set.
+func checkSymbolExports(l *log.Logger, dir string, previous map[string]bool, strict bool) error {
+	current, err := exportedSymbols(filepath.Join(dir, "src"))
+	if err != nil {
+		return err
+	}
+	added, removed := diffSymbols(previous, current)
+	if len(added) == 0 && len(removed) == 0 {
+		l.Printf("The %d exported symbols are unchanged", len(current))
+		return nil
+	}
+	if len(added) > 0 {
+		l.Printf("Upstream added %d exported symbols: %s", len(added), strings.Join(added, ", "))
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("upstream removed %d exported symbols, which breaks the ABI: %s", len(removed), strings.Join(removed, ", "))
+	if strict {
+		return fmt.Errorf("%s", msg)
+	}
+	l.Printf("WARNING: %s", msg)
+	return nil
+}
+
+// Reads the paths, relative to src, listed one per line in |path|. Blank lines and lines starting
+// with # are ignored.
+func readReferencedPaths(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// Checks that each of |paths|, which build files outside the generated ones refer to, still exists
+// in the sources in |dir|. Missing paths are warned about, or are an error if |strict| is set.
+func checkReferenced(l *log.Logger, dir string, paths []string, strict bool) error {
+	var missing []string
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(dir, "src", filepath.FromSlash(p))); os.IsNotExist(err) {
+			missing = append(missing, p)
+		} else if err != nil {
+			return fmt.Errorf("failed to stat %s: %s", p, err)
+		}
+	}
+	if len(missing) == 0 {
+		l.Printf("All %d referenced paths are still in src", len(paths))
+		return nil
+	}
+	msg := fmt.Sprintf("upstream removed %d paths that our build files refer to: %s", len(missing), strings.Join(sortedPaths(missing), ", "))
+	if strict {
+		return fmt.Errorf("%s", msg)
+	}
+	l.Printf("WARNING: %s", msg)
+	return nil
+}
+
+// Globs matching the untracked files that generation is expected to produce, relative to the
+// boringssl directory.
+var expectedGenerated = []string{
+	"BUILD.generated.gni",
+	"BUILD.generated_tests.gni",
+	"err_data.c",
+	"crypto_test_data.cc",
+	"*-aarch64",
+	"*-arm",
+	"*-ppc64le",
+	"*-x86",
+	"*-x86_64",
+	"*.bp",
+	"sources.mk",
+	"rust/boringssl-sys/src/lib.rs",
+}
+
+// Returns the untracked files in the git checkout in |dir|, excluding |exclude|.
+func untrackedFiles(dir string, exclude ...string) ([]string, error) {
+	args := []string{"-C", dir, "status", "--porcelain", "-z", "--untracked-files=all", "--", "."}
+	for _, e := range exclude {
+		args = append(args, ":(exclude)"+e)
+	}
+	out, err := output(exec.Command("git", args...))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if strings.HasPrefix(entry, "?? ") {
+			files = append(files, strings.TrimPrefix(entry, "?? "))
+		}
+	}
+	return files, nil
+}
+
+// Reports untracked files left behind by the generators, removing them if |clean| is set. Every
+// untracked file in src is unexpected, as the generators only write outside of it, except for the
+// checksums the roll writes there and the files the patches in the directory |pre| create. Those
+// the patches in |post| create in |dir| are expected too.
+func verifyCleanGenerated(dir string, clean bool, pre, post string) error {
+	log.Printf("Checking for unexpected untracked files...")
+	created, err := patchCreatedFiles(post)
+	if err != nil {
+		return err
+	}
+	var stray []string
+	files, err := untrackedFiles(dir, append([]string{"src", lockName, stateName, historyName, formatInputsName}, created...)...)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		expected := false
+		for _, pattern := range expectedGenerated {
+			expected = expected || matchPath(pattern, f)
+		}
+		if !expected {
+			stray = append(stray, f)
+		}
+	}
+	if created, err = patchCreatedFiles(pre); err != nil {
+		return err
+	}
+	files, err = untrackedFiles(filepath.Join(dir, "src"), append([]string{checksumsName}, created...)...)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		stray = append(stray, path.Join("src", f))
+	}
+
+	sort.Strings(stray)
+	for _, f := range stray {
+		if !clean {
+			log.Printf("WARNING: unexpected untracked file %s", f)
+			continue
+		}
+		log.Printf("Removing unexpected untracked file %s", f)
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+			return fmt.Errorf("failed to remove %s: %s", f, err)
+		}
+	}
+	if len(stray) > 0 && !clean {
+		log.Printf("WARNING: found %d unexpected untracked files; use --clean-generated to remove them", len(stray))
+	}
+	return nil
+}
+
+var (
+	bindgenVersionRE = regexp.MustCompile(`\bv?(\d+\.\d+\.\d+)\b`)
+	bindgenPinRE     = regexp.MustCompile(`(?m)^BINDGEN_EXPECTED_VERSION="([^"]*)"`)
+)
+
+// Extracts the dotted version number from bindgen's version string, e.g. "bindgen 0.53.2".
+func parseBindgenVersion(s string) (string, bool) {
+	m := bindgenVersionRE.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// Returns the version of bindgen pinned by bindgen.sh.
+func pinnedBindgenVersion(script string) (string, error) {
+	b, err := ioutil.ReadFile(script)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", script, err)
+	}
+	m := bindgenPinRE.FindSubmatch(b)
+	if m == nil {
+		return "", fmt.Errorf("failed to find BINDGEN_EXPECTED_VERSION in %s", script)
+	}
+	return string(m[1]), nil
+}
+
+// Matches the headers bindgen.sh names: those it includes from src/include, and any paths under
+// $BSSL, its name for src.
+var bindgenHeaderRE = regexp.MustCompile(`<(openssl/[\w.-]+\.h)>|\$\{?BSSL\}?/([\w./-]+\.h)`)
+
+// Returns the headers, relative to src, that the bindgen.sh |script| names.
+func bindgenScriptHeaders(script string) ([]string, error) {
+	b, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", script, err)
+	}
+	seen := make(map[string]bool)
+	var headers []string
+	for _, m := range bindgenHeaderRE.FindAllStringSubmatch(string(b), -1) {
+		h := m[2]
+		if m[1] != "" {
+			h = "include/" + m[1]
+		}
+		if !seen[h] {
+			seen[h] = true
+			headers = append(headers, h)
+		}
+	}
+	return headers, nil
+}
+
+// Matches the shell variables bindgen.sh assigns, such as the allowlist it passes bindgen.
+var shellAssignRE = regexp.MustCompile(`(?m)^(?:readonly\s+)?([A-Za-z_]\w*)=("[^"]*"|'[^']*'|\S*)\s*$`)
+
+// Returns the flags the bindgen.sh |script| runs bindgen with, with the variables it assigns
+// expanded. Each flag is given with the values that follow it, such as "-o src/lib.rs", including
+// those passed through to clang after "--".
+func bindgenScriptFlags(script string) ([]string, error) {
+	b, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", script, err)
+	}
+	text := strings.Replace(string(b), "\\\n", " ", -1)
+	vars := make(map[string]string)
+	for _, m := range shellAssignRE.FindAllStringSubmatch(text, -1) {
+		vars[m[1]] = strings.Trim(m[2], `"'`)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		words := shellWords(os.Expand(line, func(name string) string {
+			if v, ok := vars[name]; ok {
+				return v
+			}
+			return "$" + name
+		}))
+		// bindgen may be run directly or through echo or exec.
+		for len(words) > 0 && (words[0] == "echo" || words[0] == "exec") {
+			words = words[1:]
+		}
+		if len(words) == 0 || words[0] != "bindgen" || (len(words) > 1 && words[1] == "--version") {
+			continue
+		}
+		var flags []string
+		for _, w := range words[1:] {
+			if strings.HasPrefix(w, "-") {
+				flags = append(flags, w)
+			} else if len(flags) > 0 {
+				flags[len(flags)-1] += " " + w
+			}
+		}
+		return flags, nil
+	}
+	return nil, fmt.Errorf("failed to find the bindgen command in %s", script)
+}
+
+// Returns the words of the shell command |line|, split at unquoted whitespace and unquoted, up to
+// any comment.
+func shellWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == '#' && !inWord:
+			return words
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// For --expected-bindgen-flag, compares the flags bindgen.sh in |dir| runs bindgen with against
+// |expected|, in any order, so that a change to them, which may change the bindings, is reviewed.
+// Drift is logged as a warning, or is an error if |strict| is set.
+func checkBindgenFlags(l *log.Logger, dir string, expected []string, strict bool) error {
+	flags, err := bindgenScriptFlags(filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh"))
+	if err != nil {
+		return &bindgenError{stepError{"rust", err}}
+	}
+	want := make(map[string]bool)
+	for _, f := range expected {
+		want[f] = true
+	}
+	got := make(map[string]bool)
+	var added, removed []string
+	for _, f := range flags {
+		got[f] = true
+		if !want[f] {
+			added = append(added, f)
+		}
+	}
+	for _, f := range expected {
+		if !got[f] {
+			removed = append(removed, f)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		l.Printf("bindgen.sh runs bindgen with the %d expected flags", len(flags))
+		return nil
+	}
+	var drift []string
+	if len(added) > 0 {
+		drift = append(drift, fmt.Sprintf("passes %q, which --expected-bindgen-flag does not list", added))
+	}
+	if len(removed) > 0 {
+		drift = append(drift, fmt.Sprintf("no longer passes %q", removed))
+	}
+	msg := "bindgen.sh " + strings.Join(drift, " and ")
+	if strict {
+		return &bindgenError{stepError{"rust", fmt.Errorf("%s; review the change to the bindings' flags and update the policy", msg)}}
+	}
+	l.Printf("WARNING: %s", msg)
+	return nil
+}
+
+// For --fail-on-deleted-referenced-header, checks that every header bindgen.sh in |dir| names, and
+// every one listed in the file |listed| if set, is still in src, as bindgen may otherwise generate
+// truncated bindings without failing.
+func checkBindgenHeaders(l *log.Logger, dir, listed string) error {
+	headers, err := bindgenScriptHeaders(filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh"))
+	if err != nil {
+		return &bindgenError{stepError{"rust", err}}
+	}
+	if listed != "" {
+		more, err := readReferencedPaths(listed)
+		if err != nil {
+			return &bindgenError{stepError{"rust", err}}
+		}
+		headers = append(headers, more...)
+	}
+	var missing []string
+	for _, h := range headers {
+		if _, err := os.Stat(filepath.Join(dir, "src", filepath.FromSlash(h))); os.IsNotExist(err) {
+			missing = append(missing, h)
+		} else if err != nil {
+			return &bindgenError{stepError{"rust", fmt.Errorf("failed to stat %s: %s", h, err)}}
+		}
+	}
+	if len(missing) > 0 {
+		return &bindgenError{stepError{"rust", fmt.Errorf("headers bindgen reads are missing from src: %s", strings.Join(sortedPaths(missing), ", "))}}
+	}
+	if len(headers) == 0 {
+		l.Printf("WARNING: bindgen.sh names no headers, so none were checked; list them with --bindgen-headers")
+		return nil
+	}
+	l.Printf("All %d headers bindgen reads are in src", len(headers))
+	return nil
+}
+
+// Regenerates the Rust bindings and returns the version of bindgen used.
+//
+// If |expected| is empty, the version pinned by bindgen.sh is expected. A mismatch is fatal if
+// |strict| is set; otherwise it is logged and bindgen.sh is told to accept the installed version.
+func generateRustBindings(l *log.Logger, dir, expected string, strict bool) (version string, err error) {
+	defer func() {
+		if err != nil {
+			err = &bindgenError{stepError{"rust", err}}
+		}
+	}()
+	l.Printf("Generating Rust bindings...")
+	script := filepath.Join("rust", "boringssl-sys", "bindgen.sh")
+	if expected == "" {
+		var err error
+		if expected, err = pinnedBindgenVersion(filepath.Join(dir, script)); err != nil {
+			return "", err
+		}
+	}
+	version, err = bindgenVersion(l)
+	if err != nil {
+		return "", err
+	}
+	want, ok := parseBindgenVersion(expected)
+	if !ok {
+		return "", fmt.Errorf("failed to parse expected bindgen version %q", expected)
+	}
+
+	cmd := exec.Command(script)
+	cmd.Dir = dir
+	cmd.Env = toolEnv()
+	if got, _ := parseBindgenVersion(version); got != want {
+		if strict {
+			return "", fmt.Errorf("unexpected version of bindgen: got %q; wanted %q", version, expected)
+		}
+		l.Printf("WARNING: unexpected version of bindgen: got %q; wanted %q", version, expected)
+		l.Printf("WARNING: the generated bindings may differ from those generated with the pinned version")
+		cmd.Env = toolEnv("BINDGEN_EXPECTED_VERSION_OVERRIDE=" + version)
+	}
+	return version, runLimited(withLog(l, cmd))
+}
+
+// The crate cargo updates in --cargo-update-dir when the Rust bindings change.
+const cargoPackage = "boringssl-sys"
+
+// Runs `cargo update -p boringssl-sys` in |crateDir|, relative to |dir| unless absolute, if the
+// Rust bindings in |dir| differ from |previous|, so that the Cargo.lock of a crate that depends on
+// them records their new checksum. With --no-network, cargo runs offline.
+func updateCargoLock(l *log.Logger, dir, crateDir string, previous []byte) error {
+	bindings := filepath.Join(dir, "rust", "boringssl-sys", "src", "lib.rs")
+	b, err := ioutil.ReadFile(bindings)
+	if err != nil {
+		return &bindgenError{stepError{"cargo", fmt.Errorf("failed to read %s: %s", bindings, err)}}
+	}
+	if bytes.Equal(b, previous) {
+		l.Printf("The Rust bindings are unchanged; not updating %s", crateDir)
+		return nil
+	}
+	if !filepath.IsAbs(crateDir) {
+		crateDir = filepath.Join(dir, crateDir)
+	}
+	l.Printf("Updating %s in %s...", cargoPackage, crateDir)
+	cmd := exec.Command("cargo", "update", "-p", cargoPackage)
+	if noNetwork {
+		cmd.Args = append(cmd.Args, "--offline")
+	}
+	cmd.Dir = crateDir
+	cmd.Env = toolEnv()
+	if err := run(withLog(l, cmd)); err != nil {
+		return &bindgenError{stepError{"cargo", err}}
+	}
+	return nil
+}
+
+// Regenerates only the Rust bindings for the sources already in |dir|, for --only-rust. No git or
+// network commands run; the README records which upstream revision the bindings are for.
+func rollRust(dir string, opts *rollOptions) error {
+	unlock, err := lock(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sha1, err := readReadMeRevision(dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Regenerating the Rust bindings for src at %s", sha1.short())
+	if opts.checkBindgenHeaders {
+		if err := checkBindgenHeaders(log.Default(), dir, opts.bindgenHeaders); err != nil {
+			return err
+		}
+	}
+	version, err := generateRustBindings(log.Default(), dir, opts.bindgenExpected, opts.bindgenStrict)
+	if err != nil {
+		return err
+	}
+	if opts.manifestPath != "" {
+		return writeManifest(opts.manifestPath, &manifest{Revision: string(sha1), BindgenVersion: version})
+	}
+	return nil
+}
+
+// Returns the output of `bindgen --version`, logging its standard error to |l|.
+func bindgenVersion(l *log.Logger) (string, error) {
+	cmd := exec.Command("bindgen", "--version")
+	cmd.Env = toolEnv()
+	cmd.Stderr = l.Writer()
+	if toolContainer.image != "" {
+		cmd = containerCommand(cmd, toolContainer, resourceLimits{})
+	}
+	out, err := output(cmd)
+	if err != nil {
+		return "", err
+	}
+	version := string(out)
+	if _, ok := parseBindgenVersion(version); !ok {
+		return "", fmt.Errorf("failed to parse bindgen version from %q", version)
+	}
+	return version, nil
+}
+
+// Writes |b| to |path| by renaming a temporary file over it, so readers never see a partial file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	resources.acquire("temporary file", f.Name())
+	defer removeTemp(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+const checksumsName = "SHA256SUMS"
+
+// Returns a listing of the SHA-256 digest of every regular file under |root| except the checksums
+// file itself, sorted by path, in the format sha256sum writes and `sha256sum -c` checks. git
+// metadata is left out.
+func checksums(root string) (string, error) {
+	var files []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || p == filepath.Join(root, checksumsName) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %s", root, err)
+	}
+	sort.Strings(files)
+	var b strings.Builder
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s: %s", name, err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		fmt.Fprintf(&b, "%x  %s\n", h.Sum(nil), name)
+	}
+	return b.String(), nil
+}
+
+// Returns the patches in the directory |patches|, in the order to apply them, or none if it does
+// not exist.
+func patchFiles(patches string) ([]string, error) {
+	infos, err := ioutil.ReadDir(patches)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", patches, err)
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".patch") {
+			names = append(names, filepath.Join(patches, info.Name()))
+		}
+	}
+	return names, nil
+}
+
+// Returns the files the patches in the directory |patches| create, relative to the tree they apply
+// to.
+func patchCreatedFiles(patches string) ([]string, error) {
+	names, err := patchFiles(patches)
+	if err != nil {
+		return nil, err
+	}
+	var created []string
+	for _, name := range names {
+		out, err := output(exec.Command("git", "apply", "--summary", "--", name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		// Each created file is summarized as " create mode <mode> <path>".
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.SplitN(strings.TrimSpace(line), " ", 4); len(fields) == 4 && fields[0] == "create" && fields[1] == "mode" {
+				created = append(created, fields[3])
+			}
+		}
+	}
+	return created, nil
+}
+
+// How a local patch applied, as recorded in the manifest.
+type patchHealth struct {
+	Phase  string `json:"phase"` // pre-generate or post-generate.
+	Patch  string `json:"patch"`
+	Status string `json:"status"` // clean, fuzz, empty or conflict.
+}
+
+// Describes each patch status for the summary, and what to do about it.
+var patchStatuses = map[string]string{
+	"clean":    "applied cleanly",
+	"fuzz":     "applied only with reduced context; refresh it",
+	"empty":    "was already applied, so is likely upstreamed; consider removing it",
+	"conflict": "did not apply; rebase it",
+}
+
+// Applies the patches in the directory |patches| to the tree |root| with git apply, in order, and
+// returns how each applied: cleanly, or only with a single line of context ("fuzz"). A patch whose
+// changes are already in |root|, as its reverse applies, became "empty" and is skipped. Stops at
+// the first patch that does not apply, a "conflict".
+func applyPatches(l *log.Logger, root, patches string) ([]patchHealth, error) {
+	names, err := patchFiles(patches)
+	if err != nil {
+		return nil, err
+	}
+	var health []patchHealth
+	for _, name := range names {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return health, err
+		}
+		var stderr bytes.Buffer
+		apply := func(args ...string) error {
+			stderr.Reset()
+			cmd := exec.Command("git", append(append([]string{"apply"}, args...), "--", abs)...)
+			cmd.Dir, cmd.Stderr = root, &stderr
+			return run(cmd)
+		}
+		h := patchHealth{Patch: filepath.Base(name), Status: "clean"}
+		checkErr := apply("--check")
+		failure := strings.TrimSpace(stderr.String())
+		switch {
+		case checkErr == nil:
+			err = apply()
+		case apply("--reverse", "--check") == nil:
+			h.Status = "empty"
+		case apply("--check", "-C1") == nil:
+			h.Status = "fuzz"
+			err = apply("-C1")
+		default:
+			h.Status = "conflict"
+			health = append(health, h)
+			return health, fmt.Errorf("failed to apply %s: %s: %s", name, checkErr, failure)
+		}
+		if err != nil {
+			return health, fmt.Errorf("failed to apply %s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+		health = append(health, h)
+		if h.Status == "clean" {
+			l.Printf("Applied %s", name)
+		} else {
+			l.Printf("WARNING: %s %s", name, patchStatuses[h.Status])
+		}
+	}
+	return health, nil
+}
+
+// Returns a step running applyPatches for the |phase| with the |patches| they are in to |root|,
+// recording their health in |m|.
+func patchStep(phase, desc, root, patches string, m *manifest) step {
+	return step{name: phase + "-patches", desc: desc, run: func() error {
+		health, err := applyPatches(log.Default(), root, patches)
+		for _, h := range health {
+			h.Phase = phase
+			m.Patches = append(m.Patches, h)
+		}
+		return err
+	}}
+}
+
+// Returns |patches|, relative to the boringssl directory |dir| if not absolute.
+func patchesDir(dir, patches string) string {
+	if filepath.IsAbs(patches) {
+		return patches
+	}
+	return filepath.Join(dir, patches)
+}
+
+// A group of files with identical contents.
+type duplicateGroup struct {
+	size  int64
+	paths []string // Relative to the tree they are in, sorted.
+}
+
+// Returns the groups of non-empty files under |root| with identical contents, ordered by the bytes
+// their copies waste, most first. Only files whose size another file shares are hashed, one at a
+// time, so memory grows with the number of files rather than their contents.
+func duplicateFiles(root string) ([]duplicateGroup, error) {
+	bySize := make(map[int64][]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", root, err)
+	}
+	var groups []duplicateGroup
+	for size, names := range bySize {
+		if len(names) < 2 {
+			continue
+		}
+		byHash := make(map[[sha256.Size]byte][]string)
+		for _, name := range names {
+			f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %s", name, err)
+			}
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			var sum [sha256.Size]byte
+			copy(sum[:], h.Sum(nil))
+			byHash[sum] = append(byHash[sum], name)
+		}
+		for _, same := range byHash {
+			if len(same) > 1 {
+				sort.Strings(same)
+				groups = append(groups, duplicateGroup{size, same})
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		wi, wj := groups[i].size*int64(len(groups[i].paths)-1), groups[j].size*int64(len(groups[j].paths)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return groups[i].paths[0] < groups[j].paths[0]
+	})
+	return groups, nil
+}
+
+// Logs the groups of files in src in |dir| with identical contents, for --report-duplicates.
+func reportDuplicates(l *log.Logger, dir string) error {
+	groups, err := duplicateFiles(filepath.Join(dir, "src"))
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		l.Printf("No files in src have identical contents")
+		return nil
+	}
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.size * int64(len(g.paths)-1)
+	}
+	l.Printf("Files in src with identical contents (%d groups, %d duplicate bytes):", len(groups), wasted)
+	for _, g := range groups {
+		l.Printf("  %d bytes each: %s", g.size, strings.Join(g.paths, ", "))
+	}
+	return nil
+}
+
+// The extensions of the files in src that --strict-utf8 checks are valid UTF-8. Others, such as
+// binary test fixtures, are left alone.
+var utf8Extensions = map[string]bool{
+	".asm": true, ".c": true, ".cc": true, ".cmake": true, ".gn": true, ".gni": true, ".go": true,
+	".h": true, ".inc": true, ".json": true, ".md": true, ".pl": true, ".py": true, ".rs": true,
+	".S": true, ".txt": true,
+}
+
+// A file that is not valid UTF-8, and the offset of its first invalid byte.
+type invalidUTF8 struct {
+	path   string // Relative to the tree it is in.
+	offset int
+}
+
+// Returns the files under |root| with one of utf8Extensions that are not valid UTF-8, sorted by
+// path.
+func invalidUTF8Files(root string) ([]invalidUTF8, error) {
+	var invalid []invalidUTF8
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || !utf8Extensions[filepath.Ext(p)] {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if utf8.Valid(b) {
+			return nil
+		}
+		offset := 0
+		for offset < len(b) {
+			r, size := utf8.DecodeRune(b[offset:])
+			if r == utf8.RuneError && size == 1 {
+				break
+			}
+			offset += size
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		invalid = append(invalid, invalidUTF8{filepath.ToSlash(rel), offset})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %s", root, err)
+	}
+	return invalid, nil
+}
+
+// Checks that the text files in src in |dir| are valid UTF-8, for --strict-utf8, logging the
+// offset of the first invalid byte of each that is not.
+func checkUTF8(l *log.Logger, dir string) error {
+	invalid, err := invalidUTF8Files(filepath.Join(dir, "src"))
+	if err != nil {
+		return err
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	var paths []string
+	for _, f := range invalid {
+		l.Printf("src/%s is not valid UTF-8 at byte %d", f.path, f.offset)
+		paths = append(paths, f.path)
+	}
+	return fmt.Errorf("%d files in src are not valid UTF-8: %s", len(invalid), strings.Join(paths, ", "))
+}
+
+// Writes the checksums of the files in src in |dir| to src/SHA256SUMS, together with those of the
+// |generated| files, given relative to |dir|, for --include-generated-in-manifest. The generated
+// files are listed relative to src, as ../NAME, so that `sha256sum -c` in src checks them all.
+func writeChecksums(dir string, generated []string) error {
+	src := filepath.Join(dir, "src")
+	sums, err := checksums(src)
+	if err != nil {
+		return err
+	}
+	if len(generated) > 0 {
+		lines := strings.SplitAfter(sums, "\n")
+		lines = lines[:len(lines)-1]
+		for _, name := range generated {
+			b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			lines = append(lines, fmt.Sprintf("%x  ../%s\n", sha256.Sum256(b), name))
+		}
+		// Sorted by path, after the digest and two spaces.
+		sort.Slice(lines, func(i, j int) bool { return lines[i][2*sha256.Size+2:] < lines[j][2*sha256.Size+2:] })
+		sums = strings.Join(lines, "")
+	}
+	if err := writeFileAtomic(filepath.Join(src, checksumsName), []byte(sums)); err != nil {
+		return fmt.Errorf("failed to write %s: %s", checksumsName, err)
+	}
+	log.Printf("Wrote the checksums of %d files to src/%s", strings.Count(sums, "\n"), checksumsName)
+	return nil
+}
+
+// Writes to |manifest| the SHA-256 digest of every file in src in |dir|, in the format of
+// checksums, and if |casDir| is set hardlinks each file into it as HH/HASH, where HH is the first
+// two digits of HASH. Files already in |casDir| are left alone; files that cannot be hardlinked
+// there, as on another file system, are copied.
+func writeCAS(dir, casDir, manifest string) error {
+	src := filepath.Join(dir, "src")
+	sums, err := checksums(src)
+	if err != nil {
+		return err
+	}
+	if casDir != "" {
+		if err := addToCAS(src, casDir, sums); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(manifest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %s", filepath.Dir(manifest), err)
+	}
+	if err := writeFileAtomic(manifest, []byte(sums)); err != nil {
+		return fmt.Errorf("failed to write %s: %s", manifest, err)
+	}
+	log.Printf("Wrote the content hashes of src to %s", manifest)
+	return nil
+}
+
+// Hardlinks, or copies, each file in |src| listed in |sums| into |casDir| by its hash.
+func addToCAS(src, casDir, sums string) error {
+	added, total := 0, 0
+	for _, line := range strings.SplitAfter(sums, "\n") {
+		if line == "" {
+			continue
+		}
+		total++
+		hash, name := line[:sha256.Size*2], strings.TrimSuffix(line[sha256.Size*2+2:], "\n")
+		object := filepath.Join(casDir, hash[:2], hash)
+		if _, err := os.Stat(object); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat %s: %s", object, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %s", filepath.Dir(object), err)
+		}
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.Link(path, object); err != nil {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			if err := writeFileAtomic(object, b); err != nil {
+				return fmt.Errorf("failed to add %s to %s: %s", name, casDir, err)
+			}
+		}
+		added++
+	}
+	log.Printf("Added %d of the %d files in src to %s", added, total, casDir)
+	return nil
+}
+
+// Returns the contents of the version header for |sha1|, generated on |date|.
+func versionHeader(sha1 revision, date time.Time) string {
+	return fmt.Sprintf(`// Generated by roll_boringssl.go. Do not edit.
+
+#ifndef BORINGSSL_VENDORED_REVISION_H_
+#define BORINGSSL_VENDORED_REVISION_H_
+
+#define BORINGSSL_VENDORED_REVISION "%s"
+#define BORINGSSL_VENDORED_DATE "%s"
+
+#endif  // BORINGSSL_VENDORED_REVISION_H_
+`, sha1, date.UTC().Format("2006-01-02"))
+}
+
+// Writes the header at |path| defining the vendored revision |sha1| and the date |now|, and returns
+// whether it changed. A header that already defines |sha1| is left alone, so its date stays that of
+// the roll.
+func updateVersionHeader(path string, sha1 revision, now time.Time) (bool, error) {
+	if _, err := parseRevision(string(sha1)); err != nil {
+		return false, fmt.Errorf("refusing to write to %s: %s", path, err)
+	}
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	if bytes.Contains(old, []byte(fmt.Sprintf("#define BORINGSSL_VENDORED_REVISION %q\n", sha1))) {
+		log.Printf("%s is already at %s", path, sha1.short())
+		return false, nil
+	}
+	log.Printf("Updating %s...", path)
+	if err := writeFileAtomic(path, []byte(versionHeader(sha1, now))); err != nil {
+		return false, fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return true, nil
+}
+
+// The README that records the upstream revision, which a project in --projects may rename.
+var readmeName = "README.fuchsia"
+
+// Matches the upstream git URL that the README ends with.
+var readmeRevisionRE = regexp.MustCompile(`/\+/([0-9a-f]{40})/\s*$`)
+
+// Returns the offset in |readme|, the contents of the README, of the upstream revision it ends with,
+// or an error saying why it has none.
+func readmeRevisionOffset(readme []byte) (int, error) {
+	switch {
+	case len(readme) == 0:
+		return 0, fmt.Errorf("%s is empty; it should end with an upstream revision URL", readmeName)
+	case !utf8.Valid(readme) || bytes.IndexByte(readme, 0) >= 0:
+		return 0, fmt.Errorf("%s is not UTF-8 text", readmeName)
+	}
+	m := readmeRevisionRE.FindSubmatchIndex(readme)
+	if m == nil {
+		return 0, fmt.Errorf("%s does not end with an upstream revision URL", readmeName)
+	}
+	return m[2], nil
+}
+
+// Returns the upstream revision recorded in the README.
+func readReadMeRevision(dir string) (revision, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, readmeName))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", readmeName, err)
+	}
+	offset, err := readmeRevisionOffset(b)
+	if err != nil {
+		return "", err
+	}
+	return revision(b[offset : offset+40]), nil
+}
+
+// How many times updateReadMe reads the README afresh when another tool edits it in the meantime.
+const readmeAttempts = 5
+
+// Reads the README for updateReadMe. Tests replace it to edit the README behind its back.
+var readReadMeFile = ioutil.ReadFile
+
+// Updates the README file that ends with the current upstream git revision. If the README changes
+// between reading it and writing the revision, it is read again and the revision URL located
+// afresh, so that an edit made meanwhile by another tool is neither lost nor overwritten.
+func updateReadMe(dir string, sha1 revision) (err error) {
+	defer func() {
+		if err != nil {
+			err = &readmeError{stepError{"readme", err}}
+		}
+	}()
+	log.Printf("Updating %s...", readmeName)
+	if _, err := parseRevision(string(sha1)); err != nil {
+		return fmt.Errorf("refusing to write to %s: %s", readmeName, err)
+	}
+	path := filepath.Join(dir, readmeName)
+	for attempt := 1; ; attempt++ {
+		b, err := readReadMeFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", readmeName, err)
+		}
+		offset, err := readmeRevisionOffset(b)
+		if err != nil {
+			return err
+		}
+		if revision(b[offset:offset+40]) == sha1 {
+			return nil
+		}
+		if ok, err := writeReadMeRevision(path, b, offset, sha1); err != nil || ok {
+			return err
+		}
+		if attempt == readmeAttempts {
+			return fmt.Errorf("%s changed each of the %d times it was about to be updated", readmeName, readmeAttempts)
+		}
+		log.Printf("%s changed while it was being updated; reading it again", readmeName)
+	}
+}
+
+// Writes |sha1| at |offset| in the README at |path|, provided that it still holds |b|. Returns
+// whether it did.
+func writeReadMeRevision(path string, b []byte, offset int, sha1 revision) (ok bool, err error) {
+	readme, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %s", readmeName, err)
+	}
+	defer func() {
+		if cerr := readme.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close %s: %s", readmeName, cerr)
+		}
+	}()
+	current, err := ioutil.ReadAll(readme)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %s", readmeName, err)
+	}
+	if !bytes.Equal(current, b) {
+		return false, nil
+	}
+	if _, err = readme.WriteAt([]byte(sha1), int64(offset)); err != nil {
+		return false, fmt.Errorf("failed to write to %s: %s", readmeName, err)
+	}
+	return true, nil
+}
+
+// Writes the roll manifest to |path| as JSON.
+func writeManifest(path string, m *manifest) error {
+	log.Printf("Writing manifest to %s...", path)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// Returns the dotenv-style lines --export-env-file writes for the roll manifest |m|, which may be
+// nil if the roll failed before it had one, and whether the roll succeeded.
+func envFile(m *manifest, success bool) []byte {
+	if m == nil {
+		m = &manifest{}
+	}
+	changed := 0
+	if m.DiffStat != nil {
+		changed = m.DiffStat.Files
+	}
+	size := ""
+	if m.SourcesSize != 0 {
+		size = strconv.FormatInt(m.SourcesSize, 10)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "ROLL_OLD_SHA=%s\n", m.PreviousRevision)
+	fmt.Fprintf(&b, "ROLL_NEW_SHA=%s\n", m.Revision)
+	fmt.Fprintf(&b, "ROLL_CHANGED_FILES=%d\n", changed)
+	fmt.Fprintf(&b, "ROLL_SRC_SIZE=%s\n", size)
+	fmt.Fprintf(&b, "ROLL_SUCCESS=%t\n", success)
+	return []byte(b.String())
+}
+
+// Writes the --export-env-file for the roll manifest |m| to |path|, replacing it atomically so that
+// a CI job sourcing it never reads a partial file.
+func writeEnvFile(path string, m *manifest, success bool) error {
+	log.Printf("Writing roll variables to %s...", path)
+	if err := writeFileAtomic(path, envFile(m, success)); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// Reads the roll manifest at |path|, returning nil if there is none.
+func readManifest(path string) (*manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return m, nil
+}
+
+// Returns the SHA-256 digest of each file |steps| write in |dir|, keyed by the path in their
+// writes. The sources the steps check out in src are left out, as the checksums cover them.
+func outputHashes(dir string, steps []step) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, s := range steps {
+		for _, name := range s.writes {
+			if name == "src" {
+				continue
+			}
+			path := name
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, name)
+			}
+			if info, err := os.Stat(path); os.IsNotExist(err) || (err == nil && info.IsDir()) {
+				continue
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %s", name, err)
+			}
+			hashes[name] = fmt.Sprintf("%x", sha256.Sum256(b))
+		}
+	}
+	return hashes, nil
+}
+
+// Returns the differences between the manifest of the previous roll, |old|, and that of this one,
+// |new|, one per line, for --summary-only. Fields that are the same in both are left out.
+func diffManifests(old, new *manifest) []string {
+	if old == nil {
+		return []string{fmt.Sprintf("no previous manifest; rolled to %s", new.Revision)}
+	}
+	var diffs []string
+	diff := func(name, o, n string) {
+		if o != n {
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", name, orNone(o), orNone(n)))
+		}
+	}
+	diff("revision", old.Revision, new.Revision)
+	diff("bindgen", old.BindgenVersion, new.BindgenVersion)
+	generator := func(m *manifest) string {
+		if m.Generator == "" {
+			return "upstream"
+		}
+		return m.Generator
+	}
+	diff("generator", generator(old), generator(new))
+	if old.GeneratorBlob != "" && new.GeneratorBlob != "" {
+		diff("generator blob", old.GeneratorBlob, new.GeneratorBlob)
+	}
+	diff("build formats", strings.Join(old.BuildFormats, " "), strings.Join(new.BuildFormats, " "))
+	if old.SourcesSize != 0 && new.SourcesSize != 0 && old.SourcesSize != new.SourcesSize {
+		diffs = append(diffs, "sources size: "+formatSizeDelta(old.SourcesSize, new.SourcesSize))
+	}
+	var names []string
+	for name := range old.Outputs {
+		names = append(names, name)
+	}
+	for name := range new.Outputs {
+		if _, ok := old.Outputs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, inOld := old.Outputs[name]
+		n, inNew := new.Outputs[name]
+		switch {
+		case !inOld:
+			diffs = append(diffs, "added: "+name)
+		case !inNew:
+			diffs = append(diffs, "removed: "+name)
+		case o != n && isGeneratedOutput(name):
+			diffs = append(diffs, "changed: "+name+attributionNote(attributeOutputChange(old, new)))
+		case o != n:
+			diffs = append(diffs, "changed: "+name)
+		}
+	}
+	return diffs
+}
+
+// Returns the git blob hash of the generator a roll in |dir| with |opts| runs, as `git hash-object`
+// computes it, so a change to upstream's generator can be told apart from changes to the sources.
+func generatorBlob(dir string, opts *rollOptions) (string, error) {
+	generator, upstream := activeGenerator(opts)
+	if upstream {
+		generator = filepath.Join(dir, "src", filepath.FromSlash(generator))
+	}
+	b, err := ioutil.ReadFile(generator)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash the generator: %s", err)
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(b))
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Returns whether |name|, an output recorded in the manifest, is a build file the generator writes.
+func isGeneratedOutput(name string) bool {
+	for _, gn := range gnOutputs {
+		if name == gn {
+			return true
+		}
+	}
+	return !strings.Contains(name, "/") && path.Ext(name) == ".bp"
+}
+
+// Returns why the generated build file |name| differs between the manifests |old| and |new|:
+// "sources" if they were generated with the same generator, so only the sources it read changed,
+// "generator" if the generator changed too, or "unknown" if either manifest lacks its hash.
+func attributeOutputChange(old, new *manifest) string {
+	switch {
+	case old.GeneratorBlob == "" || new.GeneratorBlob == "":
+		return "unknown"
+	case old.GeneratorBlob == new.GeneratorBlob:
+		return "sources"
+	}
+	return "generator"
+}
+
+// Returns the note diffManifests adds to a generated build file that changed for |cause|. A change
+// that cannot be attributed, as from a manifest written before generator hashes were, has none.
+func attributionNote(cause string) string {
+	switch cause {
+	case "sources":
+		return " (from the sources; the generator is unchanged)"
+	case "generator":
+		return " (the generator changed)"
+	}
+	return ""
+}
+
+// Returns |s|, or "none" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// Prints to |w| what changed between the manifests |old| and |new|, for --summary-only, and the
+// volume of the upstream changes |new| rolled in.
+func printSummary(w io.Writer, old, new *manifest) {
+	diffs := diffManifests(old, new)
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "nothing changed since the previous roll")
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(w, d)
+	}
+	for _, h := range new.Patches {
+		fmt.Fprintf(w, "patch %s/%s: %s\n", h.Phase, h.Patch, patchStatuses[h.Status])
+	}
+	for _, f := range new.Advisories {
+		if f.Status == "fixed" {
+			fmt.Fprintf(w, "advisory %s: fixed by %s\n", f.ID, revision(f.Commit).short())
+		} else {
+			fmt.Fprintf(w, "advisory %s: still vulnerable\n", f.ID)
+		}
+	}
+	if new.DiffStat != nil {
+		fmt.Fprintf(w, "upstream diff: %s\n", new.DiffStat)
+		for _, d := range new.DiffStat.Dirs {
+			fmt.Fprintf(w, "  %5.1f%% %s\n", d.Percent, d.Dir)
+		}
+	}
+	if s := new.Licenses; s != nil {
+		fmt.Fprintf(w, "licenses: %s\n", strings.Join(s.ids(), ", "))
+		for _, id := range s.New {
+			fmt.Fprintf(w, "new license: %s\n", id)
+		}
+		for _, id := range s.Disallowed {
+			fmt.Fprintf(w, "disallowed license: %s\n", id)
+		}
+	}
+}
+
+// Prints the upstream changes a --sources-only roll checked out: its commits, the files added and
+// removed, and the volume of the diff.
+func printSourcesSummary(w io.Writer, m *manifest) {
+	if m.PreviousRevision == m.Revision {
+		fmt.Fprintf(w, "src is already at %s\n", m.Revision)
+		return
+	}
+	fmt.Fprintf(w, "src: %s -> %s\n", orNone(m.PreviousRevision), m.Revision)
+	if m.CommitCount > 0 {
+		fmt.Fprintf(w, "%d commits:\n", m.CommitCount)
+	}
+	for _, c := range m.Commits {
+		fmt.Fprintf(w, "  %s %s\n", revision(c.SHA1).short(), c.Subject)
+	}
+	for _, p := range m.Added {
+		fmt.Fprintf(w, "added: %s\n", p)
+	}
+	for _, p := range m.Removed {
+		fmt.Fprintf(w, "removed: %s\n", p)
+	}
+	if m.DiffStat != nil {
+		fmt.Fprintf(w, "upstream diff: %s\n", m.DiffStat)
+		for _, d := range m.DiffStat.Dirs {
+			fmt.Fprintf(w, "  %5.1f%% %s\n", d.Percent, d.Dir)
+		}
+	}
+}
+
+// Records in |m| the files added and removed between |old| and |new| in the git checkout in |dir|.
+func recordChanges(dir string, old, new revision, m *manifest) error {
+	changes, err := diffTree(dir, old, new)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		switch c.status {
+		case 'A':
+			m.Added = append(m.Added, c.path)
+		case 'D':
+			m.Removed = append(m.Removed, c.path)
+		}
+	}
+	return nil
+}
+
+// Returns the output of git diff with |stat|, --shortstat or --dirstat, of the range from |old| to
+// |new| in the git checkout |dir|; replaced in tests.
+var gitDiffStat = func(dir string, old, new revision, stat string) (string, error) {
+	out, err := output(exec.Command("git", "-C", dir, "diff", stat, string(old), string(new), "--"))
+	return string(out), err
+}
+
+var (
+	shortStatRE = regexp.MustCompile(`(\d+) (files? changed|insertions?\(\+\)|deletions?\(-\))`)
+	dirStatRE   = regexp.MustCompile(`(?m)^\s*([0-9.]+)% (.+)$`)
+)
+
+// Returns the volume of the changes from |old| to |new| in the git checkout in |dir|.
+func recordDiffStat(dir string, old, new revision) (*diffStat, error) {
+	s := &diffStat{}
+	if old == new {
+		return s, nil
+	}
+	short, err := gitDiffStat(dir, old, new, "--shortstat")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range shortStatRE.FindAllStringSubmatch(short, -1) {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2][0] {
+		case 'f':
+			s.Files = n
+		case 'i':
+			s.Insertions = n
+		case 'd':
+			s.Deletions = n
+		}
+	}
+	dirs, err := gitDiffStat(dir, old, new, "--dirstat")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range dirStatRE.FindAllStringSubmatch(dirs, -1) {
+		percent, _ := strconv.ParseFloat(m[1], 64)
+		s.Dirs = append(s.Dirs, dirStat{percent, m[2]})
+	}
+	return s, nil
+}
+
+// Returns the one-line summary of |s|, as git diff --shortstat words it.
+func (s *diffStat) String() string {
+	plural := func(n int, one, many string) string {
+		if n == 1 {
+			return "1 " + one
+		}
+		return fmt.Sprintf("%d %s", n, many)
+	}
+	return fmt.Sprintf("%s, %s, %s", plural(s.Files, "file changed", "files changed"), plural(s.Insertions, "insertion(+)", "insertions(+)"), plural(s.Deletions, "deletion(-)", "deletions(-)"))
+}
+
+// Returns |steps|, each recording in |m| how long it took. Steps that run concurrently may finish
+// in any order.
+func timeSteps(steps []step, m *manifest) []step {
+	var mu sync.Mutex
+	record := func(name string, start time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		m.Steps = append(m.Steps, stepTiming{Name: name, Seconds: time.Since(start).Seconds()})
+	}
+	timed := make([]step, len(steps))
+	for i, s := range steps {
+		s := s
+		timed[i] = s
+		timed[i].run = func() error {
+			defer record(s.name, time.Now())
+			return s.run()
+		}
+		if s.logged != nil {
+			timed[i].logged = func(l *log.Logger) error {
+				defer record(s.name, time.Now())
+				return s.logged(l)
+			}
+		}
+	}
+	return timed
+}
+
+// Returns the timeout of the step |name| with |opts| and where it was set, or zero if it has none.
+func stepTimeout(name string, opts *rollOptions) (time.Duration, string) {
+	if d, ok := opts.stepTimeouts[name]; ok {
+		return d, "--step-timeout"
+	}
+	if opts.timeout > 0 {
+		return opts.timeout, "--timeout"
+	}
+	return 0, ""
+}
+
+// Runs |f|, the step |name|, failing it if it runs for longer than |timeout|. When it times out, the
+// commands the roll is running are killed, which are those of the step unless it runs concurrently
+// with others under --jobs, and it fails once it returns.
+func runWithTimeout(name string, timeout time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	log.Printf("%s has run for its timeout of %s; killed %d commands", name, timeout, killRunning())
+	<-done
+	return &stepError{name, fmt.Errorf("timed out after %s", timeout)}
+}
+
+// Returns |steps| with each that has a timeout with |opts| limited to it.
+func limitSteps(steps []step, opts *rollOptions) []step {
+	limited := make([]step, len(steps))
+	for i, s := range steps {
+		s := s
+		limited[i] = s
+		timeout, source := stepTimeout(s.name, opts)
+		if timeout <= 0 {
+			continue
+		}
+		limited[i].run = func() error {
+			log.Printf("Running %s with a timeout of %s from %s", s.name, timeout, source)
+			return runWithTimeout(s.name, timeout, s.run)
+		}
+		if s.logged != nil {
+			limited[i].logged = func(l *log.Logger) error {
+				l.Printf("Running %s with a timeout of %s from %s", s.name, timeout, source)
+				return runWithTimeout(s.name, timeout, func() error { return s.logged(l) })
+			}
+		}
+	}
+	return limited
+}
+
+// Returns the soft budget of the step |name| with |opts| and where it was set, or zero if it has none.
+func stepBudget(name string, opts *rollOptions) (time.Duration, string) {
+	if d, ok := opts.stepBudgets[name]; ok {
+		return d, "--step-budget"
+	}
+	if opts.maxRuntimeWarn > 0 {
+		return opts.maxRuntimeWarn, "--max-runtime-warn"
+	}
+	return 0, ""
+}
+
+// Runs |f|, the step |name|, logging to |l| every |interval| that it is still running and warning
+// once if it runs for longer than |budget|, from |source|. Neither stops it.
+func runWithHeartbeat(l *log.Logger, name string, interval, budget time.Duration, source string, f func() error) error {
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var tick, over <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		if budget > 0 {
+			timer := time.NewTimer(budget)
+			defer timer.Stop()
+			over = timer.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick:
+				l.Printf("Still running %s after %s", name, time.Since(start).Truncate(interval))
+			case <-over:
+				l.Printf("WARNING: %s has run for longer than its budget of %s from %s; it is left running", name, budget, source)
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(done)
+	return f()
+}
+
+// Returns |steps| with each run under runWithHeartbeat if |opts| sets a heartbeat interval or a
+// budget for it.
+func watchSteps(steps []step, opts *rollOptions) []step {
+	watched := make([]step, len(steps))
+	for i, s := range steps {
+		s := s
+		watched[i] = s
+		budget, source := stepBudget(s.name, opts)
+		if opts.heartbeatInterval <= 0 && budget <= 0 {
+			continue
+		}
+		watched[i].run = func() error {
+			return runWithHeartbeat(log.Default(), s.name, opts.heartbeatInterval, budget, source, s.run)
+		}
+		if s.logged != nil {
+			watched[i].logged = func(l *log.Logger) error {
+				return runWithHeartbeat(l, s.name, opts.heartbeatInterval, budget, source, func() error { return s.logged(l) })
+			}
+		}
+	}
+	return watched
+}
+
+// For --commit-per-step, returns |steps| each committing the changes it made in |dir| to the roll
+// |m| when it succeeds. The steps lose their loggers, so that they run one at a time and each
+// commit holds the changes of a single step.
+func commitSteps(steps []step, dir string, m *manifest, opts *rollOptions) []step {
+	if !opts.commitPerStep {
+		return steps
+	}
+	committing := make([]step, len(steps))
+	for i, s := range steps {
+		i, s := i, s
+		committing[i] = s
+		committing[i].logged = nil
+		committing[i].run = func() error {
+			if err := s.run(); err != nil {
+				return err
+			}
+			msg := stepCommitMessage(m, s, i+1, len(steps), opts.commitSubjectPrefix, opts.bugs)
+			committed, err := commitStaged(dir, msg, opts.signCommit)
+			if err != nil {
+				return fmt.Errorf("failed to commit the changes of the %s step: %s", s.name, err)
+			}
+			if committed {
+				log.Printf("Committed the changes of the %s step", s.name)
+			} else {
+				log.Printf("The %s step changed nothing to commit", s.name)
+			}
+			return nil
+		}
+	}
+	return committing
+}
+
+const defaultCommitURL = "https://boringssl.googlesource.com/boringssl/+/{revision}"
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"short": func(sha1 string) string { return revision(sha1).short() },
+	"size":  formatSizeDelta,
+	"join":  func(s []string) string { return strings.Join(s, ", ") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BoringSSL roll to {{short .Manifest.Revision}}</title>
+</head>
+<body>
+<h1>BoringSSL roll to {{short .Manifest.Revision}}</h1>
+{{if .Manifest.FailedStep}}<p><strong>The roll failed in the {{.Manifest.FailedStep}} step.</strong></p>
+{{end}}<h2>Revisions</h2>
+<ul>
+{{if .Manifest.PreviousRevision}}<li>From <a href="{{.Link .Manifest.PreviousRevision}}">{{.Manifest.PreviousRevision}}</a></li>
+{{end}}<li>To <a href="{{.Link .Manifest.Revision}}">{{.Manifest.Revision}}</a></li>
+{{with .Manifest.DiffStat}}<li>Upstream diff: {{.}}</li>
+{{end}}{{if .Manifest.SourcesSize}}<li>Size of src: {{size .Manifest.PreviousSourcesSize .Manifest.SourcesSize}}</li>
+{{end}}</ul>
+{{with .Manifest.Advisories}}<h2>Advisories</h2>
+<ul>
+{{range .}}<li>{{if eq .Status "fixed"}}<strong>Fixes {{.ID}}</strong> with <a href="{{$.Link .Commit}}">{{short .Commit}}</a>{{else}}<strong>Still vulnerable to {{.ID}}</strong>{{end}}{{with .Summary}}: {{.}}{{end}}</li>
+{{end}}</ul>
+{{end}}{{with .Manifest.Licenses}}<h2>Licenses</h2>
+{{with .Disallowed}}<p><strong>Not allowed: {{join .}}</strong></p>
+{{end}}{{with .New}}<p><strong>New in this roll: {{join .}}</strong></p>
+{{end}}<ul>
+{{range $id, $n := .Files}}<li>{{$id}}: {{$n}} files</li>
+{{end}}</ul>
+{{end}}{{with .Security}}<h2>Security-relevant changes</h2>
+<ul>
+{{range .}}<li><a href="{{$.Link .SHA1}}">{{short .SHA1}}</a> {{.Subject}}</li>
+{{end}}</ul>
+{{end}}{{with .Manifest.GeneratorWarnings}}<h2>Generator warnings</h2>
+<ul>
+{{range .}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}<h2>Changelog</h2>
+{{if lt (len .Manifest.Commits) .Manifest.CommitCount}}<p>Showing the first {{len .Manifest.Commits}} of {{.Manifest.CommitCount}} commits.</p>
+{{end}}<ul>
+{{range .Manifest.Commits}}<li><a href="{{$.Link .SHA1}}">{{short .SHA1}}</a> {{.Subject}}{{if .Security}} <strong>(security)</strong>{{end}}</li>
+{{else}}<li>No upstream commits recorded.</li>
+{{end}}</ul>
+<h2>Files</h2>
+<ul>
+{{range .Manifest.Added}}<li>Added {{.}}</li>
+{{end}}{{range .Manifest.Removed}}<li>Removed {{.}}</li>
+{{end}}</ul>
+<h2>Steps</h2>
+<table>
+{{range .Manifest.Steps}}<tr><td>{{.Name}}</td><td>{{printf "%.1f" .Seconds}}s</td><td>{{with .Timeout}}timeout {{.}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// The data the report template is rendered from.
+type reportData struct {
+	Manifest  *manifest
+	Security  []manifestCommit
+	commitURL string
+}
+
+// Returns the URL of |sha1| for the report.
+func (d *reportData) Link(sha1 string) string {
+	return strings.ReplaceAll(d.commitURL, "{revision}", sha1)
+}
+
+// Returns the change in size from |old| to |new| bytes, for the report.
+func formatSizeDelta(old, new int64) string {
+	return fmt.Sprintf("%.1f MiB (%+.1f MiB)", float64(new)/(1<<20), float64(new-old)/(1<<20))
+}
+
+// Renders the HTML report of the roll recorded in |m| to |w|, linking to commits at |commitURL|
+// with {revision} replaced.
+func renderReport(w io.Writer, m *manifest, commitURL string) error {
+	d := &reportData{Manifest: m, commitURL: commitURL}
+	for _, c := range m.Commits {
+		if c.Security {
+			d.Security = append(d.Security, c)
+		}
+	}
+	if err := reportTemplate.Execute(w, d); err != nil {
+		return fmt.Errorf("failed to render report: %s", err)
+	}
+	return nil
+}
+
+// Writes the HTML report of the roll recorded in |m| to |path|.
+func writeReport(path string, m *manifest, commitURL string) error {
+	log.Printf("Writing report to %s...", path)
+	var buf bytes.Buffer
+	if err := renderReport(&buf, m, commitURL); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// A roll resolved by --plan-out, for a later run with --plan-in to apply exactly.
+type rollPlan struct {
+	Commit           string                 `json:"commit"`
+	Revision         revision               `json:"revision"`
+	PreviousRevision revision               `json:"previous_revision"`
+	Settings         map[string]interface{} `json:"settings"`
+	Changes          []string               `json:"changes,omitempty"` // git diff --name-status lines.
+}
+
+// The flags that select what the roller does rather than how the roll is made, which a plan
+// leaves out.
+var planModeFlags = []string{"commit", "plan-out", "plan-in", "allow-plan-drift", "config", "print-config", "selftest", "explain", "print-plan-json", "verify-only", "verify-tree-matches-commit", "emit-patch", "serve", "watch", "only-rust", "dry-run-generators", "poll-interval", "log-dir", "json-logs"}
+
+// Returns the settings of the flags that |sources| records as set, less the mode flags, in the
+// form of a config file.
+func planSettings(sources map[string]string) map[string]interface{} {
+	settings := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		for _, name := range planModeFlags {
+			if f.Name == name {
+				return
+			}
+		}
+		if sources[f.Name] != "" {
+			settings[f.Name] = flagValue(f)
+		}
+	})
+	return settings
+}
+
+// Writes |p| to |path| as JSON.
+func writePlan(path string, p *rollPlan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// Reads the plan at |path|.
+func readPlan(path string) (*rollPlan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var p rollPlan
+	if err := d.Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if _, err := parseRevision(string(p.Revision)); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &p, nil
+}
+
+// Returns the revision to roll to for the plan |p|, given that its commit-ish now resolves to
+// |resolved| and the sources are at |current|. Unless |allowDrift| is set, it is an error for
+// either to differ from the plan.
+func plannedRevision(p *rollPlan, resolved, current revision, allowDrift bool) (revision, error) {
+	var drift []string
+	if resolved != p.Revision {
+		drift = append(drift, fmt.Sprintf("%s now resolves to %s, not the planned %s", p.Commit, resolved.short(), p.Revision.short()))
+	}
+	if current != p.PreviousRevision {
+		drift = append(drift, fmt.Sprintf("src is at %s, not the planned %s", current.short(), p.PreviousRevision.short()))
+	}
+	if len(drift) > 0 {
+		msg := "the roll has drifted from its plan: " + strings.Join(drift, "; ")
+		if !allowDrift {
+			return "", fmt.Errorf("%s; use --allow-plan-drift to roll to %s anyway", msg, p.Revision.short())
+		}
+		log.Printf("WARNING: %s", msg)
+	}
+	return p.Revision, nil
+}
+
+// A named stage of the roll. Steps run in the order they are listed in roll().
+type step struct {
+	name string
+	desc string // What the step does, for --explain.
+	run  func() error
+
+	// If set, the step logs only to the logger it is given, so it can run concurrently with the
+	// adjacent steps that also do.
+	logged func(l *log.Logger) error
+
+	// If set, the later steps depend on this one, so they are not run if it fails even without
+	// --fail-fast.
+	required bool
+
+	// The command the step runs, if any, and the paths relative to the boringssl directory that it
+	// writes, for --print-plan-json.
+	cmd    *exec.Cmd
+	writes []string
+}
+
+// The failures of several steps, from a roll with --fail-fast=false.
+type stepErrors []error
+
+func (e stepErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d steps failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e stepErrors) Unwrap() []error {
+	return e
+}
+
+// Returns the failures as one error: the only one, or all of them.
+func (e stepErrors) err() error {
+	if len(e) == 1 {
+		return e[0]
+	}
+	return e
+}
+
+// Returns a step that logs to the logger it is given, which is the standard logger unless the step
+// runs concurrently.
+func loggedStep(name, desc string, f func(l *log.Logger) error) step {
+	return step{name: name, desc: desc, run: func() error { return f(log.Default()) }, logged: f}
+}
+
+// Serializes the lines written to it and to the other lineWriters sharing |mu| onto |w|, with
+// |prefix| before each, so that concurrent writers never interleave within a line.
+type lineWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if _, err := fmt.Fprintf(l.w, "%s%s", l.prefix, l.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		l.buf = l.buf[i+1:]
+	}
+}
+
+// Writes out any final partial line.
+func (l *lineWriter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		fmt.Fprintf(l.w, "%s%s\n", l.prefix, l.buf)
+		l.buf = nil
+	}
+}
+
+// A line of the log as --json-logs writes it.
+type logEvent struct {
+	Time      string  `json:"time"`  // RFC 3339, to the nanosecond.
+	Level     string  `json:"level"` // info, warning or error.
+	Step      string  `json:"step,omitempty"`
+	Message   string  `json:"message"`
+	Seconds   float64 `json:"duration_seconds,omitempty"` // How long the step took, when it finishes.
+	ErrorType string  `json:"error_type,omitempty"`       // The errorKind of an error.
+}
+
+// Writes each line written to it, and to the other jsonLogWriters sharing |mu|, onto |w| as a
+// logEvent of |step|. Lines starting with WARNING: are warnings.
+type jsonLogWriter struct {
+	mu   *sync.Mutex
+	w    io.Writer
+	step string
+	buf  []byte
+}
+
+// The log writer of --json-logs, or nil without it.
+var jsonLog *jsonLogWriter
+
+// Returns a writer of the events of the step |name| onto the same output as |j|.
+func (j *jsonLogWriter) forStep(name string) *jsonLogWriter {
+	return &jsonLogWriter{mu: j.mu, w: j.w, step: name}
+}
+
+// Writes |e| at the current time. The caller holds |j.mu|.
+func (j *jsonLogWriter) write(e logEvent) error {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if e.Level == "" {
+		e.Level = "info"
+	}
+	if e.Step == "" {
+		e.Step = j.step
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+// Writes |e| as an event of the step of |j|.
+func (j *jsonLogWriter) event(e logEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.write(e)
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.buf = append(j.buf, p...)
+	for {
+		i := bytes.IndexByte(j.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := j.write(lineEvent(string(j.buf[:i]))); err != nil {
+			return 0, err
+		}
+		j.buf = j.buf[i+1:]
+	}
+}
+
+// Writes out any final partial line.
+func (j *jsonLogWriter) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.buf) > 0 {
+		j.write(lineEvent(string(j.buf)))
+		j.buf = nil
+	}
+}
+
+// Returns the event of a line of the log.
+func lineEvent(line string) logEvent {
+	if msg := strings.TrimPrefix(line, "WARNING: "); msg != line {
+		return logEvent{Level: "warning", Message: msg}
+	}
+	return logEvent{Message: line}
+}
+
+// Starts logging to |jsonLog|, if there is one, as the step |name|, and returns a function that
+// logs that the step finished with |err| and stops.
+func logStep(name string) func(err error) {
+	if jsonLog == nil {
+		return func(error) {}
+	}
+	jsonLog.mu.Lock()
+	jsonLog.step = name
+	jsonLog.mu.Unlock()
+	start := time.Now()
+	return func(err error) {
+		jsonLogStepEnd(jsonLog, name, start, err)
+		jsonLog.mu.Lock()
+		jsonLog.step = ""
+		jsonLog.mu.Unlock()
+	}
+}
+
+// Writes to |j| that the step |name|, started at |start|, finished with |err|.
+func jsonLogStepEnd(j *jsonLogWriter, name string, start time.Time, err error) {
+	e := logEvent{Step: name, Message: "finished", Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		e.Level, e.Message = "error", "failed"
+	}
+	j.event(e)
+}
+
+// Logs |err|, with its kind as a field under --json-logs.
+func logError(err error) {
+	if jsonLog == nil {
+		log.Print(err)
+		return
+	}
+	jsonLog.event(logEvent{Level: "error", Step: failedStep(err), Message: err.Error(), ErrorType: errorKind(err)})
+}
+
+// Runs |group| concurrently, at most |jobs| at a time, with each step's log and command output
+// prefixed with its name, or under --json-logs, in events of the step. Returns the error of each
+// step.
+func runConcurrently(group []step, jobs int) []error {
+	names := make([]string, len(group))
+	for i, s := range group {
+		names[i] = s.name
+	}
+	log.Printf("Running %s concurrently...", strings.Join(names, ", "))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	errs := make([]error, len(group))
+	for i, s := range group {
+		var w interface {
+			io.Writer
+			flush()
+		} = &lineWriter{mu: &mu, w: logOutput, prefix: "[" + s.name + "] "}
+		if jsonLog != nil {
+			w = jsonLog.forStep(s.name)
+		}
+		wg.Add(1)
+		go func(i int, s step) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			start := time.Now()
+			errs[i] = s.logged(log.New(w, "", log.Flags()))
+			w.flush()
+			if jsonLog != nil {
+				jsonLogStepEnd(jsonLog, s.name, start, errs[i])
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
+
+const stateName = ".roll_state.json"
+
+// Records the steps that have completed for a revision, so an interrupted roll can be resumed.
+type rollState struct {
+	Revision  string   `json:"revision"`
+	Completed []string `json:"completed"`
+}
+
+// Returns whether the named step has completed.
+func (s *rollState) done(name string) bool {
+	for _, c := range s.Completed {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the roll state from |dir|. If there is no state for |sha1|, an empty state is returned.
+func readState(dir string, sha1 revision) (*rollState, error) {
+	state := &rollState{Revision: string(sha1)}
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", stateName, err)
+	}
+	var prev rollState
+	if err := json.Unmarshal(b, &prev); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", stateName, err)
+	}
+	if prev.Revision != state.Revision {
+		log.Printf("Discarding %s for %s; target is now %s", stateName, revision(prev.Revision).short(), sha1.short())
+		return state, nil
+	}
+	return &prev, nil
+}
+
+// Writes the roll state to |dir|.
+func writeState(dir string, state *rollState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", stateName, err)
+	}
+	// Atomically, since the roll may be interrupted at any point, which is what --resume is for.
+	if err := writeFileAtomic(filepath.Join(dir, stateName), append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %s", stateName, err)
+	}
+	return nil
+}
+
+// Runs |steps| in order, recording each completed step in the roll state. If |resume| is set,
+// steps that completed in a previous run for the same revision are skipped. If |jobs| is more than
+// one, adjacent steps that can run concurrently do, that many at a time. Unless |failFast| is set,
+// a failed step that is not required does not stop the later ones, and all the failures are
+// returned together. Returns the names of the steps that have completed.
+func runSteps(dir string, sha1 revision, steps []step, resume bool, jobs int, failFast bool) ([]string, error) {
+	state := &rollState{Revision: string(sha1)}
+	if resume {
+		var err error
+		if state, err = readState(dir, sha1); err != nil {
+			return nil, err
+		}
+	}
+	var failed stepErrors
+	for i := 0; i < len(steps); {
+		s := steps[i]
+		if state.done(s.name) {
+			log.Printf("Skipping %s; already completed for %s", s.name, sha1.short())
+			i++
+			continue
+		}
+		group := []step{s}
+		for j := i + 1; jobs > 1 && s.logged != nil && j < len(steps) && steps[j].logged != nil && !state.done(steps[j].name); j++ {
+			group = append(group, steps[j])
+		}
+		i += len(group)
+		var errs []error
+		if len(group) == 1 {
+			end := logStep(s.name)
+			errs = []error{s.run()}
+			end(errs[0])
+		} else {
+			errs = runConcurrently(group, jobs)
+		}
+		// Record the steps that succeeded before reporting those that failed.
+		stop := false
+		for k, s := range group {
+			if err := errs[k]; err != nil {
+				if failedStep(err) == "" {
+					err = &stepError{s.name, err}
+				}
+				failed = append(failed, err)
+				stop = stop || failFast || s.required
+				continue
+			}
+			state.Completed = append(state.Completed, s.name)
+			if err := writeState(dir, state); err != nil {
+				return state.Completed, err
+			}
+		}
+		if stop {
+			return state.Completed, failed.err()
+		}
+		if len(failed) > 0 && i < len(steps) {
+			log.Printf("WARNING: %d steps have failed; continuing because of --fail-fast=false", len(failed))
+		}
+	}
+	if len(failed) > 0 {
+		return state.Completed, failed.err()
+	}
+	if err := os.Remove(filepath.Join(dir, stateName)); err != nil && !os.IsNotExist(err) {
+		return state.Completed, fmt.Errorf("failed to remove %s: %s", stateName, err)
+	}
+	return state.Completed, nil
+}
+
+const historyName = ".roll_history.jsonl"
+
+// A line of the roll history, recording one roll attempt.
+type historyEntry struct {
+	Time    time.Time `json:"time"`
+	Old     revision  `json:"old"`
+	New     revision  `json:"new"`
+	Success bool      `json:"success"`
+	Steps   []string  `json:"steps"`
+	Error   string    `json:"error,omitempty"`
+
+	// The size in bytes of the files checked out in src after a successful roll.
+	SourcesSize int64 `json:"sources_size,omitempty"`
+	// The licenses --license-scanner found in src, sorted, if it ran.
+	Licenses []string `json:"licenses,omitempty"`
+}
+
+// Reads the roll history in |dir|, oldest first. A missing history is empty.
+func readHistory(dir string) ([]historyEntry, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, historyName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", historyName, err)
+	}
+	var history []historyEntry
+	for i, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e historyEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse %s:%d: %s", historyName, i+1, err)
+		}
+		history = append(history, e)
+	}
+	return history, nil
+}
+
+// Appends |e| to the roll history in |dir|.
+func appendHistory(dir string, e *historyEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s entry: %s", historyName, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", historyName, err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %s", historyName, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %s", historyName, err)
+	}
+	return nil
+}
+
+// Writes the last |n| entries of the roll history in |dir| to |w|, oldest first: as a table, or as
+// the lines of the history itself if |raw| is set.
+func printRecentRolls(w io.Writer, dir string, n int, raw bool) error {
+	if n <= 0 {
+		return fmt.Errorf("--since-roll requires a positive number of rolls")
+	}
+	if raw {
+		b, err := ioutil.ReadFile(filepath.Join(dir, historyName))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %s", historyName, err)
+		}
+		var lines []string
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		return nil
+	}
+	history, err := readHistory(dir)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		fmt.Fprintf(w, "No rolls are recorded in %s\n", historyName)
+		return nil
+	}
+	if len(history) > n {
+		history = history[len(history)-n:]
+	}
+	fmt.Fprintf(w, "%-16s  %-26s  %-6s  %s\n", "DATE", "ROLL", "RESULT", "STEPS")
+	for _, e := range history {
+		result := "ok"
+		if !e.Success {
+			result = "failed"
+		}
+		old := "(none)"
+		if e.Old != "" {
+			old = e.Old.short()
+		}
+		fmt.Fprintf(w, "%-16s  %-26s  %-6s  %s\n", e.Time.UTC().Format("2006-01-02 15:04"), old+".."+e.New.short(), result, strings.Join(e.Steps, ","))
+	}
+	return nil
+}
+
+// Returns the most recent successful roll in |history|, or false if there is none.
+func lastGreen(history []historyEntry) (historyEntry, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Success {
+			return history[i], true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// Returns whether |a| is an ancestor of |b|, or the same commit, in the git checkout in |dir|.
+var isAncestor = func(dir string, a, b revision) (bool, error) {
+	cmd := exec.Command("git", "-C", dir, "merge-base", "--is-ancestor", string(a), string(b))
+	cmd.Stderr = logOutput
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	return true, nil
+}
+
+// Returns whether a --since-last-green-roll roll of the sources in |dir| should go to |tip|: only
+// if |tip| descends from the revision of the last successful roll in the roll history. If it does
+// not, upstream has diverged from what was last rolled, which is logged.
+func sinceLastGreenRoll(dir string, tip revision) (bool, error) {
+	history, err := readHistory(dir)
+	if err != nil {
+		return false, err
+	}
+	green, ok := lastGreen(history)
+	if !ok {
+		return false, fmt.Errorf("--since-last-green-roll requires a successful roll in %s", historyName)
+	}
+	descends, err := isAncestor(filepath.Join(dir, "src"), green.New, tip)
+	if err != nil {
+		return false, err
+	}
+	if !descends {
+		log.Printf("WARNING: %s does not descend from %s, last rolled successfully on %s; upstream may have been rewritten", tip.short(), green.New.short(), green.Time.Format("2006-01-02"))
+		return false, nil
+	}
+	log.Printf("%s descends from %s, last rolled successfully on %s", tip.short(), green.New.short(), green.Time.Format("2006-01-02"))
+	return true, nil
+}
+
+// Warns if the roll history in |dir| records a previous successful roll to |sha1|, which may mean
+// a revision that was rolled away from is being rolled to again. If |strict| is set, this is an
+// error instead.
+func checkHistory(dir string, sha1 revision, strict bool) error {
+	history, err := readHistory(dir)
+	if err != nil {
+		return err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if e := history[i]; e.Success && e.New == sha1 {
+			msg := fmt.Sprintf("%s was previously rolled on %s", sha1.short(), e.Time.Format("2006-01-02"))
+			if strict {
+				return fmt.Errorf("%s; aborting because of --strict-history", msg)
+			}
+			log.Printf("WARNING: %s", msg)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Who wrote and who committed an upstream commit.
+type commitIdentity struct {
+	sha1      revision
+	author    string
+	committer string
+	subject   string
+}
+
+// Returns the author and committer email addresses of every upstream commit after |old| up to and
+// including |sha1| in the git checkout |dir|, newest first.
+var commitIdentities = func(dir string, old, sha1 revision) ([]commitIdentity, error) {
+	out, err := output(exec.Command("git", "-C", dir, "log", "--format=%H%x00%ae%x00%ce%x00%s", string(old)+".."+string(sha1), "--"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []commitIdentity
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		ids = append(ids, commitIdentity{revision(fields[0]), fields[1], fields[2], fields[3]})
+	}
+	return ids, nil
+}
+
+// Returns a function reporting whether an email address is one of |allowed|. Each is an address,
+// compared case-insensitively, or a regexp between slashes that must match the whole address.
+func authorAllowlist(allowed []string) (func(email string) bool, error) {
+	emails := make(map[string]bool)
+	var res []*regexp.Regexp
+	for _, a := range allowed {
+		if len(a) > 1 && strings.HasPrefix(a, "/") && strings.HasSuffix(a, "/") {
+			re, err := regexp.Compile("(?i)^(?:" + a[1:len(a)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid --allowed-authors regexp %s: %s", a, err)
+			}
+			res = append(res, re)
+		} else {
+			emails[strings.ToLower(a)] = true
+		}
+	}
+	return func(email string) bool {
+		if emails[strings.ToLower(email)] {
+			return true
+		}
+		for _, re := range res {
+			if re.MatchString(email) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Returns an error naming each of |commits| whose author or committer is not in |allowed|, as
+// authorAllowlist interprets it.
+func checkAuthors(commits []commitIdentity, allowed []string) error {
+	ok, err := authorAllowlist(allowed)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for _, c := range commits {
+		var who []string
+		if !ok(c.author) {
+			who = append(who, "author "+c.author)
+		}
+		if !ok(c.committer) && c.committer != c.author {
+			who = append(who, "committer "+c.committer)
+		}
+		if len(who) > 0 {
+			bad = append(bad, fmt.Sprintf("%s %s (%s)", c.sha1.short(), c.subject, strings.Join(who, ", ")))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d commits are by people not in --allowed-authors: %s", len(bad), strings.Join(bad, "; "))
+	}
+	return nil
+}
+
+// Checks that every upstream commit in the roll of the sources in |dir| from |old| to |sha1| was
+// authored and committed by someone in |opts.allowedAuthors|.
+func checkRollAuthors(dir string, old, sha1 revision, opts *rollOptions) error {
+	src := filepath.Join(dir, "src")
+	if opts.shallow || !hasCommit(src, old) {
+		return fmt.Errorf("cannot check the authors of the commits without the history from %s to %s; omit --shallow or --allowed-authors", old.short(), sha1.short())
+	}
+	commits, err := commitIdentities(src, old, sha1)
+	if err != nil {
+		return err
+	}
+	if err := checkAuthors(commits, opts.allowedAuthors); err != nil {
+		return err
+	}
+	log.Printf("All %d commits from %s to %s are by allowed authors", len(commits), old.short(), sha1.short())
+	return nil
+}
+
+// Returns how many upstream commits the git checkout |src| has after |old| up to and including
+// |sha1|; replaced in tests.
+var countCommits = func(src string, old, sha1 revision) (int, error) {
+	rng := string(old) + ".." + string(sha1)
+	out, err := output(exec.Command("git", "-C", src, "rev-list", "--count", rng, "--"))
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	if _, err := fmt.Sscan(string(out), &total); err != nil {
+		return 0, fmt.Errorf("unexpected commit count %q for %s", out, rng)
+	}
+	return total, nil
+}
+
+// Checks that a roll of the sources in |dir| from |old| to |sha1| with more commits than
+// --review-threshold has had its changelog reviewed: either --changelog-reviewed is given, or
+// --expect-commits names how many commits the roll has. --expect-commits is checked whatever the
+// size of the roll.
+func checkChangelogReviewed(dir string, old, sha1 revision, opts *rollOptions) error {
+	src := filepath.Join(dir, "src")
+	if opts.shallow || !hasCommit(src, old) {
+		if opts.expectCommits > 0 {
+			return fmt.Errorf("cannot count the commits without the history from %s to %s; omit --shallow or --expect-commits", old.short(), sha1.short())
+		}
+		log.Printf("WARNING: the history from %s to %s is not available, so the size of the roll is not checked against --review-threshold", old.short(), sha1.short())
+		return nil
+	}
+	total, err := countCommits(src, old, sha1)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.expectCommits > 0 && opts.expectCommits != total:
+		return fmt.Errorf("the roll from %s to %s has %d commits, not the %d given by --expect-commits", old.short(), sha1.short(), total, opts.expectCommits)
+	case opts.expectCommits > 0:
+		log.Printf("The roll has the %d commits expected", total)
+	case opts.reviewThreshold <= 0 || total <= opts.reviewThreshold:
+	case opts.changelogReviewed:
+		log.Printf("The roll has %d commits, more than --review-threshold=%d, and its changelog was reviewed", total, opts.reviewThreshold)
+	default:
+		return fmt.Errorf("the roll from %s to %s has %d commits, more than --review-threshold=%d; review its changelog (see --changelog), then pass --changelog-reviewed or --expect-commits=%d", old.short(), sha1.short(), total, opts.reviewThreshold, total)
+	}
+	return nil
+}
+
+// The default patterns that mark a commit as security-relevant in the changelog.
+var defaultSecurityKeywords = []string{`CVE-\d+`, `security`, `vulnerability`, `overflow`}
+
+// An upstream commit included in a roll.
+type commit struct {
+	sha1    revision
+	author  string // The author's name.
+	email   string // The author's email address.
+	date    time.Time
+	subject string
+	body    string
+	footers []footer // The trailers in the last paragraph of the body, in order.
+}
+
+// A trailer of a commit message, like "Change-Id: I0123".
+type footer struct {
+	key, value string
+}
+
+var footerRE = regexp.MustCompile(`^([A-Za-z0-9-]+): *(.*)$`)
+
+// Returns the footers of the commit message body |body|: its last paragraph, if every line of it
+// is a trailer.
+func parseFooters(body string) []footer {
+	paragraphs := strings.Split(strings.TrimSpace(body), "\n\n")
+	var footers []footer
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		m := footerRE.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			return nil
+		}
+		footers = append(footers, footer{m[1], m[2]})
+	}
+	return footers
+}
+
+// Returns the upstream commits after |old| up to and including |sha1|, newest first, and how many
+// there are. If |max| is positive, at most that many are returned.
+func commitLog(dir string, old, sha1 revision, max int) ([]commit, int, error) {
+	src := filepath.Join(dir, "src")
+	rng := string(old) + ".." + string(sha1)
+	total, err := countCommits(src, old, sha1)
+	if err != nil {
+		return nil, 0, err
+	}
+	args := []string{"-C", src, "log", "--format=%H%x00%an%x00%ae%x00%aI%x00%s%x00%b%x1e"}
+	if max > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", max))
+	}
+	out, err := output(exec.Command("git", append(args, rng, "--")...))
+	if err != nil {
+		return nil, 0, err
+	}
+	var commits []commit
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.SplitN(strings.TrimSpace(record), "\x00", 6)
+		if len(fields) != 6 {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return nil, 0, fmt.Errorf("unexpected date %q of %s: %s", fields[3], fields[0], err)
+		}
+		body := strings.TrimSpace(fields[5])
+		commits = append(commits, commit{sha1: revision(fields[0]), author: fields[1], email: fields[2], date: date, subject: fields[4],
+			body: body, footers: parseFooters(body)})
+	}
+	return commits, total, nil
+}
+
+const defaultCompareURL = "https://boringssl.googlesource.com/boringssl/+log/{old}..{new}"
+
+// Returns |compareURL| with {old} and {new} replaced by |old| and |new|.
+func compareLink(compareURL string, old, new revision) string {
+	return strings.NewReplacer("{old}", string(old), "{new}", string(new)).Replace(compareURL)
+}
+
+// An advisory of the --report-cves feed: a JSON array of these.
+type advisory struct {
+	ID         string   `json:"id"`
+	Summary    string   `json:"summary,omitempty"`
+	Introduced []string `json:"introduced,omitempty"` // The commits that introduced the vulnerability; every earlier revision is affected if empty.
+	Fixed      []string `json:"fixed"`                // The commits that fix it.
+}
+
+// How the roll relates to an advisory, as recorded in the manifest.
+type advisoryFinding struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary,omitempty"`
+	Status  string `json:"status"`           // fixed, if the roll picks up the fix, or vulnerable, if the new revision lacks it.
+	Commit  string `json:"commit,omitempty"` // The fix the roll picks up.
+}
+
+// Returns the advisories of |feed|, an http(s) URL or a local JSON file.
+func readAdvisories(feed string) ([]advisory, error) {
+	var b []byte
+	if strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://") {
+		if noNetwork {
+			return nil, fmt.Errorf("--no-network forbids fetching the advisories from %s", feed)
+		}
+		resp, err := httpClient.Get(feed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the advisories: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch the advisories from %s: %s", feed, resp.Status)
+		}
+		if b, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("failed to fetch the advisories: %s", err)
+		}
+	} else {
+		var err error
+		if b, err = ioutil.ReadFile(feed); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", feed, err)
+		}
+	}
+	var advisories []advisory
+	if err := json.Unmarshal(b, &advisories); err != nil {
+		return nil, fmt.Errorf("failed to parse the advisories of %s: %s", feed, err)
+	}
+	return advisories, nil
+}
+
+// Returns the first of |commits| known to the git checkout |src| that |sha1| contains, if any, and
+// whether any of them is known to it.
+func containedCommit(src string, commits []string, sha1 revision) (string, bool, error) {
+	known := false
+	for _, c := range commits {
+		if !hasCommit(src, revision(c)) {
+			continue
+		}
+		known = true
+		ok, err := isAncestor(src, revision(c), sha1)
+		if err != nil {
+			return "", known, err
+		}
+		if ok {
+			return c, known, nil
+		}
+	}
+	return "", known, nil
+}
+
+// Returns which of |advisories| the roll from |old| to |new| in the git checkout |src| fixes, as it
+// picks up one of their fixes, and which |new| is still affected by, as it contains none of their
+// fixes but does contain what introduced them. Advisories none of whose commits are in |src|, such
+// as most of OpenSSL's, are left out.
+func checkAdvisories(src string, old, new revision, advisories []advisory) ([]advisoryFinding, error) {
+	var findings []advisoryFinding
+	for _, a := range advisories {
+		fix, known, err := containedCommit(src, a.Fixed, new)
+		if err != nil {
+			return nil, err
+		}
+		if fix != "" {
+			if already, err := isAncestor(src, revision(fix), old); err != nil {
+				return nil, err
+			} else if !already {
+				findings = append(findings, advisoryFinding{ID: a.ID, Summary: a.Summary, Status: "fixed", Commit: fix})
+			}
+			continue
+		}
+		affected := known && len(a.Introduced) == 0
+		if len(a.Introduced) > 0 {
+			introduced, _, err := containedCommit(src, a.Introduced, new)
+			if err != nil {
+				return nil, err
+			}
+			affected = introduced != ""
+		}
+		if affected {
+			findings = append(findings, advisoryFinding{ID: a.ID, Summary: a.Summary, Status: "vulnerable"})
+		}
+	}
+	return findings, nil
+}
+
+// For --report-cves, records in |m| how the roll from |old| to |new| in the git checkout |src|
+// relates to the advisories of |feed|, warning about each.
+func reportAdvisories(src string, old, new revision, feed string, m *manifest) error {
+	advisories, err := readAdvisories(feed)
+	if err != nil {
+		return err
+	}
+	if m.Advisories, err = checkAdvisories(src, old, new, advisories); err != nil {
+		return err
+	}
+	for _, f := range m.Advisories {
+		if f.Status == "fixed" {
+			log.Printf("WARNING: this roll picks up %s, the fix for %s: %s", revision(f.Commit).short(), f.ID, f.Summary)
+		} else {
+			log.Printf("WARNING: %s is still vulnerable to %s: %s", new.short(), f.ID, f.Summary)
+		}
+	}
+	log.Printf("Checked the roll against %d advisories; %d apply", len(advisories), len(m.Advisories))
+	return nil
+}
+
+// The licenses --license-scanner may find in src unless --allowed-license is given: those of
+// BoringSSL and of the third-party code it vendors.
+var defaultAllowedLicenses = []string{"Apache-2.0", "BSD-3-Clause", "ISC", "MIT", "OpenSSL", "SSLeay"}
+
+// What the license scan of src found, as recorded in the manifest.
+type licenseScan struct {
+	Files      map[string]int `json:"files"`                // The number of files under each license.
+	New        []string       `json:"new,omitempty"`        // The licenses the last successful roll's scan did not find.
+	Disallowed []string       `json:"disallowed,omitempty"` // The licenses not in --allowed-license.
+}
+
+// Returns the licenses the scan found, sorted.
+func (s *licenseScan) ids() []string {
+	var ids []string
+	for id := range s.Files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Parses the output of --license-scanner, a line for each file with the SPDX identifier of its
+// license, whitespace, and its path. Blank lines and lines starting with # are ignored. Returns the
+// number of files under each license.
+func parseLicenseScan(out string) (map[string]int, error) {
+	files := make(map[string]int)
+	for i, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d of the license scan, %q, is not a license and a path", i+1, line)
+		}
+		files[fields[0]]++
+	}
+	return files, nil
+}
+
+// Runs |scanner| with sh on src in |dir| and records in |m| the licenses it finds, which of them
+// the last successful roll's scan did not find, and which are not in |allowed|. Fails if any are
+// not allowed.
+func scanLicenses(l *log.Logger, dir, scanner string, allowed []string, m *manifest) error {
+	l.Printf("Scanning src for licenses with `%s`...", scanner)
+	cmd := exec.Command("sh", "-c", scanner, "license-scanner", filepath.Join(dir, "src"))
+	cmd.Dir = dir
+	out, err := output(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to run --license-scanner: %s", err)
+	}
+	files, err := parseLicenseScan(string(out))
+	if err != nil {
+		return err
+	}
+	scan := &licenseScan{Files: files}
+	m.Licenses = scan
+
+	history, err := readHistory(dir)
+	if err != nil {
+		l.Printf("WARNING: %s", err)
+	}
+	var previous []string
+	for i := len(history) - 1; i >= 0 && previous == nil; i-- {
+		if e := history[i]; e.Success {
+			previous = e.Licenses
+		}
+	}
+	known := make(map[string]bool)
+	for _, id := range previous {
+		known[id] = true
+	}
+	ok := make(map[string]bool)
+	for _, id := range allowed {
+		ok[id] = true
+	}
+	for _, id := range scan.ids() {
+		l.Printf("  %s: %d files", id, files[id])
+		if previous != nil && !known[id] {
+			scan.New = append(scan.New, id)
+		}
+		if !ok[id] {
+			scan.Disallowed = append(scan.Disallowed, id)
+		}
+	}
+	if previous == nil {
+		l.Printf("No earlier roll recorded a license scan to compare with")
+	} else if len(scan.New) > 0 {
+		l.Printf("WARNING: the roll introduces the licenses %s", strings.Join(scan.New, ", "))
+	}
+	if len(scan.Disallowed) > 0 {
+		return fmt.Errorf("src has files under licenses not allowed by --allowed-license: %s", strings.Join(scan.Disallowed, ", "))
+	}
+	return nil
+}
+
+// Returns whether the git checkout in |dir| has the commit |sha1|.
+func hasCommit(dir string, sha1 revision) bool {
+	return exec.Command("git", "-C", dir, "cat-file", "-e", string(sha1)+"^{commit}").Run() == nil
+}
+
+// Returns a case-insensitive regexp matching any of |keywords|, which are themselves regexps.
+func securityRE(keywords []string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?i)(?:" + strings.Join(keywords, "|") + ")")
+	if err != nil {
+		return nil, fmt.Errorf("invalid security keyword: %s", err)
+	}
+	return re, nil
+}
+
+// The changelog of a roll, as a changelogFormatter sees it.
+type changelog struct {
+	old, new revision
+	commits  []commit // Newest first. If there are fewer than total, only the newest are listed.
+	total    int
+	compare  string            // A link to every commit in the roll.
+	relevant []commit          // The security-relevant commits, in the order of commits.
+	security map[revision]bool // Whether each commit is security-relevant.
+	news     *newsDiff         // What was added to upstream's own changelog, if it has one.
+	excluded int               // How many commits --changelog-exclude left out of commits.
+
+	// Set if the upstream history is not available, as with --shallow, so that there are no
+	// commits and compare is all the changelog can give.
+	noHistory bool
+}
+
+// Returns how many commits the changelog |c| shows or left out by --changelog-exclude.
+func (c *changelog) counted() int {
+	return len(c.commits) + c.excluded
+}
+
+// Returns a regexp matching any of |patterns|, for --changelog-exclude, or nil if there are none.
+func changelogExcludeRE(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var alternatives []string
+	for _, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid --changelog-exclude %q: %s", p, err)
+		}
+		alternatives = append(alternatives, "(?:"+p+")")
+	}
+	return regexp.MustCompile(strings.Join(alternatives, "|")), nil
+}
+
+// The lines added to a human-written changelog upstream keeps, like NEWS, in a roll.
+type newsDiff struct {
+	path  string
+	added []string
+}
+
+// The human-written changelogs upstream may keep, tried in order.
+var defaultUpstreamChangelogs = []string{"NEWS", "NEWS.md", "CHANGELOG", "CHANGELOG.md"}
+
+// Returns the lines added from |old| to |sha1| to the first of |paths| that exists at |sha1| in the
+// git checkout |src|, or nil if none does.
+func readNewsDiff(src string, old, sha1 revision, paths []string) (*newsDiff, error) {
+	for _, p := range paths {
+		if exec.Command("git", "-C", src, "cat-file", "-e", string(sha1)+":"+p).Run() != nil {
+			continue
+		}
+		out, err := output(exec.Command("git", "-C", src, "diff", "--no-color", "--no-ext-diff", "--unified=0", string(old), string(sha1), "--", p))
+		if err != nil {
+			return nil, err
+		}
+		news := &newsDiff{path: p}
+		inHunk := false
+		for _, line := range strings.Split(string(out), "\n") {
+			switch {
+			case strings.HasPrefix(line, "@@"):
+				inHunk = true
+			case inHunk && strings.HasPrefix(line, "+"):
+				news.added = append(news.added, line[1:])
+			}
+		}
+		return news, nil
+	}
+	return nil, nil
+}
+
+// Formats the changelog of a roll for --changelog in one of the changelogFormats.
+type changelogFormatter interface {
+	format(c *changelog) string
+}
+
+// The formats --changelog-format chooses from.
+var changelogFormats = map[string]changelogFormatter{
+	"plain":    plainChangelog{},
+	"markdown": markdownChangelog{},
+	"json":     jsonChangelog{},
+	"gerrit":   gerritChangelog{},
+}
+
+// Returns the names of changelogFormats, sorted.
+func changelogFormatNames() []string {
+	var names []string
+	for name := range changelogFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lists the security-relevant commits in a section at the top, then every commit. A truncated
+// changelog says so and links to the rest.
+type plainChangelog struct{}
+
+func (plainChangelog) format(c *changelog) string {
+	var b strings.Builder
+	if c.noHistory {
+		fmt.Fprintf(&b, "BoringSSL %s..%s\n\nThe upstream history is not available; see %s for the commits.\n", c.old.short(), c.new.short(), c.compare)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "BoringSSL %s..%s (%d commits)\n", c.old.short(), c.new.short(), c.total)
+	if c.counted() < c.total {
+		fmt.Fprintf(&b, "\nShowing the first %d of %d commits, which alone were checked for security-relevant changes; see %s for all of them.\n", c.counted(), c.total, c.compare)
+	}
+	if len(c.relevant) > 0 {
+		b.WriteString("\nSecurity-relevant changes:\n")
+		for _, r := range c.relevant {
+			fmt.Fprintf(&b, "  %s %s\n", r.sha1.short(), r.subject)
+		}
+	}
+	if c.news != nil {
+		fmt.Fprintf(&b, "\nAdded to upstream's %s:\n", c.news.path)
+		for _, line := range c.news.added {
+			fmt.Fprintf(&b, "%s\n", strings.TrimRight("  "+line, " "))
+		}
+	}
+	b.WriteString("\nChanges:\n")
+	for _, r := range c.commits {
+		fmt.Fprintf(&b, "  %s %s\n", r.sha1.short(), r.subject)
+	}
+	if c.excluded > 0 {
+		fmt.Fprintf(&b, "  (%d commits matching --changelog-exclude are not listed)\n", c.excluded)
+	}
+	return b.String()
+}
+
+// Like plainChangelog, in Markdown.
+type markdownChangelog struct{}
+
+func (markdownChangelog) format(c *changelog) string {
+	var b strings.Builder
+	if c.noHistory {
+		fmt.Fprintf(&b, "# BoringSSL %s..%s\n\nThe upstream history is not available; see [the commits](%s).\n", c.old.short(), c.new.short(), c.compare)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "# BoringSSL %s..%s (%d commits)\n", c.old.short(), c.new.short(), c.total)
+	if c.counted() < c.total {
+		fmt.Fprintf(&b, "\nShowing the first %d of %d commits, which alone were checked for security-relevant changes; see [all of them](%s).\n", c.counted(), c.total, c.compare)
+	}
+	if len(c.relevant) > 0 {
+		b.WriteString("\n## Security-relevant changes\n\n")
+		for _, r := range c.relevant {
+			fmt.Fprintf(&b, "- `%s` %s\n", r.sha1.short(), r.subject)
+		}
+	}
+	if c.news != nil {
+		fmt.Fprintf(&b, "\n## Added to upstream's %s\n\n```\n%s```\n", c.news.path, joinLines(c.news.added))
+	}
+	b.WriteString("\n## Changes\n\n")
+	for _, r := range c.commits {
+		fmt.Fprintf(&b, "- `%s` %s (%s)\n", r.sha1.short(), r.subject, r.author)
+	}
+	if c.excluded > 0 {
+		fmt.Fprintf(&b, "\n%d commits matching `--changelog-exclude` are not listed.\n", c.excluded)
+	}
+	return b.String()
+}
+
+// Every detail of the changelog as JSON, for tools.
+type jsonChangelog struct{}
+
+func (jsonChangelog) format(c *changelog) string {
+	type jsonFooter struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	type jsonCommit struct {
+		SHA1     string       `json:"sha1"`
+		Author   string       `json:"author"`
+		Email    string       `json:"email"`
+		Date     time.Time    `json:"date"`
+		Subject  string       `json:"subject"`
+		Body     string       `json:"body,omitempty"`
+		Footers  []jsonFooter `json:"footers,omitempty"`
+		Security bool         `json:"security,omitempty"`
+	}
+	out := struct {
+		Old       string       `json:"old"`
+		New       string       `json:"new"`
+		Total     int          `json:"total"`
+		Excluded  int          `json:"excluded,omitempty"`
+		Compare   string       `json:"compare,omitempty"`
+		NoHistory bool         `json:"history_unavailable,omitempty"`
+		Commits   []jsonCommit `json:"commits"`
+		News      *struct {
+			Path  string   `json:"path"`
+			Added []string `json:"added"`
+		} `json:"news,omitempty"`
+	}{Old: string(c.old), New: string(c.new), Total: c.total, Excluded: c.excluded, Compare: c.compare, NoHistory: c.noHistory, Commits: []jsonCommit{}}
+	if c.news != nil {
+		out.News = &struct {
+			Path  string   `json:"path"`
+			Added []string `json:"added"`
+		}{c.news.path, append([]string{}, c.news.added...)}
+	}
+	for _, r := range c.commits {
+		jc := jsonCommit{SHA1: string(r.sha1), Author: r.author, Email: r.email, Date: r.date, Subject: r.subject, Body: r.body, Security: c.security[r.sha1]}
+		for _, f := range r.footers {
+			jc.Footers = append(jc.Footers, jsonFooter{f.key, f.value})
+		}
+		out.Commits = append(out.Commits, jc)
+	}
+	var b strings.Builder
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	e.Encode(out)
+	return b.String()
+}
+
+// A description for a Gerrit change rolling BoringSSL, listing the commits like the Chromium
+// autoroller, as git log --date=short --format='%ad %ae %s' would.
+type gerritChangelog struct{}
+
+func (gerritChangelog) format(c *changelog) string {
+	var b strings.Builder
+	if c.noHistory {
+		fmt.Fprintf(&b, "Roll BoringSSL from %s to %s\n\n%s\n\nThe upstream history is not available.\n", c.old.short(), c.new.short(), c.compare)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Roll BoringSSL from %s to %s (%d commits)\n\n", c.old.short(), c.new.short(), c.total)
+	if c.compare != "" {
+		fmt.Fprintf(&b, "%s\n\n", c.compare)
+	}
+	for _, r := range c.commits {
+		mark := ""
+		if c.security[r.sha1] {
+			mark = " [security]"
+		}
+		fmt.Fprintf(&b, "%s %s %s%s\n", r.date.UTC().Format("2006-01-02"), r.email, r.subject, mark)
+	}
+	if c.excluded > 0 {
+		fmt.Fprintf(&b, "... and %d commits matching --changelog-exclude\n", c.excluded)
+	}
+	if more := c.total - c.counted(); more > 0 {
+		fmt.Fprintf(&b, "... and %d more\n", more)
+	}
+	if c.news != nil {
+		fmt.Fprintf(&b, "\nAdded to %s:\n%s", c.news.path, joinLines(c.news.added))
+	}
+	return b.String()
+}
+
+// Returns |lines|, each ended by a newline.
+func joinLines(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// Returns the changelog for a roll from |old| to |sha1| of |commits| and |news|, which may be nil,
+// in format |f|, and the commits whose subject or body matches |security|. If |commits| are only
+// the newest of the |total| in the roll, the changelog links to |compare| for the rest. Commits
+// whose subject matches |exclude|, if it is not nil, are counted but not listed, unless they are
+// security-relevant.
+func formatChangelog(f changelogFormatter, old, sha1 revision, commits []commit, total int, compare string, security *regexp.Regexp, news *newsDiff, exclude *regexp.Regexp) (string, []commit) {
+	c := &changelog{old: old, new: sha1, total: total, compare: compare, security: make(map[revision]bool), news: news}
+	for _, r := range commits {
+		if security.MatchString(r.subject) || security.MatchString(r.body) {
+			c.relevant = append(c.relevant, r)
+			c.security[r.sha1] = true
+		} else if exclude != nil && exclude.MatchString(r.subject) {
+			c.excluded++
+			continue
+		}
+		c.commits = append(c.commits, r)
+	}
+	return f.format(c), c.relevant
+}
+
+// Returns the changelog for a roll from |old| to |sha1| whose history is not available, in format
+// |f|, which can only link to |compare|.
+func unavailableChangelog(f changelogFormatter, old, sha1 revision, compare string) string {
+	return f.format(&changelog{old: old, new: sha1, compare: compare, security: make(map[revision]bool), noHistory: true})
+}
+
+// Writes the changelog for the roll of the sources in |dir| from |old| to |sha1| to the changelog
+// path in |opts|, if any, records it in |m|, and warns about security-relevant commits. With
+// --strict-security, those commits are an error instead, so that the roll is reviewed before it is
+// made.
+func writeChangelog(dir string, old, sha1 revision, opts *rollOptions, m *manifest) error {
+	keywords := opts.securityKeywords
+	if len(keywords) == 0 {
+		keywords = defaultSecurityKeywords
+	}
+	security, err := securityRE(keywords)
+	if err != nil {
+		return err
+	}
+	compare := compareLink(opts.compareURL, old, sha1)
+	format := changelogFormats[opts.changelogFormat]
+	if format == nil {
+		format = plainChangelog{}
+	}
+	if opts.shallow || !hasCommit(filepath.Join(dir, "src"), old) {
+		log.Printf("WARNING: the history from %s to %s is not available, so the changelog only links to %s", old.short(), sha1.short(), compare)
+		if opts.strictSecurity {
+			return fmt.Errorf("cannot check for security-relevant commits without the history from %s to %s; omit --shallow or --strict-security", old.short(), sha1.short())
+		}
+		return writeChangelogFile(opts.changelogPath, unavailableChangelog(format, old, sha1, compare))
+	}
+	commits, total, err := commitLog(dir, old, sha1, opts.changelogMaxCommits)
+	if err != nil {
+		return err
+	}
+	if len(commits) < total {
+		log.Printf("WARNING: the roll has %d commits; the changelog only shows the first %d", total, len(commits))
+	}
+	m.CommitCount = total
+	news, err := readNewsDiff(filepath.Join(dir, "src"), old, sha1, opts.upstreamChangelogs)
+	if err != nil {
+		return err
+	}
+	if news != nil {
+		log.Printf("%d lines were added to upstream's %s", len(news.added), news.path)
+	}
+	exclude, err := changelogExcludeRE(opts.changelogExcludes)
+	if err != nil {
+		return err
+	}
+	text, relevant := formatChangelog(format, old, sha1, commits, total, compare, security, news, exclude)
+	flagged := map[revision]bool{}
+	for _, c := range relevant {
+		flagged[c.sha1] = true
+	}
+	excluded := 0
+	for _, c := range commits {
+		if !flagged[c.sha1] && exclude != nil && exclude.MatchString(c.subject) {
+			excluded++
+			continue
+		}
+		m.Commits = append(m.Commits, manifestCommit{string(c.sha1), c.subject, flagged[c.sha1]})
+	}
+	if excluded > 0 {
+		log.Printf("Left %d commits matching --changelog-exclude out of the changelog", excluded)
+	}
+	if err := writeChangelogFile(opts.changelogPath, text); err != nil {
+		return err
+	}
+	if len(relevant) == 0 {
+		return nil
+	}
+	for _, c := range relevant {
+		log.Printf("WARNING: security-relevant commit %s %s", c.sha1.short(), c.subject)
+	}
+	msg := fmt.Sprintf("the roll includes %d security-relevant commits; review them carefully", len(relevant))
+	if opts.strictSecurity {
+		return fmt.Errorf("%s; aborting because of --strict-security", msg)
+	}
+	log.Printf("WARNING: %s", msg)
+	return nil
+}
+
+// Writes the changelog |text| to |path|, if it is not empty.
+func writeChangelogFile(path, text string) error {
+	if path == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		return fmt.Errorf("failed to write changelog: %s", err)
+	}
+	log.Printf("Wrote changelog to %s", path)
+	return nil
+}
+
+// Returns the steps that roll the sources in |dir| to |sha1|, recording their results in |m|.
+func rollSteps(dir string, sha1 revision, opts *rollOptions, m *manifest) []step {
+	sources := fmt.Sprintf("Check out %s in src", sha1)
+	if opts.subtree != "" {
+		sources = fmt.Sprintf("Check out only %s of %s in src", opts.subtree, sha1)
+	}
+	if opts.tarballURL != "" {
+		sources = fmt.Sprintf("Replace src with the tarball of %s from %s, checking its SHA-256", sha1, opts.tarballURL)
+		if opts.subtree != "" {
+			sources += ", keeping only " + opts.subtree
+		}
+		if opts.touchOnlyChanged {
+			sources += ", rewriting only the files that changed"
+		}
+	}
+	if len(opts.excludes) > 0 {
+		sources += fmt.Sprintf(", leaving out paths matching %s", strings.Join(opts.excludes, ", "))
+		if len(opts.includeTests) > 0 {
+			sources += fmt.Sprintf(" unless they match %s", strings.Join(opts.includeTests, ", "))
+		}
+	}
+	var checkout *exec.Cmd
+	if opts.tarballURL == "" {
+		checkout = exec.Command("git", "-C", filepath.Join(dir, "src"), "checkout", string(sha1))
+	}
+	update := func() error { return updateSources(dir, sha1, opts) }
+	if opts.noOpIfIdenticalTree {
+		sources += ", and stop there if the files kept are byte-identical to those already in src"
+		update = func() error {
+			identical, err := checkoutSources(dir, sha1, opts, true)
+			if identical {
+				log.Printf("Tree content unchanged despite new SHA %s; skipping the later steps", sha1.short())
+				m.TreeUnchanged = true
+			}
+			return err
+		}
+	}
+	steps := []step{
+		{name: "sources", desc: sources, run: update, required: true, cmd: checkout, writes: []string{"src"}},
+	}
+	if opts.sourcesOnly {
+		return skipSteps(steps, opts.skip)
+	}
+	// Plain steps, so that the patches apply before the generators start and after they finish.
+	pre := patchesDir(dir, opts.preGeneratePatches)
+	if names, _ := patchFiles(pre); len(names) > 0 {
+		s := patchStep("pre-generate", fmt.Sprintf("Apply the %d patches in %s to src, before generating build files", len(names), pre), filepath.Join(dir, "src"), pre, m)
+		s.writes = []string{"src"}
+		steps = append(steps, s)
+	}
+	if opts.strictUTF8 {
+		steps = append(steps, step{name: "utf8", desc: "Check that the text files in src are valid UTF-8",
+			run: func() error { return checkUTF8(log.Default(), dir) }})
+	}
+	if opts.writeChecksums && !opts.checksumGenerated {
+		steps = append(steps, step{name: "checksums", desc: "Write the SHA-256 digest of every file in src to src/" + checksumsName,
+			run: func() error { return writeChecksums(dir, nil) }, writes: []string{"src/" + checksumsName}})
+	}
+	if opts.casDir != "" || opts.casManifest != "" {
+		manifest := opts.casManifest
+		if manifest == "" {
+			manifest = filepath.Join(opts.casDir, "manifests", string(sha1))
+		}
+		desc := "Write the content hash of every file in src to " + manifest
+		if opts.casDir != "" {
+			desc += ", hardlinking the files missing from " + opts.casDir + " into it by hash"
+		}
+		steps = append(steps, step{name: "cas", desc: desc, run: func() error { return writeCAS(dir, opts.casDir, manifest) }, writes: []string{manifest}})
+	}
+	// Not a logged step, so that it finishes before the steps that read the headers start.
+	if inSubtree(opts.subtree, "include") {
+		steps = append(steps, step{name: "headers", desc: "Check that the headers in src/include include no headers missing from src",
+			run: func() error { return checkIncludes(log.Default(), dir, opts.allowDanglingIncludes) }})
+	}
+	generator, upstream := activeGenerator(opts)
+	gn := "Run src/" + generator + " " + strings.Join(opts.buildFormats, " ")
+	if !upstream {
+		gn = "Run the non-upstream generator " + generator + " " + strings.Join(opts.buildFormats, " ")
+	}
+	if opts.scopedGenerate {
+		gn += ", unless no upstream change can affect its output"
+	}
+	if opts.onlyChangedFormats && !opts.forceAllFormats {
+		gn += ", for only the formats whose inputs changed"
+	}
+	if opts.checkDeterminism {
+		gn += fmt.Sprintf(" with %s, twice, stopping if the runs differ", strings.Join(deterministicGeneratorEnv, " "))
+	}
+	generate := !upstream || inSubtree(opts.subtree, generator)
+	if !generate {
+		gn = fmt.Sprintf("Skip generating build files, since %s is not in %s", generator, opts.subtree)
+	}
+	steps = append(steps, loggedStep("gn", gn, func(l *log.Logger) error {
+		if !generate {
+			l.Printf("Not generating build files: %s is not in %s", generator, opts.subtree)
+			return nil
+		}
+		if !upstream {
+			l.Printf("WARNING: generating build files with %s instead of upstream's src/%s", generator, opts.generator)
+			m.Generator = generator
+		}
+		// An existing record is kept up to date even without --only-changed-build-formats, so that it
+		// never vouches for build files generated from other inputs.
+		_, err := os.Stat(filepath.Join(dir, formatInputsName))
+		record := err == nil || opts.onlyChangedFormats
+		var hashes map[string]string
+		if record {
+			if hashes, err = formatInputHashes(dir, generator, opts.generatorArtifacts, opts.buildFormats); err != nil {
+				return &generateError{stepError{"gn", err}}
+			}
+		}
+		formats := opts.buildFormats
+		if opts.onlyChangedFormats && !opts.forceAllFormats {
+			if formats, err = changedFormats(l, dir, formats, hashes); err != nil {
+				return &generateError{stepError{"gn", err}}
+			}
+			if len(formats) == 0 {
+				return nil
+			}
+		}
+		warnings, err := newWarningCollector(opts.generatorWarnings)
+		if err != nil {
+			return &generateError{stepError{"gn", err}}
+		}
+		if !opts.scopedGenerate {
+			err = generateGN(l, dir, generator, opts.generatorArtifacts, formats, warnings)
+		} else {
+			err = generateChanged(l, dir, generator, opts.generatorArtifacts, revision(m.PreviousRevision), sha1, formats, warnings)
+		}
+		m.GeneratorWarnings = warnings.warnings
+		for _, w := range warnings.warnings {
+			l.Printf("The generator warned: %s", w)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.checkDeterminism {
+			if err := checkDeterministic(l, dir, generator, opts.generatorArtifacts, formats); err != nil {
+				return err
+			}
+		}
+		if !record {
+			return nil
+		}
+		generated := make(map[string]string)
+		for _, f := range formats {
+			generated[f] = hashes[f]
+		}
+		if err := writeFormatInputs(dir, generated); err != nil {
+			return &generateError{stepError{"gn", err}}
+		}
+		return nil
+	}))
+	if opts.checkFIPS {
+		// The fips step checks the build files this step generates.
+		steps[len(steps)-1].required = true
+	}
+	if generate {
+		s := &steps[len(steps)-1]
+		s.cmd = generatorCommand(dir, generator, opts.buildFormats)
+		s.writes, _ = generatedFiles(dir, opts.buildFormats)
+		if opts.onlyChangedFormats {
+			s.writes = append(s.writes, formatInputsName)
+		}
+	}
+	if inSubtree(opts.subtree, "include") {
+		desc := "Run rust/boringssl-sys/bindgen.sh, writing rust/boringssl-sys/src/lib.rs"
+		if len(opts.bindgenFlags) > 0 {
+			desc += ", after comparing the flags it passes bindgen against --expected-bindgen-flag"
+		}
+		s := loggedStep("rust", desc,
+			func(l *log.Logger) (err error) {
+				if opts.checkBindgenHeaders {
+					if err := checkBindgenHeaders(l, dir, opts.bindgenHeaders); err != nil {
+						return err
+					}
+				}
+				if len(opts.bindgenFlags) > 0 {
+					if err := checkBindgenFlags(l, dir, opts.bindgenFlags, opts.strictBindgenFlags); err != nil {
+						return err
+					}
+				}
+				m.BindgenVersion, err = generateRustBindings(l, dir, opts.bindgenExpected, opts.bindgenStrict)
+				return err
+			})
+		s.cmd = exec.Command(filepath.Join("rust", "boringssl-sys", "bindgen.sh"))
+		s.cmd.Dir = dir
+		s.writes = []string{"rust/boringssl-sys/src/lib.rs"}
+		steps = append(steps, s)
+	}
+	if opts.cargoUpdateDir != "" && inSubtree(opts.subtree, "include") {
+		// Read before the rust step regenerates them, to tell whether they changed. A plain step, so
+		// that it runs after the rust step.
+		previous, _ := ioutil.ReadFile(filepath.Join(dir, "rust", "boringssl-sys", "src", "lib.rs"))
+		s := step{name: "cargo", desc: "If the Rust bindings changed, run cargo update -p " + cargoPackage + " in " + opts.cargoUpdateDir,
+			run: func() error { return updateCargoLock(log.Default(), dir, opts.cargoUpdateDir, previous) }}
+		s.cmd = exec.Command("cargo", "update", "-p", cargoPackage)
+		s.cmd.Dir = opts.cargoUpdateDir
+		if !filepath.IsAbs(opts.cargoUpdateDir) {
+			s.writes = []string{filepath.ToSlash(filepath.Join(opts.cargoUpdateDir, "Cargo.lock"))}
+		}
+		steps = append(steps, s)
+	}
+	post := patchesDir(dir, opts.postGeneratePatches)
+	if names, _ := patchFiles(post); len(names) > 0 {
+		steps = append(steps, patchStep("post-generate", fmt.Sprintf("Apply the %d patches in %s to the generated files", len(names), post), dir, post, m))
+	}
+	// With the generated files, once they are generated and patched, and not as a logged step, so
+	// that it never runs concurrently with the steps that write them.
+	if opts.writeChecksums && opts.checksumGenerated {
+		var generated []string
+		for _, s := range skipSteps(steps, opts.skip) {
+			if s.name != "gn" && s.name != "rust" {
+				continue
+			}
+			for _, name := range s.writes {
+				if name != formatInputsName {
+					generated = append(generated, name)
+				}
+			}
+		}
+		steps = append(steps, step{name: "checksums", desc: "Write the SHA-256 digest of every file in src and of the generated files to src/" + checksumsName,
+			run: func() error { return writeChecksums(dir, generated) }, writes: []string{"src/" + checksumsName}})
+	}
+	// The steps that read the generated build files are not logged steps, so that they never run
+	// concurrently with the gn step.
+	if len(opts.asmArchs) > 0 && generate {
+		steps = append(steps, step{name: "asm", desc: "Check that the generator wrote assembly for " + strings.Join(opts.asmArchs, ", "),
+			run: func() error { return checkAsmArchs(dir, opts.asmArchs) }})
+	}
+	if !opts.allowAbsolutePaths && generate {
+		steps = append(steps, step{name: "absolute-paths", desc: "Check that the generated build files contain no absolute paths, URLs, or other forbidden patterns",
+			run: func() error {
+				return checkForbiddenPatterns(log.Default(), dir, opts.buildFormats, opts.forbiddenPatterns)
+			}})
+	}
+	if opts.goldenDir != "" && generate {
+		desc := "Check that the generated build files match their goldens in " + opts.goldenDir
+		if opts.updateGolden {
+			desc = "Replace the goldens in " + opts.goldenDir + " with the generated build files"
+		}
+		steps = append(steps, step{name: "golden", desc: desc,
+			run: func() error {
+				return checkGolden(log.Default(), dir, opts.goldenDir, opts.buildFormats, opts.goldenFiles, opts.updateGolden)
+			}})
+	}
+	if opts.compareGenerated && generate {
+		steps = append(steps, step{name: "compare-generated", desc: "Report differences between the generated build files and those committed in src",
+			run: func() error { return reportGeneratedDiffs(log.Default(), dir, opts.buildFormats) }})
+	}
+	if opts.explainDiff && generate {
+		// Read before the gn step replaces them, to tell which removed files were built.
+		previous, err := readGenerated(dir, opts.buildFormats)
+		steps = append(steps, step{name: "explain-diff", desc: "Report which of the changed upstream files the generated build files use", run: func() error {
+			if err != nil {
+				return err
+			}
+			return explainDiff(log.Default(), dir, revision(m.PreviousRevision), sha1, opts.buildFormats, previous)
+		}})
+	}
+	if opts.checkSymbols && inSubtree(opts.subtree, "include") {
+		// Read before the sources step replaces them, to compare with the new ones.
+		previous, err := exportedSymbols(filepath.Join(dir, "src"))
+		desc := "Report the symbols the headers in src/include export that were added or removed, warning about removals"
+		if opts.strictSymbols {
+			desc = "Report the symbols the headers in src/include export that were added or removed, failing on removals"
+		}
+		steps = append(steps, step{name: "symbols", desc: desc, run: func() error {
+			if err != nil {
+				return err
+			}
+			return checkSymbolExports(log.Default(), dir, previous, opts.strictSymbols)
+		}})
+	}
+	if opts.reportDuplicates {
+		steps = append(steps, loggedStep("duplicates", "Report the files in src with identical contents", func(l *log.Logger) error {
+			return reportDuplicates(l, dir)
+		}))
+	}
+	if opts.reportUpstreamGen {
+		steps = append(steps, loggedStep("upstream-generated", "Report the changed upstream files that upstream generates, such as test vectors, apart from the hand-written ones",
+			func(l *log.Logger) error {
+				return reportUpstreamGenerated(l, filepath.Join(dir, "src"), revision(m.PreviousRevision), sha1, opts.upstreamGenerated)
+			}))
+	}
+	if opts.licenseScanner != "" {
+		desc := fmt.Sprintf("Scan src for licenses with `%s`, failing on any but %s", opts.licenseScanner, strings.Join(opts.allowedLicenses, ", "))
+		steps = append(steps, loggedStep("licenses", desc, func(l *log.Logger) error {
+			return scanLicenses(l, dir, opts.licenseScanner, opts.allowedLicenses, m)
+		}))
+	}
+	if len(opts.referencedPaths) > 0 || opts.referencedPathsFile != "" {
+		desc := "Warn about any path our build files refer to that is missing from src"
+		if opts.strictReferenced {
+			desc = "Check that every path our build files refer to is still in src"
+		}
+		steps = append(steps, loggedStep("referenced", desc, func(l *log.Logger) error {
+			paths := opts.referencedPaths
+			if opts.referencedPathsFile != "" {
+				listed, err := readReferencedPaths(opts.referencedPathsFile)
+				if err != nil {
+					return err
+				}
+				paths = append(append([]string{}, paths...), listed...)
+			}
+			return checkReferenced(l, dir, paths, opts.strictReferenced)
+		}))
+	}
+	if opts.checkFIPS {
+		files := opts.fipsFiles
+		if len(files) == 0 {
+			files = defaultFIPSFiles
+		}
+		steps = append(steps, step{name: "fips", desc: "Check that src contains " + strings.Join(files, ", ") + " and that the generated build files have a target building them",
+			run: func() error {
+				if !generate {
+					return fmt.Errorf("--check-fips checks the generated build files, but the gn step does not generate them: %s is not in %s", generator, opts.subtree)
+				}
+				return checkFIPS(dir, files, opts.buildFormats)
+			}})
+	}
+	if opts.verifyClean || opts.cleanGenerated {
+		desc := "Report untracked files the generators left behind"
+		if opts.cleanGenerated {
+			desc = "Remove untracked files the generators left behind"
+		}
+		steps = append(steps, step{name: "verify-clean", desc: desc, run: func() error {
+			return verifyCleanGenerated(dir, opts.cleanGenerated, patchesDir(dir, opts.preGeneratePatches), patchesDir(dir, opts.postGeneratePatches))
+		}})
+	}
+	if opts.versionHeader {
+		header := opts.versionHeaderPath
+		if !filepath.IsAbs(header) {
+			header = filepath.Join(dir, header)
+		}
+		steps = append(steps, step{name: "version-header", desc: "Write the new revision to " + opts.versionHeaderPath, run: func() error {
+			_, err := updateVersionHeader(header, sha1, time.Now())
+			return err
+		}, writes: []string{opts.versionHeaderPath}})
+	}
+	if opts.mirrorDir != "" {
+		mirror := filepath.Join(opts.mirrorDir, "src")
+		desc := "Copy src to " + mirror
+		if opts.mirrorSubtree != "" {
+			desc = fmt.Sprintf("Copy only %s of src to %s", opts.mirrorSubtree, mirror)
+		}
+		if len(opts.mirrorExcludes) > 0 {
+			desc += fmt.Sprintf(", leaving out paths matching %s", strings.Join(opts.mirrorExcludes, ", "))
+		}
+		steps = append(steps, step{name: "mirror", desc: desc, run: func() error { return mirrorSources(dir, sha1, opts) }, writes: []string{mirror}})
+	}
+	if !opts.useGitNotes {
+		steps = append(steps, step{name: "readme", desc: "Write the new revision to " + readmeName, run: func() error { return updateReadMe(dir, sha1) }, writes: []string{readmeName}})
+	}
+	if opts.noOpIfIdenticalTree {
+		steps = append(steps[:1], unlessTreeUnchanged(steps[1:], m, opts.readmeIfIdenticalTree)...)
+	}
+	return skipSteps(steps, opts.skip)
+}
+
+// Returns |steps|, each doing nothing once |m| records that the sources step found the tree
+// unchanged, except for the readme step if |readme| is set.
+func unlessTreeUnchanged(steps []step, m *manifest, readme bool) []step {
+	guarded := make([]step, len(steps))
+	for i, s := range steps {
+		s := s
+		guarded[i] = s
+		if s.name == "readme" && readme {
+			continue
+		}
+		guarded[i].run = func() error {
+			if m.TreeUnchanged {
+				log.Printf("Skipping %s, as the tree is unchanged", s.name)
+				return nil
+			}
+			return s.run()
+		}
+		if s.logged != nil {
+			guarded[i].logged = func(l *log.Logger) error {
+				if m.TreeUnchanged {
+					l.Printf("Skipping %s, as the tree is unchanged", s.name)
+					return nil
+				}
+				return s.logged(l)
+			}
+		}
+	}
+	return guarded
+}
+
+// The names of the steps a roll may have, in order.
+var stepNames = []string{"sources", "pre-generate-patches", "utf8", "checksums", "cas", "headers", "gn", "rust", "cargo", "post-generate-patches", "asm", "absolute-paths", "golden", "compare-generated", "explain-diff", "symbols", "duplicates", "upstream-generated", "licenses", "referenced", "fips", "verify-clean", "version-header", "mirror", "readme"}
+
+// Validates the names of the steps to skip.
+func checkSkip(skip []string) error {
+	for _, s := range skip {
+		known := false
+		for _, name := range stepNames {
+			known = known || s == name
+		}
+		if !known {
+			return fmt.Errorf("unknown step %q to skip; steps are %s", s, strings.Join(stepNames, ", "))
+		}
+	}
+	return nil
+}
+
+// Returns |steps| less those named in |skip|.
+func skipSteps(steps []step, skip []string) []step {
+	var kept []step
+	for _, s := range steps {
+		skipped := false
+		for _, name := range skip {
+			skipped = skipped || s.name == name
+		}
+		if !skipped {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// Describes how the sources are fetched, for --explain.
+func fetchDesc(opts *rollOptions) string {
+	if opts.tarballURL != "" {
+		return "Fetch nothing; the sources step downloads the tarball"
+	}
+	if opts.upstreamURL == "" {
+		return "Fetch all remotes in src"
+	}
+	desc := fmt.Sprintf("Fetch %s from %s into src", opts.commit, opts.upstreamURL)
+	if opts.shallow {
+		desc += ", without its history"
+	}
+	return desc
+}
+
+// Describes how the target revision is chosen, for --explain.
+func resolveDesc(opts *rollOptions) string {
+	if len(opts.branches) > 0 {
+		return fmt.Sprintf("Resolve %s and roll to their %s", strings.Join(opts.branches, ", "), opts.branchStrategy)
+	}
+	return fmt.Sprintf("Resolve %s to a revision", opts.commit)
+}
+
+// Prints to |w| what a roll with |opts| would do, without running any commands.
+func explain(w io.Writer, dir string, opts *rollOptions) {
+	var plan []string
+	plan = append(plan,
+		"Take the roll lock "+filepath.Join(dir, lockName),
+		fetchDesc(opts),
+		resolveDesc(opts))
+	if opts.minAge > 0 {
+		plan = append(plan, fmt.Sprintf("Use instead the newest commit in its first-parent history that is at least %s old", opts.minAge))
+	}
+	if opts.asOf != "" {
+		plan = append(plan, fmt.Sprintf("Use instead the newest commit in its history made before %s", opts.asOf))
+	}
+	if opts.requireSignedTags {
+		plan = append(plan, "If --commit names a tag, stop unless it is annotated and signed by one of --trusted-key")
+	}
+	if opts.upstreamBranch != "" {
+		if opts.allowOffBranch {
+			plan = append(plan, "Warn if that revision is not on "+opts.upstreamBranch)
+		} else {
+			plan = append(plan, "Stop unless that revision is on "+opts.upstreamBranch)
+		}
+	}
+	if opts.requireLinear {
+		plan = append(plan, "Stop if that revision is a merge commit")
+	}
+	if opts.sinceLastGreen {
+		plan = append(plan, "Stop unless that revision descends from the last successful roll in "+historyName)
+	}
+	if opts.plan != nil {
+		p := fmt.Sprintf("Use the planned revision %s, stopping if upstream or src have moved since the plan", opts.plan.Revision)
+		if opts.allowPlanDrift {
+			p = fmt.Sprintf("Use the planned revision %s, even if upstream or src have moved since the plan", opts.plan.Revision)
+		}
+		plan = append(plan, p)
+	}
+	if opts.validateHook != "" {
+		plan = append(plan, fmt.Sprintf("Run `%s` with that revision, stopping if it fails", opts.validateHook))
+	}
+	if opts.planOut != "" {
+		plan = append(plan, "Write the roll plan to "+opts.planOut+" and stop")
+		for i, p := range plan {
+			fmt.Fprintf(w, "%d. %s\n", i+1, p)
+		}
+		return
+	}
+	if opts.skipIfCurrent {
+		plan = append(plan, "Stop if src is already at that revision")
+	}
+	if len(opts.allowedAuthors) > 0 {
+		plan = append(plan, "Stop if any upstream commit being rolled in was authored or committed by someone not in --allowed-authors")
+	}
+	switch {
+	case opts.expectCommits > 0:
+		plan = append(plan, fmt.Sprintf("Stop unless the roll has exactly %d upstream commits", opts.expectCommits))
+	case opts.reviewThreshold > 0 && !opts.changelogReviewed:
+		plan = append(plan, fmt.Sprintf("Stop if the roll has more than %d upstream commits, until its changelog is reviewed", opts.reviewThreshold))
+	}
+	if opts.changelogPath != "" || opts.strictSecurity {
+		c := "Scan the upstream commits being rolled in for security-relevant changes"
+		if opts.changelogPath != "" {
+			c = "Write the changelog to " + opts.changelogPath + ", listing security-relevant changes first"
+		}
+		if opts.strictSecurity {
+			c += ", and stop if there are any"
+		}
+		plan = append(plan, c)
+	}
+	if opts.sandbox {
+		plan = append(plan, "Copy the boringssl directory to a sandbox, run the steps below there, and only if they all succeed, move the results back")
+	}
+	if opts.resume {
+		plan = append(plan, "Skip the steps below that completed in an interrupted roll to that revision")
+	}
+	if opts.commitPerStep {
+		plan = append(plan, "Run the steps below one at a time, committing the changes of each as it succeeds")
+	}
+	desc := fmt.Sprintf("the revision %s resolves to", opts.commit)
+	for _, s := range rollSteps(dir, revision(desc), opts, &manifest{}) {
+		plan = append(plan, fmt.Sprintf("[%s] %s", s.name, s.desc))
+	}
+	if opts.manifestPath != "" {
+		plan = append(plan, "Write the roll manifest to "+opts.manifestPath)
+	}
+	if opts.reportPath != "" {
+		plan = append(plan, "Write an HTML report of the roll to "+opts.reportPath)
+	}
+	if opts.useGitNotes {
+		plan = append(plan, "After committing the roll, record the new revision and changelog in a git note on the commit instead of in "+readmeName)
+	}
+	for i, p := range plan {
+		fmt.Fprintf(w, "%d. %s\n", i+1, p)
+	}
+}
+
+// The outcome of one of the checks --doctor makes.
+type doctorCheck struct {
+	name   string
+	status string // pass, warn or fail.
+	detail string
+}
+
+// Looks up the tools --doctor checks for; replaced in tests.
+var lookPath = exec.LookPath
+
+// Checks, without rolling, whether a roll of the sources in |dir| with |opts| could run: that the
+// tools it runs are installed, that src and its upstream remote resolve, that README.fuchsia
+// records a revision, and that there is room for the sources. Failures would stop a roll; warnings
+// would not.
+func doctor(dir string, opts *rollOptions) []doctorCheck {
+	var checks []doctorCheck
+	add := func(name, status, format string, args ...interface{}) {
+		checks = append(checks, doctorCheck{name, status, fmt.Sprintf(format, args...)})
+	}
+	skipped := func(step string) bool {
+		for _, s := range opts.skip {
+			if s == step {
+				return true
+			}
+		}
+		return false
+	}
+	generator, upstream := activeGenerator(opts)
+	generate := (!upstream || inSubtree(opts.subtree, generator)) && !skipped("gn")
+	rust := inSubtree(opts.subtree, "include") && !skipped("rust")
+	tool := func(name string, needed bool, why string) bool {
+		path, err := lookPath(name)
+		if err != nil {
+			if needed {
+				add(name, "fail", "not found in PATH, but %s", why)
+			} else {
+				add(name, "pass", "not found in PATH, and not needed")
+			}
+			return false
+		}
+		if name == "bindgen" {
+			return true
+		}
+		out, err := output(exec.Command(path, "--version"))
+		if err != nil {
+			add(name, "warn", "%s does not report its version: %s", path, err)
+			return true
+		}
+		add(name, "pass", "%s (%s)", strings.SplitN(string(out), "\n", 2)[0], path)
+		return true
+	}
+	tool("git", true, "every roll runs git")
+	tool("cargo", rust && opts.cargoUpdateDir != "", "--cargo-update-dir runs it")
+	contained := toolContainer.image != ""
+	if contained {
+		// The generator and bindgen are in the image, not on the PATH.
+		tool(toolContainer.runtime, generate || rust, "--container runs the generator and bindgen with it")
+	} else {
+		tool("python", generate, "the generator runs with it")
+	}
+	if (contained && rust) || (!contained && tool("bindgen", rust, "the Rust bindings are generated with it")) {
+		version, err := bindgenVersion(log.New(ioutil.Discard, "", 0))
+		expected := opts.bindgenExpected
+		if expected == "" && err == nil {
+			expected, err = pinnedBindgenVersion(filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh"))
+		}
+		got, _ := parseBindgenVersion(version)
+		want, _ := parseBindgenVersion(expected)
+		switch {
+		case err != nil && rust:
+			add("bindgen version", "fail", "%s", err)
+		case err != nil:
+			add("bindgen version", "warn", "%s", err)
+		case got != want && opts.bindgenStrict:
+			add("bindgen version", "fail", "%s, but %s is expected and --strict-bindgen-version is set", version, expected)
+		case got != want:
+			add("bindgen version", "warn", "%s, but %s is expected; the bindings may differ", version, expected)
+		default:
+			add("bindgen version", "pass", "%s", version)
+		}
+	}
+	for _, f := range opts.buildFormats {
+		if f == "android" && generate {
+			if _, err := lookPath("bpfmt"); err != nil {
+				add("bpfmt", "warn", "not found in PATH, so the generated .bp files will not be checked")
+			} else {
+				add("bpfmt", "pass", "found")
+			}
+		}
+	}
+
+	if opts.tarballURL == "" {
+		if _, err := output(exec.Command("git", "-C", filepath.Join(dir, "src"), "rev-parse", "--git-dir")); err != nil {
+			add("src", "fail", "%s is not a git checkout: %s", filepath.Join(dir, "src"), err)
+		} else {
+			add("src", "pass", "%s is a git checkout", filepath.Join(dir, "src"))
+		}
+	}
+	if sha1, err := resolveWithoutFetch(dir, opts); err != nil {
+		add("upstream", "fail", "%s does not resolve: %s", opts.commit, err)
+	} else {
+		add("upstream", "pass", "%s resolves to %s without fetching", opts.commit, sha1.short())
+	}
+	if current, err := sourcesRevision(dir, opts); err != nil {
+		add("README.fuchsia", "fail", "%s", err)
+	} else {
+		add("README.fuchsia", "pass", "src is at %s", current.short())
+	}
+	if generate && upstream && opts.tarballURL == "" {
+		if err := checkGenerator(dir, generator); err != nil {
+			add("generator", "fail", "%s", err)
+		} else {
+			add("generator", "pass", "src/%s exists", generator)
+		}
+	}
+	if err := checkDiskSpace(dir, opts.diskHeadroom<<20); err != nil {
+		add("disk space", "fail", "%s", err)
+	} else {
+		add("disk space", "pass", "enough free for src and %d MiB of headroom", opts.diskHeadroom)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockName)); err == nil {
+		add("lock", "warn", "%s exists; another roll is in progress, or it is stale", filepath.Join(dir, lockName))
+	}
+	return checks
+}
+
+// Prints |checks| to |w| as a checklist, and returns whether none failed.
+func printDoctor(w io.Writer, checks []doctorCheck) bool {
+	ok := true
+	for _, c := range checks {
+		fmt.Fprintf(w, "[%s] %s: %s\n", c.status, c.name, c.detail)
+		ok = ok && c.status != "fail"
+	}
+	if ok {
+		fmt.Fprintln(w, "A roll can run.")
+	} else {
+		fmt.Fprintln(w, "A roll cannot run until the failures above are fixed.")
+	}
+	return ok
+}
+
+// The execution plan --print-plan-json prints.
+type executionPlan struct {
+	Revision         revision      `json:"revision"`
+	PreviousRevision revision      `json:"previous_revision"`
+	Steps            []plannedStep `json:"steps"`
+	Files            []string      `json:"files"`             // Relative to the boringssl directory.
+	Changes          []string      `json:"changes,omitempty"` // git diff --name-status lines.
+}
+
+// A step of an executionPlan.
+type plannedStep struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Command     []string `json:"command,omitempty"`
+	Dir         string   `json:"dir,omitempty"` // Where the command runs.
+	Writes      []string `json:"writes,omitempty"`
+}
+
+// Resolves the revision a roll of the sources in |dir| with |opts| would roll to, without fetching
+// or otherwise changing the checkout: from the refs src already has, or by asking --upstream-url.
+func resolveWithoutFetch(dir string, opts *rollOptions) (revision, error) {
+	if opts.plan != nil {
+		return opts.plan.Revision, nil
+	}
+	if opts.tarballURL != "" {
+		return resolveCommit(dir, opts)
+	}
+	src := filepath.Join(dir, "src")
+	var sha1 revision
+	var err error
+	switch {
+	case len(opts.branches) > 0:
+		sha1, err = branchesCommit(src, opts.branches, opts.branchStrategy)
+	case opts.upstreamURL != "":
+		if sha1, err = parseRevision(opts.commit); err != nil {
+			var out []byte
+			if out, err = output(exec.Command("git", "ls-remote", "--", opts.upstreamURL, opts.commit)); err != nil {
+				return "", err
+			}
+			fields := strings.Fields(string(out))
+			if len(fields) == 0 {
+				return "", fmt.Errorf("%s has no ref %s", opts.upstreamURL, opts.commit)
+			}
+			sha1, err = parseRevision(fields[0])
+		}
+	default:
+		sha1, err = revParseFallback(src, opts.commit, opts.commitFallbacks)
+	}
+	if err != nil {
+		return "", err
+	}
+	if opts.asOf != "" {
+		return asOfCommit(src, sha1, opts.asOf)
+	}
+	if opts.minAge <= 0 {
+		return sha1, nil
+	}
+	return oldEnough(src, sha1, opts.minAge)
+}
+
+// Returns the plan of a roll of the sources in |dir| with |opts|, as --print-plan-json prints it:
+// the revisions, the steps with the commands they run, the files they write and the upstream
+// changes. Only read-only git commands run, so nothing in |dir| changes, and nothing is fetched.
+func planExecution(dir string, opts *rollOptions) (*executionPlan, error) {
+	sha1, err := resolveWithoutFetch(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	current, err := sourcesRevision(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &executionPlan{Revision: sha1, PreviousRevision: current, Steps: []plannedStep{}}
+	m := &manifest{Revision: string(sha1), PreviousRevision: string(current), BuildFormats: opts.buildFormats}
+	files := map[string]bool{historyName: true}
+	for _, s := range rollSteps(dir, sha1, opts, m) {
+		ps := plannedStep{Name: s.name, Description: s.desc, Writes: s.writes}
+		if s.cmd != nil {
+			ps.Command, ps.Dir = s.cmd.Args, s.cmd.Dir
+		}
+		for _, w := range s.writes {
+			files[w] = true
+		}
+		p.Steps = append(p.Steps, ps)
+	}
+	for f := range files {
+		p.Files = append(p.Files, f)
+	}
+	sort.Strings(p.Files)
+	if opts.tarballURL == "" && current != sha1 {
+		changes, err := diffTree(filepath.Join(dir, "src"), current, sha1)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range changes {
+			p.Changes = append(p.Changes, fmt.Sprintf("%c\t%s", c.status, c.path))
+		}
+	}
+	return p, nil
+}
+
+// Writes the plan of a roll of the sources in |dir| with |opts| to |w| as JSON.
+func printPlanJSON(w io.Writer, dir string, opts *rollOptions) error {
+	p, err := planExecution(dir, opts)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the plan: %s", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// With --no-network, checks that nothing |opts| asks for needs the network: the sources must come
+// from the remote-tracking branches src already has, a local --upstream-url, or a tarball in
+// --cache-dir.
+func checkNoNetworkOptions(opts *rollOptions) error {
+	switch {
+	case !noNetwork:
+	case opts.dryRunNetwork:
+		return fmt.Errorf("--dry-run-network cannot be used with --no-network")
+	case opts.upstreamURL != "" && !isLocalRepo(opts.upstreamURL):
+		return fmt.Errorf("--no-network requires --upstream-url to be a local mirror, not %s", opts.upstreamURL)
+	case opts.tarballURL != "" && opts.cacheDir == "":
+		return fmt.Errorf("--no-network cannot download --tarball-url; it requires --cache-dir to hold the extracted sources")
+	}
+	return nil
+}
+
+// Rolls BoringSSL in |dir| and returns the manifest of the roll. If a step of the roll fails, the
+// manifest so far is returned along with the error.
+func roll(dir string, opts *rollOptions) (*manifest, error) {
+	if err := checkBuildFormats(opts.buildFormats); err != nil {
+		return nil, err
+	}
+	if err := checkSkip(opts.skip); err != nil {
+		return nil, err
+	}
+	for _, s := range opts.skip {
+		if s == "gn" && opts.checkFIPS {
+			return nil, fmt.Errorf("--check-fips checks the build files the gn step generates and cannot be used with --skip=gn")
+		}
+	}
+	if _, err := authorAllowlist(opts.allowedAuthors); err != nil {
+		return nil, err
+	}
+	if err := checkNoNetworkOptions(opts); err != nil {
+		return nil, err
+	}
+	if opts.changelogFormat != "" && changelogFormats[opts.changelogFormat] == nil {
+		return nil, fmt.Errorf("unknown --changelog-format %q; the formats are %s", opts.changelogFormat, strings.Join(changelogFormatNames(), ", "))
+	}
+	if opts.sandbox && opts.planOut == "" && !opts.dryRunNetwork {
+		return sandboxRoll(dir, opts)
+	}
+	unlock, err := lock(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sha1, err := resolveCommit(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Commit resolved to %s", sha1)
+	if opts.requireSignedTags && opts.tarballURL == "" {
+		if err := checkTagSignature(filepath.Join(dir, "src"), opts.commit, opts.trustedKeys); err != nil {
+			return nil, err
+		}
+	}
+	if opts.upstreamBranch != "" {
+		if err := checkOnBranch(filepath.Join(dir, "src"), sha1, opts.upstreamBranch, opts.allowOffBranch); err != nil {
+			return nil, err
+		}
+	}
+	if opts.requireLinear {
+		p, err := parents(filepath.Join(dir, "src"), sha1)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLinear(sha1, p); err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := sourcesRevision(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.sinceLastGreen {
+		ok, err := sinceLastGreenRoll(dir, sha1)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("Not rolling, because of --since-last-green-roll")
+			return &manifest{Revision: string(current), PreviousRevision: string(current), BuildFormats: opts.buildFormats}, nil
+		}
+	}
+	if opts.plan != nil {
+		if sha1, err = plannedRevision(opts.plan, sha1, current, opts.allowPlanDrift); err != nil {
+			return nil, err
+		}
+		log.Printf("Rolling to %s as planned", sha1)
+	}
+	if opts.validateHook != "" {
+		if err := runValidateHook(dir, opts.validateHook, current, sha1); err != nil {
+			return nil, err
+		}
+	}
+	if opts.planOut != "" {
+		p := &rollPlan{Commit: opts.commit, Revision: sha1, PreviousRevision: current, Settings: opts.planSettings}
+		if opts.tarballURL == "" {
+			changes, err := diffTree(filepath.Join(dir, "src"), current, sha1)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range changes {
+				p.Changes = append(p.Changes, fmt.Sprintf("%c\t%s", c.status, c.path))
+			}
+		}
+		if err := writePlan(opts.planOut, p); err != nil {
+			return nil, err
+		}
+		log.Printf("Wrote the plan to roll %s to %s to %s; apply it with --plan-in", current.short(), sha1.short(), opts.planOut)
+		return &manifest{Revision: string(sha1), PreviousRevision: string(current), BuildFormats: opts.buildFormats}, nil
+	}
+	m := &manifest{Revision: string(sha1), PreviousRevision: string(current), BuildFormats: opts.buildFormats}
+	if opts.skipIfCurrent && current == sha1 {
+		log.Printf("Sources are already at %s", sha1.short())
+		return m, nil
+	}
+	if opts.dryRunNetwork {
+		return m, dryRunNetwork(dir, current, sha1, opts, m)
+	}
+	details := opts.manifestPath != "" || opts.reportPath != "" || opts.envFilePath != "" || opts.autoCommit || opts.sourcesOnly
+	if current != sha1 {
+		if err := checkHistory(dir, sha1, opts.strictHistory); err != nil {
+			return nil, err
+		}
+		if len(opts.allowedAuthors) > 0 {
+			if err := checkRollAuthors(dir, current, sha1, opts); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkChangelogReviewed(dir, current, sha1, opts); err != nil {
+			return nil, err
+		}
+		if opts.changelogPath != "" || opts.strictSecurity || details {
+			if err := writeChangelog(dir, current, sha1, opts, m); err != nil {
+				return nil, err
+			}
+		}
+		if details && opts.tarballURL == "" {
+			if err := recordChanges(filepath.Join(dir, "src"), current, sha1, m); err != nil {
+				return nil, err
+			}
+			if m.DiffStat, err = recordDiffStat(filepath.Join(dir, "src"), current, sha1); err != nil {
+				return nil, err
+			}
+		}
+		if opts.advisoryFeed != "" {
+			if err := reportAdvisories(filepath.Join(dir, "src"), current, sha1, opts.advisoryFeed, m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if details {
+		if m.PreviousSourcesSize, err = treeSize(filepath.Join(dir, "src")); err != nil {
+			log.Printf("WARNING: failed to measure src: %s", err)
+		}
+	}
+
+	entry := historyEntry{Time: time.Now().UTC(), Old: current, New: sha1}
+	steps := rollSteps(dir, sha1, opts, m)
+	entry.Steps, err = runSteps(dir, sha1, commitSteps(timeSteps(limitSteps(watchSteps(steps, opts), opts), m), dir, m, opts), opts.resume, opts.jobs, !opts.keepGoing)
+	for i := range m.Steps {
+		if timeout, source := stepTimeout(m.Steps[i].Name, opts); timeout > 0 {
+			m.Steps[i].Timeout = timeout.String() + " (" + source + ")"
+		}
+	}
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+	} else if size, serr := treeSize(filepath.Join(dir, "src")); serr != nil {
+		log.Printf("WARNING: failed to measure src: %s", serr)
+	} else {
+		entry.SourcesSize = size
+		if m.Licenses != nil {
+			entry.Licenses = m.Licenses.ids()
+		}
+		m.SourcesSize = size
+	}
+	if err == nil && details {
+		if m.Outputs, err = outputHashes(dir, steps); err != nil {
+			entry.Success, entry.Error = false, err.Error()
+		}
+		if m.GeneratorBlob, err = generatorBlob(dir, opts); err != nil {
+			log.Printf("WARNING: %s", err)
+			err = nil
+		}
+	}
+	if herr := appendHistory(dir, &entry); herr != nil {
+		log.Printf("WARNING: %s", herr)
+	}
+	m.FailedStep = failedStep(err)
+	if opts.manifestPath != "" {
+		if merr := writeManifest(opts.manifestPath, m); merr != nil && err == nil {
+			err = merr
+		}
+	}
+	if opts.reportPath != "" {
+		if rerr := writeReport(opts.reportPath, m, opts.commitURL); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return m, err
+}
+
+// The prefix of the temporary directories a --sandbox roll makes in the boringssl directory.
+const sandboxPrefix = ".sandbox-"
+
+// Rolls BoringSSL as roll does, but in a copy of |dir| made inside it, and only once every step
+// has succeeded moves the results into |dir| in place of what was there. If the roll fails, |dir|
+// is left as it was, and the failure is not recorded in its roll history either.
+//
+// The copy includes the git repositories of |dir| and src, so neither may be a worktree or
+// submodule whose repository is elsewhere.
+func sandboxRoll(dir string, opts *rollOptions) (*manifest, error) {
+	if opts.resume {
+		return nil, fmt.Errorf("--resume cannot be used with --sandbox, which discards the state of a failed roll")
+	}
+	unlock, err := lock(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	for _, d := range []string{dir, filepath.Join(dir, "src")} {
+		if info, err := os.Lstat(filepath.Join(d, ".git")); err == nil && !info.IsDir() {
+			return nil, fmt.Errorf("--sandbox cannot copy %s, whose git repository is elsewhere", d)
+		}
+	}
+	inner := *opts
+	inner.sandbox = false
+	if filepath.IsAbs(opts.versionHeaderPath) {
+		rel, err := filepath.Rel(dir, opts.versionHeaderPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("--sandbox cannot leave --version-header %s unchanged on failure, as it is outside %s", opts.versionHeaderPath, dir)
+		}
+		inner.versionHeaderPath = rel
+	}
+
+	work, err := tempDir(dir, sandboxPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(work)
+	log.Printf("Copying %s to %s...", dir, work)
+	if err := copyTree(dir, work, false, func(name string) bool {
+		return name == lockName || strings.HasPrefix(name, sandboxPrefix)
+	}); err != nil {
+		return nil, err
+	}
+	log.Printf("Rolling in %s...", work)
+	m, err := roll(work, &inner)
+	if err != nil {
+		log.Printf("Leaving %s unchanged, as the roll in the sandbox failed", dir)
+		return m, err
+	}
+	if err := swapIn(dir, work); err != nil {
+		return nil, err
+	}
+	log.Printf("Moved the results of the roll into %s", dir)
+	return m, nil
+}
+
+// Copies the directory |src| to |dst|, which must be empty, keeping the modes and modification
+// times of files and directories and copying symlinks as symlinks. If |link| is set, files are
+// hardlinked instead where possible. The top-level entries for which |skip| returns true are left
+// out.
+func copyTree(src, dst string, link bool, skip func(name string) bool) error {
+	dirTimes := make(map[string]time.Time)
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if !strings.ContainsRune(rel, filepath.Separator) && skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			dirTimes[target] = info.ModTime()
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			if link && os.Link(p, target) == nil {
+				return nil
+			}
+			in, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, in); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to copy %s: %s", p, err)
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		default:
+			return fmt.Errorf("cannot copy %s, which is not a file, directory or symlink", p)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %s", src, err)
+	}
+	// Directories are stamped last, as copying their contents modifies them.
+	for d, t := range dirTimes {
+		if err := os.Chtimes(d, t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the top-level entries of |dir| with those of |work|, a directory inside it, except for
+// .git, the lock and the sandbox directories. Entries of |dir| that |work| does not have are
+// removed. The old entries are moved aside first, and back if any move fails, so |dir| ends up
+// either wholly updated or as it was.
+func swapIn(dir, work string) (err error) {
+	keep := func(name string) bool {
+		return name == ".git" || name == lockName || strings.HasPrefix(name, sandboxPrefix)
+	}
+	list := func(d string) ([]string, error) {
+		entries, err := ioutil.ReadDir(d)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range entries {
+			if !keep(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+		return names, nil
+	}
+	old, err := list(dir)
+	if err != nil {
+		return err
+	}
+	updated, err := list(work)
+	if err != nil {
+		return err
+	}
+	backup, err := tempDir(dir, sandboxPrefix+"old-")
+	if err != nil {
+		return err
+	}
+	var movedAside, movedIn []string
+	defer func() {
+		if err != nil {
+			for _, name := range movedIn {
+				if rerr := os.Rename(filepath.Join(dir, name), filepath.Join(work, name)); rerr != nil {
+					log.Printf("WARNING: failed to restore %s: %s", name, rerr)
+				}
+			}
+			for _, name := range movedAside {
+				if rerr := os.Rename(filepath.Join(backup, name), filepath.Join(dir, name)); rerr != nil {
+					log.Printf("WARNING: failed to restore %s from %s: %s", name, backup, rerr)
+					return
+				}
+			}
+		}
+		removeTemp(backup)
+	}()
+	for _, name := range old {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(backup, name)); err != nil {
+			return fmt.Errorf("failed to move %s aside: %s", name, err)
+		}
+		movedAside = append(movedAside, name)
+	}
+	for _, name := range updated {
+		if err := os.Rename(filepath.Join(work, name), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to move %s into %s: %s", name, dir, err)
+		}
+		movedIn = append(movedIn, name)
+	}
+	return nil
+}
+
+// Finishes a --dry-run-network roll of the sources in |dir| from |current| to |sha1|, which have
+// been fetched and resolved: reads the changelog and checks that any tarball can be downloaded,
+// then prints the steps the roll would run. Nothing in |dir| is changed.
+func dryRunNetwork(dir string, current, sha1 revision, opts *rollOptions, m *manifest) error {
+	if current != sha1 {
+		readOnly := *opts
+		readOnly.changelogPath = ""
+		if err := writeChangelog(dir, current, sha1, &readOnly, m); err != nil {
+			return err
+		}
+	}
+	if opts.tarballURL != "" {
+		url := strings.Replace(opts.tarballURL, "{revision}", string(sha1), -1)
+		resp, err := httpClient.Head(url)
+		if err != nil {
+			return fmt.Errorf("failed to reach %s: %s", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to reach %s: %s", url, resp.Status)
+		}
+		log.Printf("%s is available", url)
+	}
+	fmt.Printf("Would roll %s to %s (%d commits):\n", current.short(), sha1.short(), m.CommitCount)
+	for i, s := range rollSteps(dir, sha1, opts, m) {
+		fmt.Printf("%d. [%s] %s\n", i+1, s.name, s.desc)
+	}
+	return nil
+}
+
+// Rolls BoringSSL in a temporary copy of |dir| and writes the changes the roll makes to |patch|, as
+// a patch that applies with `git apply` in |dir|. Neither |dir| nor its sources are modified.
+//
+// The copy is made with git worktrees of |dir| and src at their current commits, so uncommitted
+// changes in |dir| are not included and the patch is relative to those commits.
+func emitPatch(dir string, opts *rollOptions, patch string) (err error) {
+	tmp, err := tempDir("", "roll_boringssl")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmp)
+	work := filepath.Join(tmp, "boringssl")
+
+	if err := run(exec.Command("git", "-C", dir, "worktree", "add", "--detach", work, "HEAD")); err != nil {
+		return err
+	}
+	defer func() {
+		if werr := run(exec.Command("git", "-C", dir, "worktree", "remove", "--force", work)); werr != nil && err == nil {
+			err = werr
+		}
+	}()
+	if err := run(exec.Command("git", "-C", filepath.Join(dir, "src"), "worktree", "add", "--detach", filepath.Join(work, "src"), "HEAD")); err != nil {
+		return err
+	}
+	defer func() {
+		if werr := run(exec.Command("git", "-C", filepath.Join(dir, "src"), "worktree", "remove", "--force", filepath.Join(work, "src"))); werr != nil && err == nil {
+			err = werr
+		}
+	}()
+
+	log.Printf("Rolling in %s...", work)
+	m, err := roll(work, opts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing patch to %s...", patch)
+	var buf bytes.Buffer
+	{
+		cmd := exec.Command("git", "-C", filepath.Join(work, "src"), "diff", "--binary", "--src-prefix=a/src/", "--dst-prefix=b/src/", m.PreviousRevision, m.Revision)
+		cmd.Stdout = &buf
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+	out, err := output(exec.Command("git", "-C", work, "ls-files", "--others", "--exclude-standard", "-z", "--", ".", ":(exclude)src", ":(exclude)"+historyName))
+	if err != nil {
+		return err
+	}
+	if untracked := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"); untracked[0] != "" {
+		if err := run(exec.Command("git", append([]string{"-C", work, "add", "--intent-to-add", "--"}, untracked...)...)); err != nil {
+			return err
+		}
+	}
+	{
+		cmd := exec.Command("git", "-C", work, "diff", "--binary", "HEAD", "--", ".", ":(exclude)src")
+		cmd.Stdout = &buf
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(patch, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", patch, err)
+	}
+	log.Printf("To apply, run `git apply %s` in %s", patch, dir)
+	return nil
+}
+
+// Returns the first of |commits|, oldest first, that |good| reports is not good, assuming that the
+// last commit is bad and that every commit after a bad one is also bad. Each commit tested is
+// logged with its result.
+func firstBad(commits []revision, good func(revision) (bool, error)) (revision, error) {
+	lo, hi := 0, len(commits)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		ok, err := good(commits[mid])
+		if err != nil {
+			return "", err
+		}
+		result := "bad"
+		if ok {
+			result = "good"
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+		log.Printf("%s is %s; %d commits left to test", commits[mid].short(), result, hi-lo)
+	}
+	return commits[hi], nil
+}
+
+// Finds the first upstream commit after |good| and up to |bad| for which |test|, a shell command
+// run in |dir|, fails. Each commit tested is rolled to with the sources and gn steps. Afterwards,
+// the sources and every file outside of them are restored, so the tree must not have uncommitted
+// changes outside of src.
+func bisect(dir string, opts *rollOptions, good, bad, test string) (err error) {
+	unlock, err := lock(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	src := filepath.Join(dir, "src")
+	changed, err := output(exec.Command("git", "-C", dir, "diff", "--name-only", "HEAD", "--", ".", ":(exclude)src"))
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("--bisect restores the tree when done, so commit or stash its changes first:\n%s", changed)
+	}
+	untracked, err := untrackedFiles(dir, "src", lockName, stateName, historyName)
+	if err != nil {
+		return err
+	}
+	orig, err := currentRevision(dir)
+	if err != nil {
+		return err
+	}
+	goodRev, err := revParse(src, good)
+	if err != nil {
+		return err
+	}
+	badRev, err := revParse(src, bad)
+	if err != nil {
+		return err
+	}
+	out, err := output(exec.Command("git", "-C", src, "rev-list", "--first-parent", "--reverse", string(goodRev)+".."+string(badRev), "--"))
+	if err != nil {
+		return err
+	}
+	var commits []revision
+	for _, c := range strings.Fields(string(out)) {
+		commits = append(commits, revision(c))
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("%s is not after %s in the upstream history", bad, good)
+	}
+
+	defer func() {
+		log.Printf("Restoring the tree to %s...", orig.short())
+		rerr := updateSources(dir, orig, opts)
+		if rerr == nil {
+			rerr = run(exec.Command("git", "-C", dir, "checkout", "HEAD", "--", ".", ":(exclude)src"))
+		}
+		if rerr == nil {
+			var now []string
+			if now, rerr = untrackedFiles(dir, "src", lockName, stateName, historyName); rerr == nil {
+				for _, f := range now {
+					keep := false
+					for _, u := range untracked {
+						keep = keep || f == u
+					}
+					if !keep {
+						os.Remove(filepath.Join(dir, filepath.FromSlash(f)))
+					}
+				}
+			}
+		}
+		if rerr != nil && err == nil {
+			err = fmt.Errorf("failed to restore the tree: %s", rerr)
+		}
+	}()
+
+	log.Printf("Bisecting %d commits from %s to %s with `%s`...", len(commits), goodRev.short(), badRev.short(), test)
+	first, err := firstBad(commits, func(c revision) (bool, error) {
+		if err := updateSources(dir, c, opts); err != nil {
+			return false, err
+		}
+		if generator, upstream := activeGenerator(opts); !upstream || inSubtree(opts.subtree, generator) {
+			if err := generateGN(log.Default(), dir, generator, opts.generatorArtifacts, opts.buildFormats, nil); err != nil {
+				return false, err
+			}
+		}
+		cmd := exec.Command("sh", "-c", test)
+		cmd.Dir = dir
+		cmd.Stdout = logOutput
+		cmd.Stderr = logOutput
+		err := cmd.Run()
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+	subject, _ := output(exec.Command("git", "-C", src, "log", "-1", "--format=%s", string(first), "--"))
+	log.Printf("The first bad commit is %s %s", first, subject)
+	return nil
+}
+
+// Runs the shell command |hook| in |dir| to vet the roll from |old| to |new|, which it is given as
+// its argument and in $ROLL_BORINGSSL_REVISION, with |old| in $ROLL_BORINGSSL_PREVIOUS_REVISION.
+// Its output is logged, and if it fails the roll is vetoed.
+func runValidateHook(dir, hook string, old, new revision) error {
+	log.Printf("Validating %s with `%s`...", new.short(), hook)
+	cmd := exec.Command("sh", "-c", hook, "validate-hook", string(new))
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "ROLL_BORINGSSL_REVISION="+string(new), "ROLL_BORINGSSL_PREVIOUS_REVISION="+string(old))
+	cmd.Stdout = logOutput
+	cmd.Stderr = logOutput
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("--validate-hook vetoed the roll to %s: %s", new.short(), err)
+		}
+		return fmt.Errorf("failed to run --validate-hook: %s", err)
+	}
+	return nil
+}
+
+// Returns an error with guidance if |key|, the configured user.signingkey, is empty.
+func checkSigningKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("--sign-commit requires a signing key; set one with `git config user.signingkey <key>`")
+	}
+	return nil
+}
+
+// Checks that a key to sign the roll commit in |dir| with is configured.
+func signingKey(dir string) error {
+	// git config exits with 1 when the key is unset, which checkSigningKey reports.
+	out, _ := output(exec.Command("git", "-C", dir, "config", "user.signingkey"))
+	return checkSigningKey(string(out))
+}
+
+var bugRE = regexp.MustCompile(`^[0-9]+$`)
+
+// Validates that each of |bugs| is a numeric bug ID.
+func checkBugs(bugs []string) error {
+	for _, b := range bugs {
+		if !bugRE.MatchString(b) {
+			return fmt.Errorf("--bug %q is not a numeric bug ID", b)
+		}
+	}
+	return nil
+}
+
+// Returns the commit message for the roll |m|: a subject starting with |prefix| in brackets, the
+// upstream commits rolled in, and a "Bug:" footer for each of |bugs|.
+func commitMessage(m *manifest, prefix string, bugs []string) string {
+	var b strings.Builder
+	if prefix != "" {
+		fmt.Fprintf(&b, "[%s] ", prefix)
+	}
+	fmt.Fprintf(&b, "Roll BoringSSL %s..%s\n\nRolls from %s to %s.\n",
+		revision(m.PreviousRevision).short(), revision(m.Revision).short(), m.PreviousRevision, m.Revision)
+	if len(m.Commits) > 0 {
+		b.WriteString("\nChanges:\n")
+		for _, c := range m.Commits {
+			fmt.Fprintf(&b, "  %s %s\n", revision(c.SHA1).short(), c.Subject)
+		}
+		if more := m.CommitCount - len(m.Commits); more > 0 {
+			fmt.Fprintf(&b, "  ... and %d more\n", more)
+		}
+	}
+	if len(bugs) > 0 {
+		b.WriteString("\n")
+		for _, bug := range bugs {
+			fmt.Fprintf(&b, "Bug: %s\n", bug)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Returns the git arguments that commit the staged roll with the message |msg|, with a GPG
+// signature if |sign| is set.
+func commitArgs(msg string, sign bool) []string {
+	args := []string{"commit", "-m", msg}
+	if sign {
+		args = append(args, "-S")
+	}
+	return args
+}
+
+// Stages the changes the roll made in |dir|, leaving out the sources, which are a separate checkout.
+func stageRoll(dir string) error {
+	if err := run(exec.Command("git", "-C", dir, "add", "--update", "--", ".", ":(exclude)src")); err != nil {
+		return err
+	}
+	untracked, err := untrackedFiles(dir, "src", lockName, stateName)
+	if err != nil {
+		return err
+	}
+	if len(untracked) > 0 {
+		return run(exec.Command("git", append([]string{"-C", dir, "add", "--"}, untracked...)...))
+	}
+	return nil
+}
+
+// Commits the changes the roll made in |dir| with the message |msg|, leaving out the sources, which
+// are a separate checkout.
+func commitRoll(dir, msg string, sign bool) error {
+	log.Println("Committing the roll...")
+	if err := stageRoll(dir); err != nil {
+		return err
+	}
+	return run(exec.Command("git", append([]string{"-C", dir}, commitArgs(msg, sign)...)...))
+}
+
+// Like commitRoll, but returns whether there were any changes to commit rather than failing if
+// there were none.
+func commitStaged(dir, msg string, sign bool) (bool, error) {
+	if err := stageRoll(dir); err != nil {
+		return false, err
+	}
+	staged, err := output(exec.Command("git", "-C", dir, "diff", "--cached", "--name-only"))
+	if err != nil || len(staged) == 0 {
+		return false, err
+	}
+	return true, run(exec.Command("git", append([]string{"-C", dir}, commitArgs(msg, sign)...)...))
+}
+
+// Commits the roll |m| in |dir| for --auto-commit: all of its changes or, with --commit-per-step,
+// those its steps left, if any. With --use-git-notes, the roll is then noted on the commit.
+func autoCommitRoll(dir string, m *manifest, opts *rollOptions, sign bool) error {
+	msg := commitMessage(m, opts.commitSubjectPrefix, opts.bugs)
+	if m.TreeUnchanged {
+		// At most the README changed, and there is no roll commit to note.
+		committed, err := commitStaged(dir, msg, sign)
+		if err == nil && !committed {
+			log.Println("Committing nothing, as the tree is unchanged")
+		}
+		return err
+	}
+	if !opts.commitPerStep {
+		if err := commitRoll(dir, msg, sign); err != nil {
+			return err
+		}
+	} else {
+		log.Println("Committing the rest of the roll...")
+		committed, err := commitStaged(dir, msg, sign)
+		if err != nil {
+			return err
+		} else if !committed {
+			log.Println("The steps committed all of the roll's changes")
+		}
+	}
+	if opts.useGitNotes {
+		log.Println("Recording the roll in a git note on the roll commit...")
+		return addGitNote(dir, rollNote(m))
+	}
+	return nil
+}
+
+// Adds |note| as the git note of HEAD in the git checkout |dir|; replaced in tests.
+var addGitNote = func(dir, note string) error {
+	return run(exec.Command("git", "-C", dir, "notes", "add", "-m", note, "HEAD"))
+}
+
+// Returns the git note --use-git-notes records on the commit of the roll |m|, in place of the
+// revision the README would record: the upstream revisions and the commits rolled in.
+func rollNote(m *manifest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Upstream revision: %s\n", m.Revision)
+	if m.PreviousRevision != "" {
+		fmt.Fprintf(&b, "Previous upstream revision: %s\n", m.PreviousRevision)
+	}
+	if len(m.Commits) > 0 {
+		b.WriteString("\nChanges:\n")
+		for _, c := range m.Commits {
+			fmt.Fprintf(&b, "  %s %s\n", revision(c.SHA1).short(), c.Subject)
+		}
+		if more := m.CommitCount - len(m.Commits); more > 0 {
+			fmt.Fprintf(&b, "  ... and %d more\n", more)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Returns the message with which --commit-per-step commits the changes of |s|, step |i| of |n| of
+// the roll |m|: commitMessage's subject naming the step, and a body marking the commit as part of
+// the roll, which may not build until its last commit.
+func stepCommitMessage(m *manifest, s step, i, n int, prefix string, bugs []string) string {
+	var b strings.Builder
+	if prefix != "" {
+		fmt.Fprintf(&b, "[%s] ", prefix)
+	}
+	fmt.Fprintf(&b, "Roll BoringSSL %s..%s (step %d/%d: %s)\n\n%s.\n\n", revision(m.PreviousRevision).short(), revision(m.Revision).short(), i, n, s.name, s.desc)
+	fmt.Fprintf(&b, "Part of the roll from %s to %s, committed step by step for bisecting. The tree may not build until the roll's last commit.\n", m.PreviousRevision, m.Revision)
+	if len(bugs) > 0 {
+		b.WriteString("\n")
+		for _, bug := range bugs {
+			fmt.Fprintf(&b, "Bug: %s\n", bug)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Runs git push in |dir| with |args| and returns what it wrote; replaced in tests.
+var gitPush = func(dir string, args []string) (string, error) {
+	var b bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", dir, "push"}, args...)...)
+	cmd.Stdout, cmd.Stderr = &b, &b
+	err := run(cmd)
+	logOutput.Write(b.Bytes())
+	return b.String(), err
+}
+
+// Matches the URL of the review a push to refs/for/ created, as Gerrit reports it.
+var reviewURLRE = regexp.MustCompile(`(?m)^remote:\s+(https?://\S+)`)
+
+// Checks that |remote| is a remote of the git checkout |dir| and |branch| is given, for --upload.
+func checkUpload(dir, remote, branch string) error {
+	if branch == "" {
+		return fmt.Errorf("--upload requires --upload-branch, the branch the review is for")
+	}
+	if _, err := output(exec.Command("git", "-C", dir, "remote", "get-url", "--", remote)); err != nil {
+		return fmt.Errorf("--upload-remote %s is not a remote of %s: %s", remote, dir, err)
+	}
+	return nil
+}
+
+// Pushes the roll commit in |dir| to |remote| for review on |branch|, as Gerrit takes it, and
+// returns the URL of the review. The commit message, with its changelog and bug footers, becomes
+// the description.
+func uploadRoll(dir, remote, branch string) (string, error) {
+	log.Printf("Uploading the roll to %s for review on %s...", remote, branch)
+	out, err := gitPush(dir, []string{remote, "HEAD:refs/for/" + branch})
+	if err != nil {
+		return "", err
+	}
+	m := reviewURLRE.FindStringSubmatch(out)
+	if m == nil {
+		log.Printf("WARNING: git push did not report the URL of the review")
+		return "", nil
+	}
+	log.Printf("Uploaded the roll for review: %s", m[1])
+	return m[1], nil
+}
+
+// The GitHub API --roll-to-pr opens pull requests with; replaced in tests.
+var githubAPI = "https://api.github.com"
+
+// The environment variable holding the GitHub token --roll-to-pr authenticates with.
+const githubTokenEnv = "GITHUB_TOKEN"
+
+// The request to open a pull request, as the GitHub API takes it.
+type pullRequest struct {
+	Title string `json:"title"`
+	Head  string `json:"head"`
+	Base  string `json:"base"`
+	Body  string `json:"body"`
+	Draft bool   `json:"draft"`
+}
+
+// Checks the settings for --roll-to-pr: that |repo| is OWNER/NAME, that |remote| is a remote of the
+// git checkout |dir|, that |token| is set, and that the network may be used.
+func checkPullRequest(dir, remote, repo, token string) error {
+	if parts := strings.Split(repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("--roll-to-pr requires --pr-repo, the GitHub repository as OWNER/NAME; got %q", repo)
+	}
+	if token == "" {
+		return fmt.Errorf("--roll-to-pr requires a GitHub token in $%s", githubTokenEnv)
+	}
+	if noNetwork {
+		return fmt.Errorf("--no-network forbids --roll-to-pr")
+	}
+	if _, err := output(exec.Command("git", "-C", dir, "remote", "get-url", "--", remote)); err != nil {
+		return fmt.Errorf("--pr-remote %s is not a remote of %s: %s", remote, dir, err)
+	}
+	return nil
+}
+
+// Returns the markdown description of the roll recorded in |m|, linking to commits at |commitURL|
+// with {revision} replaced, for its pull request.
+func markdownReport(m *manifest, commitURL string) string {
+	link := func(sha1 string) string {
+		return fmt.Sprintf("[%s](%s)", revision(sha1).short(), strings.ReplaceAll(commitURL, "{revision}", sha1))
+	}
+	var b strings.Builder
+	if m.PreviousRevision != "" {
+		fmt.Fprintf(&b, "Rolls BoringSSL from %s to %s.\n", link(m.PreviousRevision), link(m.Revision))
+	} else {
+		fmt.Fprintf(&b, "Rolls BoringSSL to %s.\n", link(m.Revision))
+	}
+	if m.SourcesSize != 0 {
+		fmt.Fprintf(&b, "\nSize of src: %s\n", formatSizeDelta(m.PreviousSourcesSize, m.SourcesSize))
+	}
+	var security []manifestCommit
+	for _, c := range m.Commits {
+		if c.Security {
+			security = append(security, c)
+		}
+	}
+	if len(security) > 0 {
+		b.WriteString("\n### Security-relevant changes\n\n")
+		for _, c := range security {
+			fmt.Fprintf(&b, "- %s %s\n", link(c.SHA1), c.Subject)
+		}
+	}
+	if len(m.GeneratorWarnings) > 0 {
+		b.WriteString("\n### Generator warnings\n\n")
+		for _, w := range m.GeneratorWarnings {
+			fmt.Fprintf(&b, "- `%s`\n", w)
+		}
+	}
+	b.WriteString("\n### Changelog\n\n")
+	if len(m.Commits) < m.CommitCount {
+		fmt.Fprintf(&b, "Showing the first %d of %d commits.\n\n", len(m.Commits), m.CommitCount)
+	}
+	for _, c := range m.Commits {
+		fmt.Fprintf(&b, "- %s %s", link(c.SHA1), c.Subject)
+		if c.Security {
+			b.WriteString(" **(security)**")
+		}
+		b.WriteString("\n")
+	}
+	if len(m.Commits) == 0 {
+		b.WriteString("No upstream commits recorded.\n")
+	}
+	if len(m.Added) > 0 || len(m.Removed) > 0 {
+		b.WriteString("\n### Files\n\n")
+		for _, name := range m.Added {
+			fmt.Fprintf(&b, "- Added `%s`\n", name)
+		}
+		for _, name := range m.Removed {
+			fmt.Fprintf(&b, "- Removed `%s`\n", name)
+		}
+	}
+	return b.String()
+}
+
+// Opens the pull request |pr| on the GitHub repository |repo| through the API at |api|,
+// authenticating with |token|, and returns its URL.
+func openPullRequest(api, token, repo string, pr *pullRequest) (string, error) {
+	body, err := json.Marshal(pr)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the pull request: %s", err)
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(api, "/")+"/repos/"+repo+"/pulls", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to open a pull request: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to open a pull request: %s", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		URL     string `json:"html_url"`
+		Message string `json:"message"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusCreated {
+		msg := result.Message
+		for _, e := range result.Errors {
+			if e.Message != "" {
+				msg += "; " + e.Message
+			}
+		}
+		if msg == "" {
+			msg = resp.Status
+		}
+		return "", fmt.Errorf("failed to open a pull request on %s: %s", repo, msg)
+	}
+	if decodeErr != nil || result.URL == "" {
+		return "", fmt.Errorf("failed to read the URL of the pull request opened on %s: %v", repo, decodeErr)
+	}
+	return result.URL, nil
+}
+
+// Pushes the roll commit in |dir| to |branch| of |remote| and opens a draft pull request from it to
+// |base| of the GitHub repository |repo|, describing the roll recorded in |m| with |title|. Returns
+// the URL of the pull request. If the API fails, the pushed branch is left for a pull request to
+// be opened by hand; the local checkout is never changed.
+func rollToPR(dir, remote, repo, base, branch, token, title string, m *manifest, commitURL string) (string, error) {
+	log.Printf("Pushing the roll to %s of %s...", branch, remote)
+	if _, err := gitPush(dir, []string{remote, "HEAD:refs/heads/" + branch}); err != nil {
+		return "", err
+	}
+	owner := strings.SplitN(repo, "/", 2)[0]
+	pr := &pullRequest{Title: title, Head: owner + ":" + branch, Base: base, Body: markdownReport(m, commitURL), Draft: true}
+	url, err := openPullRequest(githubAPI, token, repo, pr)
+	if err != nil {
+		return "", fmt.Errorf("%s; the roll was pushed to %s of %s, from which a pull request can be opened by hand", err, branch, remote)
+	}
+	log.Printf("Opened a draft pull request for the roll: %s", url)
+	return url, nil
+}
+
+// Lays down the upstream source tree at a revision.
+type extractor interface {
+	// Writes the files of |sha1| into the empty directory |dst|.
+	extract(sha1 revision, dst string) error
+}
+
+// Extracts sources with git archive from a git checkout that has the revision.
+type gitArchiveExtractor struct {
+	dir     string // The git checkout.
+	subtree string // If set, only this directory is extracted.
+	opts    tarOptions
+
+	// If set, paths the revision marks export-ignore in .gitattributes are extracted too.
+	noExportIgnore bool
+}
+
+func (g *gitArchiveExtractor) extract(sha1 revision, dst string) error {
+	opts := g.opts
+	if opts.preserveMtime {
+		out, err := output(exec.Command("git", "-C", g.dir, "log", "-1", "--format=%ct", string(sha1), "--"))
+		if err != nil {
+			return err
+		}
+		var secs int64
+		if _, err := fmt.Sscan(string(out), &secs); err != nil {
+			return fmt.Errorf("unexpected commit time %q for %s", out, sha1.short())
+		}
+		opts.fallbackMtime = time.Unix(secs, 0)
+	}
+	gitDir := []string{"-C", g.dir}
+	if g.noExportIgnore {
+		log.Printf("Archiving %s with its export-ignore rules disabled", sha1.short())
+		raw, err := rawGitDir(g.dir)
+		if err != nil {
+			return err
+		}
+		defer removeTemp(raw)
+		gitDir = []string{"--git-dir=" + raw}
+	} else {
+		log.Printf("Archiving %s with its export-ignore rules and those of the src checkout", sha1.short())
+	}
+	cmd := exec.Command("git", append(gitDir, archiveArgs(sha1, g.subtree, g.noExportIgnore)...)...)
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = logOutput
+	if err := startTracked(cmd); err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	if err := extractTar(archive, dst, opts); err != nil {
+		waitTracked(cmd)
+		return err
+	}
+	if err := waitTracked(cmd); err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Args, err)
+	}
+	return nil
+}
+
+// Returns a temporary bare git directory that shares the objects of the git checkout in |dir| and
+// unsets export-ignore on every path. Attributes in $GIT_DIR/info/attributes take precedence over
+// the .gitattributes files of the revision being archived, so git archive of it extracts the whole
+// tree. The caller removes the directory.
+func rawGitDir(dir string) (string, error) {
+	out, err := output(exec.Command("git", "-C", dir, "rev-parse", "--path-format=absolute", "--git-common-dir"))
+	if err != nil {
+		return "", err
+	}
+	objects := filepath.Join(string(out), "objects")
+	raw, err := tempDir("", "roll_boringssl")
+	if err != nil {
+		return "", err
+	}
+	if err := run(exec.Command("git", "init", "--quiet", "--bare", raw)); err != nil {
+		removeTemp(raw)
+		return "", err
+	}
+	for name, content := range map[string]string{
+		"objects/info/alternates": objects + "\n",
+		"info/attributes":         "* -export-ignore\n",
+	} {
+		path := filepath.Join(raw, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			removeTemp(raw)
+			return "", fmt.Errorf("failed to create %s: %s", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			removeTemp(raw)
+			return "", fmt.Errorf("failed to write %s: %s", path, err)
+		}
+	}
+	return raw, nil
+}
+
+// The formats of archive --tarball-url may download. A tar.gz archive may also be an uncompressed tar.
+var archiveFormats = []string{"tar.gz", "zip"}
+
+// Extracts sources from a downloaded tarball, which may be gzipped, or zip archive after checking its
+// digest.
+type tarballExtractor struct {
+	url         string // The tarball URL, in which {revision} is replaced with the revision.
+	sha256      string // The expected hex SHA-256 digest of the tarball.
+	downloadDir string // Where partial downloads are kept to be resumed; the temporary directory if empty.
+	rateLimit   int64  // If positive, the most bytes per second to download.
+	opts        tarOptions
+	format      string // One of archiveFormats; tar.gz if empty.
+}
+
+func (t *tarballExtractor) extract(sha1 revision, dst string) error {
+	url := strings.Replace(t.url, "{revision}", string(sha1), -1)
+	if noNetwork {
+		return fmt.Errorf("the sources of %s are not in --cache-dir, and --no-network forbids downloading %s", sha1.short(), url)
+	}
+	dir := t.downloadDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	partial := filepath.Join(dir, "roll_boringssl-"+strings.ToLower(t.sha256)+".part")
+	if err := download(url, partial, t.rateLimit); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(partial)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", partial, err)
+	}
+	// Once complete, the download is never resumed, whether or not it is what was expected.
+	os.Remove(partial)
+	if sum := fmt.Sprintf("%x", sha256.Sum256(b)); sum != strings.ToLower(t.sha256) {
+		return fmt.Errorf("%s has SHA-256 %s; want %s", url, sum, t.sha256)
+	}
+	if t.format == "zip" {
+		return extractZip(b, dst, t.opts)
+	}
+	var r io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(r); err != nil {
+			return fmt.Errorf("failed to decompress %s: %s", url, err)
+		}
+	}
+	return extractTar(r, dst, t.opts)
+}
+
+// Downloads |url| to the file |partial|. If |partial| already holds the start of it from an
+// interrupted download, only the rest is requested, with a Range header; a server that does not
+// honor it sends the whole file again. If |rateLimit| is positive, the download is held to that
+// many bytes per second. If the download is interrupted again, |partial| is kept to be resumed.
+func download(url, partial string, rateLimit int64) error {
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", partial, err)
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", partial, err)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %s", url, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	log.Printf("Downloading %s...", url)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download sources: %s", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		log.Printf("Resuming the download after %d bytes", offset)
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is no shorter than the whole, so it is either complete or not the
+		// tarball; the checksum tells which.
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			log.Printf("Restarting the download, as the server does not resume it")
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate %s: %s", partial, err)
+		}
+	default:
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	var r io.Reader = resp.Body
+	if rateLimit > 0 {
+		r = &throttledReader{r: r, rate: rateLimit, start: time.Now()}
+	}
+	if n, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to download %s after %d bytes, which are kept in %s to resume: %s", url, n, partial, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %s", partial, err)
+	}
+	return nil
+}
+
+// Reads through |r| at no more than |rate| bytes per second on average.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	if due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)); due > time.Since(t.start) {
+		time.Sleep(due - time.Since(t.start))
+	}
+	return n, err
+}
+
+// Returns the extractor for the sources of a roll in |dir| with |opts|: a downloaded tarball if
+// one is given, or git archive of the src checkout. If |filter| is set, the files it leaves out
+// are not extracted.
+func newExtractor(dir string, opts *rollOptions, filter *fileFilter) extractor {
+	t := tarOptions{preserveMtime: opts.preserveMtime, bufferSize: opts.ioBuffer << 10, fileMode: opts.fileMode, dirMode: opts.dirMode,
+		maxFileSize: opts.maxFileSize << 20, allowLargeFiles: opts.allowLargeFiles, filter: filter, allowCaseCollisions: opts.allowCaseCollisions}
+	if opts.tarballURL != "" {
+		t.stripComponents = opts.stripComponents
+		return &tarballExtractor{opts.tarballURL, opts.expectedSHA256, opts.downloadDir, opts.downloadRateLimit << 10, t, opts.archiveFormat}
+	}
+	return &gitArchiveExtractor{dir: filepath.Join(dir, "src"), subtree: opts.subtree, opts: t, noExportIgnore: opts.noExportIgnore}
+}
+
+// Returns the slash-separated paths of the files under |root|, relative to it.
+func walkFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// How extractTar lays down an archive.
+type tarOptions struct {
+	// If set, files and directories get the modification time in their header, or fallbackMtime if
+	// the header has none and it is not zero, instead of the extraction time.
+	preserveMtime bool
+	fallbackMtime time.Time
+
+	// If positive, the size of the buffer the archive is read through.
+	bufferSize int
+
+	// If not zero, the permissions extracted files and directories get instead of those in their
+	// header and 0755. Files that are executable in the archive also get an execute bit for each
+	// read bit of fileMode.
+	fileMode, dirMode os.FileMode
+
+	// If positive, files larger than this many bytes are an error, or only a warning if
+	// allowLargeFiles is set.
+	maxFileSize     int64
+	allowLargeFiles bool
+
+	// If positive, this many leading components are stripped from each entry's name, like tar
+	// --strip-components. Every entry must share them.
+	stripComponents int
+
+	// If set, the files it leaves out are skipped instead of extracted.
+	filter *fileFilter
+
+	// If set, entries that differ only in case are only a warning, not an error.
+	allowCaseCollisions bool
+}
+
+// The entries of an archive extracted so far and their parent directories, by case-folded path,
+// so that extraction stops before an entry overwrites another that differs from it only in case,
+// as it would on a case-insensitive file system.
+type entryNames map[string]string
+
+// Records the archive entry |name|. It is an error if it or one of its parent directories differs
+// only in case from an entry already recorded, unless |allow| is set, when a warning is logged.
+func (seen entryNames) add(name string, allow bool) error {
+	for p := path.Clean(name); p != "." && p != "/"; p = path.Dir(p) {
+		key := strings.ToLower(p)
+		prev, ok := seen[key]
+		if !ok {
+			seen[key] = p
+			continue
+		}
+		if prev != p {
+			if !allow {
+				return fmt.Errorf("archive entries %s and %s differ only in case and would collide on case-insensitive file systems; use --allow-case-collisions to proceed", prev, p)
+			}
+			log.Printf("WARNING: archive entries %s and %s differ only in case", prev, p)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Returns the first |n| components of the slash-separated archive entry |name| and the rest of it.
+// If it has no more than |n| components, the rest is empty.
+func splitComponents(name string, n int) (prefix, rest string) {
+	parts := strings.SplitN(strings.Trim(path.Clean(name), "/"), "/", n+1)
+	if len(parts) <= n {
+		return strings.Join(parts, "/"), ""
+	}
+	return strings.Join(parts[:n], "/"), parts[n]
+}
+
+// The permissions of an extracted file that has |mode| in the archive, with |opts|.
+func (opts tarOptions) filePerm(mode os.FileMode) os.FileMode {
+	if opts.fileMode == 0 {
+		return mode.Perm()
+	}
+	if mode&0111 != 0 {
+		return opts.fileMode | opts.fileMode&0444>>2
+	}
+	return opts.fileMode
+}
+
+// A file permission flag, given in octal.
+type modeFlag os.FileMode
+
+func (f *modeFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*f))
+}
+
+func (f *modeFlag) Set(v string) error {
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0777 {
+		return fmt.Errorf("%q is not an octal permission mode like 0644", v)
+	}
+	*f = modeFlag(m)
+	return nil
+}
+
+// Gives |mode| to each of |dirs| and the directories between them and |root|.
+func chmodDirs(root string, dirs map[string]bool, mode os.FileMode) error {
+	done := make(map[string]bool)
+	for d := range dirs {
+		for ; !done[d] && strings.HasPrefix(d, root+string(filepath.Separator)); d = filepath.Dir(d) {
+			if err := os.Chmod(d, mode); err != nil {
+				return err
+			}
+			done[d] = true
+		}
+	}
+	return nil
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Returns where the archive entry |name| goes under |dst|, or an error if it is outside of |dst|.
+func entryPath(dst, name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("archive entry %q is outside the destination", name)
+	}
+	return filepath.Join(dst, filepath.FromSlash(clean)), nil
+}
+
+// Strips the leading components of archive entries, which every entry must share.
+type componentStripper struct {
+	n      int
+	prefix string // The components stripped from the first entry.
+}
+
+// Returns the archive entry |name| without its first s.n components, or an error if they differ
+// from those of the entries before it.
+func (s *componentStripper) strip(name string) (string, error) {
+	p, rest := splitComponents(name, s.n)
+	switch {
+	case s.prefix == "":
+		s.prefix = p
+		log.Printf("Stripping %s/ from the archive entries", s.prefix)
+	case p != s.prefix:
+		return "", fmt.Errorf("archive entry %q is not under %s/, the leading components of the other entries", name, s.prefix)
+	}
+	return rest, nil
+}
+
+// Writes the regular file of |size| bytes read from |r| to |target|, for the archive entry |name|
+// that has |mode|, as |opts| describes. Its directory is added to |dirs|.
+func writeExtractedFile(target, name string, size int64, mode os.FileMode, r io.Reader, opts tarOptions, dirs map[string]bool) error {
+	if opts.maxFileSize > 0 && size > opts.maxFileSize {
+		msg := fmt.Sprintf("%s is %.1f MiB, more than the --max-file-size of %.1f MiB", name, float64(size)/(1<<20), float64(opts.maxFileSize)/(1<<20))
+		if !opts.allowLargeFiles {
+			return fmt.Errorf("%s; pass --allow-large-files if it is meant to be rolled in", msg)
+		}
+		log.Printf("WARNING: %s", msg)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	dirs[filepath.Dir(target)] = true
+	perm := opts.filePerm(mode)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to extract %s: %s", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if opts.fileMode != 0 {
+		// Unlike OpenFile, Chmod is not subject to the umask.
+		if err := os.Chmod(target, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A symlink or hardlink entry, which extractTar creates after the rest of the archive.
+type tarLink struct {
+	hdr    *tar.Header
+	target string
+}
+
+// Extracts the tar archive read from |r| into |dst| as |opts| describes, logging the throughput.
+// Entries that would be written outside of |dst| are an error, as are entries that do not share the
+// leading components |opts| strips from their names.
+//
+// Extraction is in two phases: directories and regular files are written as they are read, and
+// symlinks and then hardlinks are only created once the whole archive has been, so every link is
+// made after what it refers to exists wherever it is in the archive. Directory modes and
+// modification times are applied last of all.
+func extractTar(r io.Reader, dst string, opts tarOptions) error {
+	mtime := func(hdr *tar.Header) (time.Time, bool) {
+		if !opts.preserveMtime {
+			return time.Time{}, false
+		}
+		if !hdr.ModTime.IsZero() && hdr.ModTime.Unix() != 0 {
+			return hdr.ModTime, true
+		}
+		return opts.fallbackMtime, !opts.fallbackMtime.IsZero()
+	}
+	counter := &countingReader{r: r}
+	r = counter
+	if opts.bufferSize > 0 {
+		r = bufio.NewReaderSize(r, opts.bufferSize)
+	}
+	start := time.Now()
+	tr := tar.NewReader(r)
+	dirMtimes := make(map[string]time.Time)
+	dirs := make(map[string]bool)
+	var symlinks, hardlinks []tarLink
+	stripper := &componentStripper{n: opts.stripComponents}
+	names := make(entryNames)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// Hardlinks are created before any symlink, which could lead them out of |dst|.
+			for _, l := range hardlinks {
+				old, err := entryPath(dst, l.hdr.Linkname)
+				if err != nil {
+					return fmt.Errorf("hardlink %q: %s", l.hdr.Name, err)
+				}
+				if err := os.Link(old, l.target); err != nil {
+					return fmt.Errorf("failed to extract hardlink %s: %s", l.hdr.Name, err)
+				}
+			}
+			for _, l := range symlinks {
+				if err := os.Symlink(l.hdr.Linkname, l.target); err != nil {
+					return err
+				}
+			}
+			if opts.dirMode != 0 {
+				if err := chmodDirs(dst, dirs, opts.dirMode); err != nil {
+					return err
+				}
+			}
+			// Directories are stamped last, as extracting their contents modifies them.
+			for target, t := range dirMtimes {
+				if err := os.Chtimes(target, t, t); err != nil {
+					return err
+				}
+			}
+			elapsed := time.Since(start)
+			log.Printf("Extracted %.1f MiB in %s (%.1f MiB/s)", float64(counter.n)/(1<<20), elapsed.Round(time.Millisecond), float64(counter.n)/(1<<20)/elapsed.Seconds())
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+		name := hdr.Name
+		if opts.stripComponents > 0 && hdr.Typeflag != tar.TypeXGlobalHeader {
+			if name, err = stripper.strip(hdr.Name); err != nil {
+				return err
+			}
+			if name == "" {
+				if hdr.Typeflag != tar.TypeDir {
+					return fmt.Errorf("archive entry %q has no more than the %d components --strip-components strips", hdr.Name, opts.stripComponents)
+				}
+				continue
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				if hdr.Linkname, err = stripper.strip(hdr.Linkname); err != nil {
+					return fmt.Errorf("hardlink %q: %s", hdr.Name, err)
+				}
+			}
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeXGlobalHeader && opts.filter != nil && opts.filter.excluded(path.Clean(name)) {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			if err := names.add(name, opts.allowCaseCollisions); err != nil {
+				return err
+			}
+		}
+		target, err := entryPath(dst, name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs[target] = true
+			if t, ok := mtime(hdr); ok {
+				dirMtimes[target] = t
+			}
+		case tar.TypeReg:
+			if err := writeExtractedFile(target, hdr.Name, hdr.Size, os.FileMode(hdr.Mode), tr, opts, dirs); err != nil {
+				return err
+			}
+			if t, ok := mtime(hdr); ok {
+				if err := os.Chtimes(target, t, t); err != nil {
+					return err
+				}
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dirs[filepath.Dir(target)] = true
+			symlinks = append(symlinks, tarLink{hdr, target})
+		case tar.TypeLink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dirs[filepath.Dir(target)] = true
+			hardlinks = append(hardlinks, tarLink{hdr, target})
+		case tar.TypeXGlobalHeader:
+			// git archive records the commit in a global header.
+		default:
+			return fmt.Errorf("archive entry %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// Extracts the zip archive |b| into |dst| as extractTar does a tar archive, with the same checks
+// that entries stay within |dst| and share the leading components |opts| strips. Symlinks are
+// created once the rest of the archive has been; zip archives have no hardlinks.
+func extractZip(b []byte, dst string, opts tarOptions) error {
+	start := time.Now()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %s", err)
+	}
+	mtime := func(f *zip.File) (time.Time, bool) {
+		if !opts.preserveMtime {
+			return time.Time{}, false
+		}
+		if !f.Modified.IsZero() {
+			return f.Modified, true
+		}
+		return opts.fallbackMtime, !opts.fallbackMtime.IsZero()
+	}
+	dirMtimes := make(map[string]time.Time)
+	dirs := make(map[string]bool)
+	type zipLink struct{ linkname, target string }
+	var symlinks []zipLink
+	stripper := &componentStripper{n: opts.stripComponents}
+	names := make(entryNames)
+	for _, f := range zr.File {
+		mode := f.Mode()
+		name := f.Name
+		if opts.stripComponents > 0 {
+			if name, err = stripper.strip(f.Name); err != nil {
+				return err
+			}
+			if name == "" {
+				if !mode.IsDir() {
+					return fmt.Errorf("archive entry %q has no more than the %d components --strip-components strips", f.Name, opts.stripComponents)
+				}
+				continue
+			}
+		}
+		if !mode.IsDir() && opts.filter != nil && opts.filter.excluded(path.Clean(name)) {
+			continue
+		}
+		if err := names.add(name, opts.allowCaseCollisions); err != nil {
+			return err
+		}
+		target, err := entryPath(dst, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs[target] = true
+			if t, ok := mtime(f); ok {
+				dirMtimes[target] = t
+			}
+		case mode.IsRegular():
+			r, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %s", f.Name, err)
+			}
+			err = writeExtractedFile(target, f.Name, int64(f.UncompressedSize64), mode, r, opts, dirs)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if t, ok := mtime(f); ok {
+				if err := os.Chtimes(target, t, t); err != nil {
+					return err
+				}
+			}
+		case mode&os.ModeSymlink != 0:
+			// A zip archive stores the target of a symlink as its contents.
+			r, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %s", f.Name, err)
+			}
+			linkname, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %s", f.Name, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dirs[filepath.Dir(target)] = true
+			symlinks = append(symlinks, zipLink{string(linkname), target})
+		default:
+			return fmt.Errorf("archive entry %q has unsupported mode %s", f.Name, mode)
+		}
+	}
+	for _, l := range symlinks {
+		if err := os.Symlink(l.linkname, l.target); err != nil {
+			return err
+		}
+	}
+	if opts.dirMode != 0 {
+		if err := chmodDirs(dst, dirs, opts.dirMode); err != nil {
+			return err
+		}
+	}
+	for target, t := range dirMtimes {
+		if err := os.Chtimes(target, t, t); err != nil {
+			return err
+		}
+	}
+	elapsed := time.Since(start)
+	log.Printf("Extracted %.1f MiB in %s (%.1f MiB/s)", float64(len(b))/(1<<20), elapsed.Round(time.Millisecond), float64(len(b))/(1<<20)/elapsed.Seconds())
+	return nil
+}
+
+// Returns the differences between the files under |want| and |got|, ignoring the paths for which
+// |skip| returns true. Paths are slash-separated and relative to the roots, and each difference is
+// described as "missing", "unexpected", or "modified".
+func diffDirs(want, got string, skip func(name string) bool) ([]string, error) {
+	list := func(root string) (map[string]os.FileInfo, error) {
+		files := make(map[string]os.FileInfo)
+		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if skip(name) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() {
+				files[name] = info
+			}
+			return nil
+		})
+		return files, err
+	}
+	wantFiles, err := list(want)
+	if err != nil {
+		return nil, err
+	}
+	gotFiles, err := list(got)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	for name, w := range wantFiles {
+		g, ok := gotFiles[name]
+		if !ok {
+			diffs = append(diffs, "missing: "+name)
+			continue
+		}
+		same, err := sameFile(filepath.Join(want, name), w, filepath.Join(got, name), g)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			diffs = append(diffs, "modified: "+name)
+		}
+	}
+	for name := range gotFiles {
+		if _, ok := wantFiles[name]; !ok {
+			diffs = append(diffs, "unexpected: "+name)
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// Returns whether the files at |a| and |b| have the same type, executable bit, and contents.
+func sameFile(a string, ai os.FileInfo, b string, bi os.FileInfo) (bool, error) {
+	if ai.Mode().Type() != bi.Mode().Type() || ai.Mode()&0111 != bi.Mode()&0111 {
+		return false, nil
+	}
+	if ai.Mode()&os.ModeSymlink != 0 {
+		al, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		bl, err := os.Readlink(b)
+		return al == bl, err
+	}
+	if ai.Size() != bi.Size() {
+		return false, nil
+	}
+	ab, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
+
+// Returns the git arguments that archive |subtree| of |sha1|, or all of it if |subtree| is empty.
+// Unless |noExportIgnore| is set, the attributes of the working tree apply as well as those of the
+// revision.
+func archiveArgs(sha1 revision, subtree string, noExportIgnore bool) []string {
+	args := []string{"archive", "--format=tar"}
+	if !noExportIgnore {
+		args = append(args, "--worktree-attributes")
+	}
+	args = append(args, string(sha1))
+	if subtree != "" {
+		args = append(args, "--", subtree)
+	}
+	return args
+}
+
+// The most differences verifySources names in its error; all are logged.
+const maxReportedDiffs = 10
+
+// Checks that the sources in |dir| are exactly the upstream revision recorded in the README, less
+// the paths |opts| leaves out. The revision is extracted as a roll with |opts| would extract it
+// and compared file by file, so local commits and uncommitted changes in src are both caught.
+// Nothing is fetched: unless |opts| downloads a tarball, the revision must already be in src.
+func verifySources(dir string, opts *rollOptions) error {
+	subtree, excludes := opts.subtree, opts.excludes
+	sha1, err := readReadMeRevision(dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Verifying that src matches %s...", sha1.short())
+	if opts.tarballURL == "" {
+		if _, err := output(exec.Command("git", "-C", filepath.Join(dir, "src"), "cat-file", "-e", string(sha1)+"^{commit}")); err != nil {
+			return fmt.Errorf("%s, the revision in %s, is not in the src checkout, and verifying does not fetch it", sha1, readmeName)
+		}
+	}
+	tmp, err := tempDir("", "roll_boringssl")
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmp)
+
+	src := filepath.Join(dir, "src")
+	if err := newExtractor(dir, opts, nil).extract(sha1, tmp); err != nil {
+		return err
+	}
+
+	diffs, err := diffDirs(tmp, src, func(name string) bool {
+		if name == ".git" || opts.writeChecksums && name == checksumsName || !inSubtree(subtree, name) && !strings.HasPrefix(subtree, name+"/") {
+			return true
+		}
+		if matchAny(opts.includeTests, name) {
+			return false
+		}
+		if len(opts.includeTests) > 0 {
+			// An excluded directory may still hold included files, so only files are left out.
+			if info, err := os.Lstat(filepath.Join(tmp, filepath.FromSlash(name))); err == nil && info.IsDir() {
+				return false
+			}
+		}
+		return matchAny(excludes, name)
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		log.Printf("src differs from %s: %s", sha1.short(), d)
+	}
+	if len(diffs) > 0 {
+		listed := diffs
+		if len(listed) > maxReportedDiffs {
+			listed = append(listed[:maxReportedDiffs:maxReportedDiffs], fmt.Sprintf("and %d more", len(diffs)-maxReportedDiffs))
+		}
+		return fmt.Errorf("src has %d differences from %s: %s", len(diffs), sha1, strings.Join(listed, ", "))
+	}
+	log.Printf("src matches %s", sha1)
+	return nil
+}
+
+// A vendored library that --projects rolls. Empty fields take the settings of the command line, so
+// an entry with only a name rolls BoringSSL as the roller otherwise would.
+type project struct {
+	Name        string `json:"name"`
+	Dir         string `json:"dir,omitempty"`          // The directory holding src and the README; the boringssl directory if empty.
+	UpstreamURL string `json:"upstream_url,omitempty"` // As with --upstream-url.
+	Commit      string `json:"commit,omitempty"`       // As with --commit.
+	Generator   string `json:"generator,omitempty"`    // As with --generator-script.
+	ReadMe      string `json:"readme,omitempty"`       // The README in Dir to record the revision in.
+}
+
+// Reads the JSON list of projects at |path|. Their relative directories and generators are resolved
+// against the directory of |path|, except that a project without a directory is in |dir|.
+func readProjects(path, dir string) ([]project, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	var projects []project
+	if err := json.Unmarshal(b, &projects); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if len(projects) == 0 {
+		return nil, fmt.Errorf("%s lists no projects", path)
+	}
+	base := filepath.Dir(path)
+	seen := make(map[string]bool)
+	for i := range projects {
+		p := &projects[i]
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("%s: project %d has no name", path, i+1)
+		case seen[p.Name]:
+			return nil, fmt.Errorf("%s: project %q is listed twice", path, p.Name)
+		}
+		seen[p.Name] = true
+		if p.Dir == "" {
+			p.Dir = dir
+		} else if !filepath.IsAbs(p.Dir) {
+			p.Dir = filepath.Join(base, p.Dir)
+		}
+		if p.Generator != "" {
+			if !filepath.IsAbs(p.Generator) {
+				p.Generator = filepath.Join(base, p.Generator)
+			}
+			if p.Generator, err = checkGeneratorScript(p.Generator); err != nil {
+				return nil, fmt.Errorf("%s: project %q: %s", path, p.Name, err)
+			}
+		}
+	}
+	return projects, nil
 }
 
-// Updates BoringSSL sources and returns the revision.
-func updateSources(dir, commit string) []byte {
-	log.Println("Updating BoringSSL sources...")
-	dir = filepath.Join(dir, "src")
-	{
-		cmd := exec.Command("git", "-C", dir, "fetch", "--all", "--prune")
-		if err := cmd.Run(); err != nil {
-			log.Fatalf("%s failed: %s", cmd.Args, err)
+// The outcome of rolling one of --projects.
+type projectResult struct {
+	name     string
+	revision revision
+	err      error
+}
+
+// Rolls each of |projects| with |opts| and the project's own settings, committing each roll if
+// |opts| auto-commits. Unless |continueOnError| is set, the projects after one that fails are not
+// rolled and have no result.
+func rollProjects(projects []project, opts *rollOptions, continueOnError, sign bool) []projectResult {
+	defaultReadMe := readmeName
+	defer func() { readmeName = defaultReadMe }()
+	var results []projectResult
+	for _, p := range projects {
+		log.Printf("Rolling %s in %s...", p.Name, p.Dir)
+		inner := *opts
+		if p.UpstreamURL != "" {
+			inner.upstreamURL = p.UpstreamURL
+		}
+		if p.Commit != "" {
+			inner.commit = p.Commit
+		}
+		if p.Generator != "" {
+			inner.generatorScript = p.Generator
+		}
+		readmeName = defaultReadMe
+		if p.ReadMe != "" {
+			readmeName = p.ReadMe
+		}
+		result := projectResult{name: p.Name}
+		m, err := roll(p.Dir, &inner)
+		if err == nil && inner.autoCommit {
+			err = autoCommitRoll(p.Dir, m, &inner, sign)
+		}
+		if err != nil {
+			log.Printf("Rolling %s failed: %s", p.Name, err)
+			result.err = err
+		} else {
+			result.revision = revision(m.Revision)
+		}
+		results = append(results, result)
+		if err != nil && !continueOnError {
+			break
 		}
 	}
-	{
-		cmd := exec.Command("git", "-C", dir, "checkout", commit)
-		if err := cmd.Run(); err != nil {
-			log.Fatalf("%s failed: %s", cmd.Args, err)
+	return results
+}
+
+// Writes a line for each of |results| to |w|, noting the |total| projects that were not rolled,
+// and returns whether every project was rolled.
+func printProjectResults(w io.Writer, results []projectResult, total int) bool {
+	ok := len(results) == total
+	for _, r := range results {
+		if r.err != nil {
+			ok = false
+			fmt.Fprintf(w, "[fail] %s: %s\n", r.name, r.err)
+		} else {
+			fmt.Fprintf(w, "[ok]   %s: rolled to %s\n", r.name, r.revision.short())
 		}
 	}
-	{
-		cmd := exec.Command("git", "-C", dir, "rev-parse", commit)
-		out, err := cmd.Output()
+	if len(results) < total {
+		fmt.Fprintf(w, "%d projects were not rolled after the failure; pass --continue-on-error to roll them anyway\n", total-len(results))
+	}
+	return ok
+}
+
+// The outcome of a roll run by the server.
+type rollResult struct {
+	Revision   string    `json:"revision,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	FailedStep string    `json:"failed_step,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+}
+
+// Runs rolls on request, for using the roller as a long-lived service.
+type server struct {
+	dir  string
+	opts rollOptions
+	roll func(dir string, opts *rollOptions) (*manifest, error) // roll, but replaced in tests.
+
+	mu      sync.Mutex
+	running bool
+	last    *rollResult
+}
+
+// Starts a roll in the background unless one is already running. Returns whether it started.
+func (s *server) start(opts rollOptions) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	go func() {
+		result := &rollResult{Started: time.Now()}
+		m, err := s.roll(s.dir, &opts)
+		result.Finished = time.Now()
 		if err != nil {
-			log.Fatalf("%s failed: %s", cmd.Args, err)
+			log.Printf("Roll failed: %s", err)
+			result.Error = err.Error()
+			result.FailedStep = failedStep(err)
+		} else {
+			result.Revision = m.Revision
 		}
-		return bytes.TrimSpace(out)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = false
+		s.last = result
+	}()
+	return true
+}
+
+// Writes |v| to |w| as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %s", err)
 	}
 }
 
-// Create the GN build files for the current sources.
-func generateGN(dir string) {
-	log.Printf("Generating build files...")
-	cmd := exec.Command("python", filepath.Join("src", "util", "generate_build_files.py"), "gn")
-	cmd.Dir = dir
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("%s failed: %s", cmd.Args, err)
+// Reports whether a roll is running and the result of the last one.
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, struct {
+		Running bool        `json:"running"`
+		Last    *rollResult `json:"last"`
+	}{s.running, s.last})
+}
+
+// Starts a roll in response to a POST.
+func (s *server) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
 	}
+	if !s.start(s.opts) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a roll is already running"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]bool{"started": true})
 }
 
-// Regenerates the Rust bindings.
-func generateRustBindings(dir string) {
-	log.Printf("Generating Rust bindings...")
-	cmd := exec.Command(filepath.Join("rust", "boringssl-sys", "bindgen.sh"))
-	cmd.Dir = dir
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("%s failed: %s", cmd.Args, err)
+// Returns the HTTP handler for the server's endpoints.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/trigger", s.handleTrigger)
+	return mux
+}
+
+// Serves the roll endpoints on |addr|. If |poll| is non-zero, a roll is also started every
+// |poll| and is skipped if upstream has not advanced past the current sources.
+func serve(dir string, opts rollOptions, addr string, poll time.Duration) error {
+	s := &server{dir: dir, opts: opts, roll: roll}
+	if poll > 0 {
+		go func() {
+			polled := opts
+			polled.skipIfCurrent = true
+			for range time.Tick(poll) {
+				s.start(polled)
+			}
+		}()
 	}
+	log.Printf("Serving on %s...", addr)
+	return http.ListenAndServe(addr, s.handler())
 }
 
-// Updates the README file that ends with the current upstream git revision.
-func updateReadMe(dir string, sha1 []byte) {
-	const readmeName = "README.fuchsia"
-	log.Printf("Updating %s...", readmeName)
-	readme, err := os.OpenFile(filepath.Join(dir, readmeName), os.O_RDWR, 0644)
+// The longest --watch waits after failed polls, as a multiple of the poll interval.
+const maxWatchBackoff = 8
+
+// Rolls whenever upstream advances, for --watch.
+type watcher struct {
+	interval time.Duration
+	resolve  func() (revision, error) // Fetches and returns the revision the target resolves to.
+	current  func() (revision, error) // Returns the revision of the sources.
+	roll     func() error
+}
+
+// Checks upstream once and rolls if it has advanced past the sources, returning whether it rolled.
+func (w *watcher) poll() (bool, error) {
+	sha1, err := w.resolve()
 	if err != nil {
-		log.Fatalf("failed to open %s: %s", readmeName, err)
+		return false, err
 	}
-	defer func() {
-		if err := readme.Close(); err != nil {
-			log.Fatalf("failed to close %s: %s", readmeName, err)
+	current, err := w.current()
+	if err != nil {
+		return false, err
+	}
+	if sha1 == current {
+		log.Printf("Upstream is still at %s", sha1.short())
+		return false, nil
+	}
+	log.Printf("Upstream advanced from %s to %s; rolling", current.short(), sha1.short())
+	return true, w.roll()
+}
+
+// Polls every interval until |stop| is closed. After a failed poll, the wait doubles up to
+// maxWatchBackoff intervals.
+func (w *watcher) run(stop <-chan struct{}) {
+	wait := w.interval
+	for {
+		if _, err := w.poll(); err != nil {
+			if wait *= 2; wait > maxWatchBackoff*w.interval {
+				wait = maxWatchBackoff * w.interval
+			}
+			log.Printf("Poll failed: %s; trying again in %s", err, wait)
+		} else {
+			wait = w.interval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
 		}
+	}
+}
+
+// Re-rolls the sources in |dir| with |opts| whenever upstream advances, checking every |interval|,
+// until interrupted. An interrupt waits for the poll or roll in progress, so the roll lock is
+// released; a second interrupt exits at once.
+func watch(dir string, opts *rollOptions, interval time.Duration, sign bool) {
+	w := &watcher{
+		interval: interval,
+		resolve:  func() (revision, error) { return resolveCommit(dir, opts) },
+		current:  func() (revision, error) { return sourcesRevision(dir, opts) },
+		roll: func() error {
+			m, err := roll(dir, opts)
+			if err != nil || !opts.autoCommit {
+				return err
+			}
+			return autoCommitRoll(dir, m, opts, sign)
+		},
+	}
+	stop := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		log.Println("Interrupted; stopping after the current poll (interrupt again to exit now)")
+		close(stop)
 	}()
+	log.Printf("Watching upstream every %s...", interval)
+	w.run(stop)
+	log.Println("Stopped watching")
+}
+
+// The README line the "README revision" self test parses; a variable, so a test can corrupt it.
+var readmeFixture = "Source: https://fuchsia.googlesource.com/third_party/boringssl/+/d5aae81fb79f5174ad348890b49a6c8f2d250c26/\n"
+
+// An offline check of one of the roller's parsers against embedded fixtures, for --selftest.
+type selfTest struct {
+	name string
+	run  func() error
+}
 
-	// Assume that the file ends with a git URL.
-	info, err := readme.Stat()
+var selfTests = []selfTest{
+	{"bindgen version", func() error {
+		for in, want := range map[string]string{
+			"bindgen 0.53.2":            "0.53.2",
+			"bindgen v0.59.1":           "0.59.1",
+			"bindgen 0.60.1 (a1b2c3)\n": "0.60.1",
+		} {
+			if got, ok := parseBindgenVersion(in); !ok || got != want {
+				return fmt.Errorf("parseBindgenVersion(%q) = %q, %t; want %q", in, got, ok, want)
+			}
+		}
+		if got, ok := parseBindgenVersion("bindgen"); ok {
+			return fmt.Errorf("parseBindgenVersion(%q) = %q; want failure", "bindgen", got)
+		}
+		return nil
+	}},
+	{"bindgen.sh pin", func() error {
+		const script = "set -e\nBINDGEN_EXPECTED_VERSION=\"bindgen 0.53.2\"\nBINDGEN_GOT_VERSION=\"$(bindgen --version)\"\n"
+		m := bindgenPinRE.FindStringSubmatch(script)
+		if m == nil || m[1] != "bindgen 0.53.2" {
+			return fmt.Errorf("failed to find the pinned version in %q", script)
+		}
+		return nil
+	}},
+	{"revision", func() error {
+		const full = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		if r, err := parseRevision(full); err != nil || r.short() != full[:12] {
+			return fmt.Errorf("parseRevision(%q) = %q, %v", full, r, err)
+		}
+		for _, bad := range []string{full[:12], strings.ToUpper(full), "origin/upstream/master", ""} {
+			if _, err := parseRevision(bad); err == nil {
+				return fmt.Errorf("parseRevision(%q) succeeded; want failure", bad)
+			}
+		}
+		return nil
+	}},
+	{"exclude globs", func() error {
+		for _, c := range []struct {
+			pattern, name string
+			want          bool
+		}{
+			{"*.md", "README.md", true},
+			{"*.md", "crypto/README.md", false},
+			{"docs", "docs/a/b.txt", true},
+			{"crypto/*/asm", "crypto/fipsmodule/asm/x.pl", true},
+			{"crypto/fipsmodule", "crypto/fipsmodule.c", false},
+		} {
+			if got := matchPath(c.pattern, c.name); got != c.want {
+				return fmt.Errorf("matchPath(%q, %q) = %t; want %t", c.pattern, c.name, got, c.want)
+			}
+		}
+		if got, want := sparsePatternEscaper.Replace("a/[b]*.c"), `a/\[b]\*.c`; got != want {
+			return fmt.Errorf("escaped sparse pattern is %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"case collisions", func() error {
+		got := caseCollisions([]string{"include/openssl/ssl.h", "Include/x.h", "crypto/a.c", "crypto/A.c", "ssl/a.c"})
+		want := [][]string{{"crypto/A.c", "crypto/a.c"}, {"Include", "include"}}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("caseCollisions = %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"security changelog", func() error {
+		commits := []commit{
+			{sha1: "1111111111111111111111111111111111111111", subject: "Fix a buffer overrun in X509 parsing", body: "This is CVE-2023-0001."},
+			{sha1: "2222222222222222222222222222222222222222", subject: "Add a test"},
+		}
+		security, err := securityRE(defaultSecurityKeywords)
+		if err != nil {
+			return err
+		}
+		text, relevant := formatChangelog(plainChangelog{}, "3333333333333333333333333333333333333333", commits[0].sha1, commits, len(commits), "", security, nil, nil)
+		if len(relevant) != 1 || relevant[0].sha1 != commits[0].sha1 {
+			return fmt.Errorf("security-relevant commits are %v; want only %s", relevant, commits[0].sha1)
+		}
+		const want = "Security-relevant changes:\n  111111111111 Fix a buffer overrun in X509 parsing\n\nChanges:\n"
+		if !strings.Contains(text, want) {
+			return fmt.Errorf("changelog %q does not contain %q", text, want)
+		}
+		return nil
+	}},
+	{"include tests", func() error {
+		files := []string{"crypto/a.c", "crypto/test/test_util.cc", "crypto/test/abi_test.cc", "ssl/ssl_test.cc"}
+		kept, excluded, err := excludeFiles(files, []string{"*/*_test.cc", "crypto/test"}, []string{"crypto/test/test_util.cc"})
+		if err != nil {
+			return err
+		}
+		if want := "[crypto/a.c crypto/test/test_util.cc]"; fmt.Sprint(kept) != want {
+			return fmt.Errorf("kept %q; want %s", kept, want)
+		}
+		if want := "[crypto/test/abi_test.cc ssl/ssl_test.cc]"; fmt.Sprint(excluded) != want {
+			return fmt.Errorf("excluded %q; want %s", excluded, want)
+		}
+		return nil
+	}},
+	{"subtree", func() error {
+		const sha1 = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		if got, want := archiveArgs(sha1, "crypto/fipsmodule", false), []string{"archive", "--format=tar", "--worktree-attributes", sha1, "--", "crypto/fipsmodule"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("archiveArgs = %q; want %q", got, want)
+		}
+		files := []string{"crypto/a.c", "crypto/fipsmodule/bcm.c", "crypto/fipsmodule.c", "ssl/s.c"}
+		if got, err := subtreeFiles(files, "crypto/fipsmodule"); err != nil || fmt.Sprint(got) != "[crypto/fipsmodule/bcm.c]" {
+			return fmt.Errorf("subtreeFiles = %q, %v; want only crypto/fipsmodule/bcm.c", got, err)
+		}
+		for _, bad := range []string{"rust", "ssl/s.c", "../ssl", "/ssl", "ssl/"} {
+			if _, err := subtreeFiles(files, bad); err == nil {
+				return fmt.Errorf("subtreeFiles(%q) succeeded; want failure", bad)
+			}
+		}
+		return nil
+	}},
+	{"min age", func() error {
+		commits, err := parseTimestamps("1700600000 3333333333333333333333333333333333333333\n1700000000 2222222222222222222222222222222222222222\n1699000000 1111111111111111111111111111111111111111\n")
+		if err != nil {
+			return err
+		}
+		now := time.Unix(1700000000, 0).Add(7 * 24 * time.Hour)
+		if c, ok := newestOlderThan(commits, now, 7*24*time.Hour); !ok || c.sha1 != commits[1].sha1 {
+			return fmt.Errorf("newestOlderThan = %s, %t; want %s", c.sha1, ok, commits[1].sha1)
+		}
+		if c, ok := newestOlderThan(commits, now, 30*24*time.Hour); ok {
+			return fmt.Errorf("newestOlderThan = %s; want no commit", c.sha1)
+		}
+		return nil
+	}},
+	{"absolute paths", func() error {
+		const gni = `crypto_sources = [
+  "//third_party/boringssl/src/crypto/a.c",
+  "src/crypto/b.c",
+  "/home/dev/fuchsia/third_party/boringssl/src/crypto/c.c",
+  "C:\\fuchsia\\src\\crypto\\d.c",
+]
+# Generated in /work/boringssl
+`
+		var got []string
+		for _, m := range forbiddenLines(gni, "/work/boringssl", []*regexp.Regexp{absolutePathRE}) {
+			got = append(got, fmt.Sprintf("%d: %s", m.line, m.text))
+		}
+		want := []string{
+			`4: "/home/dev/fuchsia/third_party/boringssl/src/crypto/c.c",`,
+			`5: "C:\\fuchsia\\src\\crypto\\d.c",`,
+			`7: # Generated in /work/boringssl`,
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("forbiddenLines = %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"README revision", func() error {
+		if m := readmeRevisionRE.FindStringSubmatch(readmeFixture); m == nil || m[1] != "d5aae81fb79f5174ad348890b49a6c8f2d250c26" {
+			return fmt.Errorf("failed to find the revision in %q", readmeFixture)
+		}
+		return nil
+	}},
+}
+
+// Runs the self tests, logging each result, and returns whether they all passed.
+func selftest() bool {
+	ok := true
+	for _, t := range selfTests {
+		if err := t.run(); err != nil {
+			log.Printf("FAIL %s: %s", t.name, err)
+			ok = false
+		} else {
+			log.Printf("PASS %s", t.name)
+		}
+	}
+	return ok
+}
+
+// The environment variable naming the commit-ish to roll to if --commit is not given.
+const commitEnv = "BORINGSSL_ROLL_COMMIT"
+
+// Sets the commit of |opts| to |env|, the value of $BORINGSSL_ROLL_COMMIT, unless --commit or a
+// plan set it, recording in |sources| where the commit came from.
+func setTargetCommit(opts *rollOptions, sources map[string]string, env string) {
+	if env != "" && sources["commit"] != "flag" && sources["commit"] != "plan" {
+		opts.commit = env
+		sources["commit"] = "env"
+	}
+	if opts.upstreamURL != "" && sources["commit"] == "" {
+		// The default names a remote-tracking branch, which the upstream repository lacks.
+		opts.commit = "master"
+	}
+}
+
+// Returns where each flag given on the command line was set from.
+func flagSources() map[string]string {
+	sources := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	return sources
+}
+
+// Applies the settings in the JSON config file at |path| to the flags that |sources| does not
+// already have a source for. The file is an object mapping flag names to values; repeatable flags
+// take an array.
+func applyConfig(path string, sources map[string]string) error {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("failed to stat %s: %s", readmeName, err)
+		return fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var config map[string]interface{}
+	if err := d.Decode(&config); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return applySettings(path, config, sources, "config")
+}
+
+// Sets the flags named in |settings|, which were read from |origin|, to their values, except for
+// those given on the command line. Each flag set is recorded in |sources| as set from |source|.
+func applySettings(origin string, settings map[string]interface{}, sources map[string]string, source string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", origin, name)
+		}
+		if sources[name] == "flag" {
+			continue
+		}
+		values, ok := settings[name].([]interface{})
+		if object, isObject := settings[name].(map[string]interface{}); isObject {
+			// An object, like that of --step-timeout, is a KEY=VALUE setting of each of its keys.
+			keys := make([]string, 0, len(object))
+			for k := range object {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				values = append(values, k+"="+fmt.Sprint(object[k]))
+			}
+		} else if !ok {
+			values = []interface{}{settings[name]}
+		}
+		for _, v := range values {
+			if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: invalid value for %q: %s", origin, name, err)
+			}
+		}
+		sources[name] = source
+	}
+	return nil
+}
+
+// Returns the value of |f| as it is written in a config file.
+func flagValue(f *flag.Flag) interface{} {
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch v := g.Get().(type) {
+		case bool, []string, map[string]string:
+			return v
+		}
+	}
+	return f.Value.String()
+}
+
+// Prints the value of every flag and where it was set from as JSON.
+func printConfig(sources map[string]string) error {
+	type setting struct {
+		Value  interface{} `json:"value"`
+		Source string      `json:"source"`
 	}
-	offset := info.Size() - int64(len(sha1)+2 /* trailing newlines */)
-	if _, err = readme.WriteAt(sha1, offset); err != nil {
-		log.Fatalf("failed to write to %s: %s", readmeName, err)
+	settings := make(map[string]setting)
+	flag.VisitAll(func(f *flag.Flag) {
+		source := sources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		settings[f.Name] = setting{flagValue(f), source}
+	})
+	b, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
 	}
+	fmt.Printf("%s\n", b)
+	return nil
 }
 
 func main() {
-	commit := flag.String("commit", "origin/upstream/master", "Upstream commit-ish to check out")
+	os.Exit(rollMain())
+}
+
+// Parses the command line and does what it asks, returning the exit status.
+func rollMain() (status int) {
+	var opts rollOptions
+	flag.StringVar(&opts.commit, "commit", "origin/upstream/master", "Upstream commit-ish to check out; overrides $"+commitEnv)
+	flag.Var((*stringsFlag)(&opts.commitFallbacks), "commit-fallback", "A commit-ish to try when the default --commit does not exist, in order (may be repeated; default: "+strings.Join(defaultCommitFallbacks, ", ")+")")
+	flag.Var((*stringsFlag)(&opts.branches), "branches", "Instead of --commit, an upstream branch to roll from together with the others given (may be repeated)")
+	flag.StringVar(&opts.branchStrategy, "branch-strategy", defaultBranchStrategy, "With --branches, how to choose the commit: "+defaultBranchStrategy+" rolls to the newest commit merged into every branch")
+	flag.StringVar(&opts.upstreamURL, "upstream-url", "", "If set, fetch --commit from this repository URL instead of fetching all remotes of src")
+	flag.StringVar(&opts.cacheDir, "cache-dir", "", "A directory in which to keep the sources extracted from archives, as with --tarball-url, to reuse when the same revision is extracted with the same options")
+	flag.IntVar(&opts.cacheMaxEntries, "cache-max-entries", 8, "With --cache-dir, how many extracted trees to keep, evicting the least recently used; 0 keeps any number")
+	flag.Int64Var(&opts.cacheMaxSize, "cache-max-size", 0, "With --cache-dir, the MiB the extracted trees may take up in all, evicting the least recently used; 0 is unlimited")
+	flag.StringVar(&opts.cargoUpdateDir, "cargo-update-dir", "", "The directory, relative to the boringssl directory unless absolute, of a crate whose Cargo.lock to update with cargo update -p "+cargoPackage+" when the Rust bindings change")
+	flag.StringVar(&opts.tarballURL, "tarball-url", "", "Extract src from the tarball at this URL, with {revision} replaced by --commit, instead of checking it out with git (e.g. https://boringssl.googlesource.com/boringssl/+archive/{revision}.tar.gz)")
+	flag.BoolVar(&opts.preserveMtime, "preserve-mtime", false, "With --tarball-url, give extracted files the modification time recorded in the tarball instead of the extraction time")
+	flag.StringVar(&opts.casDir, "cas-dir", "", "If set, hardlink each file in src into this content-addressed store as HH/SHA256, skipping those already there")
+	flag.StringVar(&opts.casManifest, "cas-manifest", "", "Write a sorted listing of the SHA-256 of each file in src here (default with --cas-dir: manifests/<revision> in it)")
+	flag.BoolVar(&opts.checksumGenerated, "include-generated-in-manifest", false, "With --write-manifest, also list the generated build files and Rust bindings, once they are generated, as ../PATH")
+	flag.BoolVar(&opts.writeChecksums, "write-manifest", false, "After checking out the sources, write the SHA-256 digest of each file in src, sorted by path, to src/"+checksumsName)
+	flag.BoolVar(&opts.noExportIgnore, "no-export-ignore", false, "When extracting with git archive, as --verify-only does, include the paths .gitattributes marks export-ignore")
+	flag.Var((*modeFlag)(&opts.fileMode), "file-mode", "Octal permissions for files extracted from an archive, as with --tarball-url, instead of those in the archive; executable files also get an execute bit for each read bit")
+	flag.Var((*modeFlag)(&opts.dirMode), "dir-mode", "Octal permissions for directories extracted from an archive instead of 0755")
+	flag.Int64Var(&opts.maxFileSize, "max-file-size", 64, "MiB that no single file extracted into src may exceed, to catch large blobs added upstream; 0 allows any size")
+	flag.BoolVar(&opts.allowLargeFiles, "allow-large-files", false, "Only warn about files larger than --max-file-size instead of failing the roll")
+	flag.StringVar(&opts.downloadDir, "download-dir", "", "With --tarball-url, where to keep a partial download to resume on the next roll (default: the temporary directory)")
+	flag.Int64Var(&opts.downloadRateLimit, "download-rate-limit", 0, "With --tarball-url, the most KiB per second to download; 0 is unlimited")
+	flag.IntVar(&opts.stripComponents, "strip-components", 0, "With --tarball-url, strip this many leading directories, which every entry must share, from the tarball's entries, like tar --strip-components")
+	flag.BoolVar(&opts.touchOnlyChanged, "touch-only-changed", false, "Leave the files in src that --tarball-url would extract unchanged as they are, keeping their modification times")
+	flag.StringVar(&opts.vcsMetadata, "vcs-metadata", "fail", "What to do with version control metadata (.git, .gitmodules, .hg, .svn) in the sources extracted from --tarball-url: fail the roll or remove it")
+	flag.IntVar(&opts.ioBuffer, "io-buffer", 0, "KiB of buffering between the archive and its extraction; 0 reads the archive unbuffered")
+	flag.StringVar(&opts.expectedSHA256, "expected-sha256", "", "With --tarball-url, the hex SHA-256 digest the tarball must have")
+	flag.StringVar(&opts.archiveFormat, "archive-format", "tar.gz", "With --tarball-url, the format of the archive it downloads: "+strings.Join(archiveFormats, " or "))
+	flag.BoolVar(&opts.shallow, "shallow", false, "With --upstream-url, fetch only the target commit and none of its history")
+	flag.StringVar(&opts.validateHook, "validate-hook", "", "A shell command, run in the boringssl directory with the resolved revision as its argument and in $ROLL_BORINGSSL_REVISION, that vetoes the roll by failing")
+	flag.BoolVar(&opts.requireLinear, "require-linear", false, "Abort if the target is a merge commit")
+	flag.BoolVar(&opts.requireSignedTags, "require-signed-tags", false, "If --commit names a tag, abort unless it is an annotated tag that git verify-tag finds signed by one of --trusted-key")
+	flag.StringVar(&opts.upstreamBranch, "upstream-branch", "", "If set, abort unless the target is on this branch of src (e.g. origin/upstream/master), checked with git merge-base --is-ancestor")
+	flag.BoolVar(&opts.allowOffBranch, "allow-offbranch", false, "With --upstream-branch, only warn if the target is not on it")
+	flag.Var((*stringsFlag)(&opts.trustedKeys), "trusted-key", "With --require-signed-tags, the fingerprint or key ID of a key trusted to sign tags (may be repeated)")
+	flag.StringVar(&opts.asOf, "as-of", "", "Roll to the commit --commit pointed to as of this date (e.g. 2023-06-01), the newest in its history made before it")
+	flag.DurationVar(&opts.minAge, "min-age", 0, "Roll to the newest commit in the first-parent history of --commit that is at least this old (e.g. 168h)")
+	flag.StringVar(&opts.manifestPath, "manifest", "", "If set, write a JSON summary of the roll to this path")
+	summaryOnly := flag.Bool("summary-only", false, "With --manifest, print only what changed since the manifest of the previous roll instead of the testing instructions")
+	flag.StringVar(&opts.envFilePath, "export-env-file", "", "If set, write ROLL_OLD_SHA, ROLL_NEW_SHA, ROLL_CHANGED_FILES, ROLL_SRC_SIZE and ROLL_SUCCESS to this dotenv-style file for CI, even if the roll fails")
+	flag.StringVar(&opts.reportPath, "report", "", "If set, write an HTML summary of the roll, for sharing with reviewers, to this path")
+	flag.StringVar(&opts.commitURL, "commit-url", defaultCommitURL, "With --report, the URL of an upstream commit, with {revision} replaced by its SHA-1")
+	flag.StringVar(&opts.bindgenExpected, "expected-bindgen-version", "", "Expected bindgen version (default: the version pinned by bindgen.sh)")
+	flag.BoolVar(&opts.bindgenStrict, "strict-bindgen-version", false, "Abort if the installed bindgen is not the expected version")
+	flag.Var((*stringsFlag)(&opts.bindgenFlags), "expected-bindgen-flag", "A flag bindgen.sh is expected to run bindgen with, with its values, such as \"-o src/lib.rs\"; if any are given, the flags bindgen.sh passes are compared against them, warning of any drift (may be repeated)")
+	flag.BoolVar(&opts.strictBindgenFlags, "strict-bindgen-flags", false, "Abort if the flags bindgen.sh runs bindgen with differ from --expected-bindgen-flag")
+	flag.BoolVar(&opts.checkBindgenHeaders, "fail-on-deleted-referenced-header", false, "Before running bindgen, abort if a header bindgen.sh names, or --bindgen-headers lists, is missing from src")
+	flag.StringVar(&opts.bindgenHeaders, "bindgen-headers", "", "With --fail-on-deleted-referenced-header, a file listing more headers bindgen reads, one per line relative to src")
+	flag.BoolVar(&opts.resume, "resume", false, "Skip steps that completed in an interrupted roll to the same revision")
+	flag.BoolVar(&opts.sinceLastGreen, "since-last-green-roll", false, "Only roll if the target descends from the revision of the last successful roll in "+historyName+", warning if upstream has diverged from it")
+	flag.BoolVar(&opts.sandbox, "sandbox", false, "Roll in a copy of the boringssl directory and only move the results into it if every step succeeds")
+	flag.Var((*stringsFlag)(&opts.excludes), "exclude", "Glob of upstream paths to leave out of src (may be repeated)")
+	flag.Var((*stringsFlag)(&opts.includeTests), "include-tests", "Glob of upstream test paths to keep in src even if --exclude would leave them out (may be repeated)")
+	flag.StringVar(&opts.mirrorDir, "mirror-dir", "", "If set, after the roll, copy src, less what --mirror-subtree and --mirror-exclude leave out, to src in this directory")
+	flag.StringVar(&opts.mirrorSubtree, "mirror-subtree", "", "With --mirror-dir, only mirror this directory of src")
+	flag.Var((*stringsFlag)(&opts.mirrorExcludes), "mirror-exclude", "With --mirror-dir, a glob of paths in src to leave out of the mirror (may be repeated)")
+	flag.StringVar(&opts.subtree, "subtree", "", "Only check out this upstream directory, which must exist at --commit; build files and Rust bindings are not generated unless it contains --generator and include")
+	flag.BoolVar(&opts.allowCaseCollisions, "allow-case-collisions", false, "Only warn if upstream paths differ only in case")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "How long each step without a --step-timeout may run before it fails and its commands are killed; 0 is unlimited")
+	flag.Var((*stepDurationsFlag)(&opts.stepTimeouts), "step-timeout", "STEP=DURATION: how long the step may run, overriding --timeout (may be repeated; in a config file, an object of steps to durations)")
+	flag.DurationVar(&opts.heartbeatInterval, "heartbeat-interval", 0, "How often to log that a long step is still running; 0 logs nothing")
+	flag.DurationVar(&opts.maxRuntimeWarn, "max-runtime-warn", 0, "How long each step without a --step-budget may run before a warning, without stopping it; 0 is unlimited")
+	flag.Var((*stepDurationsFlag)(&opts.stepBudgets), "step-budget", "STEP=DURATION: how long the step may run before a warning, overriding --max-runtime-warn (may be repeated; in a config file, an object of steps to durations)")
+	flag.IntVar(&opts.jobs, "jobs", 1, "How many steps to run at once; build file and Rust binding generation run concurrently when adjacent")
+	flag.Var((*stringsFlag)(&opts.skip), "skip", "A step not to run: "+strings.Join(stepNames, ", ")+" (may be repeated)")
+	noGN := flag.Bool("no-gn", false, "Do not generate build files; the same as --skip=gn")
+	noRust := flag.Bool("no-rust", false, "Do not generate Rust bindings; the same as --skip=rust")
+	noReadme := flag.Bool("no-readme", false, "Do not update README.fuchsia; the same as --skip=readme")
+	formats := flag.String("build-formats", "gn", "Comma-separated build file formats to generate ("+strings.Join(buildFormats, ", ")+")")
+	flag.StringVar(&opts.generator, "generator", defaultGenerator, "The upstream path of the script that generates the build files")
+	flag.StringVar(&opts.generatorScript, "generator-script", "", "Generate the build files with this script, outside src, instead of upstream's --generator, to test a change to it")
+	flag.Var((*stringsFlag)(&opts.referencedPaths), "referenced-path", "A path under src that hand-written build files refer to, which the roll warns about if upstream removes it (may be repeated)")
+	flag.StringVar(&opts.referencedPathsFile, "referenced-paths-file", "", "A file listing, one per line, more paths like --referenced-path")
+	flag.BoolVar(&opts.checkSymbols, "check-symbol-exports", false, "Report the symbols the headers export that the roll adds or removes, warning about removals")
+	flag.BoolVar(&opts.strictSymbols, "strict-symbol-exports", false, "With --check-symbol-exports, fail the roll, instead of warning, if it removes an exported symbol")
+	flag.BoolVar(&opts.strictReferenced, "strict-referenced-paths", false, "Fail the roll, instead of warning, if a referenced path is missing")
+	ensureCleanExit := flag.Bool("ensure-clean-exit", false, "At exit, check that every temporary file and directory and lock the roll made was removed, warning about and failing on any left behind")
+	isolateEnv := flag.Bool("clean-env", false, "Run the generators and bindgen with only the environment variables --clean-env-allow names, so that rolls do not depend on who runs them")
+	var envAllow []string
+	flag.Var((*stringsFlag)(&envAllow), "clean-env-allow", "With --clean-env, an environment variable to keep (may be repeated; default: "+strings.Join(defaultEnvAllowlist, ", ")+")")
+	failFast := flag.Bool("fail-fast", true, "Stop at the first failed step; if false, run every step that does not depend on the sources step and report all the failures")
+	flag.BoolVar(&opts.noFetch, "no-fetch", false, "Resolve --commit against what src already has instead of fetching first")
+	httpProxy := flag.String("http-proxy", "", "The proxy for tarball downloads and API requests, instead of the one $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY choose")
+	forceIPv4 := flag.Bool("force-ipv4", false, "Make tarball downloads and API requests only over IPv4")
+	httpTimeout := flag.Duration("http-timeout", 0, "How long each tarball download or API request may take, including reading its response; 0 is unlimited")
+	noNet := flag.Bool("no-network", false, "Fail rather than reach the network: implies --no-fetch, allows only a local --upstream-url or a tarball already in --cache-dir, and refuses any git command that would contact a remote")
+	flag.BoolVar(&opts.dryRunNetwork, "dry-run-network", false, "Fetch and resolve the target and read its changelog, then print the steps of the roll without running them")
+	flag.Var((*stringsFlag)(&opts.asmArchs), "asm-arch", "An architecture the generator must write assembly for, or the roll fails (may be repeated; default: "+strings.Join(defaultAsmArchs, ", ")+"; skip the check with --skip=asm)")
+	flag.BoolVar(&opts.allowDanglingIncludes, "allow-dangling-includes", false, "Do not fail the roll if the headers in src/include include headers missing from src")
+	flag.BoolVar(&opts.allowAbsolutePaths, "allow-absolute-paths", false, "Do not fail the roll if the generated build files contain absolute paths or other forbidden patterns")
+	flag.StringVar(&opts.goldenDir, "golden-dir", "", "After generating the build files, fail with the diff if they differ from the goldens in this directory, relative to the boringssl directory unless absolute")
+	flag.Var((*stringsFlag)(&opts.goldenFiles), "golden-file", "With --golden-dir, a glob of the generated build files to compare (may be repeated; default: all)")
+	flag.BoolVar(&opts.updateGolden, "update-golden", false, "With --golden-dir, replace the goldens with the generated build files instead of comparing them")
+	flag.Var((*stringsFlag)(&opts.forbiddenPatterns), "forbidden-pattern", "Regexp the lines of the generated build files must not match (may be repeated; default: "+strings.Join(defaultForbiddenPatterns, ", ")+")")
+	flag.BoolVar(&opts.compareGenerated, "compare-generated-with-upstream", false, "After generating the build files, report how they differ from any of the same name committed in src")
+	flag.BoolVar(&opts.explainDiff, "explain-diff", false, "After generating the build files, report which of the changed upstream files they use, and so affect our build")
+	flag.StringVar(&opts.preGeneratePatches, "pre-generate-patches", "patches/pre-generate", "The directory, relative to the boringssl directory if not absolute, of the patches to src to apply in order after checking it out and before generating build files")
+	flag.StringVar(&opts.postGeneratePatches, "post-generate-patches", "patches/post-generate", "The directory, relative to the boringssl directory if not absolute, of the patches to apply in order to the boringssl directory after generating build files")
+	flag.StringVar(&opts.advisoryFeed, "report-cves", "", "An http(s) URL or file of a JSON array of advisories, {\"id\", \"summary\", \"introduced\": [SHA1...], \"fixed\": [SHA1...]}, to report which the roll fixes or is still vulnerable to")
+	flag.BoolVar(&opts.noOpIfIdenticalTree, "no-op-if-identical-tree", false, "If the files kept in src are byte-identical at the new revision, as when upstream only changed files left out, skip the steps after updating the sources")
+	flag.BoolVar(&opts.readmeIfIdenticalTree, "update-readme-if-identical-tree", false, "With --no-op-if-identical-tree, still write the new revision to "+readmeName+" when the files are identical")
+	flag.BoolVar(&opts.sourcesOnly, "sources-only", false, "Only check out the new sources in src, without generating build files or updating "+readmeName+", and print their changelog and diff")
+	flag.BoolVar(&opts.strictUTF8, "strict-utf8", false, "After checking out the sources, fail if any of their text files, by extension, is not valid UTF-8")
+	flag.BoolVar(&opts.reportDuplicates, "report-duplicates", false, "Report the groups of files in src with identical contents, which may be worth pruning")
+	flag.BoolVar(&opts.reportUpstreamGen, "report-upstream-generated", false, "Report the changed upstream files that upstream generates, such as test vectors, apart from the hand-written ones")
+	flag.Var((*stringsFlag)(&opts.upstreamGenerated), "upstream-generated", "With --report-upstream-generated, a glob of the files upstream generates; one without a slash matches base names (may be repeated; default: "+strings.Join(defaultUpstreamGenerated, ", ")+")")
+	flag.StringVar(&opts.licenseScanner, "license-scanner", "", "A shell command, run with src as $1, that prints a line for each file with its license's SPDX identifier and its path; the roll fails if it finds a license not allowed")
+	flag.Var((*stringsFlag)(&opts.allowedLicenses), "allowed-license", "With --license-scanner, the SPDX identifier of a license src may have (may be repeated; default "+strings.Join(defaultAllowedLicenses, ", ")+")")
+	flag.Int64Var(&toolLimits.memoryMiB, "tool-memory-limit", 0, "If positive, the MiB of virtual memory the generator and bindgen may use, so a runaway run fails instead of exhausting the machine (Unix only)")
+	flag.DurationVar(&toolLimits.cpu, "tool-cpu-limit", 0, "If positive, the CPU time the generator and bindgen may use, rounded up to whole seconds (Unix only)")
+	flag.StringVar(&toolContainer.image, "container", "", "If set, the container image to run the generator and bindgen in, with the BoringSSL directory bind-mounted; git, extraction and the README stay on the host")
+	flag.StringVar(&toolContainer.runtime, "container-runtime", "", "The container runtime --container runs the image with; docker or else podman, whichever is on the PATH, if empty")
+	flag.BoolVar(&opts.checkDeterminism, "abort-on-generator-nondeterminism", false, "Run the generator with "+strings.Join(deterministicGeneratorEnv, " ")+", for deterministic output, and then again, failing the roll if the two runs' build files differ")
+	flag.Var((*stringsFlag)(&opts.generatorWarnings), "generator-warning", "Regexp matching the lines of generator output to list as warnings at the end of the roll (may be repeated; default: "+strings.Join(defaultGeneratorWarnings, ", ")+")")
+	flag.Var((*stringsFlag)(&opts.generatorArtifacts), "generator-artifact", "Glob, relative to the boringssl directory, of an intermediate file of the generator to remove before it runs (may be repeated; default: "+strings.Join(defaultGeneratorArtifacts, ", ")+")")
+	flag.BoolVar(&opts.scopedGenerate, "scoped-generate", false, "Skip build file generation if the roll changes no generator inputs; any other roll falls back to generating them in full")
+	flag.BoolVar(&opts.onlyChangedFormats, "only-changed-build-formats", false, "Only generate the build formats whose inputs changed since their build files were last generated, as recorded in "+formatInputsName)
+	flag.BoolVar(&opts.forceAllFormats, "force-all-formats", false, "Generate every build format, even with --only-changed-build-formats")
+	flag.BoolVar(&opts.checkFIPS, "check-fips", false, "Check that the FIPS module is present and that the generated build files have a target building it")
+	flag.Var((*stringsFlag)(&opts.fipsFiles), "fips-file", "With --check-fips, a path under src the FIPS module requires (may be repeated; default: "+strings.Join(defaultFIPSFiles, ", ")+")")
+	flag.BoolVar(&opts.verifyClean, "verify-clean-generated", false, "After generating, report untracked files that are not expected generator outputs")
+	flag.BoolVar(&opts.cleanGenerated, "clean-generated", false, "Like --verify-clean-generated, but also remove the files")
+	flag.BoolVar(&opts.versionHeader, "annotate-version-header", false, "Write the new revision to the C header at --version-header")
+	flag.StringVar(&opts.versionHeaderPath, "version-header", "boringssl_vendored_revision.h", "With --annotate-version-header, the header to write, relative to the boringssl directory")
+	flag.BoolVar(&opts.strictHistory, "strict-history", false, "Abort if the roll history shows the target was rolled to before")
+	flag.Uint64Var(&opts.diskHeadroom, "disk-headroom", 256, "MiB of free space to require beyond the size of the sources before checking them out")
+	flag.StringVar(&opts.changelogPath, "changelog", "", "Write the upstream commits being rolled in to this file, with security-relevant ones listed first")
+	flag.Var((*stringsFlag)(&opts.upstreamChangelogs), "upstream-changelog", "A human-written changelog upstream may keep; the lines the roll adds to the first that exists are included in --changelog (may be repeated; default: "+strings.Join(defaultUpstreamChangelogs, ", ")+")")
+	flag.StringVar(&opts.changelogFormat, "changelog-format", "plain", "The format of --changelog: "+strings.Join(changelogFormatNames(), ", "))
+	flag.IntVar(&opts.changelogMaxCommits, "changelog-max-commits", 1000, "List at most this many commits in the changelog, linking to --compare-url for the rest; 0 lists them all")
+	flag.StringVar(&opts.compareURL, "compare-url", defaultCompareURL, "The URL of the upstream commits in a roll, with {old} and {new} replaced by its revisions")
+	flag.Var((*stringsFlag)(&opts.changelogExcludes), "changelog-exclude", "A regexp of the subjects of upstream commits, like automated rolls, to count but not list in the changelog unless they are security-relevant (may be repeated)")
+	flag.Var((*stringsFlag)(&opts.securityKeywords), "security-keyword", "A case-insensitive regexp that marks a commit as security-relevant (may be repeated; default: "+strings.Join(defaultSecurityKeywords, ", ")+")")
+	flag.BoolVar(&opts.strictSecurity, "strict-security", false, "Abort before rolling if any upstream commit being rolled in is security-relevant")
+	flag.IntVar(&opts.reviewThreshold, "review-threshold", 200, "Abort a roll of more than this many upstream commits unless --changelog-reviewed or --expect-commits is given (0 disables)")
+	flag.BoolVar(&opts.changelogReviewed, "changelog-reviewed", false, "Confirm that the changelog of a roll larger than --review-threshold was reviewed")
+	flag.IntVar(&opts.expectCommits, "expect-commits", 0, "Abort unless the roll has exactly this many upstream commits; also satisfies --review-threshold")
+	flag.Var((*stringsFlag)(&opts.allowedAuthors), "allowed-authors", "An email address, or a /regexp/ matching whole addresses, of someone allowed to author or commit the upstream commits being rolled in; if given, the roll aborts on any other (may be repeated)")
+	selftestOnly := flag.Bool("selftest", false, "Check the roller's parsers against built-in fixtures and exit")
+	projectsPath := flag.String("projects", "", "JSON list of the vendored libraries to roll in turn, each with a name and optionally its dir, upstream_url, commit, generator, and readme")
+	continueOnError := flag.Bool("continue-on-error", false, "With --projects, roll the remaining projects after one fails")
+	sinceRoll := flag.Int("since-roll", 0, "Print the last N rolls recorded in "+historyName+" and exit without rolling")
+	quiet := flag.Bool("quiet", false, "With --since-roll, print the history's JSON lines instead of a table")
+	doctorOnly := flag.Bool("doctor", false, "Check the tools, checkout and disk space a roll needs, print a checklist of the results and exit without rolling; fails if a roll could not run")
+	explainOnly := flag.Bool("explain", false, "Print what the roll would do and exit without doing any of it")
+	planJSON := flag.Bool("print-plan-json", false, "Print as JSON the revisions, steps, commands, files to be written and upstream changes of the roll, resolved without fetching, and exit without doing any of it")
+	verifyOnly := flag.Bool("verify-only", false, "Check that src exactly matches the revision in the README, less excluded paths, and exit without fetching; fails listing the differing files")
+	flag.BoolVar(verifyOnly, "verify-tree-matches-commit", false, "The same as --verify-only, for CI")
+	patch := flag.String("emit-patch", "", "If set, roll in a temporary copy and write the changes to this patch file instead")
+	bisectRange := flag.String("bisect", "", "Given GOOD..BAD upstream commits, find the first bad commit between them with --test-command, then restore the tree")
+	testCommand := flag.String("test-command", "", "With --bisect, the shell command, run in the boringssl directory, that fails on a bad commit")
+	flag.BoolVar(&opts.autoCommit, "auto-commit", false, "After a successful roll, commit the changes outside of src")
+	flag.StringVar(&opts.commitSubjectPrefix, "commit-subject-prefix", "boringssl", "With --auto-commit, the bracketed prefix of the commit subject")
+	flag.Var((*stringsFlag)(&opts.bugs), "bug", "With --auto-commit, a numeric bug ID for a \"Bug:\" footer of the commit message (may be repeated)")
+	var signatures []string
+	flag.Var((*stringsFlag)(&signatures), "build-system-signature", "PATH=DESCRIPTION: a path in src that marks a build system upstream may have migrated to, reported if the generator is missing (may be repeated)")
+	toPR := flag.Bool("roll-to-pr", false, "With --auto-commit, push the roll commit to --pr-branch and open a draft pull request for it with the GitHub API, authenticating with $"+githubTokenEnv)
+	prRepo := flag.String("pr-repo", "", "With --roll-to-pr, the GitHub repository to open the pull request on, as OWNER/NAME")
+	prRemote := flag.String("pr-remote", "origin", "With --roll-to-pr, the remote to push the roll commit to")
+	prBranch := flag.String("pr-branch", "", "With --roll-to-pr, the branch to push the roll commit to (default: roll-boringssl-<revision>)")
+	prBase := flag.String("pr-base", "main", "With --roll-to-pr, the branch to open the pull request against")
+	upload := flag.Bool("upload", false, "With --auto-commit, push the roll commit for review with git push to refs/for/ on --upload-branch, as Gerrit takes it, and report the review URL")
+	uploadRemote := flag.String("upload-remote", "origin", "With --upload, the remote to push the roll commit to")
+	uploadBranch := flag.String("upload-branch", "", "With --upload, the branch the review is for")
+	flag.BoolVar(&opts.signCommit, "sign-commit", false, "With --auto-commit, GPG-sign the roll commit with the key in git config user.signingkey")
+	flag.BoolVar(&opts.useGitNotes, "use-git-notes", false, "With --auto-commit, record the new revision and changelog in a git note on the roll commit instead of updating "+readmeName)
+	flag.BoolVar(&opts.commitPerStep, "commit-per-step", false, "With --auto-commit, also commit the changes of each step as it succeeds, for bisecting; the steps then run one at a time")
+	addr := flag.String("serve", "", "If set, serve /status and /trigger on this address instead of rolling once")
+	dryRunGen := flag.Bool("dry-run-generators", false, "Only run the generator on the sources already in src, writing into a temporary directory, and report how its output differs from the build files here, which are left untouched")
+	onlyRust := flag.Bool("only-rust", false, "Only regenerate the Rust bindings for the sources already in src, without running git or fetching anything")
+	watchUpstream := flag.Bool("watch", false, "Instead of rolling once, re-roll whenever upstream advances, checking every --poll-interval, until interrupted")
+	poll := flag.Duration("poll-interval", 0, "With --serve or --watch, roll whenever upstream has advanced, checking this often")
+	jsonLogs := flag.Bool("json-logs", false, "Write the log to stdout as JSON lines, each with the time, level, step and message, instead of as text")
+	logDir := flag.String("log-dir", "", "If set, also write the full log to a timestamped file in this directory")
+	flag.StringVar(&opts.planOut, "plan-out", "", "Resolve the roll and write it with the settings in effect to this plan file, without rolling")
+	planIn := flag.String("plan-in", "", "Roll exactly as the plan file written by --plan-out says, in place of --config")
+	flag.BoolVar(&opts.allowPlanDrift, "allow-plan-drift", false, "With --plan-in, roll to the planned revision even if upstream or src have moved since the plan")
+	configPath := flag.String("config", "", "JSON file of flag settings, used for flags not given on the command line")
+	var compared []string
+	flag.Var((*stringsFlag)(&compared), "compare-branches", "Instead of rolling, print the tip of this upstream branch and how many commits it is ahead of and behind the rolled revision (may be repeated)")
+	printConfigOnly := flag.Bool("print-config", false, "Print the effective settings and where each came from, and exit")
 
 	flag.Parse()
+	sources := flagSources()
+	if *planIn != "" {
+		p, err := readPlan(*planIn)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if err := applySettings(*planIn, p.Settings, sources, "plan"); err != nil {
+			log.Print(err)
+			return 1
+		}
+		opts.commit = p.Commit
+		sources["commit"] = "plan"
+		opts.plan = p
+	} else if *configPath != "" {
+		if err := applyConfig(*configPath, sources); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	setTargetCommit(&opts, sources, os.Getenv(commitEnv))
+	if len(opts.commitFallbacks) == 0 {
+		opts.commitFallbacks = defaultCommitFallbacks
+	}
+	if sources["commit"] != "" || opts.upstreamURL != "" {
+		// A commit-ish that was asked for is authoritative, and the fallbacks are remote-tracking
+		// branches, which the upstream repository lacks.
+		opts.commitFallbacks = nil
+	}
+	opts.buildFormats = strings.Split(*formats, ",")
+	opts.keepGoing = !*failFast
+	client, err := newHTTPClient(*httpProxy, *forceIPv4, *httpTimeout)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	httpClient = client
+	if *noNet {
+		noNetwork = true
+		// git itself then refuses every transport but the local one, whatever runs it.
+		os.Setenv("GIT_ALLOW_PROTOCOL", "file")
+		if opts.upstreamURL == "" {
+			opts.noFetch = true
+		}
+	}
+	if len(envAllow) == 0 {
+		envAllow = defaultEnvAllowlist
+	}
+	if *isolateEnv {
+		toolEnviron = cleanEnv(os.Environ(), envAllow)
+	}
+	if opts.checkDeterminism {
+		generatorEnv = deterministicGeneratorEnv
+	}
+	if toolLimits.memoryMiB < 0 || toolLimits.cpu < 0 {
+		log.Print("--tool-memory-limit and --tool-cpu-limit cannot be negative")
+		return 1
+	}
+	if toolLimits != (resourceLimits{}) && runtime.GOOS == "windows" && toolContainer.image == "" {
+		log.Print("WARNING: --tool-memory-limit and --tool-cpu-limit have no effect on Windows")
+	}
+	if toolContainer.runtime != "" && toolContainer.image == "" {
+		log.Print("--container-runtime requires --container")
+		return 1
+	}
+	if toolContainer.image != "" && toolContainer.runtime == "" {
+		name, err := detectContainerRuntime()
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		toolContainer.runtime = name
+	}
+	if len(opts.generatorWarnings) == 0 {
+		opts.generatorWarnings = defaultGeneratorWarnings
+	}
+	if len(opts.forbiddenPatterns) == 0 {
+		opts.forbiddenPatterns = defaultForbiddenPatterns
+	}
+	if len(opts.upstreamGenerated) == 0 {
+		opts.upstreamGenerated = defaultUpstreamGenerated
+	}
+	if len(opts.allowedLicenses) == 0 {
+		opts.allowedLicenses = defaultAllowedLicenses
+	}
+	if len(opts.generatorArtifacts) == 0 {
+		opts.generatorArtifacts = defaultGeneratorArtifacts
+	}
+	if len(opts.asmArchs) == 0 {
+		opts.asmArchs = defaultAsmArchs
+	}
+	for _, s := range signatures {
+		sig, err := parseBuildSystemSignature(s)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		buildSystemSignatures = append(buildSystemSignatures, sig)
+	}
+	if len(opts.upstreamChangelogs) == 0 {
+		opts.upstreamChangelogs = defaultUpstreamChangelogs
+	}
+	// These add to --skip, so a step either names is skipped.
+	for name, no := range map[string]bool{"gn": *noGN, "rust": *noRust, "readme": *noReadme} {
+		if no {
+			opts.skip = append(opts.skip, name)
+		}
+	}
+	if *printConfigOnly {
+		if err := printConfig(sources); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
 
+	if *jsonLogs {
+		// These print what they find to stdout, which the events would be mixed into.
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"explain", *explainOnly},
+			{"print-plan-json", *planJSON},
+			{"dry-run-network", opts.dryRunNetwork},
+			{"sources-only", opts.sourcesOnly},
+			{"summary-only", *summaryOnly},
+			{"doctor", *doctorOnly},
+			{"since-roll", *sinceRoll != 0},
+			{"compare-branches", len(compared) > 0},
+			{"projects", *projectsPath != ""},
+		} {
+			if f.set {
+				log.Printf("--json-logs cannot be combined with --%s, which prints to stdout too", f.name)
+				return 1
+			}
+		}
+	}
 	log.SetFlags(log.Lmicroseconds)
+	if *jsonLogs {
+		logOutput = os.Stdout
+		log.SetOutput(logOutput)
+	}
+	if *logDir != "" {
+		logPath, closeLog := teeLog(*logDir)
+		defer closeLog()
+		if logPath != "" {
+			defer log.Printf("Full log written to %s", logPath)
+		}
+	}
+	if *jsonLogs {
+		jsonLog = &jsonLogWriter{mu: &sync.Mutex{}, w: logOutput}
+		logOutput = jsonLog
+		log.SetFlags(0)
+		log.SetOutput(logOutput)
+		defer func() {
+			jsonLog.flush()
+			jsonLog = nil
+		}()
+	}
+	if *ensureCleanExit {
+		defer func() {
+			if leaks := reportLeaks(); len(leaks) > 0 && status == 0 {
+				status = 1
+			}
+		}()
+	}
+
+	if *selftestOnly {
+		if !selftest() {
+			return 1
+		}
+		return 0
+	}
+	if *isolateEnv {
+		log.Printf("Running the generators and bindgen with only %s from the environment", strings.Join(envAllow, ", "))
+	}
+	switch {
+	case len(opts.branches) > 0:
+		log.Printf("Target is the %s of %s (from --branches)", opts.branchStrategy, strings.Join(opts.branches, ", "))
+	case sources["commit"] == "flag":
+		log.Printf("Target is %s (from --commit)", opts.commit)
+	case sources["commit"] == "config":
+		log.Printf("Target is %s (from %s)", opts.commit, *configPath)
+	case sources["commit"] == "env":
+		log.Printf("Target is %s (from $%s)", opts.commit, commitEnv)
+	case sources["commit"] == "plan":
+		log.Printf("Target is %s (from %s)", opts.commit, *planIn)
+	default:
+		log.Printf("Target is %s (default)", opts.commit)
+	}
+
+	if opts.generatorScript != "" {
+		script, err := checkGeneratorScript(opts.generatorScript)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		opts.generatorScript = script
+		log.Printf("WARNING: generating build files with %s, which is not upstream's generator", script)
+	}
 
 	dir := configure()
-	sha1 := updateSources(dir, *commit)
+	if *explainOnly {
+		explain(os.Stdout, dir, &opts)
+		return 0
+	}
+	if *doctorOnly {
+		if !printDoctor(os.Stdout, doctor(dir, &opts)) {
+			return 1
+		}
+		return 0
+	}
+	if *sinceRoll != 0 {
+		if err := printRecentRolls(os.Stdout, dir, *sinceRoll, *quiet); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if len(compared) > 0 {
+		if err := printBranchDistances(os.Stdout, dir, &opts, compared); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if *planJSON {
+		if err := printPlanJSON(os.Stdout, dir, &opts); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if *dryRunGen {
+		if err := dryRunGenerators(log.Default(), dir, &opts); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if *onlyRust {
+		if err := rollRust(dir, &opts); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if *addr != "" {
+		log.Print(serve(dir, opts, *addr, *poll))
+		return 1
+	}
+	if *verifyOnly {
+		if err := verifySources(dir, &opts); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+	if *bisectRange != "" {
+		r := strings.SplitN(*bisectRange, "..", 2)
+		if len(r) != 2 || r[0] == "" || r[1] == "" || *testCommand == "" {
+			log.Print("--bisect takes GOOD..BAD and requires --test-command")
+			return 1
+		}
+		if err := bisect(dir, &opts, r[0], r[1], *testCommand); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if *patch != "" {
+		if err := emitPatch(dir, &opts, *patch); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if len(opts.bugs) > 0 {
+		if !opts.autoCommit {
+			log.Print("--bug requires --auto-commit")
+			return 1
+		}
+		if err := checkBugs(opts.bugs); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if opts.commitPerStep && !opts.autoCommit {
+		log.Print("--commit-per-step requires --auto-commit")
+		return 1
+	}
+	if opts.useGitNotes && !opts.autoCommit {
+		log.Print("--use-git-notes requires --auto-commit")
+		return 1
+	}
+	if opts.readmeIfIdenticalTree && !opts.noOpIfIdenticalTree {
+		log.Print("--update-readme-if-identical-tree requires --no-op-if-identical-tree")
+		return 1
+	}
+	if opts.sourcesOnly && opts.autoCommit {
+		log.Print("--sources-only cannot be combined with --auto-commit, as it leaves the build files and " + readmeName + " at the previous revision")
+		return 1
+	}
+	if opts.advisoryFeed != "" && opts.tarballURL != "" {
+		log.Print("--report-cves cannot be combined with --tarball-url, as it needs the upstream history")
+		return 1
+	}
+	if opts.useGitNotes && opts.tarballURL != "" {
+		log.Print("--use-git-notes cannot be combined with --tarball-url, which reads the revision of src from " + readmeName)
+		return 1
+	}
+	if opts.commitPerStep && opts.sandbox {
+		log.Print("--commit-per-step and --sandbox cannot both be given")
+		return 1
+	}
+	if opts.signCommit {
+		if !opts.autoCommit {
+			log.Print("--sign-commit requires --auto-commit")
+			return 1
+		}
+		if err := signingKey(dir); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if *upload {
+		if !opts.autoCommit {
+			log.Print("--upload requires --auto-commit")
+			return 1
+		}
+		if err := checkUpload(dir, *uploadRemote, *uploadBranch); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if *toPR {
+		if !opts.autoCommit {
+			log.Print("--roll-to-pr requires --auto-commit")
+			return 1
+		}
+		if *upload {
+			log.Print("--roll-to-pr and --upload cannot both be given")
+			return 1
+		}
+		if err := checkPullRequest(dir, *prRemote, *prRepo, os.Getenv(githubTokenEnv)); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if opts.requireSignedTags && len(opts.trustedKeys) == 0 {
+		log.Print("--require-signed-tags requires --trusted-key")
+		return 1
+	}
+	if opts.checksumGenerated && !opts.writeChecksums {
+		log.Print("--include-generated-in-manifest requires --write-manifest")
+		return 1
+	}
+	if opts.allowOffBranch && opts.upstreamBranch == "" {
+		log.Print("--allow-offbranch requires --upstream-branch")
+		return 1
+	}
+	if opts.upstreamBranch != "" && opts.tarballURL != "" {
+		log.Print("--upstream-branch cannot be combined with --tarball-url, which fetches no branches")
+		return 1
+	}
+	if opts.strictBindgenFlags && len(opts.bindgenFlags) == 0 {
+		log.Print("--strict-bindgen-flags requires --expected-bindgen-flag")
+		return 1
+	}
+	if opts.bindgenHeaders != "" && !opts.checkBindgenHeaders {
+		log.Print("--bindgen-headers requires --fail-on-deleted-referenced-header")
+		return 1
+	}
+	if opts.updateGolden && opts.goldenDir == "" {
+		log.Print("--update-golden requires --golden-dir")
+		return 1
+	}
+	if opts.cargoUpdateDir != "" {
+		if _, err := lookPath("cargo"); err != nil {
+			log.Printf("--cargo-update-dir requires cargo: %s", err)
+			return 1
+		}
+	}
+	if *watchUpstream {
+		if *poll <= 0 {
+			log.Print("--watch requires a positive --poll-interval")
+			return 1
+		}
+		watch(dir, &opts, *poll, opts.signCommit)
+		return 0
+	}
+	if opts.planOut != "" {
+		opts.planSettings = planSettings(sources)
+		if _, err := roll(dir, &opts); err != nil {
+			log.Print(err)
+			return exitStatus(err)
+		}
+		return 0
+	}
+	if *projectsPath != "" {
+		if *upload || *toPR || *summaryOnly {
+			log.Print("--projects cannot be given with --upload, --roll-to-pr, or --summary-only")
+			return 1
+		}
+		projects, err := readProjects(*projectsPath, dir)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !printProjectResults(os.Stdout, rollProjects(projects, &opts, *continueOnError, opts.signCommit), len(projects)) {
+			return 1
+		}
+		return 0
+	}
+	var previous *manifest
+	if *summaryOnly {
+		if opts.manifestPath == "" {
+			log.Print("--summary-only requires --manifest, to compare with the manifest of the previous roll")
+			return 1
+		}
+		var err error
+		if previous, err = readManifest(opts.manifestPath); err != nil {
+			log.Print(err)
+			return 1
+		}
+		if previous == nil {
+			log.Printf("WARNING: there is no previous manifest at %s to compare with", opts.manifestPath)
+		}
+	}
+	m, err := roll(dir, &opts)
+	if opts.envFilePath != "" && !opts.dryRunNetwork {
+		if eerr := writeEnvFile(opts.envFilePath, m, err == nil); eerr != nil {
+			log.Print(eerr)
+			if err == nil {
+				return 1
+			}
+		}
+	}
+	if err != nil {
+		logError(err)
+		return exitStatus(err)
+	}
+	if opts.dryRunNetwork {
+		return 0
+	}
+	if opts.sourcesOnly {
+		printSourcesSummary(os.Stdout, m)
+		return 0
+	}
+	if opts.autoCommit {
+		if err := autoCommitRoll(dir, m, &opts, opts.signCommit); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	review := ""
+	if *upload {
+		if review, err = uploadRoll(dir, *uploadRemote, *uploadBranch); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if *toPR {
+		branch := *prBranch
+		if branch == "" {
+			branch = "roll-boringssl-" + revision(m.Revision).short()
+		}
+		title := strings.SplitN(commitMessage(m, opts.commitSubjectPrefix, opts.bugs), "\n", 2)[0]
+		if review, err = rollToPR(dir, *prRemote, *prRepo, *prBase, branch, os.Getenv(githubTokenEnv), title, m, opts.commitURL); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
 
-	log.Printf("Commit resolved to %s", sha1)
+	if *summaryOnly {
+		printSummary(os.Stdout, previous, m)
+		return 0
+	}
 
-	generateGN(dir)
-	generateRustBindings(dir)
-	updateReadMe(dir, sha1)
+	if len(m.GeneratorWarnings) > 0 {
+		log.Println()
+		log.Printf("The generator printed %d warnings; check them before submitting:", len(m.GeneratorWarnings))
+		for _, w := range m.GeneratorWarnings {
+			log.Printf("  %s", w)
+		}
+	}
 
 	log.Println()
 	log.Println("To test, please run:")
@@ -123,6 +10393,15 @@ func main() {
 	log.Println("  $ fx serve")
 	log.Println("  $ fx run-test boringssl_tests")
 
-	log.Println("If tests pass; commit the changes in //third_party/boringssl")
+	if (*upload || *toPR) && review != "" {
+		log.Printf("If tests pass; submit %s", review)
+	} else if *upload {
+		log.Println("If tests pass; submit the review of the roll commit in //third_party/boringssl")
+	} else if opts.autoCommit {
+		log.Println("If tests pass; upload the roll commit in //third_party/boringssl")
+	} else {
+		log.Println("If tests pass; commit the changes in //third_party/boringssl")
+	}
 	log.Println("Then, update the BoringSSL revision in the internal integration repository")
+	return 0
 }
@@ -0,0 +1,5826 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Tests of the roller's behavior, against fixtures, git checkouts, files and HTTP servers, which
+// --selftest leaves out to keep to its parser fixtures.
+var behaviorTests = []selfTest{
+	{"deleted bindgen header", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const script = "#!/bin/sh\nreadonly BSSL=\"../../src\"\necho \"#include <openssl/ssl.h>\" > bindgen.h\necho \"#include <openssl/ssl.h>\" >> bindgen.h\n" +
+			"echo \"#include <openssl/curve25519.h>\" >> bindgen.h\nbindgen bindgen.h -o src/lib.rs -- -include $BSSL/include/openssl/base.h\n"
+		for name, content := range map[string]string{
+			"rust/boringssl-sys/bindgen.sh": script,
+			"src/include/openssl/ssl.h":     "",
+			"src/include/openssl/base.h":    "",
+			"bindgen_headers.txt":           "# Read by bindgen through ssl.h\ninclude/openssl/x509.h\n",
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+				return err
+			}
+		}
+		headers, err := bindgenScriptHeaders(filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh"))
+		if err != nil {
+			return err
+		}
+		if got, want := fmt.Sprint(headers), "[include/openssl/ssl.h include/openssl/curve25519.h include/openssl/base.h]"; got != want {
+			return fmt.Errorf("bindgenScriptHeaders = %s; want %s", got, want)
+		}
+		err = checkBindgenHeaders(log.New(ioutil.Discard, "", 0), dir, filepath.Join(dir, "bindgen_headers.txt"))
+		var be *bindgenError
+		if !errors.As(err, &be) || !strings.HasSuffix(err.Error(), "missing from src: include/openssl/curve25519.h, include/openssl/x509.h") {
+			return fmt.Errorf("checkBindgenHeaders with deleted headers = %v; want a bindgen error naming them", err)
+		}
+		for _, h := range []string{"curve25519.h", "x509.h"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, "src", "include", "openssl", h), nil, 0644); err != nil {
+				return err
+			}
+		}
+		return checkBindgenHeaders(log.New(ioutil.Discard, "", 0), dir, filepath.Join(dir, "bindgen_headers.txt"))
+	}},
+	{"bindgen flags policy", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		script := filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh")
+		if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+			return err
+		}
+		write := func(allow string) error {
+			content := "#!/bin/sh\nreadonly BSSL=\"../../src\"\nBINDGEN_GOT_VERSION=\"$(bindgen --version)\"\n" +
+				"ALLOW=\"" + allow + "\"\n# Only BoringSSL's symbols.\nbindgen bindgen.h \\\n    --allowlist-function \"$ALLOW\" \\\n" +
+				"    -o src/lib.rs -- \\\n    -I $BSSL/include \\\n    --target=x86_64-fuchsia\n"
+			return ioutil.WriteFile(script, []byte(content), 0755)
+		}
+		if err := write("(SSL|EVP)_.*"); err != nil {
+			return err
+		}
+		policy := []string{"--allowlist-function (SSL|EVP)_.*", "-o src/lib.rs", "--", "-I ../../src/include", "--target=x86_64-fuchsia"}
+		flags, err := bindgenScriptFlags(script)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(flags) != fmt.Sprint(policy) {
+			return fmt.Errorf("bindgenScriptFlags = %q; want %q", flags, policy)
+		}
+		if err := checkBindgenFlags(log.New(ioutil.Discard, "", 0), dir, policy, true); err != nil {
+			return fmt.Errorf("checkBindgenFlags with the flags of the policy = %v", err)
+		}
+
+		// A fork narrows the allowlist, which would drop bindings.
+		if err := write("SSL_.*"); err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		if err := checkBindgenFlags(log.New(&out, "", 0), dir, policy, false); err != nil {
+			return fmt.Errorf("checkBindgenFlags with drift but not strict = %v; want a warning", err)
+		}
+		if want := `WARNING: bindgen.sh passes ["--allowlist-function SSL_.*"], which --expected-bindgen-flag does not list and no longer passes ["--allowlist-function (SSL|EVP)_.*"]`; !strings.Contains(out.String(), want) {
+			return fmt.Errorf("checkBindgenFlags logged %q; want %q", out.String(), want)
+		}
+		err = checkBindgenFlags(log.New(ioutil.Discard, "", 0), dir, policy, true)
+		var be *bindgenError
+		if !errors.As(err, &be) || !strings.Contains(err.Error(), `no longer passes ["--allowlist-function (SSL|EVP)_.*"]`) {
+			return fmt.Errorf("checkBindgenFlags with drift under --strict-bindgen-flags = %v; want a bindgen error naming it", err)
+		}
+		return nil
+	}},
+	{"upstream news", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		src := filepath.Join(tmp, "src")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		if err := run(exec.Command("git", "init", "-q", src)); err != nil {
+			return err
+		}
+		var revs []revision
+		for _, news := range []string{"", "1.1\n* Fixed a leak.\n\n1.0\n* First release.\n", "1.2\n* Added ML-KEM.\n+ Faster AES.\n\n1.1\n* Fixed a leak.\n\n1.0\n* First release.\n"} {
+			if news != "" {
+				if err := ioutil.WriteFile(filepath.Join(src, "NEWS"), []byte(news), 0644); err != nil {
+					return err
+				}
+				if err := git("add", "NEWS"); err != nil {
+					return err
+				}
+			}
+			if err := git("commit", "-q", "--allow-empty", "-m", "Update NEWS"); err != nil {
+				return err
+			}
+			sha1, err := revParse(src, "HEAD")
+			if err != nil {
+				return err
+			}
+			revs = append(revs, sha1)
+		}
+		if news, err := readNewsDiff(src, revs[0], revs[0], defaultUpstreamChangelogs); err != nil || news != nil {
+			return fmt.Errorf("readNewsDiff without a NEWS file = %v, %v; want nothing", news, err)
+		}
+		news, err := readNewsDiff(src, revs[1], revs[2], defaultUpstreamChangelogs)
+		if err != nil {
+			return err
+		}
+		if news == nil || news.path != "NEWS" || fmt.Sprintf("%q", news.added) != `["1.2" "* Added ML-KEM." "+ Faster AES." ""]` {
+			return fmt.Errorf("readNewsDiff = %+v; want the lines added for 1.2", news)
+		}
+		security, err := securityRE(defaultSecurityKeywords)
+		if err != nil {
+			return err
+		}
+		text, _ := formatChangelog(plainChangelog{}, revs[1], revs[2], []commit{{sha1: revs[2], subject: "Update NEWS"}}, 1, "", security, news, nil)
+		if want := "\nAdded to upstream's NEWS:\n  1.2\n  * Added ML-KEM.\n  + Faster AES.\n\n\nChanges:\n"; !strings.Contains(text, want) {
+			return fmt.Errorf("changelog %q does not contain %q", text, want)
+		}
+		return nil
+	}},
+	{"extraction modes", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for _, hdr := range []*tar.Header{
+			{Name: "crypto/", Mode: 0700, Typeflag: tar.TypeDir},
+			{Name: "crypto/a.c", Mode: 0600, Typeflag: tar.TypeReg},
+			{Name: "util/run.sh", Mode: 0700, Typeflag: tar.TypeReg},
+		} {
+			if err := w.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		var mode modeFlag
+		if err := mode.Set("0750"); err != nil || mode != 0750 {
+			return fmt.Errorf("modeFlag.Set(\"0750\") = %o, %v", mode, err)
+		}
+		if err := mode.Set("0999"); err == nil {
+			return fmt.Errorf("modeFlag.Set(\"0999\") succeeded")
+		}
+		if err := extractTar(&b, tmp, tarOptions{fileMode: 0640, dirMode: 0750}); err != nil {
+			return err
+		}
+		for name, want := range map[string]os.FileMode{"crypto": 0750, "util": 0750, "crypto/a.c": 0640, "util/run.sh": 0750} {
+			info, err := os.Stat(filepath.Join(tmp, filepath.FromSlash(name)))
+			if err != nil {
+				return err
+			}
+			if got := info.Mode().Perm(); got != want {
+				return fmt.Errorf("%s has mode %04o; want %04o", name, got, want)
+			}
+		}
+		return nil
+	}},
+	{"max file size", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for name, size := range map[string]int{"crypto/a.c": 1 << 10, "third_party/fixture.bin": 3 << 19} {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(size)}); err != nil {
+				return err
+			}
+			if _, err := w.Write(make([]byte, size)); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		err = extractTar(bytes.NewReader(b.Bytes()), tmp, tarOptions{maxFileSize: 1 << 20})
+		if err == nil || !strings.Contains(err.Error(), "third_party/fixture.bin is 1.5 MiB") {
+			return fmt.Errorf("extracting a file over the limit = %v; want an error naming it and its size", err)
+		}
+		if err := extractTar(bytes.NewReader(b.Bytes()), tmp, tarOptions{maxFileSize: 1 << 20, allowLargeFiles: true}); err != nil {
+			return fmt.Errorf("extracting a file over the limit with allowLargeFiles: %s", err)
+		}
+		if err := extractTar(bytes.NewReader(b.Bytes()), tmp, tarOptions{maxFileSize: 2 << 20}); err != nil {
+			return fmt.Errorf("extracting files under the limit: %s", err)
+		}
+		return nil
+	}},
+	{"exclude while extracting", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		// The excluded fixture is over the size limit, so extracting it at all fails.
+		sizes := map[string]int{"crypto/a.c": 1 << 10, "crypto/test/test_util.cc": 1 << 10, "crypto/test/fixture.bin": 3 << 19, "third_party/x.c": 1 << 10}
+		var tb, zb bytes.Buffer
+		tw, zw := tar.NewWriter(&tb), zip.NewWriter(&zb)
+		for name, size := range sizes {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(size)}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(make([]byte, size)); err != nil {
+				return err
+			}
+			f, err := zw.Create(name)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(make([]byte, size)); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		for format, extract := range map[string]func(dst string, opts tarOptions) error{
+			"tar": func(dst string, opts tarOptions) error { return extractTar(bytes.NewReader(tb.Bytes()), dst, opts) },
+			"zip": func(dst string, opts tarOptions) error { return extractZip(zb.Bytes(), dst, opts) },
+		} {
+			filter, err := newFileFilter([]string{"crypto/test", "third_party"}, []string{"crypto/test/test_util.cc"}, "")
+			if err != nil {
+				return err
+			}
+			dst := filepath.Join(tmp, format)
+			if err := extract(dst, tarOptions{maxFileSize: 1 << 20, filter: filter}); err != nil {
+				return fmt.Errorf("extracting the %s archive with excludes: %s", format, err)
+			}
+			files, err := walkFiles(dst)
+			if err != nil {
+				return err
+			}
+			sort.Strings(files)
+			if got := strings.Join(files, " "); got != "crypto/a.c crypto/test/test_util.cc" {
+				return fmt.Errorf("extracting the %s archive with excludes wrote %s; want only the kept files", format, got)
+			}
+			if fmt.Sprint(filter.counts) != "[1 1]" || filter.included != 1 {
+				return fmt.Errorf("extracting the %s archive counted %v excluded and %d included files; want [1 1] and 1", format, filter.counts, filter.included)
+			}
+		}
+		return nil
+	}},
+	{"strip components", func() error {
+		archive := func(names ...string) (*bytes.Buffer, error) {
+			var b bytes.Buffer
+			w := tar.NewWriter(&b)
+			if err := w.WriteHeader(&tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "x"}}); err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				hdr := &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+				switch {
+				case strings.HasSuffix(name, ".h"):
+					hdr = &tar.Header{Name: name, Linkname: strings.Replace(name, "include/alias.h", "crypto/a.c", 1), Typeflag: tar.TypeLink}
+				case !strings.HasSuffix(name, "/"):
+					hdr = &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+				}
+				if err := w.WriteHeader(hdr); err != nil {
+					return nil, err
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					if _, err := io.WriteString(w, name); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return &b, w.Close()
+		}
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		b, err := archive("boringssl-1234/", "boringssl-1234/crypto/", "boringssl-1234/crypto/a.c", "boringssl-1234/include/alias.h", "boringssl-1234/LICENSE")
+		if err != nil {
+			return err
+		}
+		if err := extractTar(b, tmp, tarOptions{stripComponents: 1}); err != nil {
+			return err
+		}
+		files, err := walkFiles(tmp)
+		if err != nil {
+			return err
+		}
+		if got, want := fmt.Sprint(files), "[LICENSE crypto/a.c include/alias.h]"; got != want {
+			return fmt.Errorf("extracting with one component stripped gave %s; want %s", got, want)
+		}
+		if c, err := ioutil.ReadFile(filepath.Join(tmp, "include", "alias.h")); err != nil || string(c) != "boringssl-1234/crypto/a.c" {
+			return fmt.Errorf("the stripped hardlink has %q (%v); want the contents of crypto/a.c", c, err)
+		}
+		if b, err = archive("boringssl-1234/crypto/a.c", "other/LICENSE"); err != nil {
+			return err
+		}
+		if err := extractTar(b, filepath.Join(tmp, "mixed"), tarOptions{stripComponents: 1}); err == nil || !strings.Contains(err.Error(), `"other/LICENSE" is not under boringssl-1234/`) {
+			return fmt.Errorf("extracting entries with different prefixes = %v; want an error", err)
+		}
+		return nil
+	}},
+	{"links before targets", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		const contents = "int x;\n"
+		for _, e := range []struct {
+			hdr  *tar.Header
+			body string
+		}{
+			{&tar.Header{Name: "include/alias.h", Linkname: "crypto/x.h", Typeflag: tar.TypeLink}, ""},
+			{&tar.Header{Name: "include/x.h", Linkname: "../crypto/x.h", Typeflag: tar.TypeSymlink}, ""},
+			{&tar.Header{Name: "crypto/x.h", Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))}, contents},
+		} {
+			if err := w.WriteHeader(e.hdr); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, e.body); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := extractTar(&b, tmp, tarOptions{}); err != nil {
+			return fmt.Errorf("extracting a hardlink before its target: %s", err)
+		}
+		target, err := os.Stat(filepath.Join(tmp, "crypto", "x.h"))
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"alias.h", "x.h"} {
+			info, err := os.Stat(filepath.Join(tmp, "include", name))
+			if err != nil {
+				return err
+			}
+			if !os.SameFile(info, target) {
+				return fmt.Errorf("include/%s is not linked to crypto/x.h", name)
+			}
+		}
+		b.Reset()
+		w = tar.NewWriter(&b)
+		if err := w.WriteHeader(&tar.Header{Name: "escape.h", Linkname: "../outside.h", Typeflag: tar.TypeLink}); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := extractTar(&b, tmp, tarOptions{}); err == nil || !strings.Contains(err.Error(), "outside the destination") {
+			return fmt.Errorf("extracting a hardlink to outside the destination = %v; want an error", err)
+		}
+		return nil
+	}},
+	{"watch", func() error {
+		const old, new = revision("1111111111111111111111111111111111111111"), revision("2222222222222222222222222222222222222222")
+		upstream := []revision{old, new}
+		rolls := 0
+		w := &watcher{
+			resolve: func() (revision, error) {
+				sha1 := upstream[0]
+				upstream = upstream[1:]
+				return sha1, nil
+			},
+			current: func() (revision, error) { return old, nil },
+			roll: func() error {
+				rolls++
+				return nil
+			},
+		}
+		for i, want := range []bool{false, true} {
+			rolled, err := w.poll()
+			if err != nil {
+				return err
+			}
+			if rolled != want {
+				return fmt.Errorf("poll %d rolled: %t; want %t", i+1, rolled, want)
+			}
+		}
+		if rolls != 1 {
+			return fmt.Errorf("rolled %d times; want once", rolls)
+		}
+		return nil
+	}},
+	{"checksums", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for _, f := range []struct{ name, content string }{
+			{"crypto/a.c", "int a;\n"},
+			{"LICENSE", "license\n"},
+			{".git/HEAD", "ref\n"},
+			{checksumsName, "stale\n"},
+		} {
+			if err := w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(f.content)); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := extractTar(&b, tmp, tarOptions{}); err != nil {
+			return err
+		}
+		got, err := checksums(tmp)
+		if err != nil {
+			return err
+		}
+		want := fmt.Sprintf("%x  LICENSE\n%x  crypto/a.c\n", sha256.Sum256([]byte("license\n")), sha256.Sum256([]byte("int a;\n")))
+		if got != want {
+			return fmt.Errorf("checksums = %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"checksums with generated files", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		files := map[string]string{
+			"src/crypto/a.c":                "int a;\n",
+			"BUILD.generated.gni":           "crypto_sources = []\n",
+			"BUILD.generated_tests.gni":     "crypto_test_sources = []\n",
+			"rust/boringssl-sys/src/lib.rs": "pub fn a() {}\n",
+			formatInputsName:                "{}\n",
+		}
+		for name, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		sum := func(name string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(files[name]))) }
+
+		opts := &rollOptions{buildFormats: []string{"gn"}, generator: defaultGenerator, writeChecksums: true, checksumGenerated: true, onlyChangedFormats: true}
+		var names []string
+		var checksums step
+		for _, s := range rollSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, &manifest{}) {
+			names = append(names, s.name)
+			if s.name == "checksums" {
+				checksums = s
+			}
+		}
+		if got := strings.Join(names, " "); !strings.HasPrefix(got, "sources headers gn rust checksums ") {
+			return fmt.Errorf("the steps are %q; want checksums after gn and rust", got)
+		}
+		if err := checksums.run(); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "src", checksumsName))
+		if err != nil {
+			return err
+		}
+		want := sum("BUILD.generated.gni") + "  ../BUILD.generated.gni\n" +
+			sum("BUILD.generated_tests.gni") + "  ../BUILD.generated_tests.gni\n" +
+			sum("rust/boringssl-sys/src/lib.rs") + "  ../rust/boringssl-sys/src/lib.rs\n" +
+			sum("src/crypto/a.c") + "  crypto/a.c\n"
+		if string(b) != want {
+			return fmt.Errorf("%s with the generated files is %q; want %q", checksumsName, b, want)
+		}
+
+		// Without the option, the sources alone are listed, before generating.
+		opts.checksumGenerated = false
+		names = nil
+		for _, s := range rollSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, &manifest{}) {
+			names = append(names, s.name)
+			if s.name == "checksums" {
+				checksums = s
+			}
+		}
+		if got := strings.Join(names, " "); !strings.HasPrefix(got, "sources checksums headers gn rust ") {
+			return fmt.Errorf("the steps are %q; want checksums right after sources", got)
+		}
+		if err := checksums.run(); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "src", checksumsName)); err != nil || string(b) != sum("src/crypto/a.c")+"  crypto/a.c\n" {
+			return fmt.Errorf("%s of the sources alone is %q, %v", checksumsName, b, err)
+		}
+		return nil
+	}},
+	{"as of", func() error {
+		history, err := parseTimestamps("1688169600 3333333333333333333333333333333333333333\n1685577600 2222222222222222222222222222222222222222\n1682899200 1111111111111111111111111111111111111111\n")
+		if err != nil {
+			return err
+		}
+		tip := history[0].sha1
+		real := commitBefore
+		defer func() { commitBefore = real }()
+		commitBefore = func(_ string, sha1 revision, date string) (datedCommit, bool, error) {
+			if sha1 != tip {
+				return datedCommit{}, false, fmt.Errorf("rev-list --before of %s; want %s", sha1, tip)
+			}
+			before, err := time.Parse("2006-01-02", date)
+			if err != nil {
+				return datedCommit{}, false, err
+			}
+			for _, c := range history {
+				if c.time.Before(before) {
+					return c, true, nil
+				}
+			}
+			return datedCommit{}, false, nil
+		}
+		// The commits were made at midnight UTC on May 1st, June 1st and July 1st, 2023.
+		if sha1, err := asOfCommit("src", tip, "2023-06-02"); err != nil || sha1 != history[1].sha1 {
+			return fmt.Errorf("asOfCommit(2023-06-02) = %s, %v; want %s", sha1, err, history[1].sha1)
+		}
+		if sha1, err := asOfCommit("src", tip, "2023-05-15"); err != nil || sha1 != history[2].sha1 {
+			return fmt.Errorf("asOfCommit(2023-05-15) = %s, %v; want %s", sha1, err, history[2].sha1)
+		}
+		if _, err := asOfCommit("src", tip, "2023-01-01"); err == nil || !strings.Contains(err.Error(), "no commit in the history of 333333333333 was made before 2023-01-01") {
+			return fmt.Errorf("asOfCommit before the first commit = %v; want no commit found", err)
+		}
+
+		// And with git itself, through the resolution of --commit.
+		commitBefore = real
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		src := filepath.Join(tmp, "src")
+		git := func(date string, args ...string) error {
+			cmd := exec.Command("git", append([]string{"-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)
+			cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+			return run(cmd)
+		}
+		if err := os.Mkdir(src, 0755); err != nil {
+			return err
+		}
+		if err := git("", "init", "-q"); err != nil {
+			return err
+		}
+		for _, date := range []string{"2023-05-01T00:00:00Z", "2023-05-31T12:00:00Z", "2023-06-15T00:00:00Z"} {
+			if err := git(date, "commit", "-q", "--allow-empty", "-m", date); err != nil {
+				return err
+			}
+		}
+		want, err := revParse(src, "HEAD~1")
+		if err != nil {
+			return err
+		}
+		opts := &rollOptions{commit: "HEAD", noFetch: true, asOf: "2023-06-01T00:00:00Z"}
+		if sha1, err := resolveCommit(tmp, opts); err != nil || sha1 != want {
+			return fmt.Errorf("resolveCommit with --as-of %s = %s, %v; want %s", opts.asOf, sha1, err, want)
+		}
+		opts.asOf = "2023-04-01"
+		if _, err := resolveCommit(tmp, opts); err == nil || !strings.Contains(err.Error(), "was made before 2023-04-01") {
+			return fmt.Errorf("resolveCommit with --as-of %s = %v; want no commit found", opts.asOf, err)
+		}
+		return nil
+	}},
+	{"branch intersection", func() error {
+		defer func(f func(string, []revision) (revision, error)) { mergeBase = f }(mergeBase)
+		main := revision("3333333333333333333333333333333333333333")
+		release := revision("2222222222222222222222222222222222222222")
+		base := revision("1111111111111111111111111111111111111111")
+		mergeBase = func(_ string, revs []revision) (revision, error) {
+			if len(revs) == 2 && revs[0] == main && revs[1] == release {
+				return base, nil
+			}
+			return "", nil
+		}
+		if sha1, err := chooseBranchCommit("", []revision{main, release}, defaultBranchStrategy); err != nil || sha1 != base {
+			return fmt.Errorf("chooseBranchCommit = %s, %v; want %s", sha1, err, base)
+		}
+		if _, err := chooseBranchCommit("", []revision{main, base}, defaultBranchStrategy); err == nil || !strings.Contains(err.Error(), "no common history") {
+			return fmt.Errorf("chooseBranchCommit of unrelated branches = %v; want an error", err)
+		}
+		return nil
+	}},
+	{"html report", func() error {
+		m := &manifest{
+			Revision:            "3333333333333333333333333333333333333333",
+			PreviousRevision:    "1111111111111111111111111111111111111111",
+			Commits:             []manifestCommit{{"3333333333333333333333333333333333333333", "Fix <script>alert(1)</script> & more", true}, {"2222222222222222222222222222222222222222", "Add a test", false}},
+			Added:               []string{"crypto/new<file>.c"},
+			Removed:             []string{"crypto/old.c"},
+			PreviousSourcesSize: 1 << 20,
+			SourcesSize:         3 << 20,
+			Steps:               []stepTiming{{Name: "gn", Seconds: 1.5}},
+		}
+		var buf bytes.Buffer
+		if err := renderReport(&buf, m, defaultCommitURL); err != nil {
+			return err
+		}
+		report := buf.String()
+		for _, want := range []string{
+			`<a href="https://boringssl.googlesource.com/boringssl/&#43;/1111111111111111111111111111111111111111">`,
+			"<h2>Security-relevant changes</h2>",
+			"Fix &lt;script&gt;alert(1)&lt;/script&gt; &amp; more",
+			"Added crypto/new&lt;file&gt;.c",
+			"Removed crypto/old.c",
+			"3.0 MiB (&#43;2.0 MiB)",
+			"<td>gn</td><td>1.5s</td>",
+		} {
+			if !strings.Contains(report, want) {
+				return fmt.Errorf("report does not contain %q:\n%s", want, report)
+			}
+		}
+		if strings.Contains(report, "<script>") {
+			return fmt.Errorf("report contains an unescaped commit subject:\n%s", report)
+		}
+		return nil
+	}},
+	{"disk space", func() error {
+		defer func(f func(string, *syscall.Statfs_t) error) { statfs = f }(statfs)
+		statfs = func(_ string, st *syscall.Statfs_t) error {
+			st.Bavail, st.Bsize = 1024, 4096
+			return nil
+		}
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := checkDiskSpace(dir, 0); err == nil || !strings.Contains(err.Error(), "only 4 MiB free") {
+			return fmt.Errorf("checkDiskSpace with 4 MiB free = %v; want an error", err)
+		}
+		return nil
+	}},
+	{"signed commit", func() error {
+		if args := commitArgs("Roll", true); args[len(args)-1] != "-S" {
+			return fmt.Errorf("commitArgs(msg, true) = %q; want -S", args)
+		}
+		for _, a := range commitArgs("Roll", false) {
+			if a == "-S" {
+				return fmt.Errorf("commitArgs(msg, false) has -S")
+			}
+		}
+		if err := checkSigningKey(""); err == nil || !strings.Contains(err.Error(), "git config user.signingkey") {
+			return fmt.Errorf("checkSigningKey(\"\") = %v; want guidance to set user.signingkey", err)
+		}
+		return checkSigningKey("ABCD1234")
+	}},
+	{"commit message", func() error {
+		m := &manifest{
+			Revision:         "d5aae81fb79f5174ad348890b49a6c8f2d250c26",
+			PreviousRevision: "1111111111111111111111111111111111111111",
+			Commits:          []manifestCommit{{SHA1: "d5aae81fb79f5174ad348890b49a6c8f2d250c26", Subject: "Add a test"}},
+			CommitCount:      1,
+		}
+		msg := commitMessage(m, "roll", []string{"12345", "67890"})
+		if want := "[roll] Roll BoringSSL 111111111111..d5aae81fb79f\n"; !strings.HasPrefix(msg, want) {
+			return fmt.Errorf("commit message %q does not start with %q", msg, want)
+		}
+		for _, want := range []string{"  d5aae81fb79f Add a test\n", "\nBug: 12345\nBug: 67890"} {
+			if !strings.Contains(msg, want) {
+				return fmt.Errorf("commit message %q does not contain %q", msg, want)
+			}
+		}
+		if err := checkBugs([]string{"12345", "b/678"}); err == nil {
+			return fmt.Errorf("checkBugs accepted a non-numeric bug ID")
+		}
+		return nil
+	}},
+	{"commit per step", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		git := func(args ...string) (string, error) {
+			out, err := output(exec.Command("git", append([]string{"-C", dir}, args...)...))
+			return string(out), err
+		}
+		for _, args := range [][]string{{"init", "-q"}, {"config", "user.name", "roll"}, {"config", "user.email", "roll@example.com"}, {"commit", "-q", "--allow-empty", "-m", "Initial"}} {
+			if _, err := git(args...); err != nil {
+				return err
+			}
+		}
+		write := func(name string) func() error {
+			return func() error {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(filepath.Join(dir, name), []byte(name+"\n"), 0644)
+			}
+		}
+		var gnLogger *log.Logger
+		steps := []step{
+			{name: "sources", desc: "Update src", run: write("src/crypto/aes.c")},
+			loggedStep("gn", "Generate the GN build files", func(l *log.Logger) error {
+				gnLogger = l
+				return write("BUILD.generated.gni")()
+			}),
+			{name: "rust", desc: "Generate the Rust bindings", run: write("rust/boringssl-sys/src/lib.rs")},
+			{name: "readme", desc: "Update the revision in " + readmeName, run: write(readmeName)},
+		}
+		m := &manifest{Revision: "2222222222222222222222222222222222222222", PreviousRevision: "1111111111111111111111111111111111111111"}
+		opts := &rollOptions{autoCommit: true, commitPerStep: true, commitSubjectPrefix: "roll", bugs: []string{"12345"}}
+		if _, err := runSteps(dir, revision(m.Revision), commitSteps(steps, dir, m, opts), false, 4, true); err != nil {
+			return err
+		}
+		if gnLogger != log.Default() {
+			return fmt.Errorf("--commit-per-step ran a step with its own logger, as if concurrently")
+		}
+		if err := write("manifest.json")(); err != nil {
+			return err
+		}
+		if err := autoCommitRoll(dir, m, opts, false); err != nil {
+			return err
+		}
+		subjects, err := git("log", "--format=%s", "--reverse", "HEAD~4..")
+		if err != nil {
+			return err
+		}
+		const want = "[roll] Roll BoringSSL 111111111111..222222222222 (step 2/4: gn)\n" +
+			"[roll] Roll BoringSSL 111111111111..222222222222 (step 3/4: rust)\n" +
+			"[roll] Roll BoringSSL 111111111111..222222222222 (step 4/4: readme)\n" +
+			"[roll] Roll BoringSSL 111111111111..222222222222"
+		if subjects != want {
+			return fmt.Errorf("--commit-per-step committed %q; want %q", subjects, want)
+		}
+		body, err := git("log", "-1", "--format=%b", "HEAD~1")
+		if err != nil {
+			return err
+		}
+		for _, want := range []string{"Update the revision in " + readmeName + ".", "may not build until the roll's last commit", "Bug: 12345"} {
+			if !strings.Contains(body, want) {
+				return fmt.Errorf("step commit message %q does not contain %q", body, want)
+			}
+		}
+		if files, err := git("show", "--format=", "--name-only", "HEAD~2"); err != nil || files != "rust/boringssl-sys/src/lib.rs" {
+			return fmt.Errorf("the rust step commit has %q (%v); want only its bindings", files, err)
+		}
+		if err := autoCommitRoll(dir, m, opts, false); err != nil {
+			return fmt.Errorf("--commit-per-step with nothing left to commit: %s", err)
+		}
+		return nil
+	}},
+	{"git notes", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for _, args := range [][]string{{"init", "-q"}, {"config", "user.name", "roll"}, {"config", "user.email", "roll@example.com"}} {
+			if err := run(exec.Command("git", append([]string{"-C", dir}, args...)...)); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated.gni"), []byte("crypto_sources = []\n"), 0644); err != nil {
+			return err
+		}
+		opts := &rollOptions{autoCommit: true, useGitNotes: true, commitSubjectPrefix: "roll", skip: []string{"sources", "headers", "gn", "absolute-paths", "rust"}}
+		if steps := rollSteps(dir, "2222222222222222222222222222222222222222", opts, &manifest{}); len(steps) != 0 {
+			return fmt.Errorf("rollSteps with --use-git-notes has the %s step; want no readme step", steps[0].name)
+		}
+		saved := addGitNote
+		defer func() { addGitNote = saved }()
+		var notes []string
+		addGitNote = func(d, note string) error {
+			if d != dir {
+				return fmt.Errorf("noted a commit in %s; want %s", d, dir)
+			}
+			notes = append(notes, note)
+			return nil
+		}
+		m := &manifest{
+			Revision:         "2222222222222222222222222222222222222222",
+			PreviousRevision: "1111111111111111111111111111111111111111",
+			Commits:          []manifestCommit{{SHA1: "2222222222222222222222222222222222222222", Subject: "Add a test"}},
+			CommitCount:      3,
+		}
+		if err := autoCommitRoll(dir, m, opts, false); err != nil {
+			return err
+		}
+		const want = "Upstream revision: 2222222222222222222222222222222222222222\nPrevious upstream revision: 1111111111111111111111111111111111111111\n\n" +
+			"Changes:\n  222222222222 Add a test\n  ... and 2 more"
+		if fmt.Sprint(notes) != fmt.Sprint([]string{want}) {
+			return fmt.Errorf("--use-git-notes noted %q; want %q", notes, want)
+		}
+		return nil
+	}},
+	{"dry run generators", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const generator = "import os\n" +
+			"sources = sorted(os.listdir(os.path.join('src', 'crypto')))\n" +
+			"open('BUILD.generated.gni', 'w').write('crypto_sources = [\\n' + ''.join('  \"src/crypto/%s\",\\n' % s for s in sources) + ']\\n')\n" +
+			"open('BUILD.generated_tests.gni', 'w').write('crypto_test_sources = []\\n')\n" +
+			"open('cwd', 'w').write(os.getcwd())\n"
+		const committed = "crypto_sources = [\n  \"src/crypto/aes.c\",\n]\n"
+		for name, content := range map[string]string{
+			"src/util/generate_build_files.py": generator,
+			"src/crypto/aes.c":                 "",
+			"src/crypto/sha.c":                 "",
+			"BUILD.generated.gni":              committed,
+			"BUILD.generated_tests.gni":        "crypto_test_sources = []\n",
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		opts := &rollOptions{generator: defaultGenerator, buildFormats: []string{"gn"}}
+		var buf bytes.Buffer
+		err = dryRunGenerators(log.New(&buf, "", 0), dir, opts)
+		if err == nil || !strings.HasSuffix(err.Error(), "would change 1 of them: BUILD.generated.gni") {
+			return fmt.Errorf("dryRunGenerators with a new source = %v; want BUILD.generated.gni to differ", err)
+		}
+		if !strings.Contains(buf.String(), "+  \"src/crypto/sha.c\",") {
+			return fmt.Errorf("dryRunGenerators logged no diff adding src/crypto/sha.c:\n%s", buf.String())
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.generated.gni")); err != nil || string(b) != committed {
+			return fmt.Errorf("BUILD.generated.gni is %q, %v after --dry-run-generators; want it untouched", b, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cwd")); !os.IsNotExist(err) {
+			return fmt.Errorf("the generator ran in the boringssl directory; want a temporary directory")
+		}
+		if err := os.Remove(filepath.Join(dir, "src", "crypto", "sha.c")); err != nil {
+			return err
+		}
+		return dryRunGenerators(log.New(ioutil.Discard, "", 0), dir, opts)
+	}},
+	{"tool resource limits", func() error {
+		if runtime.GOOS == "windows" {
+			return nil
+		}
+		defer func(saved resourceLimits) { toolLimits = saved }(toolLimits)
+		toolLimits = resourceLimits{}
+		plain := exec.Command("true")
+		if limitResources(plain, toolLimits) != plain {
+			return fmt.Errorf("limitResources without limits wrapped %q", plain.Args)
+		}
+		var out bytes.Buffer
+		toolLimits = resourceLimits{memoryMiB: 256, cpu: 1500 * time.Millisecond}
+		cmd := exec.Command("sh", "-c", "ulimit -v; ulimit -t; echo \"$1\"", "sh", "an argument")
+		cmd.Stdout = &out
+		if err := runLimited(cmd); err != nil {
+			return err
+		}
+		if got, want := out.String(), "262144\n2\nan argument\n"; got != want {
+			return fmt.Errorf("the limited command printed %q; want %q", got, want)
+		}
+		toolLimits = resourceLimits{cpu: time.Second}
+		err := runLimited(exec.Command("sh", "-c", "while :; do :; done"))
+		if err == nil || !strings.Contains(err.Error(), "exceeded its limit of 1s of CPU time") {
+			return fmt.Errorf("a command spinning past --tool-cpu-limit = %v; want it to fail for its CPU time", err)
+		}
+		toolLimits = resourceLimits{memoryMiB: 64}
+		err = runLimited(exec.Command("python", "-c", "x = bytearray(1 << 30)"))
+		if err == nil || !strings.Contains(err.Error(), "limited to 64 MiB of memory") {
+			return fmt.Errorf("a command allocating past --tool-memory-limit = %v; want it to fail under the limit", err)
+		}
+		return nil
+	}},
+	{"tool container", func() error {
+		if runtime.GOOS == "windows" {
+			return nil
+		}
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		// The stub runtime records its arguments and prints what a generator would.
+		stub := filepath.Join(dir, "docker")
+		record := filepath.Join(dir, "args")
+		if err := ioutil.WriteFile(stub, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > "+record+"\necho generated\n"), 0755); err != nil {
+			return err
+		}
+		defer func(saved container, savedEnv []string) { toolContainer, generatorEnv = saved, savedEnv }(toolContainer, generatorEnv)
+		toolContainer = container{runtime: stub, image: "example.com/boringssl-tools:1"}
+		generatorEnv = []string{"ROLL_BORINGSSL_SELFTEST=1"}
+		var out bytes.Buffer
+		cmd := generatorCommand(dir, defaultGenerator, []string{"gn"})
+		cmd.Stdout = &out
+		if err := runLimited(cmd); err != nil {
+			return err
+		}
+		if out.String() != "generated\n" {
+			return fmt.Errorf("the container printed %q; want its output streamed", out.String())
+		}
+		b, err := ioutil.ReadFile(record)
+		if err != nil {
+			return err
+		}
+		want := []string{"run", "--rm", "-v", dir + ":" + dir, "-w", dir, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+			"-e", "ROLL_BORINGSSL_SELFTEST=1", "example.com/boringssl-tools:1", "python", filepath.Join("src", "util", "generate_build_files.py"), "gn"}
+		if got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("the container runtime ran with %q; want %q", got, want)
+		}
+
+		defer func(saved func(string) (string, error)) { lookPath = saved }(lookPath)
+		lookPath = func(name string) (string, error) {
+			if name == "podman" {
+				return "/usr/bin/podman", nil
+			}
+			return "", exec.ErrNotFound
+		}
+		if name, err := detectContainerRuntime(); err != nil || name != "podman" {
+			return fmt.Errorf("detectContainerRuntime() = %q, %v with only podman; want podman", name, err)
+		}
+		return nil
+	}},
+	{"generator directory", func() error {
+		const dir = "/fuchsia/third_party/boringssl"
+		cmd := generatorCommand(dir, defaultGenerator, []string{"gn", "android"})
+		if cmd.Dir != dir {
+			return fmt.Errorf("generator runs in %q; want %q", cmd.Dir, dir)
+		}
+		if got, want := cmd.Args[1:], []string{filepath.Join("src", "util", "generate_build_files.py"), "gn", "android"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("generator arguments are %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"only rust", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		bin, ran := filepath.Join(dir, "bin"), filepath.Join(dir, "ran")
+		sys := filepath.Join(dir, "rust", "boringssl-sys")
+		for _, d := range []string{bin, sys} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		for name, content := range map[string]string{
+			filepath.Join(bin, "git"):        "#!/bin/sh\necho git \"$@\" >> " + ran + "\nexit 1\n",
+			filepath.Join(bin, "bindgen"):    "#!/bin/sh\nif [ \"$1\" = --version ]; then echo bindgen 0.53.2; else echo bindgen >> " + ran + "; fi\n",
+			filepath.Join(sys, "bindgen.sh"): "#!/bin/sh\nBINDGEN_EXPECTED_VERSION=\"bindgen 0.53.2\"\nbindgen -o src/lib.rs\n",
+			filepath.Join(dir, readmeName):   "Source: https://fuchsia.googlesource.com/third_party/boringssl/+/d5aae81fb79f5174ad348890b49a6c8f2d250c26/\n",
+		} {
+			if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+				return err
+			}
+		}
+		defer os.Setenv("PATH", os.Getenv("PATH"))
+		os.Setenv("PATH", bin)
+		if err := rollRust(dir, &rollOptions{}); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(ran); err != nil || string(b) != "bindgen\n" {
+			return fmt.Errorf("--only-rust ran %q, %v; want only bindgen", b, err)
+		}
+		return nil
+	}},
+	{"cargo update", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		bin, ran := filepath.Join(dir, "bin"), filepath.Join(dir, "ran")
+		src := filepath.Join(dir, "rust", "boringssl-sys", "src")
+		for _, d := range []string{bin, src, filepath.Join(dir, "rust", "consumer")} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(bin, "cargo"), []byte("#!/bin/sh\necho \"$(basename \"$PWD\") $*\" >> "+ran+"\n"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "lib.rs"), []byte("pub fn SSL_new() {}\n"), 0644); err != nil {
+			return err
+		}
+		defer os.Setenv("PATH", os.Getenv("PATH"))
+		os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		var buf bytes.Buffer
+		l := log.New(&buf, "", 0)
+		if err := updateCargoLock(l, dir, filepath.Join("rust", "consumer"), []byte("pub fn SSL_new() {}\n")); err != nil {
+			return err
+		}
+		if _, err := os.Stat(ran); !os.IsNotExist(err) {
+			return fmt.Errorf("cargo ran although the bindings are unchanged")
+		}
+		if err := updateCargoLock(l, dir, filepath.Join("rust", "consumer"), []byte("pub fn SSL_old() {}\n")); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(ran); err != nil || string(b) != "consumer update -p boringssl-sys\n" {
+			return fmt.Errorf("cargo ran as %q (%v); want update -p boringssl-sys in the crate directory", b, err)
+		}
+		return nil
+	}},
+	{"referenced paths", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := os.MkdirAll(filepath.Join(dir, "src", "crypto"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "src", "crypto", "a.c"), nil, 0644); err != nil {
+			return err
+		}
+		list := filepath.Join(dir, "referenced.txt")
+		if err := ioutil.WriteFile(list, []byte("# Used by //build/secure\ncrypto/a.c\n\ncrypto/removed.c\n"), 0644); err != nil {
+			return err
+		}
+		paths, err := readReferencedPaths(list)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := checkReferenced(log.New(&buf, "", 0), dir, paths, false); err != nil {
+			return err
+		}
+		if want := "WARNING: upstream removed 1 paths that our build files refer to: crypto/removed.c"; !strings.Contains(buf.String(), want) {
+			return fmt.Errorf("checkReferenced logged %q; want %q", buf.String(), want)
+		}
+		if err := checkReferenced(log.New(&buf, "", 0), dir, paths, true); err == nil {
+			return fmt.Errorf("checkReferenced with strict succeeded; want failure")
+		}
+		return nil
+	}},
+	{"golden build files", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range map[string]string{"BUILD.generated.gni": "crypto_sources = [ \"src/crypto/a.c\" ]\n", "BUILD.generated_tests.gni": "test_sources = []\n"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		l := log.New(&buf, "", 0)
+		if err := checkGolden(l, dir, "golden", []string{"gn"}, nil, false); err == nil || !strings.Contains(err.Error(), "2 generated files differ") {
+			return fmt.Errorf("checkGolden without goldens = %v; want both files missing", err)
+		}
+		if err := checkGolden(l, dir, "golden", []string{"gn"}, nil, true); err != nil {
+			return err
+		}
+		if err := checkGolden(l, dir, "golden", []string{"gn"}, nil, false); err != nil {
+			return fmt.Errorf("checkGolden after --update-golden: %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated.gni"), []byte("crypto_sources = [ \"src/crypto/b.c\" ]\n"), 0644); err != nil {
+			return err
+		}
+		buf.Reset()
+		err = checkGolden(l, dir, "golden", []string{"gn"}, nil, false)
+		if err == nil || !strings.Contains(err.Error(), "1 generated files differ") || !strings.Contains(err.Error(), ": BUILD.generated.gni;") {
+			return fmt.Errorf("checkGolden with a changed file = %v; want BUILD.generated.gni to differ", err)
+		}
+		if !strings.Contains(buf.String(), "-crypto_sources = [ \"src/crypto/a.c\" ]\n+crypto_sources = [ \"src/crypto/b.c\" ]") {
+			return fmt.Errorf("checkGolden logged %q; want the diff", buf.String())
+		}
+		if err := checkGolden(l, dir, "golden", []string{"gn"}, []string{"*_tests.gni"}, false); err != nil {
+			return fmt.Errorf("checkGolden of only the test sources: %s", err)
+		}
+		return nil
+	}},
+	{"forbidden patterns", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const gni = `# Licensed under the Apache License, https://www.apache.org/licenses/LICENSE-2.0
+crypto_sources = [
+  "src/crypto/a.c",
+]
+fetch_sources = [
+  "https://example.com/boringssl.tar.gz",
+]
+`
+		if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated.gni"), []byte(gni), 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated_tests.gni"), []byte("test_sources = []\n"), 0644); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = checkForbiddenPatterns(log.New(&buf, "", 0), dir, []string{"gn"}, defaultForbiddenPatterns)
+		const want = `BUILD.generated.gni:6 matches "https?://`
+		if err == nil || !strings.Contains(err.Error(), want) {
+			return fmt.Errorf("checkForbiddenPatterns = %v; want an error reporting %s", err, want)
+		}
+		if !strings.Contains(buf.String(), want+`: "https://example.com/boringssl.tar.gz",`) {
+			return fmt.Errorf("checkForbiddenPatterns logged %q; want the line of the URL", buf.String())
+		}
+		if strings.Count(buf.String(), "\n") != 1 {
+			return fmt.Errorf("checkForbiddenPatterns logged %q; want only the URL", buf.String())
+		}
+		if err := checkForbiddenPatterns(log.New(&buf, "", 0), dir, []string{"gn"}, []string{`^crypto_`}); err == nil || !strings.Contains(err.Error(), "BUILD.generated.gni:2 matches ^crypto_") {
+			return fmt.Errorf("checkForbiddenPatterns with a custom pattern = %v; want a match on line 2", err)
+		}
+		return nil
+	}},
+	{"compare generated", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range map[string]string{
+			"BUILD.generated.gni":               "crypto_sources = []\n",
+			"BUILD.generated_tests.gni":         "crypto_test_sources = []\n",
+			"src/BUILD.generated.gni":           "crypto_sources = []\n",
+			"src/gen/BUILD.generated_tests.gni": "crypto_test_sources = [ \"a.cc\" ]\n",
+		} {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		got, err := compareGenerated(dir, gnOutputs)
+		if err != nil {
+			return err
+		}
+		want := []generatedComparison{{"BUILD.generated.gni", "BUILD.generated.gni", true}, {"BUILD.generated_tests.gni", "gen/BUILD.generated_tests.gni", false}}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("compareGenerated = %v; want %v", got, want)
+		}
+		return nil
+	}},
+	{"generator script", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir, script := filepath.Join(tmp, "boringssl"), filepath.Join(tmp, "fork", "generate_build_files.py")
+		for _, d := range []string{filepath.Join(dir, "src"), filepath.Dir(script)} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		if _, err := checkGeneratorScript(script); err == nil {
+			return fmt.Errorf("checkGeneratorScript of a missing script succeeded")
+		}
+		const generator = `for name in ("BUILD.generated.gni", "BUILD.generated_tests.gni"):
+    open(name, "w").write("# forked\n")
+`
+		if err := ioutil.WriteFile(script, []byte(generator), 0644); err != nil {
+			return err
+		}
+		if cmd := generatorCommand(dir, script, []string{"gn"}); cmd.Args[1] != script {
+			return fmt.Errorf("generator command is %q; want it to run %s", cmd.Args, script)
+		}
+		// src has no generator of its own, so the build files can only come from the override.
+		if err := generateGN(log.Default(), dir, script, nil, []string{"gn"}, nil); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.generated.gni")); err != nil || string(b) != "# forked\n" {
+			return fmt.Errorf("BUILD.generated.gni is %q, %v; want the override's output", b, err)
+		}
+		return nil
+	}},
+	{"stale generator artifacts", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		stale := filepath.Join(dir, "src", "util", "__pycache__", "generate_build_files.cpython-39.pyc")
+		if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(stale, []byte("stale"), 0644); err != nil {
+			return err
+		}
+		// The generator fails if it sees the stale artifact.
+		const generator = `import os, sys
+if os.path.exists("src/util/__pycache__"):
+    sys.exit("stale artifact")
+for name in ("BUILD.generated.gni", "BUILD.generated_tests.gni"):
+    open(name, "w").close()
+`
+		if err := ioutil.WriteFile(filepath.Join(dir, "src", "util", "generate_build_files.py"), []byte(generator), 0644); err != nil {
+			return err
+		}
+		if err := generateGN(log.Default(), dir, defaultGenerator, defaultGeneratorArtifacts, []string{"gn"}, nil); err != nil {
+			return err
+		}
+		if _, err := os.Stat(stale); !os.IsNotExist(err) {
+			return fmt.Errorf("stale artifact %s was not removed: %v", stale, err)
+		}
+		return nil
+	}},
+	{"missing generator", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		util := filepath.Join(dir, "src", "util")
+		if err := os.MkdirAll(util, 0755); err != nil {
+			return err
+		}
+		if err := generateGN(log.Default(), dir, defaultGenerator, nil, []string{"gn"}, nil); err == nil || !strings.Contains(err.Error(), "upstream generator moved") {
+			return fmt.Errorf("generateGN without a generator = %v; want an upstream generator moved error", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(util, "gen_build_files.py"), nil, 0644); err != nil {
+			return err
+		}
+		if err := checkGenerator(dir, defaultGenerator); err == nil || !strings.Contains(err.Error(), "--generator=util/gen_build_files.py") {
+			return fmt.Errorf("checkGenerator with a renamed generator = %v; want it suggested", err)
+		}
+		return nil
+	}},
+	{"build system migration", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		gen := filepath.Join(dir, "src", "gen")
+		if err := os.MkdirAll(gen, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(gen, "sources.json"), []byte("{}\n"), 0644); err != nil {
+			return err
+		}
+		err = generateGN(log.Default(), dir, defaultGenerator, nil, []string{"gn"}, nil)
+		const want = "upstream build system changed: src/util/generate_build_files.py does not exist, but src has a JSON manifest of the source lists (src/gen/sources.json); update the roller"
+		var gerr *generateError
+		if !errors.As(err, &gerr) || !strings.Contains(err.Error(), want) {
+			return fmt.Errorf("generateGN after upstream moved to gen/sources.json = %v; want a generate error containing %q", err, want)
+		}
+		if _, err := parseBuildSystemSignature("BUILD.bazel"); err == nil {
+			return fmt.Errorf("parseBuildSystemSignature accepted a signature without a description")
+		}
+		return nil
+	}},
+	{"dangling includes", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		headers := map[string]string{
+			"src/include/openssl/base.h":     "#include <stdint.h>\n#include <openssl/opensslconf.h>\n",
+			"src/include/openssl/ssl.h":      "#include <openssl/base.h>\n#include <openssl/hpke.h>\n#include \"internal.h\"\n",
+			"src/include/openssl/internal.h": "#  include \"../../crypto/missing.h\"\n",
+		}
+		for name, contents := range headers {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		got, err := danglingIncludes(filepath.Join(dir, "src"))
+		want := []string{"include/openssl/base.h includes openssl/opensslconf.h", "include/openssl/internal.h includes ../../crypto/missing.h", "include/openssl/ssl.h includes openssl/hpke.h"}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("danglingIncludes = %q, %v; want %q", got, err, want)
+		}
+		if err := checkIncludes(log.Default(), dir, false); err == nil || !strings.Contains(err.Error(), "3 includes") {
+			return fmt.Errorf("checkIncludes with dangling includes = %v; want an error counting them", err)
+		}
+		if err := checkIncludes(log.Default(), dir, true); err != nil {
+			return fmt.Errorf("checkIncludes with --allow-dangling-includes: %s", err)
+		}
+		return nil
+	}},
+	{"touch only changed", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		src, tmp := filepath.Join(dir, "src"), filepath.Join(dir, ".src-new")
+		then := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		write := func(root string, files map[string]string, mtime time.Time) error {
+			for name, contents := range files {
+				path := filepath.Join(root, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+					return err
+				}
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := write(src, map[string]string{"a.c": "a", "crypto/b.c": "b", "crypto/c.c": "c", "d.c": "d", "gone.c": "gone"}, then); err != nil {
+			return err
+		}
+		if err := write(tmp, map[string]string{"a.c": "a", "crypto/b.c": "b", "crypto/c.c": "c2", "d.c": "d", "new.c": "new"}, time.Now()); err != nil {
+			return err
+		}
+		if err := os.Chmod(filepath.Join(tmp, "d.c"), 0755); err != nil {
+			return err
+		}
+		changed, err := reuseUnchanged(src, tmp, []string{"a.c", "crypto/b.c", "crypto/c.c", "d.c", "new.c"})
+		if err != nil || changed != 3 {
+			return fmt.Errorf("reuseUnchanged = %d, %v; want 3 changed (c.c, d.c and new.c)", changed, err)
+		}
+		for name, kept := range map[string]bool{"a.c": true, "crypto/b.c": true, "crypto/c.c": false, "d.c": false, "new.c": false} {
+			info, err := os.Stat(filepath.Join(tmp, filepath.FromSlash(name)))
+			if err != nil {
+				return err
+			}
+			if info.ModTime().Equal(then) != kept {
+				return fmt.Errorf("reuseUnchanged kept the existing %s: %t; want %t", name, !kept, kept)
+			}
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(tmp, "crypto", "c.c")); err != nil || string(b) != "c2" {
+			return fmt.Errorf("reuseUnchanged replaced the changed crypto/c.c: %q, %v", b, err)
+		}
+		return nil
+	}},
+	{"validate hook", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := commit("b.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+
+		vetoed := filepath.Join(tmp, "vetoed")
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator,
+			skip: []string{"gn", "absolute-paths", "rust"}, validateHook: `echo "$1 $ROLL_BORINGSSL_PREVIOUS_REVISION" > ` + vetoed + `; exit 1`}
+		if _, err := roll(dir, opts); err == nil || !strings.Contains(err.Error(), "--validate-hook vetoed the roll") {
+			return fmt.Errorf("roll with a vetoing --validate-hook = %v; want it vetoed", err)
+		}
+		if b, err := ioutil.ReadFile(vetoed); err != nil || string(b) != string(head)+" "+string(old)+"\n" {
+			return fmt.Errorf("the hook was given %q, %v; want %s and %s", b, err, head, old)
+		}
+		if sha1, err := currentRevision(dir); err != nil || sha1 != old {
+			return fmt.Errorf("src is at %s, %v after a vetoed roll; want %s", sha1, err, old)
+		}
+		if err := runValidateHook(dir, `test "$1" = "$ROLL_BORINGSSL_REVISION"`, old, head); err != nil {
+			return fmt.Errorf("runValidateHook with an approving hook: %s", err)
+		}
+		return nil
+	}},
+	{"mirror dir", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir, mirror := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl"), filepath.Join(tmp, "bootloader")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(names ...string) error {
+			for _, name := range names {
+				path := filepath.Join(upstream, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+					return err
+				}
+				if err := git("-C", upstream, "add", name); err != nil {
+					return err
+				}
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+strings.Join(names, ", "))
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := commit("crypto/b.c", "crypto/b_test.cc", "ssl/c.c"); err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		list := func(root string) (string, error) {
+			files, err := walkFiles(root)
+			if err != nil {
+				return "", err
+			}
+			var names []string
+			for _, f := range files {
+				if !strings.HasPrefix(f, ".git/") {
+					names = append(names, f)
+				}
+			}
+			return strings.Join(names, " "), nil
+		}
+
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, skip: []string{"headers", "gn", "absolute-paths", "rust"},
+			mirrorDir: mirror, mirrorSubtree: "missing"}
+		if _, err := roll(dir, opts); failedStep(err) != "mirror" {
+			return fmt.Errorf("roll with a mirror subtree missing from src failed with %v; want the mirror step to fail", err)
+		}
+		opts.mirrorSubtree, opts.mirrorExcludes = "crypto", []string{"crypto/*_test.cc"}
+		if _, err := roll(dir, opts); err != nil {
+			return err
+		}
+		if got, err := list(filepath.Join(dir, "src")); err != nil || got != "a.c crypto/b.c crypto/b_test.cc ssl/c.c" {
+			return fmt.Errorf("src holds %q, %v; want every upstream file", got, err)
+		}
+		if got, err := list(filepath.Join(mirror, "src")); err != nil || got != "crypto/b.c" {
+			return fmt.Errorf("the mirror holds %q, %v; want only crypto/b.c", got, err)
+		}
+		return nil
+	}},
+	{"symbol exports", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		header := filepath.Join(dir, "src", "include", "openssl", "ssl.h")
+		if err := os.MkdirAll(filepath.Dir(header), 0755); err != nil {
+			return err
+		}
+		write := func(contents string) error { return ioutil.WriteFile(header, []byte(contents), 0644) }
+		if err := write(`#define OPENSSL_EXPORT __attribute__((visibility("default")))
+OPENSSL_EXPORT int SSL_kept(SSL *ssl);
+OPENSSL_EXPORT const SSL_METHOD *SSL_removed(void);
+OPENSSL_EXPORT void (*SSL_get_info_callback(const SSL *ssl))(const SSL *ssl, int type, int value);
+OPENSSL_EXPORT extern const char SSL_removed_table[];
+int SSL_internal(void);
+`); err != nil {
+			return err
+		}
+		previous, err := exportedSymbols(filepath.Join(dir, "src"))
+		if err != nil {
+			return err
+		}
+		if got, want := fmt.Sprint(previous), "map[SSL_get_info_callback:true SSL_kept:true SSL_removed:true SSL_removed_table:true]"; got != want {
+			return fmt.Errorf("exportedSymbols = %s; want %s", got, want)
+		}
+		if err := write("OPENSSL_EXPORT int SSL_kept(\n    SSL *ssl);\nOPENSSL_EXPORT void (*SSL_get_info_callback(const SSL *ssl))(const SSL *ssl, int type, int value);\nOPENSSL_EXPORT int SSL_added(void);\n"); err != nil {
+			return err
+		}
+		current, err := exportedSymbols(filepath.Join(dir, "src"))
+		if err != nil {
+			return err
+		}
+		added, removed := diffSymbols(previous, current)
+		if fmt.Sprint(added) != "[SSL_added]" || fmt.Sprint(removed) != "[SSL_removed SSL_removed_table]" {
+			return fmt.Errorf("diffSymbols = %q added, %q removed; want SSL_added added and SSL_removed, SSL_removed_table removed", added, removed)
+		}
+		if err := checkSymbolExports(log.Default(), dir, previous, false); err != nil {
+			return fmt.Errorf("checkSymbolExports without --strict-symbol-exports: %s", err)
+		}
+		err = checkSymbolExports(log.Default(), dir, previous, true)
+		if err == nil || !strings.Contains(err.Error(), "removed 2 exported symbols") || strings.Contains(err.Error(), "SSL_added") {
+			return fmt.Errorf("checkSymbolExports with removals under --strict-symbol-exports = %v; want only the removals named", err)
+		}
+		if err := checkSymbolExports(log.Default(), dir, current, true); err != nil {
+			return fmt.Errorf("checkSymbolExports with unchanged symbols: %s", err)
+		}
+		return nil
+	}},
+	{"generator warnings", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		util := filepath.Join(dir, "src", "util")
+		if err := os.MkdirAll(util, 0755); err != nil {
+			return err
+		}
+		const script = `import sys
+print("Generating gn...")
+print("WARNING: crypto/x.c is not referenced")
+sys.stderr.write("skipping crypto/y.S: unknown architecture\n")
+print("  WARNING: crypto/x.c is not referenced  ")
+print("Warning: deprecated option")
+sys.stdout.write("Done; skipping nothing else")
+open("BUILD.generated.gni", "w").close()
+open("BUILD.generated_tests.gni", "w").close()
+`
+		if err := ioutil.WriteFile(filepath.Join(util, "generate_build_files.py"), []byte(script), 0644); err != nil {
+			return err
+		}
+		warnings, err := newWarningCollector(defaultGeneratorWarnings)
+		if err != nil {
+			return err
+		}
+		if err := generateGN(log.Default(), dir, defaultGenerator, nil, []string{"gn"}, warnings); err != nil {
+			return err
+		}
+		got := strings.Join(warnings.warnings, "\n")
+		for _, want := range []string{"WARNING: crypto/x.c is not referenced", "skipping crypto/y.S: unknown architecture", "Warning: deprecated option", "Done; skipping nothing else"} {
+			if strings.Count(got, want) != 1 {
+				return fmt.Errorf("the generator warnings are %q; want %q once", warnings.warnings, want)
+			}
+		}
+		if len(warnings.warnings) != 4 {
+			return fmt.Errorf("the generator warnings are %q; want 4, without the other output", warnings.warnings)
+		}
+		if _, err := newWarningCollector([]string{"("}); err == nil {
+			return fmt.Errorf("newWarningCollector accepted an invalid regexp")
+		}
+		return nil
+	}},
+	{"roll to pr", func() error {
+		var got pullRequest
+		var path, auth string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, auth = r.URL.Path, r.Header.Get("Authorization")
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if got.Head == "fork:taken" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				io.WriteString(w, `{"message": "Validation Failed", "errors": [{"message": "A pull request already exists for fork:taken."}]}`)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"number": 7, "html_url": "https://github.com/fork/boringssl/pull/7"}`)
+		}))
+		defer srv.Close()
+		savedAPI, savedPush := githubAPI, gitPush
+		defer func() { githubAPI, gitPush = savedAPI, savedPush }()
+		githubAPI = srv.URL
+		var pushed []string
+		gitPush = func(dir string, args []string) (string, error) {
+			pushed = args
+			return "", nil
+		}
+
+		m := &manifest{Revision: "2222222222222222222222222222222222222222", PreviousRevision: "1111111111111111111111111111111111111111", CommitCount: 1,
+			Commits: []manifestCommit{{SHA1: "2222222222222222222222222222222222222222", Subject: "Fix a timing leak", Security: true}}}
+		url, err := rollToPR("/tmp", "origin", "fork/boringssl", "main", "roll", "secret", "Roll BoringSSL 111111111111..222222222222", m, "https://example.com/{revision}")
+		if err != nil {
+			return err
+		}
+		if url != "https://github.com/fork/boringssl/pull/7" {
+			return fmt.Errorf("rollToPR returned %q; want the html_url of the pull request", url)
+		}
+		if fmt.Sprint(pushed) != "[origin HEAD:refs/heads/roll]" {
+			return fmt.Errorf("rollToPR pushed %q; want HEAD to roll of origin", pushed)
+		}
+		if path != "/repos/fork/boringssl/pulls" || auth != "Bearer secret" {
+			return fmt.Errorf("rollToPR posted to %s with Authorization %q; want /repos/fork/boringssl/pulls with the token", path, auth)
+		}
+		if got.Head != "fork:roll" || got.Base != "main" || !got.Draft || got.Title != "Roll BoringSSL 111111111111..222222222222" {
+			return fmt.Errorf("rollToPR requested the pull request %+v; want a draft from fork:roll to main", got)
+		}
+		for _, want := range []string{"Rolls BoringSSL from [111111111111](https://example.com/1111111111111111111111111111111111111111)", "### Security-relevant changes", "- [222222222222](https://example.com/2222222222222222222222222222222222222222) Fix a timing leak **(security)**"} {
+			if !strings.Contains(got.Body, want) {
+				return fmt.Errorf("the pull request body is %q; want it to contain %q", got.Body, want)
+			}
+		}
+
+		_, err = rollToPR("/tmp", "origin", "fork/boringssl", "main", "taken", "secret", "Roll", m, "https://example.com/{revision}")
+		if err == nil || !strings.Contains(err.Error(), "Validation Failed; A pull request already exists") || !strings.Contains(err.Error(), "pushed to taken of origin") {
+			return fmt.Errorf("rollToPR with an API error = %v; want the API's message and where the roll was pushed", err)
+		}
+		if err := checkPullRequest("/tmp", "origin", "boringssl", "secret"); err == nil {
+			return fmt.Errorf("checkPullRequest accepted a repository without an owner")
+		}
+		if err := checkPullRequest("/tmp", "origin", "fork/boringssl", ""); err == nil {
+			return fmt.Errorf("checkPullRequest accepted a missing token")
+		}
+		return nil
+	}},
+	{"generator nondeterminism", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		defer func() { generatorEnv = nil }()
+		generatorEnv = deterministicGeneratorEnv
+		cmd := generatorCommand(dir, defaultGenerator, []string{"gn"})
+		env := strings.Join(cmd.Env, "\n") + "\n"
+		for _, want := range []string{"SOURCE_DATE_EPOCH=0\n", "PYTHONHASHSEED=0\n"} {
+			if !strings.Contains(env, want) {
+				return fmt.Errorf("the generator runs with the environment %q; want it to include %s", cmd.Env, want)
+			}
+		}
+
+		util := filepath.Join(dir, "src", "util")
+		if err := os.MkdirAll(util, 0755); err != nil {
+			return err
+		}
+		write := func(output string) error {
+			script := "import os, time\nwith open('BUILD.generated.gni', 'w') as f:\n    f.write(" + output + ")\nopen('BUILD.generated_tests.gni', 'w').close()\n"
+			return ioutil.WriteFile(filepath.Join(util, "generate_build_files.py"), []byte(script), 0644)
+		}
+		if err := write(`os.environ["SOURCE_DATE_EPOCH"] + os.environ["PYTHONHASHSEED"]`); err != nil {
+			return err
+		}
+		if err := generateGN(log.Default(), dir, defaultGenerator, nil, []string{"gn"}, nil); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.generated.gni")); err != nil || string(b) != "00" {
+			return fmt.Errorf("the generator saw %q, %v; want SOURCE_DATE_EPOCH and PYTHONHASHSEED of 0", b, err)
+		}
+		if err := checkDeterministic(log.Default(), dir, defaultGenerator, nil, []string{"gn"}); err != nil {
+			return fmt.Errorf("checkDeterministic with a deterministic generator: %s", err)
+		}
+		if err := write(`str(time.time_ns())`); err != nil {
+			return err
+		}
+		err = checkDeterministic(log.Default(), dir, defaultGenerator, nil, []string{"gn"})
+		var gerr *generateError
+		if !errors.As(err, &gerr) || !strings.Contains(err.Error(), "different build files on a second run") || !strings.Contains(err.Error(), "BUILD.generated.gni") {
+			return fmt.Errorf("checkDeterministic with a generator embedding the time = %v; want a generate error naming BUILD.generated.gni", err)
+		}
+		return nil
+	}},
+	{"since roll", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		var b bytes.Buffer
+		if err := printRecentRolls(&b, dir, 3, false); err != nil || b.String() != "No rolls are recorded in "+historyName+"\n" {
+			return fmt.Errorf("printRecentRolls without a history printed %q, %v", b.String(), err)
+		}
+		start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		revs := []revision{"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222", "3333333333333333333333333333333333333333", "4444444444444444444444444444444444444444"}
+		for i := 1; i < len(revs); i++ {
+			e := historyEntry{Time: start.Add(time.Duration(i) * 24 * time.Hour), Old: revs[i-1], New: revs[i], Success: i != 2, Steps: []string{"sources", "gn"}}
+			if err := appendHistory(dir, &e); err != nil {
+				return err
+			}
+		}
+		b.Reset()
+		if err := printRecentRolls(&b, dir, 2, false); err != nil {
+			return err
+		}
+		want := "DATE              ROLL                        RESULT  STEPS\n" +
+			"2024-03-03 12:00  222222222222..333333333333  failed  sources,gn\n" +
+			"2024-03-04 12:00  333333333333..444444444444  ok      sources,gn\n"
+		if b.String() != want {
+			return fmt.Errorf("printRecentRolls of 2 printed\n%s\nwant\n%s", b.String(), want)
+		}
+		b.Reset()
+		if err := printRecentRolls(&b, dir, 10, false); err != nil || strings.Count(b.String(), "\n") != 4 {
+			return fmt.Errorf("printRecentRolls of 10 of 3 printed %q, %v; want all 3", b.String(), err)
+		}
+		b.Reset()
+		if err := printRecentRolls(&b, dir, 1, true); err != nil {
+			return err
+		}
+		var e historyEntry
+		if err := json.Unmarshal(b.Bytes(), &e); err != nil || e.New != revs[3] || strings.Count(b.String(), "\n") != 1 {
+			return fmt.Errorf("printRecentRolls with raw printed %q (%v); want the last history line", b.String(), err)
+		}
+		if err := printRecentRolls(&b, dir, 0, false); err == nil {
+			return fmt.Errorf("printRecentRolls of 0 succeeded")
+		}
+		return nil
+	}},
+	{"doctor", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		saved := lookPath
+		defer func() { lookPath = saved }()
+		lookPath = func(name string) (string, error) {
+			if name == "git" {
+				return saved(name)
+			}
+			return "", fmt.Errorf("%s: executable file not found in $PATH", name)
+		}
+		status := func(checks []doctorCheck, name string) string {
+			for _, c := range checks {
+				if c.name == name {
+					return c.status
+				}
+			}
+			return "missing"
+		}
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator}
+		checks := doctor(dir, opts)
+		if status(checks, "git") != "pass" || status(checks, "python") != "fail" || status(checks, "bindgen") != "fail" {
+			return fmt.Errorf("doctor without python or bindgen reported %+v; want git to pass and python and bindgen to fail", checks)
+		}
+		var b bytes.Buffer
+		if printDoctor(&b, checks) || !strings.Contains(b.String(), "[fail] python: not found in PATH") {
+			return fmt.Errorf("printDoctor without python printed %q and passed; want a failure for python", b.String())
+		}
+		opts.skip = []string{"gn", "rust"}
+		if got := status(doctor(dir, opts), "python"); got != "pass" {
+			return fmt.Errorf("doctor without python when the gn step is skipped reported %s; want pass", got)
+		}
+		return nil
+	}},
+	{"content-addressed store", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		src, cas := filepath.Join(dir, "src"), filepath.Join(dir, "cas")
+		for name, contents := range map[string]string{"a.c": "x\n", "crypto/b.c": "y\n", "d.c": "x\n"} {
+			path := filepath.Join(src, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		x, y := fmt.Sprintf("%x", sha256.Sum256([]byte("x\n"))), fmt.Sprintf("%x", sha256.Sum256([]byte("y\n")))
+		// y is already in the store, from an earlier roll.
+		if err := os.MkdirAll(filepath.Join(cas, y[:2]), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(cas, y[:2], y), []byte("y\n"), 0444); err != nil {
+			return err
+		}
+		manifest := filepath.Join(cas, "manifests", "2222222222222222222222222222222222222222")
+		if err := writeCAS(dir, cas, manifest); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(manifest)
+		if want := x + "  a.c\n" + y + "  crypto/b.c\n" + x + "  d.c\n"; err != nil || string(b) != want {
+			return fmt.Errorf("the CAS manifest is %q, %v; want %q", b, err, want)
+		}
+		same := func(a, b string) (bool, error) {
+			ai, err := os.Stat(a)
+			if err != nil {
+				return false, err
+			}
+			bi, err := os.Stat(b)
+			if err != nil {
+				return false, err
+			}
+			return os.SameFile(ai, bi), nil
+		}
+		if ok, err := same(filepath.Join(src, "a.c"), filepath.Join(cas, x[:2], x)); err != nil || !ok {
+			return fmt.Errorf("a.c was not hardlinked into the store by its hash: %v", err)
+		}
+		if ok, err := same(filepath.Join(src, "crypto", "b.c"), filepath.Join(cas, y[:2], y)); err != nil || ok {
+			return fmt.Errorf("crypto/b.c replaced the copy already in the store: %v", err)
+		}
+		return nil
+	}},
+	{"generated change attribution", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		generator := filepath.Join(dir, "src", filepath.FromSlash(defaultGenerator))
+		if err := os.MkdirAll(filepath.Dir(generator), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(generator, []byte("hello\n"), 0644); err != nil {
+			return err
+		}
+		// The hash git hash-object gives a file of "hello\n".
+		if blob, err := generatorBlob(dir, &rollOptions{generator: defaultGenerator}); err != nil || blob != "ce013625030ba8dba906f756967f9e9ca394464a" {
+			return fmt.Errorf("generatorBlob = %s, %v; want git's blob hash", blob, err)
+		}
+		old := &manifest{Revision: "1", GeneratorBlob: "aaaa", Outputs: map[string]string{"BUILD.generated.gni": "1", "BUILD.generated_tests.gni": "1", "rust/boringssl-sys/src/lib.rs": "1"}}
+		sourcesOnly := &manifest{Revision: "2", GeneratorBlob: "aaaa", Outputs: map[string]string{"BUILD.generated.gni": "2", "BUILD.generated_tests.gni": "1", "rust/boringssl-sys/src/lib.rs": "2"}}
+		want := "revision: 1 -> 2; changed: BUILD.generated.gni (from the sources; the generator is unchanged); changed: rust/boringssl-sys/src/lib.rs"
+		if got := strings.Join(diffManifests(old, sourcesOnly), "; "); got != want {
+			return fmt.Errorf("with the same generator, diffManifests = %q; want %q", got, want)
+		}
+		newGenerator := &manifest{Revision: "2", GeneratorBlob: "bbbb", Outputs: map[string]string{"BUILD.generated.gni": "2", "BUILD.generated_tests.gni": "2", "rust/boringssl-sys/src/lib.rs": "1"}}
+		want = "revision: 1 -> 2; generator blob: aaaa -> bbbb; changed: BUILD.generated.gni (the generator changed); changed: BUILD.generated_tests.gni (the generator changed)"
+		if got := strings.Join(diffManifests(old, newGenerator), "; "); got != want {
+			return fmt.Errorf("with a new generator, diffManifests = %q; want %q", got, want)
+		}
+		old.GeneratorBlob = ""
+		if cause := attributeOutputChange(old, newGenerator); cause != "unknown" {
+			return fmt.Errorf("attributing a change without the previous generator hash = %s; want unknown", cause)
+		}
+		return nil
+	}},
+	{"diffstat", func() error {
+		saved := gitDiffStat
+		defer func() { gitDiffStat = saved }()
+		const old, new = revision("1111111111111111111111111111111111111111"), revision("2222222222222222222222222222222222222222")
+		var ran []string
+		gitDiffStat = func(dir string, o, n revision, stat string) (string, error) {
+			ran = append(ran, stat)
+			if o != old || n != new {
+				return "", fmt.Errorf("diffed %s..%s; want %s..%s", o, n, old, new)
+			}
+			if stat == "--shortstat" {
+				return " 12 files changed, 340 insertions(+), 1 deletion(-)\n", nil
+			}
+			return "  62.5% crypto/fipsmodule/\n  37.5% ssl/\n", nil
+		}
+		s, err := recordDiffStat("src", old, new)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		printSummary(&buf, &manifest{Revision: string(old)}, &manifest{Revision: string(new), PreviousRevision: string(old), DiffStat: s})
+		const want = "revision: 1111111111111111111111111111111111111111 -> 2222222222222222222222222222222222222222\n" +
+			"upstream diff: 12 files changed, 340 insertions(+), 1 deletion(-)\n" +
+			"   62.5% crypto/fipsmodule/\n   37.5% ssl/\n"
+		if buf.String() != want {
+			return fmt.Errorf("printSummary printed %q; want %q", buf.String(), want)
+		}
+		ran = nil
+		if s, err := recordDiffStat("src", new, new); err != nil || s.String() != "0 files changed, 0 insertions(+), 0 deletions(-)" || len(ran) != 0 {
+			return fmt.Errorf("recordDiffStat of an empty range = %v, %v after running %q; want no changes without running git", s, err, ran)
+		}
+		var report bytes.Buffer
+		if err := renderReport(&report, &manifest{Revision: string(new), DiffStat: &diffStat{Files: 1, Insertions: 2}}, defaultCommitURL); err != nil {
+			return err
+		}
+		if want := "<li>Upstream diff: 1 file changed, 2 insertions"; !strings.Contains(report.String(), want) {
+			return fmt.Errorf("the report does not contain %q:\n%s", want, report.String())
+		}
+		return nil
+	}},
+	{"summary only", func() error {
+		old := &manifest{
+			Revision:       "1111111111111111111111111111111111111111",
+			BindgenVersion: "0.59.2",
+			BuildFormats:   []string{"gn"},
+			SourcesSize:    1 << 20,
+			Outputs:        map[string]string{"BUILD.generated.gni": "aa", "README.fuchsia": "bb", "rust/boringssl-sys/src/lib.rs": "cc", "version.h": "dd"},
+		}
+		new := &manifest{
+			Revision:         "2222222222222222222222222222222222222222",
+			PreviousRevision: old.Revision,
+			BindgenVersion:   "0.59.2",
+			BuildFormats:     []string{"gn"},
+			SourcesSize:      3 << 19,
+			CommitCount:      4,
+			Outputs:          map[string]string{"BUILD.generated.gni": "ab", "README.fuchsia": "bc", "rust/boringssl-sys/src/lib.rs": "cc", "src/.checksums": "ee"},
+		}
+		want := []string{
+			"revision: 1111111111111111111111111111111111111111 -> 2222222222222222222222222222222222222222",
+			"sources size: 1.5 MiB (+0.5 MiB)",
+			"changed: BUILD.generated.gni",
+			"changed: README.fuchsia",
+			"added: src/.checksums",
+			"removed: version.h",
+		}
+		if got := diffManifests(old, new); fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("diffManifests = %q; want %q", got, want)
+		}
+		if got := diffManifests(old, old); len(got) != 0 {
+			return fmt.Errorf("diffManifests of a manifest with itself = %q; want nothing", got)
+		}
+		newer := *new
+		newer.BindgenVersion, newer.Generator = "0.60.1", "/tmp/generate.py"
+		want = []string{"bindgen: 0.59.2 -> 0.60.1", "generator: upstream -> /tmp/generate.py"}
+		if got := diffManifests(new, &newer); fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("diffManifests of a changed toolchain = %q; want %q", got, want)
+		}
+
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "manifest.json")
+		if m, err := readManifest(path); m != nil || err != nil {
+			return fmt.Errorf("readManifest of a missing manifest = %v, %v; want nil, nil", m, err)
+		}
+		var b bytes.Buffer
+		printSummary(&b, nil, new)
+		if !strings.Contains(b.String(), "no previous manifest") {
+			return fmt.Errorf("printSummary without a previous manifest = %q; want it to say so", b.String())
+		}
+		if err := writeManifest(path, old); err != nil {
+			return err
+		}
+		if m, err := readManifest(path); err != nil || len(diffManifests(old, m)) != 0 {
+			return fmt.Errorf("readManifest did not read back what writeManifest wrote: %v", err)
+		}
+		return nil
+	}},
+	{"allowed authors", func() error {
+		commits := []commitIdentity{
+			{"1111111111111111111111111111111111111111", "davidben@google.com", "davidben@google.com", "Fix the build"},
+			{"2222222222222222222222222222222222222222", "Agl@Google.com", "bot@example.com", "Update a test"},
+			{"3333333333333333333333333333333333333333", "mallory@example.org", "mallory@example.org", "Tidy up"},
+		}
+		allowed := []string{"agl@google.com", `/.*@google\.com/`, "bot@example.com"}
+		if err := checkAuthors(commits[:2], allowed); err != nil {
+			return fmt.Errorf("checkAuthors of allowed commits: %s", err)
+		}
+		err := checkAuthors(commits, allowed)
+		if err == nil || !strings.Contains(err.Error(), "333333333333 Tidy up (author mallory@example.org)") || strings.Contains(err.Error(), "Fix the build") {
+			return fmt.Errorf("checkAuthors with an unrecognized author = %v; want only 333333333333 named", err)
+		}
+		if err := checkAuthors(commits[:1], []string{`/.*@google.com/`, "/[/"}); err == nil {
+			return fmt.Errorf("checkAuthors with an invalid regexp succeeded")
+		}
+		if err := checkAuthors(commits[1:2], []string{"agl@google.com"}); err == nil || !strings.Contains(err.Error(), "committer bot@example.com") {
+			return fmt.Errorf("checkAuthors with an unrecognized committer = %v; want it named", err)
+		}
+
+		saved := commitIdentities
+		defer func() { commitIdentities = saved }()
+		commitIdentities = func(dir string, old, sha1 revision) ([]commitIdentity, error) { return commits, nil }
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		src := filepath.Join(dir, "src")
+		if err := os.Mkdir(src, 0755); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "-C", src, "init", "-q")); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "-C", src, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "base")); err != nil {
+			return err
+		}
+		base, err := output(exec.Command("git", "-C", src, "rev-parse", "HEAD"))
+		if err != nil {
+			return err
+		}
+		old := revision(strings.TrimSpace(string(base)))
+		err = checkRollAuthors(dir, old, commits[0].sha1, &rollOptions{allowedAuthors: allowed})
+		if err == nil || !strings.Contains(err.Error(), "mallory@example.org") {
+			return fmt.Errorf("checkRollAuthors = %v; want an abort naming mallory@example.org", err)
+		}
+		return nil
+	}},
+	{"upstream branch", func() error {
+		defer func(f func(string, string) (datedCommit, error)) { branchTip = f }(branchTip)
+		defer func(f func(string, revision, revision) (bool, error)) { isAncestor = f }(isAncestor)
+		const (
+			tip     = revision("3333333333333333333333333333333333333333")
+			onIt    = revision("2222222222222222222222222222222222222222")
+			offIt   = revision("1111111111111111111111111111111111111111")
+			trusted = "origin/upstream/master"
+		)
+		branchTip = func(_, branch string) (datedCommit, error) {
+			if branch != trusted {
+				return datedCommit{}, fmt.Errorf("branch %s has no commits", branch)
+			}
+			return datedCommit{sha1: tip}, nil
+		}
+		isAncestor = func(_ string, a, b revision) (bool, error) {
+			if b != tip {
+				return false, fmt.Errorf("isAncestor(%s, %s); want the tip of %s", a, b, trusted)
+			}
+			return a == onIt || a == tip, nil
+		}
+		if err := checkOnBranch("src", onIt, trusted, false); err != nil {
+			return fmt.Errorf("checkOnBranch of a commit on the branch: %s", err)
+		}
+		if err := checkOnBranch("src", offIt, trusted, false); err == nil || !strings.Contains(err.Error(), "111111111111 is not on the upstream branch "+trusted) {
+			return fmt.Errorf("checkOnBranch of a commit off the branch = %v; want it refused", err)
+		}
+		if err := checkOnBranch("src", offIt, trusted, true); err != nil {
+			return fmt.Errorf("checkOnBranch of a commit off the branch with --allow-offbranch: %s", err)
+		}
+		if err := checkOnBranch("src", onIt, "origin/fork", true); err == nil || !strings.Contains(err.Error(), "failed to resolve --upstream-branch origin/fork") {
+			return fmt.Errorf("checkOnBranch of a missing branch = %v; want it to fail even with --allow-offbranch", err)
+		}
+		return nil
+	}},
+	{"signed tags", func() error {
+		src, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(src)
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		for _, args := range [][]string{{"init", "-q"}, {"commit", "-q", "--allow-empty", "-m", "Release"}, {"tag", "light"}, {"tag", "-a", "-m", "BoringSSL 1.0", "v1.0"}} {
+			if err := git(args...); err != nil {
+				return err
+			}
+		}
+		const fpr, primary = "1234567890ABCDEF1234567890ABCDEF12345678", "FEDCBA0987654321FEDCBA0987654321FEDCBA09"
+		saved := verifyTag
+		defer func() { verifyTag = saved }()
+		var verified []string
+		signature := "[GNUPG:] NEWSIG\n[GNUPG:] GOODSIG 90ABCDEF12345678 Release Signer\n[GNUPG:] VALIDSIG " + fpr + " 2024-01-01 1704067200 0 4 0 1 10 00 " + primary + "\n"
+		var verifyErr error
+		verifyTag = func(_, tag string) (string, error) {
+			verified = append(verified, tag)
+			return signature, verifyErr
+		}
+		for _, c := range []struct {
+			name, commit string
+			trusted      []string
+			verifyErr    error
+			want         string
+		}{
+			{"signed by a trusted key", "v1.0", []string{fpr}, nil, ""},
+			{"signed by a subkey of a trusted key ID", "refs/tags/v1.0", []string{"0x" + primary[24:]}, nil, ""},
+			{"not a tag", "HEAD", []string{fpr}, nil, ""},
+			{"unsigned", "v1.0", []string{fpr}, errors.New("error: no signature found"), "is not signed with a valid signature"},
+			{"signed by another key", "v1.0", []string{"AAAAAAAAAAAAAAAA"}, nil, "which is not one of --trusted-key"},
+			{"lightweight", "light", []string{fpr}, nil, "is a lightweight tag"},
+		} {
+			verified, verifyErr = nil, c.verifyErr
+			err := checkTagSignature(src, c.commit, c.trusted)
+			if c.want == "" && err != nil || c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+				return fmt.Errorf("checkTagSignature of a tag %s = %v; want %q", c.name, err, c.want)
+			}
+			wantVerified := c.commit != "HEAD" && c.commit != "light"
+			if (len(verified) == 1) != wantVerified || wantVerified && verified[0] != "refs/tags/v1.0" {
+				return fmt.Errorf("checking a tag %s verified %q", c.name, verified)
+			}
+		}
+		return nil
+	}},
+	{"verify tree matches commit", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		upstream, src := filepath.Join(dir, "upstream"), filepath.Join(dir, "src")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-C", upstream, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		for name, content := range map[string]string{"crypto/a.c": "int a;\n", "crypto/a_test.cc": "TEST(A, B) {}\n", "ssl/s.c": "int s;\n"} {
+			p := filepath.Join(upstream, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		if err := git("init", "-q"); err != nil {
+			return err
+		}
+		if err := git("add", "-A"); err != nil {
+			return err
+		}
+		if err := git("commit", "-q", "-m", "Initial commit"); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "clone", "-q", upstream, src)); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		writeReadMe := func(sha1 revision) error {
+			return ioutil.WriteFile(filepath.Join(dir, readmeName), []byte("Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/"+string(sha1)+"/\n"), 0644)
+		}
+		if err := writeReadMe(head); err != nil {
+			return err
+		}
+		// A roll with --exclude leaves the tests out of src, which verifying ignores.
+		if err := os.Remove(filepath.Join(src, "crypto", "a_test.cc")); err != nil {
+			return err
+		}
+		opts := &rollOptions{excludes: []string{"crypto/*_test.cc"}}
+		if err := verifySources(dir, opts); err != nil {
+			return fmt.Errorf("verifying the untouched tree: %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "crypto", "a.c"), []byte("int a = 1;\n"), 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "ssl", "extra.c"), nil, 0644); err != nil {
+			return err
+		}
+		err = verifySources(dir, opts)
+		if err == nil || !strings.Contains(err.Error(), "2 differences") || !strings.Contains(err.Error(), "modified: crypto/a.c") || !strings.Contains(err.Error(), "unexpected: ssl/extra.c") {
+			return fmt.Errorf("verifying the tampered tree = %v; want it to name crypto/a.c and ssl/extra.c", err)
+		}
+		if err := writeReadMe(revision(strings.Repeat("1", 40))); err != nil {
+			return err
+		}
+		if err := verifySources(dir, opts); err == nil || !strings.Contains(err.Error(), "does not fetch it") {
+			return fmt.Errorf("verifying against a revision not in src = %v; want it missing", err)
+		}
+		return nil
+	}},
+	{"projects", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		// Sets up the project |name| with its README at |readme| and an upstream one commit ahead of src.
+		heads := make(map[string]revision)
+		setUp := func(name, readme string) error {
+			upstream, dir := filepath.Join(tmp, name+"-upstream"), filepath.Join(tmp, name)
+			commit := func(file string) error {
+				if err := ioutil.WriteFile(filepath.Join(upstream, file), []byte(file), 0644); err != nil {
+					return err
+				}
+				if err := git("-C", upstream, "add", file); err != nil {
+					return err
+				}
+				return git("-C", upstream, "commit", "-q", "-m", "Add "+file)
+			}
+			if err := git("init", "-q", upstream); err != nil {
+				return err
+			}
+			if err := commit("a.c"); err != nil {
+				return err
+			}
+			if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+				return err
+			}
+			old, err := revParse(upstream, "HEAD")
+			if err != nil {
+				return err
+			}
+			content := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/" + name + "/+/" + string(old) + "/\n"
+			if err := ioutil.WriteFile(filepath.Join(dir, readme), []byte(content), 0644); err != nil {
+				return err
+			}
+			if err := commit("b.c"); err != nil {
+				return err
+			}
+			if heads[name], err = revParse(upstream, "HEAD"); err != nil {
+				return err
+			}
+			return git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto")
+		}
+		if err := setUp("boringssl", readmeName); err != nil {
+			return err
+		}
+		if err := setUp("zlib", "README.vendor"); err != nil {
+			return err
+		}
+		list := filepath.Join(tmp, "projects.json")
+		if err := ioutil.WriteFile(list, []byte(`[{"name": "boringssl"}, {"name": "missing", "dir": "missing"}, {"name": "zlib", "dir": "zlib", "readme": "README.vendor"}]`), 0644); err != nil {
+			return err
+		}
+		projects, err := readProjects(list, filepath.Join(tmp, "boringssl"))
+		if err != nil {
+			return err
+		}
+		if projects[0].Dir != filepath.Join(tmp, "boringssl") || projects[2].Dir != filepath.Join(tmp, "zlib") {
+			return fmt.Errorf("readProjects resolved the directories to %s and %s", projects[0].Dir, projects[2].Dir)
+		}
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, skip: []string{"headers", "gn", "absolute-paths", "rust"}}
+		var b bytes.Buffer
+		if printProjectResults(&b, rollProjects(projects, opts, false, false), len(projects)) || !strings.Contains(b.String(), "1 projects were not rolled") {
+			return fmt.Errorf("rolling the projects without --continue-on-error reported %q; want zlib not rolled", b.String())
+		}
+		b.Reset()
+		if printProjectResults(&b, rollProjects(projects, opts, true, false), len(projects)) {
+			return fmt.Errorf("rolling the projects with one missing succeeded")
+		}
+		want := fmt.Sprintf("[ok]   boringssl: rolled to %s\n[fail] missing: ", heads["boringssl"].short())
+		if !strings.HasPrefix(b.String(), want) || !strings.HasSuffix(b.String(), fmt.Sprintf("[ok]   zlib: rolled to %s\n", heads["zlib"].short())) {
+			return fmt.Errorf("rolling the projects reported %q; want boringssl and zlib rolled and missing failed", b.String())
+		}
+		for name, readme := range map[string]string{"boringssl": readmeName, "zlib": "README.vendor"} {
+			if b, err := ioutil.ReadFile(filepath.Join(tmp, name, readme)); err != nil || !strings.Contains(string(b), string(heads[name])) {
+				return fmt.Errorf("the %s README is %q (%v); want it at %s", name, b, err, heads[name])
+			}
+		}
+		if readmeName != "README.fuchsia" {
+			return fmt.Errorf("rolling the projects left the README name as %s", readmeName)
+		}
+		return nil
+	}},
+	{"malformed readme", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+		for _, c := range []struct {
+			name, content, want string
+		}{
+			{"empty", "", readmeName + " is empty"},
+			{"binary", "\x7fELF\x02\x01\x01\x00\xff\xfe", readmeName + " is not UTF-8 text"},
+			{"text with a NUL", "Name: boringssl\x00\n", readmeName + " is not UTF-8 text"},
+			{"no URL", "Name: boringssl\nVersion: git\n", readmeName + " does not end with an upstream revision URL"},
+		} {
+			path := filepath.Join(dir, readmeName)
+			if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+				return err
+			}
+			err := updateReadMe(dir, sha1)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				return fmt.Errorf("updateReadMe of the %s README = %v; want %q", c.name, err, c.want)
+			}
+			if b, err := ioutil.ReadFile(path); err != nil || string(b) != c.content {
+				return fmt.Errorf("updateReadMe of the %s README changed it to %q (%v)", c.name, b, err)
+			}
+		}
+		// The URL need not be followed by exactly one newline.
+		const readme = "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/%s/\n\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(fmt.Sprintf(readme, strings.Repeat("0", 40))), 0644); err != nil {
+			return err
+		}
+		if err := updateReadMe(dir, sha1); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || string(b) != fmt.Sprintf(readme, sha1) {
+			return fmt.Errorf("updateReadMe wrote %q (%v); want %q", b, err, fmt.Sprintf(readme, sha1))
+		}
+		return nil
+	}},
+	{"concurrent readme edit", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		defer func(f func(string) ([]byte, error)) { readReadMeFile = f }(readReadMeFile)
+		const (
+			old     = revision("0000000000000000000000000000000000000000")
+			sha1    = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+			readme  = "Name: boringssl\n\nUpstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/%s/\n"
+			comment = "Security Critical: yes\n"
+		)
+		path := filepath.Join(dir, readmeName)
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(readme, old)), 0644); err != nil {
+			return err
+		}
+
+		// Another tool adds a line above the URL just after the first read, moving the revision.
+		reads := 0
+		readReadMeFile = func(name string) ([]byte, error) {
+			b, err := ioutil.ReadFile(name)
+			if reads++; reads == 1 && err == nil {
+				err = ioutil.WriteFile(name, []byte(comment+string(b)), 0644)
+			}
+			return b, err
+		}
+		if err := updateReadMe(dir, sha1); err != nil {
+			return err
+		}
+		want := comment + fmt.Sprintf(readme, sha1)
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != want {
+			return fmt.Errorf("updateReadMe after a concurrent edit wrote %q (%v); want %q", b, err, want)
+		}
+		if reads != 2 {
+			return fmt.Errorf("updateReadMe read %s %d times; want once more after the edit", readmeName, reads)
+		}
+		// Updating it again to the same revision leaves it alone.
+		if err := updateReadMe(dir, sha1); err != nil {
+			return err
+		}
+
+		// An edit that removes the URL fails the update.
+		reads = 0
+		readReadMeFile = func(name string) ([]byte, error) {
+			b, err := ioutil.ReadFile(name)
+			if reads++; reads == 1 && err == nil {
+				err = ioutil.WriteFile(name, []byte("Name: boringssl\n"), 0644)
+			}
+			return b, err
+		}
+		if err := updateReadMe(dir, old); err == nil || !strings.Contains(err.Error(), "does not end with an upstream revision URL") {
+			return fmt.Errorf("updateReadMe after the URL was removed = %v; want it not found", err)
+		}
+		return nil
+	}},
+	{"step timeouts", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		var timeouts stepDurationsFlag
+		for _, v := range []string{"gn=200ms", "rust=20m"} {
+			if err := timeouts.Set(v); err != nil {
+				return err
+			}
+		}
+		for _, bad := range []string{"gn", "generate=1m", "gn=soon", "gn=-1s"} {
+			if err := timeouts.Set(bad); err == nil {
+				return fmt.Errorf("--step-timeout %q was accepted", bad)
+			}
+		}
+		if got := fmt.Sprint(timeouts.Get()); got != "map[gn:200ms rust:20m0s]" {
+			return fmt.Errorf("--step-timeout settings are %s", got)
+		}
+		opts := &rollOptions{timeout: 5 * time.Second, stepTimeouts: timeouts}
+		for name, want := range map[string]string{"gn": "200ms --step-timeout", "rust": "20m0s --step-timeout", "sources": "5s --timeout"} {
+			if d, source := stepTimeout(name, opts); fmt.Sprint(d, " ", source) != want {
+				return fmt.Errorf("stepTimeout(%q) = %s, %s; want %s", name, d, source, want)
+			}
+		}
+		sleep := func(name, duration string) step {
+			return step{name: name, run: func() error { return run(exec.Command("sleep", duration)) }}
+		}
+		m := &manifest{}
+		start := time.Now()
+		completed, err := runSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", timeSteps(limitSteps([]step{sleep("sources", "0.3"), sleep("gn", "10")}, opts), m), false, 1, true)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			return fmt.Errorf("the steps took %s; want the gn step killed after 200ms", elapsed)
+		}
+		if fmt.Sprint(completed) != "[sources]" || failedStep(err) != "gn" || !strings.Contains(err.Error(), "timed out after 200ms") {
+			return fmt.Errorf("runSteps completed %q, %v; want sources to complete under --timeout and gn to time out", completed, err)
+		}
+		if len(m.Steps) != 2 || m.Steps[1].Seconds > 2 {
+			return fmt.Errorf("the steps were timed as %v; want gn stopped at its timeout", m.Steps)
+		}
+		return nil
+	}},
+	{"heartbeats", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		slow := step{name: "gn", logged: func(l *log.Logger) error {
+			time.Sleep(350 * time.Millisecond)
+			return nil
+		}}
+		slow.run = func() error { return slow.logged(log.Default()) }
+		opts := &rollOptions{heartbeatInterval: 100 * time.Millisecond, stepBudgets: map[string]time.Duration{"gn": 200 * time.Millisecond}}
+		var buf bytes.Buffer
+		l := log.New(&buf, "", 0)
+		if err := watchSteps([]step{slow}, opts)[0].logged(l); err != nil {
+			return err
+		}
+		if !strings.Contains(buf.String(), "Still running gn after 100ms\n") {
+			return fmt.Errorf("the slow step logged %q; want a heartbeat", buf.String())
+		}
+		if strings.Count(buf.String(), "WARNING: gn has run for longer than its budget of 200ms from --step-budget") != 1 {
+			return fmt.Errorf("the slow step logged %q; want one warning that it is over its budget", buf.String())
+		}
+		// The heartbeats stop with the step.
+		logged := buf.String()
+		time.Sleep(150 * time.Millisecond)
+		if buf.String() != logged {
+			return fmt.Errorf("the step logged %q after it finished", strings.TrimPrefix(buf.String(), logged))
+		}
+		quick := watchSteps([]step{{name: "readme", run: func() error { return errors.New("failed") }}}, &rollOptions{})[0]
+		if err := quick.run(); err == nil || err.Error() != "failed" {
+			return fmt.Errorf("a step without heartbeats returned %v; want its own error", err)
+		}
+		return nil
+	}},
+	{"fail fast", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		var ran []string
+		steps := func(sourcesErr error) []step {
+			record := func(name string, err error) step {
+				return step{name: name, run: func() error {
+					ran = append(ran, name)
+					return err
+				}}
+			}
+			s := record("sources", sourcesErr)
+			s.required = true
+			return []step{s, record("gn", errors.New("generation failed")), record("rust", errors.New("bindgen failed")), record("readme", nil)}
+		}
+		const sha1 = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		completed, err := runSteps(dir, sha1, steps(nil), false, 1, false)
+		var failures stepErrors
+		if !errors.As(err, &failures) || len(failures) != 2 || !strings.Contains(err.Error(), "generation failed") || !strings.Contains(err.Error(), "bindgen failed") {
+			return fmt.Errorf("runSteps without fail-fast = %v; want both failures", err)
+		}
+		if fmt.Sprint(completed) != "[sources readme]" {
+			return fmt.Errorf("completed %q; want sources and readme", completed)
+		}
+		ran = nil
+		if _, err := runSteps(dir, sha1, steps(errors.New("checkout failed")), false, 1, false); err == nil || fmt.Sprint(ran) != "[sources]" {
+			return fmt.Errorf("after a failed sources step, ran %q with %v; want only sources", ran, err)
+		}
+		ran = nil
+		if _, err := runSteps(dir, sha1, steps(nil), false, 1, true); failedStep(err) != "gn" || fmt.Sprint(ran) != "[sources gn]" {
+			return fmt.Errorf("with fail-fast, ran %q with %v; want to stop at gn", ran, err)
+		}
+		return nil
+	}},
+	{"json logs", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		var buf bytes.Buffer
+		defer func(w io.Writer, flags int) {
+			jsonLog, logOutput = nil, w
+			log.SetOutput(w)
+			log.SetFlags(flags)
+		}(logOutput, log.Flags())
+		jsonLog = &jsonLogWriter{mu: &sync.Mutex{}, w: &buf}
+		logOutput = jsonLog
+		log.SetOutput(logOutput)
+		log.SetFlags(0)
+
+		steps := []step{
+			{name: "sources", run: func() error {
+				log.Printf("Updating sources...")
+				return run(exec.Command("sh", "-c", "echo checked out"))
+			}},
+			loggedStep("symbols", "", func(l *log.Logger) error {
+				l.Printf("WARNING: 2 symbols were removed")
+				return nil
+			}),
+			loggedStep("fips", "", func(l *log.Logger) error {
+				return &stepError{"fips", errors.New("src is missing crypto/fipsmodule/bcm.c")}
+			}),
+		}
+		_, err = runSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", steps, false, 2, true)
+		if failedStep(err) != "fips" {
+			return fmt.Errorf("runSteps failed with %v; want the fips step to fail", err)
+		}
+		logError(err)
+		log.Printf("done")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				return fmt.Errorf("log line %q is not JSON: %s", line, err)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(e["time"])); err != nil {
+				return fmt.Errorf("log line %q has no time: %s", line, err)
+			}
+			if _, ok := e["message"].(string); !ok {
+				return fmt.Errorf("log line %q has no message", line)
+			}
+			if d, ok := e["duration_seconds"].(float64); ok && d <= 0 {
+				return fmt.Errorf("log line %q has a duration of %g", line, d)
+			}
+			// The events of the concurrent steps come in either order.
+			if _, ok := e["error_type"]; !ok && (e["step"] == "symbols" || e["step"] == "fips") {
+				continue
+			}
+			delete(e, "time")
+			delete(e, "duration_seconds")
+			b, _ := json.Marshal(e)
+			got = append(got, string(b))
+		}
+		want := []string{
+			`{"level":"info","message":"Updating sources...","step":"sources"}`,
+			`{"level":"info","message":"checked out","step":"sources"}`,
+			`{"level":"info","message":"finished","step":"sources"}`,
+			`{"level":"info","message":"Running symbols, fips concurrently..."}`,
+			`{"error_type":"step","level":"error","message":"fips: src is missing crypto/fipsmodule/bcm.c","step":"fips"}`,
+			`{"level":"info","message":"done"}`,
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			return fmt.Errorf("the JSON log has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		for _, want := range []string{
+			`"level":"warning","step":"symbols","message":"2 symbols were removed"`,
+			`"level":"info","step":"symbols","message":"finished","duration_seconds":`,
+			`"level":"error","step":"fips","message":"failed","duration_seconds":`,
+		} {
+			if !strings.Contains(buf.String(), want) {
+				return fmt.Errorf("the JSON log has no event with %s", want)
+			}
+		}
+		return nil
+	}},
+	{"no-readme", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const readme = "Source: https://fuchsia.googlesource.com/third_party/boringssl/+/1111111111111111111111111111111111111111/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		opts := &rollOptions{skip: []string{"sources", "headers", "gn", "absolute-paths", "rust", "readme"}}
+		steps := rollSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, &manifest{})
+		if len(steps) != 0 {
+			return fmt.Errorf("rollSteps with every step skipped has %d steps", len(steps))
+		}
+		if _, err := runSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", steps, false, 1, true); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || string(b) != readme {
+			return fmt.Errorf("README is %q, %v after a roll with --no-readme; want it untouched", b, err)
+		}
+		return nil
+	}},
+	{"require linear", func() error {
+		const sha1 = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		merge := []revision{"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"}
+		if err := checkLinear(sha1, merge); err == nil || !strings.Contains(err.Error(), string(merge[0])) {
+			return fmt.Errorf("checkLinear of a merge = %v; want an error suggesting %s", err, merge[0])
+		}
+		return checkLinear(sha1, merge[:1])
+	}},
+	{"export-ignore", func() error {
+		const sha1 = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		for _, a := range archiveArgs(sha1, "", true) {
+			if a == "--worktree-attributes" {
+				return fmt.Errorf("archiveArgs with --no-export-ignore has --worktree-attributes")
+			}
+		}
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		repo := filepath.Join(tmp, "repo")
+		if err := os.MkdirAll(repo, 0755); err != nil {
+			return err
+		}
+		for name, content := range map[string]string{".gitattributes": "fuzz export-ignore\n", "fuzz": "corpus\n", "a.c": "int a;\n"} {
+			if err := ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"commit", "-q", "-m", "Initial commit"}} {
+			if err := run(exec.Command("git", append([]string{"-C", repo, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)); err != nil {
+				return err
+			}
+		}
+		head, err := revParse(repo, "HEAD")
+		if err != nil {
+			return err
+		}
+		for _, raw := range []bool{false, true} {
+			dst := filepath.Join(tmp, fmt.Sprint(raw))
+			if err := (&gitArchiveExtractor{dir: repo, noExportIgnore: raw}).extract(head, dst); err != nil {
+				return err
+			}
+			if _, err := os.Stat(filepath.Join(dst, "fuzz")); os.IsNotExist(err) == raw {
+				return fmt.Errorf("with noExportIgnore %t, extracted fuzz: %t", raw, err == nil)
+			}
+		}
+		return nil
+	}},
+	{"extractors", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		repo := filepath.Join(tmp, "repo")
+		for name, content := range map[string]string{"crypto/a.c": "int a;\n", "include/openssl/ssl.h": "/* ssl */\n", "README.md": "docs\n"} {
+			p := filepath.Join(repo, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		git := func(args ...string) ([]byte, error) {
+			return output(exec.Command("git", append([]string{"-C", repo, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		if _, err := git("init", "-q"); err != nil {
+			return err
+		}
+		if _, err := git("add", "-A"); err != nil {
+			return err
+		}
+		if _, err := git("commit", "-q", "-m", "Initial commit"); err != nil {
+			return err
+		}
+		head, err := revParse(repo, "HEAD")
+		if err != nil {
+			return err
+		}
+		tarball, err := git("archive", "--format=tar.gz", string(head))
+		if err != nil {
+			return err
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/"+string(head)+".tar.gz" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(tarball)
+		}))
+		defer server.Close()
+
+		fromGit, fromTarball := filepath.Join(tmp, "git"), filepath.Join(tmp, "tarball")
+		if err := (&gitArchiveExtractor{dir: repo}).extract(head, fromGit); err != nil {
+			return err
+		}
+		sum := fmt.Sprintf("%x", sha256.Sum256(tarball))
+		if err := (&tarballExtractor{url: server.URL + "/{revision}.tar.gz", sha256: sum}).extract(head, fromTarball); err != nil {
+			return err
+		}
+		diffs, err := diffDirs(fromGit, fromTarball, func(string) bool { return false })
+		if err != nil || len(diffs) > 0 {
+			return fmt.Errorf("extracted trees differ: %q, %v", diffs, err)
+		}
+		if err := (&tarballExtractor{url: server.URL + "/{revision}.tar.gz", sha256: strings.Repeat("0", 64)}).extract(head, filepath.Join(tmp, "bad")); err == nil {
+			return fmt.Errorf("extracting a tarball with the wrong digest succeeded")
+		}
+		return nil
+	}},
+	{"zip archives", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		makeZip := func(files map[string]string) ([]byte, error) {
+			var buf bytes.Buffer
+			w := zip.NewWriter(&buf)
+			var names []string
+			for name := range files {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				f, err := w.Create(name)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := io.WriteString(f, files[name]); err != nil {
+					return nil, err
+				}
+			}
+			err := w.Close()
+			return buf.Bytes(), err
+		}
+		archive, err := makeZip(map[string]string{"boringssl-abc/crypto/a.c": "int a;\n", "boringssl-abc/include/openssl/ssl.h": "/* ssl */\n"})
+		if err != nil {
+			return err
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		defer server.Close()
+		sum := fmt.Sprintf("%x", sha256.Sum256(archive))
+		dst := filepath.Join(tmp, "zip")
+		if err := (&tarballExtractor{url: server.URL + "/{revision}.zip", sha256: sum, format: "zip", opts: tarOptions{stripComponents: 1}}).extract(revision(strings.Repeat("1", 40)), dst); err != nil {
+			return err
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dst, "include", "openssl", "ssl.h")); err != nil || string(b) != "/* ssl */\n" {
+			return fmt.Errorf("the nested file was extracted as %q (%v); want its contents", b, err)
+		}
+		if err := (&tarballExtractor{url: server.URL + "/{revision}.zip", sha256: strings.Repeat("0", 64), format: "zip"}).extract(revision(strings.Repeat("1", 40)), filepath.Join(tmp, "bad")); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+			return fmt.Errorf("extracting a zip archive with the wrong digest = %v; want a digest mismatch", err)
+		}
+		for _, c := range []struct {
+			name  string
+			strip int
+		}{{"../escaped.c", 0}, {"boringssl-abc/../../escaped.c", 1}} {
+			evil, err := makeZip(map[string]string{"boringssl-abc/crypto/a.c": "int a;\n", c.name: "int escaped;\n"})
+			if err != nil {
+				return err
+			}
+			dst := filepath.Join(tmp, "evil", "dst")
+			if err := extractZip(evil, dst, tarOptions{stripComponents: c.strip}); err == nil {
+				return fmt.Errorf("extracting the zip entry %q with %d components stripped succeeded", c.name, c.strip)
+			}
+			if _, err := os.Stat(filepath.Join(tmp, "evil", "escaped.c")); !os.IsNotExist(err) {
+				return fmt.Errorf("the zip entry %q was written outside the destination", c.name)
+			}
+			os.RemoveAll(filepath.Join(tmp, "evil"))
+		}
+		return nil
+	}},
+	{"http client", func() error {
+		var proxied []string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A proxy is sent the absolute URL of the request.
+			proxied = append(proxied, r.URL.String())
+			io.WriteString(w, "via proxy")
+		}))
+		defer proxy.Close()
+		client, err := newHTTPClient(proxy.URL, false, time.Minute)
+		if err != nil {
+			return err
+		}
+		if client.Timeout != time.Minute {
+			return fmt.Errorf("the client has timeout %s; want 1m", client.Timeout)
+		}
+		resp, err := client.Get("http://boringssl.example/archive.tar.gz")
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "via proxy" || fmt.Sprint(proxied) != "[http://boringssl.example/archive.tar.gz]" {
+			return fmt.Errorf("the request through --http-proxy got %q (%v) and the proxy saw %q", body, err, proxied)
+		}
+		if _, err := newHTTPClient("proxy:3128", false, 0); err == nil {
+			return fmt.Errorf("newHTTPClient accepted a proxy that is not a URL")
+		}
+		for _, c := range []struct {
+			network   string
+			forceIPv4 bool
+			want      string
+		}{{"tcp", false, "tcp"}, {"tcp", true, "tcp4"}, {"tcp6", true, "tcp4"}, {"udp", true, "udp"}} {
+			if got := dialNetwork(c.network, c.forceIPv4); got != c.want {
+				return fmt.Errorf("dialNetwork(%q, %t) = %q; want %q", c.network, c.forceIPv4, got, c.want)
+			}
+		}
+		ipv4, err := newHTTPClient("", true, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		// An IPv6 address cannot be dialed over tcp4, whether or not the host has IPv6.
+		if _, err := ipv4.Transport.(*http.Transport).DialContext(context.Background(), "tcp", "[::1]:80"); err == nil || !strings.Contains(err.Error(), "tcp4") {
+			return fmt.Errorf("dialing [::1] with --force-ipv4 = %v; want a tcp4 dial error", err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }))
+		defer server.Close()
+		resp, err = ipv4.Get(server.URL)
+		if err != nil {
+			return fmt.Errorf("a request over IPv4 failed: %s", err)
+		}
+		resp.Body.Close()
+		return nil
+	}},
+	{"resumed download", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		content := []byte(strings.Repeat("0123456789abcdef", 4096))
+		var ranges []string
+		honorRange := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			if !honorRange {
+				w.Write(content)
+				return
+			}
+			http.ServeContent(w, r, "boringssl.tar", time.Time{}, bytes.NewReader(content))
+		}))
+		defer server.Close()
+		for _, c := range []struct {
+			honorRange bool
+			kept       int
+			rateLimit  int64
+			wantRange  string
+		}{
+			{true, 0, 0, ""},
+			{true, 10000, 0, "bytes=10000-"},
+			{false, 10000, 0, "bytes=10000-"},
+			{true, 60000, 1 << 20, "bytes=60000-"},
+		} {
+			partial := filepath.Join(tmp, "download.part")
+			if err := ioutil.WriteFile(partial, content[:c.kept], 0644); err != nil {
+				return err
+			}
+			honorRange, ranges = c.honorRange, nil
+			if err := download(server.URL, partial, c.rateLimit); err != nil {
+				return err
+			}
+			if len(ranges) != 1 || ranges[0] != c.wantRange {
+				return fmt.Errorf("with %d bytes kept, the requests had ranges %q; want [%q]", c.kept, ranges, c.wantRange)
+			}
+			if b, err := ioutil.ReadFile(partial); err != nil || !bytes.Equal(b, content) {
+				return fmt.Errorf("with %d bytes kept and ranges honored %t, the download has %d bytes (%v); want the %d of the archive", c.kept, c.honorRange, len(b), err, len(content))
+			}
+		}
+		start := time.Now()
+		if err := download(server.URL, filepath.Join(tmp, "limited.part"), 128<<10); err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			return fmt.Errorf("downloading 64 KiB at 128 KiB/s took %s; want about 500ms", elapsed)
+		}
+		return nil
+	}},
+	{"extraction cache", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for name, contents := range map[string]string{"crypto/a.c": "int a;\n", "include/openssl/base.h": "/* base */\n"} {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))}); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, contents); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		tarball := b.Bytes()
+		downloads := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			downloads++
+			w.Write(tarball)
+		}))
+		defer server.Close()
+		const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+		dir, cacheDir := filepath.Join(tmp, "boringssl"), filepath.Join(tmp, "cache")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		opts := &rollOptions{tarballURL: server.URL + "/{revision}.tar", expectedSHA256: fmt.Sprintf("%x", sha256.Sum256(tarball)), cacheDir: cacheDir, cacheMaxEntries: 1}
+		roll := func(wantDownloads int) error {
+			if _, err := extractSources(dir, sha1, opts, false); err != nil {
+				return err
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(dir, "src", "crypto", "a.c")); err != nil || string(b) != "int a;\n" {
+				return fmt.Errorf("src/crypto/a.c is %q, %v", b, err)
+			}
+			if downloads != wantDownloads {
+				return fmt.Errorf("%d downloads; want %d", downloads, wantDownloads)
+			}
+			return nil
+		}
+		if err := roll(1); err != nil {
+			return fmt.Errorf("first extraction: %s", err)
+		}
+		if err := roll(1); err != nil {
+			return fmt.Errorf("extraction of the same revision: %s", err)
+		}
+		// A damaged entry is not reused.
+		entry := filepath.Join(cacheDir, extractionKey(sha1, opts))
+		if err := os.Remove(filepath.Join(entry, "tree", "crypto", "a.c")); err != nil {
+			return err
+		}
+		if err := roll(2); err != nil {
+			return fmt.Errorf("extraction with a damaged cache: %s", err)
+		}
+		// Extracting with other options is another entry, which evicts the first.
+		opts.preserveMtime = true
+		if err := roll(3); err != nil {
+			return fmt.Errorf("extraction with other options: %s", err)
+		}
+		if _, err := os.Stat(entry); !os.IsNotExist(err) {
+			return fmt.Errorf("the first entry was not evicted: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, extractionKey(sha1, opts))); err != nil {
+			return fmt.Errorf("the second entry was not cached: %s", err)
+		}
+		return nil
+	}},
+	{"version header", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const sha1 = "d5aae81fb79f5174ad348890b49a6c8f2d250c26"
+		header := filepath.Join(dir, "revision.h")
+		if changed, err := updateVersionHeader(header, sha1, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)); err != nil || !changed {
+			return fmt.Errorf("updateVersionHeader = %t, %v; want a new header", changed, err)
+		}
+		first, err := ioutil.ReadFile(header)
+		if err != nil {
+			return err
+		}
+		if want := `#define BORINGSSL_VENDORED_REVISION "` + sha1 + `"`; !strings.Contains(string(first), want) {
+			return fmt.Errorf("header %q does not contain %q", first, want)
+		}
+		if changed, err := updateVersionHeader(header, sha1, time.Date(2021, 5, 6, 0, 0, 0, 0, time.UTC)); err != nil || changed {
+			return fmt.Errorf("updateVersionHeader with the same revision = %t, %v; want it unchanged", changed, err)
+		}
+		if second, err := ioutil.ReadFile(header); err != nil || !bytes.Equal(first, second) {
+			return fmt.Errorf("header changed on a re-run with the same revision")
+		}
+		return nil
+	}},
+	{"preserve mtime", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		stamped := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		fallback := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range []*tar.Header{
+			{Name: "crypto/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: stamped},
+			{Name: "crypto/a.c", Typeflag: tar.TypeReg, Mode: 0644, ModTime: stamped},
+			{Name: "ssl.c", Typeflag: tar.TypeReg, Mode: 0644},
+		} {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := extractTar(bytes.NewReader(buf.Bytes()), dir, tarOptions{preserveMtime: true, fallbackMtime: fallback}); err != nil {
+			return err
+		}
+		for name, want := range map[string]time.Time{"crypto": stamped, "crypto/a.c": stamped, "ssl.c": fallback} {
+			info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				return err
+			}
+			if !info.ModTime().Equal(want) {
+				return fmt.Errorf("%s has mtime %s; want %s", name, info.ModTime().UTC(), want)
+			}
+		}
+		return nil
+	}},
+	{"io buffer", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := 0; i < 64; i++ {
+			content := bytes.Repeat([]byte{byte(i)}, 64<<10+i)
+			if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("crypto/%d.c", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(content); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		var dirs []string
+		for _, size := range []int{0, 512, 4 << 10, 1 << 20} {
+			dst := filepath.Join(tmp, fmt.Sprint(size))
+			if err := extractTar(bytes.NewReader(buf.Bytes()), dst, tarOptions{bufferSize: size}); err != nil {
+				return fmt.Errorf("extracting with a %d byte buffer: %s", size, err)
+			}
+			dirs = append(dirs, dst)
+		}
+		for _, dst := range dirs[1:] {
+			if diffs, err := diffDirs(dirs[0], dst, func(string) bool { return false }); err != nil || len(diffs) > 0 {
+				return fmt.Errorf("%s differs from the unbuffered extraction: %q, %v", dst, diffs, err)
+			}
+		}
+		return nil
+	}},
+	{"plan", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const planned, old, moved revision = "d5aae81fb79f5174ad348890b49a6c8f2d250c26", "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"
+		path := filepath.Join(dir, "plan.json")
+		want := &rollPlan{Commit: "origin/upstream/master", Revision: planned, PreviousRevision: old,
+			Settings: map[string]interface{}{"exclude": []string{"*.md"}, "check-fips": true}, Changes: []string{"M\tcrypto/a.c"}}
+		if err := writePlan(path, want); err != nil {
+			return err
+		}
+		got, err := readPlan(path)
+		if err != nil {
+			return err
+		}
+		if got.Commit != want.Commit || got.Revision != want.Revision || got.PreviousRevision != want.PreviousRevision || fmt.Sprint(got.Settings) != "map[check-fips:true exclude:[*.md]]" || fmt.Sprint(got.Changes) != fmt.Sprint(want.Changes) {
+			return fmt.Errorf("read plan %+v; want %+v", got, want)
+		}
+		if sha1, err := plannedRevision(got, planned, old, false); err != nil || sha1 != planned {
+			return fmt.Errorf("plannedRevision = %s, %v; want %s", sha1, err, planned)
+		}
+		if _, err := plannedRevision(got, moved, old, false); err == nil {
+			return fmt.Errorf("plannedRevision after upstream moved succeeded; want failure")
+		}
+		if sha1, err := plannedRevision(got, moved, old, true); err != nil || sha1 != planned {
+			return fmt.Errorf("plannedRevision with drift allowed = %s, %v; want %s", sha1, err, planned)
+		}
+		return nil
+	}},
+	{"concurrent logging", func() error {
+		var buf bytes.Buffer
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, name := range []string{"gn", "rust"} {
+			w := &lineWriter{mu: &mu, w: &buf, prefix: "[" + name + "] "}
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					// Write each line in pieces, as a subprocess's output may arrive.
+					line := fmt.Sprintf("%s line %d\n", name, i)
+					for len(line) > 0 {
+						n := 1 + i%len(line)
+						w.Write([]byte(line[:n]))
+						line = line[n:]
+					}
+				}
+				w.flush()
+			}(name)
+		}
+		wg.Wait()
+		lineRE := regexp.MustCompile(`^\[(gn|rust)\] (gn|rust) line \d+$`)
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) != 400 {
+			return fmt.Errorf("got %d lines; want 400", len(lines))
+		}
+		for _, line := range lines {
+			if m := lineRE.FindStringSubmatch(line); m == nil || m[1] != m[2] {
+				return fmt.Errorf("garbled line %q", line)
+			}
+		}
+		return nil
+	}},
+	{"dry run network", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		if err := commit("b.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		opts := &rollOptions{commit: "origin/HEAD", dryRunNetwork: true, buildFormats: []string{"gn"}, generator: defaultGenerator, compareURL: defaultCompareURL}
+		m, err := roll(dir, opts)
+		if err != nil {
+			return err
+		}
+		// The fetch and rev-parse ran, but no step did.
+		if m.Revision != string(head) || m.CommitCount != 1 {
+			return fmt.Errorf("dry run resolved %s with %d commits; want %s with 1", m.Revision, m.CommitCount, head)
+		}
+		if sha1, err := currentRevision(dir); err != nil || sha1 != old {
+			return fmt.Errorf("src is at %s, %v after a dry run; want %s", sha1, err, old)
+		}
+		for _, name := range []string{readmeName, "BUILD.generated.gni", historyName, stateName} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				return fmt.Errorf("dry run wrote %s", name)
+			}
+		}
+		return nil
+	}},
+	{"clean env", func() error {
+		saved := toolEnviron
+		defer func() { toolEnviron = saved }()
+		environ := []string{"PATH=" + os.Getenv("PATH"), "HOME=/home/roll", "PYTHONPATH=/opt/python", "BINDGEN_EXTRA_CLANG_ARGS=-v", "HOMEDIR=/x"}
+		toolEnviron = cleanEnv(environ, defaultEnvAllowlist)
+		cmd := exec.Command("env")
+		cmd.Env = toolEnv("EXTRA=1")
+		out, err := output(cmd)
+		if err != nil {
+			return err
+		}
+		got := strings.Fields(string(out))
+		sort.Strings(got)
+		if want := []string{"EXTRA=1", "HOME=/home/roll", environ[0]}; fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("a child process under --clean-env has the environment %q; want %q", got, want)
+		}
+		if cmd := generatorCommand("/tmp", defaultGenerator, []string{"gn"}); fmt.Sprint(cmd.Env) != fmt.Sprint(toolEnviron) {
+			return fmt.Errorf("the generator runs with the environment %q; want %q", cmd.Env, toolEnviron)
+		}
+		toolEnviron = nil
+		if env := toolEnv(); len(env) != len(os.Environ()) {
+			return fmt.Errorf("without --clean-env, the tools inherit %d variables; want all %d", len(env), len(os.Environ()))
+		}
+		return nil
+	}},
+	{"generate patches", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const pre = "--- a/crypto/aes.c\n+++ b/crypto/aes.c\n@@ -1 +1,2 @@\n // AES\n+#include \"local.h\"\n"
+		const post = "--- a/BUILD.generated.gni\n+++ b/BUILD.generated.gni\n@@ -1 +1,2 @@\n crypto_sources = [ \"src/crypto/aes.c\" ]\n+crypto_sources += [ \"local.c\" ]\n"
+		for name, content := range map[string]string{
+			"src/crypto/aes.c":                           "// AES\n",
+			"patches/pre-generate/0001-include.patch":    pre,
+			"patches/post-generate/0001-local-gn.patch":  post,
+			"patches/post-generate/README.md":            "Not a patch\n",
+			"patches/post-generate/0002-not-apply.patch": "",
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		opts := &rollOptions{skip: []string{"sources", "headers", "absolute-paths", "rust", "readme"}, preGeneratePatches: "patches/pre-generate", postGeneratePatches: filepath.Join(dir, "patches", "post-generate")}
+		var names []string
+		for _, s := range rollSteps(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, &manifest{}) {
+			names = append(names, s.name)
+		}
+		if got, want := strings.Join(names, " "), "pre-generate-patches gn post-generate-patches"; got != want {
+			return fmt.Errorf("the steps are %q; want %q", got, want)
+		}
+		if _, err := applyPatches(log.New(ioutil.Discard, "", 0), filepath.Join(dir, "src"), patchesDir(dir, opts.preGeneratePatches)); err != nil {
+			return err
+		}
+		// Stands in for the generator, which must see the pre-generate patch.
+		b, err := ioutil.ReadFile(filepath.Join(dir, "src", "crypto", "aes.c"))
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(b, []byte("local.h")) {
+			return fmt.Errorf("the generator saw src/crypto/aes.c as %q, without the pre-generate patch", b)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated.gni"), []byte("crypto_sources = [ \"src/crypto/aes.c\" ]\n"), 0644); err != nil {
+			return err
+		}
+		_, err = applyPatches(log.New(ioutil.Discard, "", 0), dir, patchesDir(dir, opts.postGeneratePatches))
+		if err == nil || !strings.Contains(err.Error(), "0002-not-apply.patch") {
+			return fmt.Errorf("applyPatches with a patch that does not apply = %v; want it named", err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.generated.gni")); err != nil || !bytes.Contains(b, []byte("local.c")) {
+			return fmt.Errorf("the generated GN files are %q, %v; want the post-generate patch applied to them", b, err)
+		}
+		return nil
+	}},
+	{"patch health", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const upstreamed = "--- a/crypto/aes.c\n+++ b/crypto/aes.c\n@@ -1,2 +1,2 @@\n // AES\n-int aes;\n+int aes_fixed;\n"
+		const clean = "--- a/crypto/sha.c\n+++ b/crypto/sha.c\n@@ -1 +1,2 @@\n // SHA\n+#include \"local.h\"\n"
+		const fuzzy = "--- a/crypto/rsa.c\n+++ b/crypto/rsa.c\n@@ -1,4 +1,5 @@\n // RSA, before upstream changed this line\n int rsa;\n+int local;\n int rsa_renamed;\n // End\n"
+		const conflicting = "--- a/crypto/sha.c\n+++ b/crypto/sha.c\n@@ -1 +1 @@\n-// SHA-1\n+// SHA-2\n"
+		for name, content := range map[string]string{
+			"src/crypto/aes.c":               "// AES\nint aes_fixed;\n",
+			"src/crypto/sha.c":               "// SHA\n",
+			"src/crypto/rsa.c":               "// RSA\nint rsa;\nint rsa_renamed;\n// End\n",
+			"patches/0001-fix-aes.patch":     upstreamed,
+			"patches/0002-include.patch":     clean,
+			"patches/0003-local-rsa.patch":   fuzzy,
+			"patches/0004-sha-2.patch":       conflicting,
+			"patches/0005-never-tried.patch": clean,
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		m := &manifest{Revision: "2222222222222222222222222222222222222222"}
+		err = patchStep("pre-generate", "", filepath.Join(dir, "src"), filepath.Join(dir, "patches"), m).run()
+		if err == nil || !strings.Contains(err.Error(), "0004-sha-2.patch") {
+			return fmt.Errorf("applying a conflicting patch = %v; want it named", err)
+		}
+		want := []patchHealth{{"pre-generate", "0001-fix-aes.patch", "empty"}, {"pre-generate", "0002-include.patch", "clean"}, {"pre-generate", "0003-local-rsa.patch", "fuzz"}, {"pre-generate", "0004-sha-2.patch", "conflict"}}
+		if fmt.Sprint(m.Patches) != fmt.Sprint(want) {
+			return fmt.Errorf("the patch health is %v; want %v", m.Patches, want)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "src", "crypto", "aes.c")); err != nil || string(b) != "// AES\nint aes_fixed;\n" {
+			return fmt.Errorf("src/crypto/aes.c is %q, %v; want the upstreamed patch skipped", b, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "src", "crypto", "rsa.c")); err != nil || !bytes.Contains(b, []byte("int local;")) {
+			return fmt.Errorf("src/crypto/rsa.c is %q, %v; want the fuzzy patch applied", b, err)
+		}
+		var buf bytes.Buffer
+		printSummary(&buf, m, m)
+		if want := "patch pre-generate/0001-fix-aes.patch: was already applied, so is likely upstreamed; consider removing it\n"; !strings.Contains(buf.String(), want) {
+			return fmt.Errorf("the summary %q does not contain %q", buf.String(), want)
+		}
+		return nil
+	}},
+	{"advisories", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		src := filepath.Join(dir, "src")
+		if err := os.Mkdir(src, 0755); err != nil {
+			return err
+		}
+		git := func(args ...string) (revision, error) {
+			out, err := output(exec.Command("git", append([]string{"-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+			return revision(out), err
+		}
+		if _, err := git("init", "-q"); err != nil {
+			return err
+		}
+		commit := func(subject string) (revision, error) {
+			if _, err := git("commit", "-q", "--allow-empty", "-m", subject); err != nil {
+				return "", err
+			}
+			return git("rev-parse", "HEAD")
+		}
+		var revs []revision
+		for _, subject := range []string{"Fix CVE-2021-0001", "Previous roll", "Add the ASN.1 parser", "Fix CVE-2023-0002", "New roll", "Fix CVE-2023-0003"} {
+			rev, err := commit(subject)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+		}
+		old, new := revs[1], revs[4]
+		advisories := []advisory{
+			{ID: "CVE-2021-0001", Summary: "Already fixed", Fixed: []string{string(revs[0])}},
+			{ID: "CVE-2023-0002", Summary: "Overflow in the ASN.1 parser", Introduced: []string{string(revs[2])}, Fixed: []string{string(revs[3])}},
+			{ID: "CVE-2023-0003", Summary: "Fixed after the new revision", Fixed: []string{string(revs[5])}},
+			{ID: "CVE-2023-0004", Summary: "Introduced after the new revision", Introduced: []string{string(revs[5])}, Fixed: []string{"9999999999999999999999999999999999999999"}},
+			{ID: "CVE-2022-0005", Summary: "Only in OpenSSL", Fixed: []string{"8888888888888888888888888888888888888888"}},
+		}
+		b, err := json.Marshal(advisories)
+		if err != nil {
+			return err
+		}
+		feed := filepath.Join(dir, "advisories.json")
+		if err := ioutil.WriteFile(feed, b, 0644); err != nil {
+			return err
+		}
+		m := &manifest{Revision: string(new), PreviousRevision: string(old)}
+		if err := reportAdvisories(src, old, new, feed, m); err != nil {
+			return err
+		}
+		want := []advisoryFinding{
+			{ID: "CVE-2023-0002", Summary: "Overflow in the ASN.1 parser", Status: "fixed", Commit: string(revs[3])},
+			{ID: "CVE-2023-0003", Summary: "Fixed after the new revision", Status: "vulnerable"},
+		}
+		if fmt.Sprint(m.Advisories) != fmt.Sprint(want) {
+			return fmt.Errorf("reportAdvisories found %v; want %v", m.Advisories, want)
+		}
+		var summary bytes.Buffer
+		printSummary(&summary, m, m)
+		if want := "advisory CVE-2023-0002: fixed by " + revs[3].short() + "\nadvisory CVE-2023-0003: still vulnerable\n"; !strings.Contains(summary.String(), want) {
+			return fmt.Errorf("the summary %q does not contain %q", summary.String(), want)
+		}
+		var report bytes.Buffer
+		if err := renderReport(&report, m, defaultCommitURL); err != nil {
+			return err
+		}
+		for _, want := range []string{"<strong>Fixes CVE-2023-0002</strong>", "<strong>Still vulnerable to CVE-2023-0003</strong>: Fixed after the new revision"} {
+			if !strings.Contains(report.String(), want) {
+				return fmt.Errorf("the report does not contain %q", want)
+			}
+		}
+		return nil
+	}},
+	{"duplicate files", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range map[string]string{
+			"src/third_party/fiat/p256.c":     "p256\n",
+			"src/crypto/fipsmodule/ec/p256.c": "p256\n",
+			"src/crypto/ec/p224.c":            "p224\n",
+			"src/include/openssl/empty.h":     "",
+			"src/include/openssl/blank.h":     "",
+			"src/.git/objects/p256":           "p256\n",
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		if err := reportDuplicates(log.New(&buf, "", 0), dir); err != nil {
+			return err
+		}
+		const want = "Files in src with identical contents (1 groups, 5 duplicate bytes):\n" +
+			"  5 bytes each: crypto/fipsmodule/ec/p256.c, third_party/fiat/p256.c\n"
+		if buf.String() != want {
+			return fmt.Errorf("reportDuplicates logged %q; want %q", buf.String(), want)
+		}
+		return nil
+	}},
+	{"strict utf8", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range map[string]string{
+			"src/crypto/a.c":                 "// \u00e9t\u00e9\n",
+			"src/crypto/latin1.c":            "// caf\xe9\n",
+			"src/include/openssl/bad.h":      "\xff",
+			"src/crypto/test/fixture.der":    "\x30\x82\xff",
+			"src/.git/objects/invalid.txt":   "\xff",
+			"src/util/fipstools/pem/key.pem": "-----BEGIN-----\n",
+		} {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		err = checkUTF8(log.New(&buf, "", 0), dir)
+		if err == nil || err.Error() != "2 files in src are not valid UTF-8: crypto/latin1.c, include/openssl/bad.h" {
+			return fmt.Errorf("checkUTF8 failed with %v; want crypto/latin1.c and include/openssl/bad.h reported", err)
+		}
+		const want = "src/crypto/latin1.c is not valid UTF-8 at byte 6\n" +
+			"src/include/openssl/bad.h is not valid UTF-8 at byte 0\n"
+		if buf.String() != want {
+			return fmt.Errorf("checkUTF8 logged %q; want %q", buf.String(), want)
+		}
+		for _, name := range []string{"crypto/latin1.c", "include/openssl/bad.h"} {
+			if err := os.Remove(filepath.Join(dir, "src", filepath.FromSlash(name))); err != nil {
+				return err
+			}
+		}
+		if err := checkUTF8(log.New(&buf, "", 0), dir); err != nil {
+			return fmt.Errorf("checkUTF8 of valid sources: %s", err)
+		}
+		return nil
+	}},
+	{"upstream generated changes", func() error {
+		src, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(src)
+		git := func(args ...string) (revision, error) {
+			out, err := output(exec.Command("git", append([]string{"-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+			return revision(out), err
+		}
+		write := func(name, content string) error {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+		}
+		if _, err := git("init", "-q"); err != nil {
+			return err
+		}
+		var revs []revision
+		for _, files := range []map[string]string{
+			{"crypto/cipher/test/aes_tests.txt": "KEY = 00\n", "crypto/aes/aes.c": "int a;\n", "gen/crypto/err_data.c": "1\n"},
+			{"crypto/cipher/test/aes_tests.txt": "KEY = 01\n", "crypto/aes/aes.c": "int b;\n", "gen/crypto/err_data.c": "2\n"},
+		} {
+			for name, content := range files {
+				if err := write(name, content); err != nil {
+					return err
+				}
+			}
+			if _, err := git("add", "-A"); err != nil {
+				return err
+			}
+			if _, err := git("commit", "-q", "-m", "Change"); err != nil {
+				return err
+			}
+			rev, err := git("rev-parse", "HEAD")
+			if err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+		}
+		var buf bytes.Buffer
+		if err := reportUpstreamGenerated(log.New(&buf, "", 0), src, revs[0], revs[1], defaultUpstreamGenerated); err != nil {
+			return err
+		}
+		const want = "Changes to files upstream generates (2):\n  M crypto/cipher/test/aes_tests.txt\n  M gen/crypto/err_data.c\n" +
+			"Changes to hand-written files (1):\n  M crypto/aes/aes.c\n"
+		if buf.String() != want {
+			return fmt.Errorf("reportUpstreamGenerated logged %q; want %q", buf.String(), want)
+		}
+		generated, _ := splitUpstreamGenerated([]fileChange{{'M', "crypto/aes/aes.c"}}, []string{"crypto/aes"})
+		if len(generated) != 1 {
+			return fmt.Errorf("--upstream-generated crypto/aes did not match crypto/aes/aes.c")
+		}
+		return nil
+	}},
+	{"sorted reports", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		unsorted := []string{"ssl/z.c", "crypto/a-b.c", "crypto/a/b.c", "crypto/A.c"}
+		var buf bytes.Buffer
+		if err := checkReferenced(log.New(&buf, "", 0), dir, unsorted, false); err != nil {
+			return err
+		}
+		const want = "crypto/A.c, crypto/a-b.c, crypto/a/b.c, ssl/z.c\n"
+		if !strings.HasSuffix(buf.String(), want) {
+			return fmt.Errorf("checkReferenced logged %q; want the paths sorted as %q", buf.String(), want)
+		}
+		if unsorted[0] != "ssl/z.c" {
+			return fmt.Errorf("sortedPaths modified its argument: %q", unsorted)
+		}
+		err = checkFIPS(dir, unsorted, []string{"gn"})
+		if err == nil || !strings.HasSuffix(err.Error(), strings.TrimSuffix(want, "\n")) {
+			return fmt.Errorf("checkFIPS = %v; want the missing paths sorted", err)
+		}
+		return nil
+	}},
+	{"since last green roll", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		const green, failed, tip, fork = revision("1111111111111111111111111111111111111111"), revision("2222222222222222222222222222222222222222"), revision("3333333333333333333333333333333333333333"), revision("4444444444444444444444444444444444444444")
+		if _, err := sinceLastGreenRoll(dir, tip); err == nil {
+			return fmt.Errorf("sinceLastGreenRoll without a history succeeded")
+		}
+		for _, e := range []historyEntry{
+			{Time: time.Now(), Old: "0000000000000000000000000000000000000000", New: green, Success: true},
+			{Time: time.Now(), Old: green, New: failed, Success: false},
+		} {
+			if err := appendHistory(dir, &e); err != nil {
+				return err
+			}
+		}
+		saved := isAncestor
+		defer func() { isAncestor = saved }()
+		isAncestor = func(_ string, a, b revision) (bool, error) {
+			if a != green {
+				return false, fmt.Errorf("ancestry checked against %s; want the last green roll %s", a, green)
+			}
+			return b == tip, nil
+		}
+		for target, want := range map[revision]bool{tip: true, fork: false} {
+			got, err := sinceLastGreenRoll(dir, target)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("sinceLastGreenRoll(%s) = %t; want %t", target.short(), got, want)
+			}
+		}
+		return nil
+	}},
+	{"commit fallback", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, src := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "src")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		if err := git("init", "-q", "--initial-branch=main", upstream); err != nil {
+			return err
+		}
+		if err := git("-C", upstream, "commit", "-q", "--allow-empty", "-m", "Initial"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, src); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		got, err := revParseFallback(src, "origin/upstream/master", defaultCommitFallbacks)
+		if err != nil {
+			return err
+		}
+		if got != head {
+			return fmt.Errorf("revParseFallback = %s; want origin/main at %s", got.short(), head.short())
+		}
+		if _, err := revParseFallback(src, "origin/upstream/master", nil); err == nil {
+			return fmt.Errorf("revParseFallback without fallbacks resolved a missing ref")
+		}
+		_, err = revParseFallback(src, "origin/upstream/master", []string{"origin/upstream/main", "origin/master"})
+		if err == nil || !strings.Contains(err.Error(), "origin/upstream/master, origin/upstream/main, origin/master") {
+			return fmt.Errorf("revParseFallback with no ref resolving = %v; want an error listing the refs tried", err)
+		}
+		return nil
+	}},
+	{"vcs metadata", func() error {
+		for _, mode := range []string{"fail", "remove"} {
+			dir, err := ioutil.TempDir("", "roll_boringssl")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"crypto/a.c", ".git/HEAD", ".git/objects/pack/x.pack", "third_party/x/.gitmodules", "third_party/x/.svn/entries"} {
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+					return err
+				}
+			}
+			err = handleVCSMetadata(dir, mode)
+			const stray = ".git, third_party/x/.gitmodules, third_party/x/.svn"
+			if mode == "fail" {
+				if err == nil || !strings.Contains(err.Error(), stray) {
+					return fmt.Errorf("handleVCSMetadata with --vcs-metadata=fail = %v; want an error listing %s", err, stray)
+				}
+			} else if err != nil {
+				return err
+			}
+			files, err := walkFiles(dir)
+			if err != nil {
+				return err
+			}
+			want := "[.git/HEAD .git/objects/pack/x.pack crypto/a.c third_party/x/.gitmodules third_party/x/.svn/entries]"
+			if mode == "remove" {
+				want = "[crypto/a.c]"
+			}
+			if got := fmt.Sprint(files); got != want {
+				return fmt.Errorf("with --vcs-metadata=%s the tree holds %s; want %s", mode, got, want)
+			}
+		}
+		return nil
+	}},
+	{"only changed build formats", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		write := func(name, contents string) error {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(p, []byte(contents), 0644)
+		}
+		for name, contents := range map[string]string{
+			"src/crypto/a.c": "int a;\n", "src/sources.bp": "cc_defaults {}\n", "src/README.md": "BoringSSL\n",
+			"BUILD.generated.gni": "", "BUILD.generated_tests.gni": "", "android-sources.bp": "",
+		} {
+			if err := write(name, contents); err != nil {
+				return err
+			}
+		}
+		formats := []string{"gn", "android"}
+		changed := func() (string, error) {
+			hashes, err := formatInputHashes(dir, defaultGenerator, defaultGeneratorArtifacts, formats)
+			if err != nil {
+				return "", err
+			}
+			got, err := changedFormats(log.New(ioutil.Discard, "", 0), dir, formats, hashes)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprint(got), writeFormatInputs(dir, hashes)
+		}
+		for _, c := range []struct{ name, contents, want string }{
+			{"", "", "[gn android]"},
+			{"src/sources.bp", "cc_defaults { srcs: [] }\n", "[android]"},
+			{"src/README.md", "BoringSSL, changed\n", "[]"},
+			{"src/util/__pycache__/x.pyc", "", "[]"},
+			{"src/crypto/a.c", "int a = 1;\n", "[gn android]"},
+		} {
+			if c.name != "" {
+				if err := write(c.name, c.contents); err != nil {
+					return err
+				}
+			}
+			got, err := changed()
+			if err != nil {
+				return err
+			}
+			if got != c.want {
+				return fmt.Errorf("after writing %q, the changed formats are %s; want %s", c.name, got, c.want)
+			}
+		}
+		if err := os.Remove(filepath.Join(dir, "BUILD.generated.gni")); err != nil {
+			return err
+		}
+		if got, err := changed(); err != nil || got != "[gn]" {
+			return fmt.Errorf("with a gn build file missing, the changed formats are %s (%v); want [gn]", got, err)
+		}
+		return nil
+	}},
+	{"changelog reviewed", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		src := filepath.Join(tmp, "src")
+		if err := run(exec.Command("git", "init", "-q", src)); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "-C", src, "-c", "user.name=roll", "-c", "user.email=roll@example.com", "commit", "-q", "--allow-empty", "-m", "Initial")); err != nil {
+			return err
+		}
+		old, err := revParse(src, "HEAD")
+		if err != nil {
+			return err
+		}
+		const sha1 = revision("1111111111111111111111111111111111111111")
+		saved := countCommits
+		defer func() { countCommits = saved }()
+		countCommits = func(string, revision, revision) (int, error) { return 5000, nil }
+		for _, c := range []struct {
+			opts rollOptions
+			ok   bool
+		}{
+			{rollOptions{reviewThreshold: 200}, false},
+			{rollOptions{reviewThreshold: 200, changelogReviewed: true}, true},
+			{rollOptions{reviewThreshold: 200, expectCommits: 5000}, true},
+			{rollOptions{reviewThreshold: 200, expectCommits: 4999, changelogReviewed: true}, false},
+			{rollOptions{reviewThreshold: 5000}, true},
+			{rollOptions{}, true},
+		} {
+			err := checkChangelogReviewed(tmp, old, sha1, &c.opts)
+			if (err == nil) != c.ok {
+				return fmt.Errorf("checkChangelogReviewed with %+v = %v; want success %t", c.opts, err, c.ok)
+			}
+		}
+		return nil
+	}},
+	{"no network", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, src := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl", "src")
+		if err := run(exec.Command("git", "init", "-q", upstream)); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "-C", upstream, "-c", "user.name=roll", "-c", "user.email=roll@example.com", "commit", "-q", "--allow-empty", "-m", "Initial")); err != nil {
+			return err
+		}
+		if err := run(exec.Command("git", "clone", "-q", upstream, src)); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		noNetwork = true
+		defer func() { noNetwork = false }()
+		// The checkout does not exist, so only refusing the fetch before it runs names --no-network.
+		missing := filepath.Join(tmp, "missing")
+		for _, args := range [][]string{
+			{"-C", missing, "fetch", "--all", "--prune"},
+			{"-C", missing, "fetch", "--", "https://boringssl.googlesource.com/boringssl", "master"},
+			{"-c", "protocol.version=2", "ls-remote", "origin"},
+		} {
+			err := run(exec.Command("git", args...))
+			if err == nil || !strings.Contains(err.Error(), "--no-network forbids") {
+				return fmt.Errorf("git %s under --no-network = %v; want it refused before running", strings.Join(args, " "), err)
+			}
+		}
+		if err := checkNetwork(exec.Command("git", "-C", src, "fetch", "--", upstream, "HEAD")); err != nil {
+			return fmt.Errorf("fetching from a local mirror under --no-network: %s", err)
+		}
+		sha1, err := resolveCommit(filepath.Dir(src), &rollOptions{commit: "origin/HEAD", noFetch: true})
+		if err != nil {
+			return err
+		}
+		if sha1 != head {
+			return fmt.Errorf("resolving without fetching gave %s; want %s", sha1.short(), head.short())
+		}
+		for name, opts := range map[string]*rollOptions{
+			"a remote --upstream-url":       {upstreamURL: "https://boringssl.googlesource.com/boringssl"},
+			"--tarball-url without a cache": {tarballURL: "https://example.com/{revision}.tar.gz"},
+			"--dry-run-network":             {dryRunNetwork: true},
+		} {
+			if err := checkNoNetworkOptions(opts); err == nil {
+				return fmt.Errorf("checkNoNetworkOptions accepted %s", name)
+			}
+		}
+		return nil
+	}},
+	{"clean exit", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		unlock, err := lock(dir)
+		if err != nil {
+			return err
+		}
+		released, err := tempDir(dir, ".src-")
+		if err != nil {
+			return err
+		}
+		leaked, err := tempDir(dir, ".src-")
+		if err != nil {
+			return err
+		}
+		defer resources.release(leaked)
+		handedOff, err := tempDir(dir, ".src-")
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(handedOff, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		defer resources.release(handedOff)
+		if err := writeFileAtomic(filepath.Join(dir, "x"), nil); err != nil {
+			return err
+		}
+		if err := removeTemp(released); err != nil {
+			return err
+		}
+		if got, want := fmt.Sprint(reportLeaks()), fmt.Sprint([]string{"lock " + filepath.Join(dir, lockName), "temporary directory " + leaked}); got != want {
+			return fmt.Errorf("with the lock held, the leaks are %s; want %s", got, want)
+		}
+		unlock()
+		if got, want := fmt.Sprint(reportLeaks()), fmt.Sprint([]string{"temporary directory " + leaked}); got != want {
+			return fmt.Errorf("the leaks are %s; want %s", got, want)
+		}
+		return nil
+	}},
+	{"compare branches", func() error {
+		const current = revision("1111111111111111111111111111111111111111")
+		tips := map[string]datedCommit{
+			"origin/upstream/main":     {"2222222222222222222222222222222222222222", time.Date(2023, 5, 2, 12, 0, 0, 0, time.UTC)},
+			"origin/upstream/chromium": {"3333333333333333333333333333333333333333", time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)},
+		}
+		counts := map[[2]revision]int{
+			{current, tips["origin/upstream/main"].sha1}:     42,
+			{tips["origin/upstream/main"].sha1, current}:     0,
+			{current, tips["origin/upstream/chromium"].sha1}: 3,
+			{tips["origin/upstream/chromium"].sha1, current}: 7,
+		}
+		savedTip, savedCount := branchTip, countCommits
+		defer func() { branchTip, countCommits = savedTip, savedCount }()
+		branchTip = func(_, branch string) (datedCommit, error) {
+			tip, ok := tips[branch]
+			if !ok {
+				return datedCommit{}, fmt.Errorf("no branch %s", branch)
+			}
+			return tip, nil
+		}
+		countCommits = func(_ string, old, sha1 revision) (int, error) { return counts[[2]revision{old, sha1}], nil }
+		distances, err := compareBranches("", current, []string{"origin/upstream/main", "origin/upstream/chromium"})
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		formatBranchDistances(&b, current, distances)
+		const want = `Rolled revision: 111111111111
+
+BRANCH                    TIP           DATE         AHEAD  BEHIND
+origin/upstream/main      222222222222  2023-05-02      42       0
+origin/upstream/chromium  333333333333  2023-04-01       3       7
+`
+		if b.String() != want {
+			return fmt.Errorf("the branch report is\n%s\nwant\n%s", b.String(), want)
+		}
+		if _, err := compareBranches("", current, []string{"origin/missing"}); err == nil {
+			return fmt.Errorf("compareBranches succeeded with a missing branch")
+		}
+		return nil
+	}},
+	{"upload", func() error {
+		saved := gitPush
+		defer func() { gitPush = saved }()
+		var pushed []string
+		gitPush = func(_ string, args []string) (string, error) {
+			pushed = args
+			return `remote: Processing changes: refs: 1, new: 1, done
+remote:
+remote: SUCCESS
+remote:
+remote:   https://fuchsia-review.googlesource.com/c/third_party/boringssl/+/812345 [boringssl] Roll BoringSSL 111111111111..222222222222 [NEW]
+remote:
+To https://fuchsia.googlesource.com/third_party/boringssl
+ * [new reference]   HEAD -> refs/for/main
+`, nil
+		}
+		url, err := uploadRoll("", "origin", "main")
+		if err != nil {
+			return err
+		}
+		if want := "[origin HEAD:refs/for/main]"; fmt.Sprint(pushed) != want {
+			return fmt.Errorf("git push was run with %v; want %s", pushed, want)
+		}
+		if want := "https://fuchsia-review.googlesource.com/c/third_party/boringssl/+/812345"; url != want {
+			return fmt.Errorf("the review URL is %q; want %q", url, want)
+		}
+		if err := checkUpload("", "origin", ""); err == nil {
+			return fmt.Errorf("checkUpload without a branch succeeded")
+		}
+		return nil
+	}},
+	{"asm archs", func() error {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, contents := range map[string]string{
+			"linux-x86_64/crypto/chacha/chacha-x86_64.S": "",
+			"mac-x86_64/crypto/chacha/chacha-x86_64.S":   "",
+			"linux-aarch64/crypto/README":                "not assembly\n",
+			"linux-arm/crypto/chacha/chacha-armv4.S":     "",
+		} {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		if err := checkAsmArchs(dir, []string{"x86_64", "arm"}); err != nil {
+			return fmt.Errorf("checkAsmArchs with the assembly present: %s", err)
+		}
+		err = checkAsmArchs(dir, []string{"x86_64", "aarch64", "arm"})
+		var gerr *generateError
+		if !errors.As(err, &gerr) || !strings.Contains(err.Error(), "no assembly for aarch64;") {
+			return fmt.Errorf("checkAsmArchs without aarch64 assembly = %v; want a generate error naming aarch64", err)
+		}
+		if failedStep(err) != "asm" {
+			return fmt.Errorf("checkAsmArchs failed in step %q; want asm", failedStep(err))
+		}
+		return nil
+	}},
+	{"plan json", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		if err := commit("b.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		src := filepath.Join(dir, "src")
+		if err := git("-C", src, "fetch", "-q"); err != nil {
+			return err
+		}
+		snapshot := func() (string, error) {
+			var b strings.Builder
+			err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(&b, "%s %d %s\n", p, info.Size(), info.ModTime())
+				return nil
+			})
+			return b.String(), err
+		}
+		before, err := snapshot()
+		if err != nil {
+			return err
+		}
+
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, versionHeader: true, versionHeaderPath: "version.h"}
+		var out bytes.Buffer
+		if err := printPlanJSON(&out, dir, opts); err != nil {
+			return err
+		}
+		var p executionPlan
+		if err := json.Unmarshal(out.Bytes(), &p); err != nil {
+			return fmt.Errorf("failed to parse the plan %q: %s", out.String(), err)
+		}
+		if p.Revision != head || p.PreviousRevision != old {
+			return fmt.Errorf("the plan rolls %s to %s; want %s to %s", p.PreviousRevision, p.Revision, old, head)
+		}
+		commands := map[string]string{}
+		for _, s := range p.Steps {
+			commands[s.Name] = strings.Join(s.Command, " ")
+		}
+		for name, want := range map[string]string{
+			"sources": "git -C " + src + " checkout " + string(head),
+			"gn":      "python src/" + defaultGenerator + " gn",
+			"rust":    "rust/boringssl-sys/bindgen.sh",
+			"readme":  "",
+		} {
+			if got, ok := commands[name]; !ok || got != want {
+				return fmt.Errorf("the plan's %s step runs %q; want %q", name, got, want)
+			}
+		}
+		if got, want := strings.Join(p.Files, " "), historyName+" BUILD.generated.gni BUILD.generated_tests.gni "+readmeName+" rust/boringssl-sys/src/lib.rs src version.h"; got != want {
+			return fmt.Errorf("the plan writes %q; want %q", got, want)
+		}
+		if got := strings.Join(p.Changes, ";"); got != "A\tb.c" {
+			return fmt.Errorf("the plan has the changes %q; want b.c added", got)
+		}
+		if after, err := snapshot(); err != nil || after != before {
+			return fmt.Errorf("printing the plan changed %s: %v", dir, err)
+		}
+		return nil
+	}},
+	{"sandbox", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := commit("b.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		list := func() (string, error) {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return "", err
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			return strings.Join(names, " "), nil
+		}
+		before, err := list()
+		if err != nil {
+			return err
+		}
+
+		// The sources step succeeds in the sandbox, and the check of referenced paths then fails.
+		opts := &rollOptions{commit: "origin/HEAD", sandbox: true, buildFormats: []string{"gn"}, generator: defaultGenerator,
+			skip: []string{"gn", "absolute-paths", "rust"}, referencedPaths: []string{"missing.c"}, strictReferenced: true}
+		if _, err := roll(dir, opts); failedStep(err) != "referenced" {
+			return fmt.Errorf("sandboxed roll failed with %v; want the referenced step to fail", err)
+		}
+		if sha1, err := currentRevision(dir); err != nil || sha1 != old {
+			return fmt.Errorf("src is at %s, %v after a failed sandboxed roll; want %s", sha1, err, old)
+		}
+		if after, err := list(); err != nil || after != before {
+			return fmt.Errorf("the tree has %q, %v after a failed sandboxed roll; want %q", after, err, before)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || string(b) != readme {
+			return fmt.Errorf("%s changed after a failed sandboxed roll: %q, %v", readmeName, b, err)
+		}
+
+		opts.referencedPaths = nil
+		if _, err := roll(dir, opts); err != nil {
+			return fmt.Errorf("sandboxed roll: %s", err)
+		}
+		if sha1, err := currentRevision(dir); err != nil || sha1 != head {
+			return fmt.Errorf("src is at %s, %v after a sandboxed roll; want %s", sha1, err, head)
+		}
+		if after, err := list(); err != nil || after != historyName+" "+before {
+			return fmt.Errorf("the tree has %q, %v after a sandboxed roll; want %q and the roll history", after, err, before)
+		}
+		return nil
+	}},
+	{"export env file", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(names ...string) error {
+			for _, name := range names {
+				if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+					return err
+				}
+				if err := git("-C", upstream, "add", name); err != nil {
+					return err
+				}
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+strings.Join(names, ", "))
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := commit("b.c", "c.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		path := filepath.Join(tmp, "roll.env")
+		check := func(want string) error {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if string(b) != want {
+				return fmt.Errorf("the env file holds %q; want %q", b, want)
+			}
+			return nil
+		}
+
+		// The sources step succeeds, and the check of referenced paths then fails.
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, envFilePath: path,
+			skip: []string{"gn", "absolute-paths", "rust"}, referencedPaths: []string{"missing.c"}, strictReferenced: true}
+		m, err := roll(dir, opts)
+		if failedStep(err) != "referenced" {
+			return fmt.Errorf("roll failed with %v; want the referenced step to fail", err)
+		}
+		if err := writeEnvFile(path, m, false); err != nil {
+			return err
+		}
+		if err := check("ROLL_OLD_SHA=" + string(old) + "\nROLL_NEW_SHA=" + string(head) + "\nROLL_CHANGED_FILES=2\nROLL_SRC_SIZE=\nROLL_SUCCESS=false\n"); err != nil {
+			return fmt.Errorf("after a failed roll: %s", err)
+		}
+		if err := writeEnvFile(path, nil, false); err != nil {
+			return err
+		}
+		if err := check("ROLL_OLD_SHA=\nROLL_NEW_SHA=\nROLL_CHANGED_FILES=0\nROLL_SRC_SIZE=\nROLL_SUCCESS=false\n"); err != nil {
+			return fmt.Errorf("after a roll that failed before it began: %s", err)
+		}
+
+		// The failed roll left src at the new revision, so roll again from the old one.
+		if err := git("-C", filepath.Join(dir, "src"), "checkout", "-q", string(old)); err != nil {
+			return err
+		}
+		opts.referencedPaths = nil
+		if m, err = roll(dir, opts); err != nil {
+			return err
+		}
+		if err := writeEnvFile(path, m, true); err != nil {
+			return err
+		}
+		size, err := treeSize(filepath.Join(dir, "src"))
+		if err != nil {
+			return err
+		}
+		if err := check(fmt.Sprintf("ROLL_OLD_SHA=%s\nROLL_NEW_SHA=%s\nROLL_CHANGED_FILES=2\nROLL_SRC_SIZE=%d\nROLL_SUCCESS=true\n", old, head, size)); err != nil {
+			return fmt.Errorf("after a roll: %s", err)
+		}
+		if entries, err := filepath.Glob(filepath.Join(tmp, ".roll.env-*")); err != nil || len(entries) > 0 {
+			return fmt.Errorf("temporary files %q, %v are left beside the env file", entries, err)
+		}
+		return nil
+	}},
+	{"license scan", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		// The stub scanner takes the license of each file from its name.
+		scanner := filepath.Join(tmp, "scan.sh")
+		script := "#!/bin/sh\ncd \"$1\" && for f in *.c; do case $f in gpl*) echo \"GPL-2.0-only $f\";; mit*) echo \"MIT $f\";; *) echo \"ISC $f\";; esac; done\n"
+		if err := ioutil.WriteFile(scanner, []byte(script), 0755); err != nil {
+			return err
+		}
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, skip: []string{"gn", "absolute-paths", "rust"},
+			licenseScanner: scanner + ` "$1"`, allowedLicenses: defaultAllowedLicenses, reportPath: filepath.Join(tmp, "report.html")}
+
+		for _, c := range []struct {
+			add, want string
+		}{
+			{"b.c", "&{map[ISC:2] [] []}"},
+			{"mit.c", "&{map[ISC:2 MIT:1] [MIT] []}"},
+		} {
+			if err := commit(c.add); err != nil {
+				return err
+			}
+			m, err := roll(dir, opts)
+			if err != nil {
+				return err
+			}
+			if got := fmt.Sprint(m.Licenses); got != c.want {
+				return fmt.Errorf("after adding %s, the license scan found %s; want %s", c.add, got, c.want)
+			}
+		}
+
+		if err := commit("gpl.c"); err != nil {
+			return err
+		}
+		m, err := roll(dir, opts)
+		if failedStep(err) != "licenses" || !strings.Contains(err.Error(), "not allowed by --allowed-license: GPL-2.0-only") {
+			return fmt.Errorf("roll with a GPL file failed with %v; want the licenses step to fail", err)
+		}
+		if got, want := fmt.Sprint(m.Licenses), "&{map[GPL-2.0-only:1 ISC:2 MIT:1] [GPL-2.0-only] [GPL-2.0-only]}"; got != want {
+			return fmt.Errorf("the failed license scan found %s; want %s", got, want)
+		}
+		report, err := ioutil.ReadFile(opts.reportPath)
+		if err != nil {
+			return err
+		}
+		for _, want := range []string{"<strong>Not allowed: GPL-2.0-only</strong>", "<li>MIT: 1 files</li>"} {
+			if !strings.Contains(string(report), want) {
+				return fmt.Errorf("the report does not contain %q", want)
+			}
+		}
+		if _, err := parseLicenseScan("ISC\n"); err == nil {
+			return fmt.Errorf("a license scan line without a path was accepted")
+		}
+		return nil
+	}},
+	{"identical tree", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		src := filepath.Join(dir, "src")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name, content string) error {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(upstream, name)), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(content), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Change "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c", "int a;\n"); err != nil {
+			return err
+		}
+		if err := commit("fuzz/a.cc", "int fuzz;\n"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, src); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		// Upstream changes only a file the roll leaves out.
+		if err := commit("fuzz/a.cc", "int fuzzed;\n"); err != nil {
+			return err
+		}
+		if err := git("-C", src, "fetch", "-q"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+
+		// There is no generator in src, so the roll fails if it tries to generate build files.
+		opts := &rollOptions{commit: string(head), buildFormats: []string{"gn"}, generator: defaultGenerator, excludes: []string{"fuzz"},
+			noOpIfIdenticalTree: true, readmeIfIdenticalTree: true}
+		m, err := roll(dir, opts)
+		if err != nil {
+			return fmt.Errorf("rolling to a commit changing only excluded files: %s", err)
+		}
+		if !m.TreeUnchanged {
+			return errors.New("a roll changing only excluded files did not find the tree unchanged")
+		}
+		if now, err := currentRevision(dir); err != nil || now != head {
+			return fmt.Errorf("src is at %s, %v; want %s", now, err, head)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || !strings.Contains(string(b), string(head)) {
+			return fmt.Errorf("%s is %q, %v; want it updated to %s with --update-readme-if-identical-tree", readmeName, b, err, head)
+		}
+
+		if err := commit("a.c", "int b;\n"); err != nil {
+			return err
+		}
+		if err := git("-C", src, "fetch", "-q"); err != nil {
+			return err
+		}
+		if head, err = revParse(upstream, "HEAD"); err != nil {
+			return err
+		}
+		if same, err := sameKeptFiles(src, head, opts); err != nil || same {
+			return fmt.Errorf("sameKeptFiles after a.c changed = %v, %v; want false", same, err)
+		}
+		return nil
+	}},
+	{"sources only", func() error {
+		tmp, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+		git := func(args ...string) error {
+			return run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...))
+		}
+		commit := func(name string) error {
+			if err := ioutil.WriteFile(filepath.Join(upstream, name), []byte(name+"\n"), 0644); err != nil {
+				return err
+			}
+			if err := git("-C", upstream, "add", name); err != nil {
+				return err
+			}
+			return git("-C", upstream, "commit", "-q", "-m", "Add "+name)
+		}
+		if err := git("init", "-q", upstream); err != nil {
+			return err
+		}
+		if err := commit("a.c"); err != nil {
+			return err
+		}
+		if err := git("clone", "-q", upstream, filepath.Join(dir, "src")); err != nil {
+			return err
+		}
+		old, err := currentRevision(dir)
+		if err != nil {
+			return err
+		}
+		readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, readmeName), []byte(readme), 0644); err != nil {
+			return err
+		}
+		if err := commit("b.c"); err != nil {
+			return err
+		}
+		head, err := revParse(upstream, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+
+		// Every step that --skip could leave out is asked for, and only the sources step runs.
+		opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, sourcesOnly: true,
+			writeChecksums: true, checkFIPS: true, strictUTF8: true, reportDuplicates: true, versionHeader: true, versionHeaderPath: "version.h"}
+		var names []string
+		for _, s := range rollSteps(dir, head, opts, &manifest{}) {
+			names = append(names, s.name)
+		}
+		if got := strings.Join(names, " "); got != "sources" {
+			return fmt.Errorf("a --sources-only roll has the steps %q; want only sources", got)
+		}
+		m, err := roll(dir, opts)
+		if err != nil {
+			return err
+		}
+		if sha1, err := currentRevision(dir); err != nil || sha1 != head {
+			return fmt.Errorf("src is at %s, %v after a --sources-only roll; want %s", sha1, err, head)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || string(b) != readme {
+			return fmt.Errorf("a --sources-only roll changed %s to %q, %v", readmeName, b, err)
+		}
+		for _, name := range []string{"BUILD.generated.gni", "version.h", "src/" + checksumsName} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				return fmt.Errorf("a --sources-only roll wrote %s", name)
+			}
+		}
+		var b bytes.Buffer
+		printSourcesSummary(&b, m)
+		want := fmt.Sprintf("src: %s -> %s\n1 commits:\n  %s Add b.c\nadded: b.c\nupstream diff: 1 file changed, 1 insertion(+), 0 deletions(-)\n", old, head, head.short())
+		if !strings.HasPrefix(b.String(), want) {
+			return fmt.Errorf("a --sources-only roll printed %q; want %q", b.String(), want)
+		}
+		return nil
+	}},
+	{"bisect", func() error {
+		var commits []revision
+		for i := 0; i < 10; i++ {
+			commits = append(commits, revision(strings.Repeat(fmt.Sprint(i), 40)))
+		}
+		for bad := range commits {
+			var tested int
+			got, err := firstBad(commits, func(c revision) (bool, error) {
+				tested++
+				for i, want := range commits {
+					if c == want {
+						return i < bad, nil
+					}
+				}
+				return false, fmt.Errorf("tested unknown commit %s", c)
+			})
+			if err != nil || got != commits[bad] {
+				return fmt.Errorf("firstBad = %s, %v; want %s", got, err, commits[bad])
+			}
+			if tested > 4 {
+				return fmt.Errorf("firstBad tested %d of %d commits", tested, len(commits))
+			}
+		}
+		return nil
+	}},
+	{"truncated changelog", func() error {
+		commits := []commit{
+			{sha1: "2222222222222222222222222222222222222222", subject: "Add a test"},
+			{sha1: "1111111111111111111111111111111111111111", subject: "Fix a typo"},
+		}
+		security, err := securityRE(defaultSecurityKeywords)
+		if err != nil {
+			return err
+		}
+		const old = "3333333333333333333333333333333333333333"
+		compare := compareLink(defaultCompareURL, old, commits[0].sha1)
+		if want := "https://boringssl.googlesource.com/boringssl/+log/" + old + ".." + string(commits[0].sha1); compare != want {
+			return fmt.Errorf("compareLink = %q; want %q", compare, want)
+		}
+		text, _ := formatChangelog(plainChangelog{}, old, commits[0].sha1, commits, 5000, compare, security, nil, nil)
+		for _, want := range []string{"(5000 commits)", "Showing the first 2 of 5000 commits", compare} {
+			if !strings.Contains(text, want) {
+				return fmt.Errorf("changelog %q does not contain %q", text, want)
+			}
+		}
+		return nil
+	}},
+	{"explain diff", func() error {
+		changes := []fileChange{
+			{'A', "crypto/new.c"},
+			{'M', "crypto/old.c"},
+			{'M', "README.md"},
+			{'D', "crypto/gone.c"},
+			{'D', "docs/gone.md"},
+			{'A', "crypto/new_test.cc"},
+		}
+		oldBuild := []byte("crypto_sources = [\n  \"src/crypto/gone.c\",\n  \"src/crypto/old.c\",\n]\n")
+		newBuild := []byte("crypto_sources = [\n  \"src/crypto/new.c\",\n  \"src/crypto/old.c\",\n]\n")
+		affecting, other := buildImpact(changes, oldBuild, newBuild)
+		if got := fmt.Sprint(affecting); got != fmt.Sprint([]fileChange{changes[0], changes[1], changes[3]}) {
+			return fmt.Errorf("build-affecting changes: %v", affecting)
+		}
+		if got := fmt.Sprint(other); got != fmt.Sprint([]fileChange{changes[2], changes[4], changes[5]}) {
+			return fmt.Errorf("other changes: %v", other)
+		}
+		const want = "Changes to files our build uses (3):\n  A crypto/new.c\n  M crypto/old.c\n  D crypto/gone.c\n" +
+			"Changes to files our build does not use (3):\n  M README.md\n  D docs/gone.md\n  A crypto/new_test.cc\n"
+		if got := formatBuildImpact(affecting, other); got != want {
+			return fmt.Errorf("formatBuildImpact = %q; want %q", got, want)
+		}
+		return nil
+	}},
+	{"changelog formats", func() error {
+		commits := []commit{
+			{sha1: "2222222222222222222222222222222222222222", author: "Dev One", email: "one@example.com", date: time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC),
+				subject: "Fix an overflow in CBS", body: "Details.\n\nChange-Id: I1234\nReviewed-by: Dev Two <two@example.com>",
+				footers: parseFooters("Details.\n\nChange-Id: I1234\nReviewed-by: Dev Two <two@example.com>")},
+			{sha1: "1111111111111111111111111111111111111111", author: "Dev Two", email: "two@example.com", date: time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC),
+				subject: "Add a test"},
+		}
+		if got := fmt.Sprint(commits[0].footers); got != "[{Change-Id I1234} {Reviewed-by Dev Two <two@example.com>}]" {
+			return fmt.Errorf("parseFooters = %s", got)
+		}
+		if f := parseFooters("Subject line.\n\nNot: a trailer\nbecause of this line"); len(f) != 0 {
+			return fmt.Errorf("parseFooters of a paragraph that is not all trailers = %v; want none", f)
+		}
+		security, err := securityRE(defaultSecurityKeywords)
+		if err != nil {
+			return err
+		}
+		const old = revision("3333333333333333333333333333333333333333")
+		want := map[string]string{
+			"plain": `BoringSSL 333333333333..222222222222 (3 commits)
+
+Showing the first 2 of 3 commits, which alone were checked for security-relevant changes; see https://example.com/log for all of them.
+
+Security-relevant changes:
+  222222222222 Fix an overflow in CBS
+
+Changes:
+  222222222222 Fix an overflow in CBS
+  111111111111 Add a test
+`,
+			"markdown": "# BoringSSL 333333333333..222222222222 (3 commits)\n\n" +
+				"Showing the first 2 of 3 commits, which alone were checked for security-relevant changes; see [all of them](https://example.com/log).\n\n" +
+				"## Security-relevant changes\n\n- `222222222222` Fix an overflow in CBS\n\n" +
+				"## Changes\n\n- `222222222222` Fix an overflow in CBS (Dev One)\n- `111111111111` Add a test (Dev Two)\n",
+			"json": `{
+  "old": "3333333333333333333333333333333333333333",
+  "new": "2222222222222222222222222222222222222222",
+  "total": 3,
+  "compare": "https://example.com/log",
+  "commits": [
+    {
+      "sha1": "2222222222222222222222222222222222222222",
+      "author": "Dev One",
+      "email": "one@example.com",
+      "date": "2023-05-02T10:00:00Z",
+      "subject": "Fix an overflow in CBS",
+      "body": "Details.\n\nChange-Id: I1234\nReviewed-by: Dev Two <two@example.com>",
+      "footers": [
+        {
+          "key": "Change-Id",
+          "value": "I1234"
+        },
+        {
+          "key": "Reviewed-by",
+          "value": "Dev Two <two@example.com>"
+        }
+      ],
+      "security": true
+    },
+    {
+      "sha1": "1111111111111111111111111111111111111111",
+      "author": "Dev Two",
+      "email": "two@example.com",
+      "date": "2023-05-01T09:00:00Z",
+      "subject": "Add a test"
+    }
+  ]
+}
+`,
+			"gerrit": `Roll BoringSSL from 333333333333 to 222222222222 (3 commits)
+
+https://example.com/log
+
+2023-05-02 one@example.com Fix an overflow in CBS [security]
+2023-05-01 two@example.com Add a test
+... and 1 more
+`,
+		}
+		for _, name := range changelogFormatNames() {
+			got, _ := formatChangelog(changelogFormats[name], old, commits[0].sha1, commits, 3, "https://example.com/log", security, nil, nil)
+			if got != want[name] {
+				return fmt.Errorf("the %s changelog is\n%s\nwant\n%s", name, got, want[name])
+			}
+		}
+
+		// Without the history, as with --shallow, each format only links to the commits.
+		want = map[string]string{
+			"plain":    "BoringSSL 333333333333..222222222222\n\nThe upstream history is not available; see https://example.com/log for the commits.\n",
+			"markdown": "# BoringSSL 333333333333..222222222222\n\nThe upstream history is not available; see [the commits](https://example.com/log).\n",
+			"json": `{
+  "old": "3333333333333333333333333333333333333333",
+  "new": "2222222222222222222222222222222222222222",
+  "total": 0,
+  "compare": "https://example.com/log",
+  "history_unavailable": true,
+  "commits": []
+}
+`,
+			"gerrit": "Roll BoringSSL from 333333333333 to 222222222222\n\nhttps://example.com/log\n\nThe upstream history is not available.\n",
+		}
+		for _, name := range changelogFormatNames() {
+			if got := unavailableChangelog(changelogFormats[name], old, commits[0].sha1, "https://example.com/log"); got != want[name] {
+				return fmt.Errorf("the %s changelog without history is\n%s\nwant\n%s", name, got, want[name])
+			}
+		}
+		return nil
+	}},
+	{"changelog exclude", func() error {
+		commits := []commit{
+			{sha1: "4444444444444444444444444444444444444444", subject: "Roll third_party/googletest"},
+			{sha1: "3333333333333333333333333333333333333333", subject: "Fix a use-after-free in SSL_free"},
+			{sha1: "2222222222222222222222222222222222222222", subject: "Roll third_party/fiat", body: "Fixes an overflow."},
+			{sha1: "1111111111111111111111111111111111111111", subject: "Add the ML-KEM API"},
+		}
+		security, err := securityRE(defaultSecurityKeywords)
+		if err != nil {
+			return err
+		}
+		if _, err := changelogExcludeRE([]string{"("}); err == nil {
+			return fmt.Errorf("an invalid --changelog-exclude was accepted")
+		}
+		exclude, err := changelogExcludeRE([]string{"^Roll ", "^Update chromium"})
+		if err != nil {
+			return err
+		}
+		text, _ := formatChangelog(plainChangelog{}, "5555555555555555555555555555555555555555", commits[0].sha1, commits, 10, "https://example.com/log", security, nil, exclude)
+		for _, want := range []string{"(10 commits)", "Fix a use-after-free", "Add the ML-KEM API", "222222222222 Roll third_party/fiat", "(1 commits matching --changelog-exclude are not listed)", "Showing the first 4 of 10 commits"} {
+			if !strings.Contains(text, want) {
+				return fmt.Errorf("changelog %q does not contain %q", text, want)
+			}
+		}
+		if strings.Contains(text, "googletest") {
+			return fmt.Errorf("changelog %q lists an excluded commit", text)
+		}
+		text, _ = formatChangelog(gerritChangelog{}, "5555555555555555555555555555555555555555", commits[0].sha1, commits, 10, "", security, nil, exclude)
+		if !strings.Contains(text, "... and 1 commits matching --changelog-exclude\n... and 6 more\n") {
+			return fmt.Errorf("gerrit changelog %q does not count the excluded commit", text)
+		}
+		return nil
+	}},
+}
+
+func TestBehavior(t *testing.T) {
+	for _, bt := range behaviorTests {
+		bt := bt
+		t.Run(bt.name, func(t *testing.T) {
+			if err := bt.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	if !selftest() {
+		t.Fatal("--selftest fails on its fixtures")
+	}
+	defer func(saved string) { readmeFixture = saved }(readmeFixture)
+	readmeFixture = strings.Replace(readmeFixture, "/+/", "/+log/", 1)
+	if selftest() {
+		t.Fatal("--selftest passes with a corrupted README fixture")
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+	var ran []string
+	failGN := true
+	record := func(name string) step {
+		return step{name: name, required: true, run: func() error {
+			ran = append(ran, name)
+			if name == "gn" && failGN {
+				return errors.New("interrupted")
+			}
+			return nil
+		}}
+	}
+	steps := []step{record("sources"), record("gn"), record("readme")}
+
+	completed, err := runSteps(dir, sha1, steps, false, 1, true)
+	if err == nil || fmt.Sprint(completed) != "[sources]" {
+		t.Fatalf("a roll failing in gn completed %q, %v; want only sources and the failure", completed, err)
+	}
+	state, err := readState(dir, sha1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(state.Completed) != "[sources]" {
+		t.Fatalf("the state after the failure records %q; want [sources]", state.Completed)
+	}
+	if state, err := readState(dir, "1111111111111111111111111111111111111111"); err != nil || len(state.Completed) != 0 {
+		t.Fatalf("the state for another revision = %v, %v; want it empty", state, err)
+	}
+
+	ran, failGN = nil, false
+	if completed, err = runSteps(dir, sha1, steps, true, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[gn readme]" || fmt.Sprint(completed) != "[sources gn readme]" {
+		t.Fatalf("the resumed roll ran %q and completed %q; want it to skip sources", ran, completed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateName)); !os.IsNotExist(err) {
+		t.Fatalf("%s is left after the roll succeeded: %v", stateName, err)
+	}
+	if names, err := walkFiles(dir); err != nil || len(names) != 0 {
+		t.Fatalf("the roll left %q, %v in its directory; want no temporary state files", names, err)
+	}
+}
+
+func TestCleanGeneratedKeepsRollFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	const pre = "diff --git a/crypto/local.h b/crypto/local.h\nnew file mode 100644\n--- /dev/null\n+++ b/crypto/local.h\n@@ -0,0 +1 @@\n+// Local\n"
+	for name, content := range map[string]string{
+		"src/crypto/aes.c":                      "// AES\n",
+		"patches/pre-generate/0001-local.patch": pre,
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"-C", dir, "init", "-q"}, {"-C", src, "init", "-q"}, {"-C", src, "add", "."}, {"-C", src, "commit", "-q", "-m", "Initial"}} {
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "stray.o"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// As with --write-manifest --clean-generated, less the steps that need upstream's sources.
+	opts := &rollOptions{writeChecksums: true, cleanGenerated: true, preGeneratePatches: "patches/pre-generate", postGeneratePatches: "patches/post-generate",
+		skip: []string{"sources", "headers", "gn", "absolute-paths", "rust", "readme"}}
+	const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+	if _, err := runSteps(dir, sha1, rollSteps(dir, sha1, opts, &manifest{}), false, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{checksumsName, "crypto/local.h"} {
+		if _, err := os.Stat(filepath.Join(src, filepath.FromSlash(name))); err != nil {
+			t.Errorf("--clean-generated removed src/%s, which the roll wrote: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(src, "stray.o")); !os.IsNotExist(err) {
+		t.Errorf("--clean-generated left src/stray.o: %v", err)
+	}
+}
+
+// Runs rollMain with the command line |args| and fresh flags, returning its exit status and what
+// it logged.
+func runRollMain(args ...string) (int, string) {
+	var buf bytes.Buffer
+	defer func(args []string, flags *flag.FlagSet, w io.Writer, logFlags int) {
+		os.Args, flag.CommandLine = args, flags
+		log.SetOutput(w)
+		log.SetFlags(logFlags)
+	}(os.Args, flag.CommandLine, logOutput, log.Flags())
+	os.Args = append([]string{"roll_boringssl"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	log.SetOutput(&buf)
+	return rollMain(), buf.String()
+}
+
+func TestJSONLogsRejectsStdoutModes(t *testing.T) {
+	for _, mode := range []string{"--explain", "--print-plan-json", "--dry-run-network", "--sources-only", "--doctor", "--since-roll=2"} {
+		status, logged := runRollMain("--json-logs", mode)
+		if status != 1 || !strings.Contains(logged, "--json-logs cannot be combined with "+strings.SplitN(mode, "=", 2)[0]) {
+			t.Errorf("--json-logs %s exited %d, logging %q; want it refused", mode, status, logged)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	release := make(chan struct{})
+	s := &server{roll: func(string, *rollOptions) (*manifest, error) {
+		<-release
+		return &manifest{Revision: "d5aae81fb79f5174ad348890b49a6c8f2d250c26"}, nil
+	}}
+	h := s.handler()
+	request := func(method, path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s responded with %q, which is not JSON: %s", method, path, w.Body, err)
+		}
+		return w.Code, body
+	}
+
+	if code, body := request("GET", "/status"); code != http.StatusOK || body["running"] != false || body["last"] != nil {
+		t.Errorf("GET /status before any roll = %d %v; want 200, not running and no last roll", code, body)
+	}
+	if code, _ := request("GET", "/trigger"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /trigger = %d; want 405", code)
+	}
+	if code, _ := request("POST", "/trigger"); code != http.StatusAccepted {
+		t.Errorf("POST /trigger = %d; want 202", code)
+	}
+	if code, _ := request("POST", "/trigger"); code != http.StatusConflict {
+		t.Errorf("POST /trigger during a roll = %d; want 409", code)
+	}
+	if code, body := request("GET", "/status"); code != http.StatusOK || body["running"] != true {
+		t.Errorf("GET /status during a roll = %d %v; want 200 and running", code, body)
+	}
+	close(release)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, body := request("GET", "/status")
+		if last, ok := body["last"].(map[string]interface{}); ok && body["running"] == false {
+			if last["revision"] != "d5aae81fb79f5174ad348890b49a6c8f2d250c26" {
+				t.Errorf("GET /status after the roll reports %v; want its revision", last)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /status still reports %v after the roll finished", body)
+		}
+	}
+}
+
+func TestExplainRunsNoCommands(t *testing.T) {
+	var started []string
+	defer func(saved func(*exec.Cmd) error) { startCommand = saved }(startCommand)
+	startCommand = func(cmd *exec.Cmd) error {
+		started = append(started, fmt.Sprint(cmd.Args))
+		return errors.New("--explain must not run commands")
+	}
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, opts := range []*rollOptions{
+		{commit: "origin/main"},
+		{commit: "origin/main", changelogPath: "CHANGELOG", sandbox: true, writeChecksums: true, cleanGenerated: true, skip: []string{"rust"}},
+		{commit: "origin/main", planOut: "plan.json"},
+	} {
+		var buf bytes.Buffer
+		explain(&buf, dir, opts)
+		if len(started) > 0 {
+			t.Fatalf("--explain with %+v ran %q", opts, started)
+		}
+		for _, s := range rollSteps(dir, revision("the revision"), opts, &manifest{}) {
+			if opts.planOut == "" && !strings.Contains(buf.String(), "["+s.name+"] ") {
+				t.Errorf("--explain with %+v does not print the %s step:\n%s", opts, s.name, buf.String())
+			}
+			if opts.planOut != "" && strings.Contains(buf.String(), "["+s.name+"] ") {
+				t.Errorf("--explain --plan-out prints the %s step, which it does not run:\n%s", s.name, buf.String())
+			}
+		}
+		if !strings.HasPrefix(buf.String(), "1. Take the roll lock ") {
+			t.Errorf("--explain with %+v prints %q; want a numbered plan", opts, buf.String())
+		}
+	}
+}
+
+func TestSetTargetCommit(t *testing.T) {
+	for _, tt := range []struct {
+		source, env string
+		want        string
+		wantSource  string
+	}{
+		{"", "", "origin/upstream/master", ""},
+		{"", "origin/upstream/chromium-stable", "origin/upstream/chromium-stable", "env"},
+		{"config", "origin/upstream/chromium-stable", "origin/upstream/chromium-stable", "env"},
+		{"flag", "origin/upstream/chromium-stable", "origin/upstream/master", "flag"},
+		{"plan", "origin/upstream/chromium-stable", "origin/upstream/master", "plan"},
+	} {
+		opts := &rollOptions{commit: "origin/upstream/master"}
+		sources := map[string]string{}
+		if tt.source != "" {
+			sources["commit"] = tt.source
+		}
+		setTargetCommit(opts, sources, tt.env)
+		if opts.commit != tt.want || sources["commit"] != tt.wantSource {
+			t.Errorf("with the commit from %q and $%s=%q, resolved %q from %q; want %q from %q",
+				tt.source, commitEnv, tt.env, opts.commit, sources["commit"], tt.want, tt.wantSource)
+		}
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var logged bytes.Buffer
+	defer func(w io.Writer) { log.SetOutput(w) }(logOutput)
+	log.SetOutput(&logged)
+	const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+	check := func(desc string, wantWarning bool) {
+		t.Helper()
+		logged.Reset()
+		if err := checkHistory(dir, sha1, false); err != nil {
+			t.Fatalf("with %s: %s", desc, err)
+		}
+		if warned := strings.Contains(logged.String(), "WARNING: d5aae81fb79f was previously rolled on 2026-03-02"); warned != wantWarning {
+			t.Errorf("with %s, logged %q; want a warning: %t", desc, logged.String(), wantWarning)
+		}
+		err := checkHistory(dir, sha1, true)
+		if wantWarning && (err == nil || !strings.Contains(err.Error(), "--strict-history")) {
+			t.Errorf("with %s, --strict-history returned %v; want an error", desc, err)
+		} else if !wantWarning && err != nil {
+			t.Errorf("with %s, --strict-history returned %s", desc, err)
+		}
+	}
+
+	check("no history", false)
+	if err := ioutil.WriteFile(filepath.Join(dir, historyName), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check("an empty history", false)
+	for _, e := range []historyEntry{
+		{Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), Old: "1111111111111111111111111111111111111111", New: sha1, Error: "gn failed"},
+		{Time: time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC), Old: "2222222222222222222222222222222222222222", New: "3333333333333333333333333333333333333333", Success: true},
+	} {
+		if err := appendHistory(dir, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("only a failed roll to the revision", false)
+	if err := appendHistory(dir, &historyEntry{Time: time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC), Old: "3333333333333333333333333333333333333333", New: sha1, Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	check("a successful roll to the revision", true)
+}
+
+func TestStepErrors(t *testing.T) {
+	const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+	for _, tt := range []struct {
+		step   string
+		kind   string
+		status int
+	}{
+		{"sources", "sources", 2},
+		{"gn", "generate", 3},
+		{"rust", "bindgen", 4},
+		{"readme", "readme", 5},
+	} {
+		dir, err := ioutil.TempDir("", "roll_boringssl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// Run only the step, which fails in an empty directory.
+		var skip []string
+		for _, s := range rollSteps(dir, sha1, &rollOptions{}, &manifest{}) {
+			if s.name != tt.step {
+				skip = append(skip, s.name)
+			}
+		}
+		_, err = runSteps(dir, sha1, rollSteps(dir, sha1, &rollOptions{skip: skip}, &manifest{}), false, 1, true)
+		if err == nil {
+			t.Fatalf("the %s step succeeded in an empty directory", tt.step)
+		}
+		if kind, status := errorKind(err), exitStatus(err); kind != tt.kind || status != tt.status || failedStep(err) != tt.step {
+			t.Errorf("the %s step failed with %q, of kind %q from step %q, exiting %d; want kind %q, exiting %d",
+				tt.step, err, kind, failedStep(err), status, tt.kind, tt.status)
+		}
+	}
+
+	other := &stepError{"headers", errors.New("failed")}
+	if kind, status := errorKind(other), exitStatus(other); kind != "step" || status != 1 {
+		t.Errorf("another step's error is of kind %q, exiting %d; want step, exiting 1", kind, status)
+	}
+	if kind, status := errorKind(errors.New("failed")), exitStatus(errors.New("failed")); kind != "" || status != 1 {
+		t.Errorf("an error from outside the steps is of kind %q, exiting %d; want none, exiting 1", kind, status)
+	}
+}
+
+func TestTeeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var console bytes.Buffer
+	defer func(w io.Writer, flags int) {
+		logOutput = w
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}(logOutput, log.Flags())
+	logOutput = &console
+	log.SetOutput(logOutput)
+	log.SetFlags(0)
+
+	name, closeLog := teeLog(filepath.Join(dir, "logs"))
+	if name == "" {
+		t.Fatalf("teeLog created no log file, logging %q", console.String())
+	}
+	log.Print("Resolving the revision...")
+	if err := run(exec.Command("echo", "subprocess output")); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+	log.Print("after the log file is closed")
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Resolving the revision...\nsubprocess output\n"; string(b) != want || !strings.HasPrefix(console.String(), want) {
+		t.Errorf("the log file has %q and the console %q; want both to start with %q and the file to have only that", b, console.String(), want)
+	}
+
+	// A log directory that cannot be created leaves the log on the console alone.
+	console.Reset()
+	if name, closeLog := teeLog(filepath.Join(name, "logs")); name != "" {
+		closeLog()
+		t.Fatalf("teeLog created %s under a file", name)
+	}
+	log.Print("console only")
+	if !strings.Contains(console.String(), "WARNING: failed to create") || !strings.HasSuffix(console.String(), "console only\n") {
+		t.Errorf("with an unwritable log directory, the console has %q; want a warning and the log", console.String())
+	}
+}
+
+func TestGenerateChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	// Lists every source in src/crypto but unlisted.c, in the files of the formats it is given.
+	const generator = `import os, sys
+open("ran", "a").write(" ".join(sys.argv[1:]) + "\n")
+files = "".join('"%s",\n' % os.path.join(r, f) for r, _, fs in sorted(os.walk("src/crypto")) for f in sorted(fs) if f != "unlisted.c")
+if "gn" in sys.argv:
+    open("BUILD.generated.gni", "w").write(files)
+    open("BUILD.generated_tests.gni", "w").close()
+if "android" in sys.argv:
+    open("sources.bp", "w").write(files)
+`
+	git := func(args ...string) {
+		t.Helper()
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com", "-C", src}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(files map[string]string) revision {
+		t.Helper()
+		for name, content := range files {
+			name = filepath.Join(src, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git("add", ".")
+		git("commit", "-q", "-m", "Change")
+		sha1, err := revParse(src, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha1
+	}
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	base := commit(map[string]string{"util/generate_build_files.py": generator, "crypto/aes.c": "// AES\n", "ssl/ssl.c": "// SSL\n", "README.md": "# BoringSSL\n"})
+	docs := commit(map[string]string{"README.md": "# BoringSSL, updated\n"})
+	crypto := commit(map[string]string{"crypto/sha/sha.c": "// SHA\n", "crypto/aes.c": "// AES, updated\n"})
+	ran := func() string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "ran"))
+		os.Remove(filepath.Join(dir, "ran"))
+		return string(b)
+	}
+
+	if err := generateChanged(log.Default(), dir, defaultGenerator, nil, base, docs, []string{"gn"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := ran(); got != "" {
+		t.Errorf("a roll changing only README.md ran the generator with %q; want it skipped", got)
+	}
+	if err := generateChanged(log.Default(), dir, defaultGenerator, nil, docs, crypto, []string{"gn"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := ran(); got != "gn\n" {
+		t.Errorf("a roll confined to crypto ran the generator with %q; want it to fall back to generating gn in full", got)
+	}
+
+	// Without gn, the stale GN files from the last roll do not count.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.generated.gni"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateChanged(log.Default(), dir, defaultGenerator, nil, docs, crypto, []string{"android"}, nil); err != nil {
+		t.Errorf("a roll generating only android checked the stale GN files: %s", err)
+	}
+	if got := ran(); got != "android\n" {
+		t.Errorf("a roll generating only android ran the generator with %q", got)
+	}
+
+	unlisted := commit(map[string]string{"crypto/unlisted.c": "// Unlisted\n"})
+	err = generateChanged(log.Default(), dir, defaultGenerator, nil, crypto, unlisted, []string{"gn", "android"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "added sources missing from the generated BUILD.generated.gni, BUILD.generated_tests.gni, sources.bp: crypto/unlisted.c") {
+		t.Errorf("a roll adding a source the generator does not list returned %v", err)
+	}
+}
+
+func TestCheckFIPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		t.Helper()
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("src/crypto/aes/aes.c", "// AES\n")
+	if err := checkFIPS(dir, defaultFIPSFiles, []string{"gn"}); err == nil || !strings.Contains(err.Error(), "FIPS module files missing from src: crypto/fipsmodule") {
+		t.Errorf("checkFIPS of a tree without crypto/fipsmodule = %v; want it to fail", err)
+	}
+
+	write("src/crypto/fipsmodule/bcm.c", "// BCM\n")
+	write("BUILD.generated.gni", "# Mentions src/crypto/fipsmodule/bcm.c only in a comment.\ncrypto_sources = [\n  \"src/crypto/aes/aes.c\",\n]\n")
+	write("BUILD.generated_tests.gni", "")
+	if err := checkFIPS(dir, defaultFIPSFiles, []string{"gn"}); err == nil || !strings.Contains(err.Error(), "the generated gn build files define no FIPS target building crypto/fipsmodule/bcm.c") {
+		t.Errorf("checkFIPS with no GN target building bcm.c = %v; want it to fail", err)
+	}
+	write("sources.bp", "cc_defaults {\n    name: \"libcrypto_bcm_sources\",\n    srcs: [\n        \"src/crypto/fipsmodule/bcm.c\",\n    ],\n}\n")
+	if err := checkFIPS(dir, defaultFIPSFiles, []string{"android"}); err != nil {
+		t.Errorf("checkFIPS of only the android build files, which build bcm.c, checked the stale GN files: %s", err)
+	}
+	write("BUILD.generated.gni", "crypto_sources = [\n  \"src/crypto/aes/aes.c\",\n]\n\nfips_fragments = [\n  \"src/crypto/fipsmodule/bcm.c\",\n]\n")
+	if err := checkFIPS(dir, defaultFIPSFiles, []string{"gn", "android"}); err != nil {
+		t.Errorf("checkFIPS of build files with FIPS targets: %s", err)
+	}
+
+	if _, err := roll(dir, &rollOptions{buildFormats: []string{"gn"}, checkFIPS: true, skip: []string{"gn"}}); err == nil || !strings.Contains(err.Error(), "cannot be used with --skip=gn") {
+		t.Errorf("roll with --check-fips --skip=gn = %v; want it refused", err)
+	}
+}
+
+// An entry of an archive that newTar writes.
+type tarEntry struct {
+	name     string
+	typeflag byte // tar.TypeReg if zero.
+	contents string
+	linkname string
+}
+
+// Returns a tar archive of |entries|, in order.
+func newTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: e.typeflag, Linkname: e.linkname, Size: int64(len(e.contents))}
+		if e.typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestExtractTarballSubtree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	tarball := newTar(t, tarEntry{name: "crypto/a.c", contents: "int a;\n"}, tarEntry{name: "crypto/test/a_test.cc", contents: "// Test\n"}, tarEntry{name: "ssl/b.c", contents: "int b;\n"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(tarball) }))
+	defer server.Close()
+	dir := filepath.Join(tmp, "boringssl")
+	if err := os.MkdirAll(filepath.Join(dir, "src", "ssl"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "ssl", "old.c"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &rollOptions{tarballURL: server.URL + "/{revision}.tar", expectedSHA256: fmt.Sprintf("%x", sha256.Sum256(tarball)), subtree: "crypto", excludes: []string{"*/test"}}
+	if _, err := extractSources(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, false); err != nil {
+		t.Fatal(err)
+	}
+	files, err := walkFiles(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(files, " "); got != "crypto/a.c" {
+		t.Errorf("extracting a tarball with --subtree=crypto --exclude=*/test left %s in src; want only crypto/a.c", got)
+	}
+
+	opts.subtree = "include"
+	if _, err := extractSources(dir, "d5aae81fb79f5174ad348890b49a6c8f2d250c26", opts, false); err == nil || !strings.Contains(err.Error(), `subtree "include" does not exist`) {
+		t.Errorf("extracting a tarball with a subtree it lacks = %v; want an error", err)
+	}
+}
+
+func TestExtractCaseCollisions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	var logged bytes.Buffer
+	defer func(w io.Writer) { log.SetOutput(w) }(logOutput)
+	log.SetOutput(&logged)
+
+	for _, tt := range []struct {
+		a, b string
+	}{
+		{"crypto/aes.c", "crypto/AES.c"},
+		{"crypto/aes.c", "Crypto/sha.c"},
+	} {
+		archive := newTar(t, tarEntry{name: tt.a, contents: "first\n"}, tarEntry{name: tt.b, contents: "second\n"})
+		dst := filepath.Join(tmp, "strict")
+		os.RemoveAll(dst)
+		err := extractTar(bytes.NewReader(archive), dst, tarOptions{})
+		if err == nil || !strings.Contains(err.Error(), "differ only in case") {
+			t.Errorf("extracting %s and %s = %v; want an error", tt.a, tt.b, err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(tt.b))); !os.IsNotExist(err) {
+			t.Errorf("extracting %s and %s wrote %s before failing: %v", tt.a, tt.b, tt.b, err)
+		}
+
+		var zb bytes.Buffer
+		zw := zip.NewWriter(&zb)
+		for _, name := range []string{tt.a, tt.b} {
+			if _, err := zw.Create(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractZip(zb.Bytes(), filepath.Join(tmp, "zip"), tarOptions{}); err == nil || !strings.Contains(err.Error(), "differ only in case") {
+			t.Errorf("extracting a zip archive of %s and %s = %v; want an error", tt.a, tt.b, err)
+		}
+
+		logged.Reset()
+		if err := extractTar(bytes.NewReader(archive), filepath.Join(tmp, "allowed"), tarOptions{allowCaseCollisions: true}); err != nil {
+			t.Errorf("extracting %s and %s with --allow-case-collisions: %s", tt.a, tt.b, err)
+		}
+		if !strings.Contains(logged.String(), "WARNING: archive entries") {
+			t.Errorf("extracting %s and %s with --allow-case-collisions logged %q; want a warning", tt.a, tt.b, logged.String())
+		}
+	}
+	if err := extractTar(bytes.NewReader(newTar(t, tarEntry{name: "crypto/", typeflag: tar.TypeDir}, tarEntry{name: "crypto/aes.c"}, tarEntry{name: "./crypto/sha.c"})), filepath.Join(tmp, "distinct"), tarOptions{}); err != nil {
+		t.Errorf("extracting entries that differ in more than case: %s", err)
+	}
+}
+
+func TestExtractHardlinkThroughSymlink(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(tmp, "dst")
+	archive := newTar(t, tarEntry{name: "evil", typeflag: tar.TypeSymlink, linkname: outside}, tarEntry{name: "passwd", typeflag: tar.TypeLink, linkname: "evil/passwd"})
+	if err := extractTar(bytes.NewReader(archive), dst, tarOptions{}); err == nil {
+		t.Error("extracting a hardlink through a symlink out of the destination succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("extracting a hardlink through a symlink out of the destination created it: %v", err)
+	}
+}
+
+func TestEmitPatch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+	git := func(args ...string) {
+		t.Helper()
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(upstream, "crypto", "a.c"), "int a;\n")
+	git("init", "-q", upstream)
+	git("-C", upstream, "add", ".")
+	git("-C", upstream, "commit", "-q", "-m", "Add a.c")
+	git("clone", "-q", upstream, filepath.Join(dir, "src"))
+	old, err := currentRevision(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(dir, readmeName), "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/"+string(old)+"/\n")
+	write(filepath.Join(dir, ".gitignore"), "/src/\n")
+	git("init", "-q", dir)
+	git("-C", dir, "add", ".")
+	git("-C", dir, "commit", "-q", "-m", "Roll BoringSSL")
+	write(filepath.Join(upstream, "crypto", "b.c"), "int b;\n")
+	write(filepath.Join(upstream, "crypto", "a.c"), "int a = 1;\n")
+	git("-C", upstream, "add", ".")
+	git("-C", upstream, "commit", "-q", "-m", "Add b.c")
+	git("-C", filepath.Join(dir, "src"), "fetch", "-q", "origin")
+	git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto")
+	// The tree as it was, to apply the patch to.
+	original := filepath.Join(tmp, "original")
+	if err := os.Mkdir(original, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(dir, original, false, func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := filepath.Join(tmp, "roll.patch")
+	opts := &rollOptions{commit: "origin/HEAD", buildFormats: []string{"gn"}, generator: defaultGenerator, skip: []string{"headers", "gn", "absolute-paths", "rust"}}
+	if err := emitPatch(dir, opts, patch); err != nil {
+		t.Fatal(err)
+	}
+	if sha1, err := currentRevision(dir); err != nil || sha1 != old {
+		t.Errorf("src is at %s, %v after --emit-patch; want it left at %s", sha1, err, old)
+	}
+	for _, repo := range []string{dir, filepath.Join(dir, "src")} {
+		if out, err := output(exec.Command("git", "-C", repo, "status", "--porcelain")); err != nil || len(out) != 0 {
+			t.Errorf("--emit-patch changed %s: %q, %v", repo, out, err)
+		}
+	}
+
+	git("-C", original, "apply", patch)
+	for name, want := range map[string]string{"src/crypto/a.c": "int a = 1;\n", "src/crypto/b.c": "int b;\n"} {
+		if b, err := ioutil.ReadFile(filepath.Join(original, filepath.FromSlash(name))); err != nil || string(b) != want {
+			t.Errorf("after applying the patch, %s is %q, %v; want %q", name, b, err, want)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(original, readmeName)); err != nil || strings.Contains(string(b), string(old)) {
+		t.Errorf("after applying the patch, %s is %q, %v; want it to record the new revision", readmeName, b, err)
+	}
+}
+
+func TestBindgenVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin, ran := filepath.Join(dir, "bin"), filepath.Join(dir, "ran")
+	for name, content := range map[string]string{
+		filepath.Join(bin, "bindgen"): "#!/bin/sh\necho bindgen 0.69.1\n",
+		// Records the version override bindgen.sh is given.
+		filepath.Join(dir, "rust", "boringssl-sys", "bindgen.sh"): "#!/bin/sh\nBINDGEN_EXPECTED_VERSION=\"bindgen 0.69.1\"\necho \"override=$BINDGEN_EXPECTED_VERSION_OVERRIDE\" >> " + ran + "\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ranWith := func() string {
+		b, _ := ioutil.ReadFile(ran)
+		os.Remove(ran)
+		return string(b)
+	}
+
+	// The pinned version, through the rust step, which records it in the manifest.
+	const sha1 = revision("d5aae81fb79f5174ad348890b49a6c8f2d250c26")
+	var skip []string
+	for _, s := range rollSteps(dir, sha1, &rollOptions{}, &manifest{}) {
+		if s.name != "rust" {
+			skip = append(skip, s.name)
+		}
+	}
+	m := &manifest{}
+	if _, err := runSteps(dir, sha1, rollSteps(dir, sha1, &rollOptions{skip: skip}, m), false, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if m.BindgenVersion != "bindgen 0.69.1" {
+		t.Errorf("the manifest records bindgen version %q; want bindgen 0.69.1", m.BindgenVersion)
+	}
+	if got := ranWith(); got != "override=\n" {
+		t.Errorf("with the pinned version, bindgen.sh ran with %q; want no override", got)
+	}
+
+	var logged bytes.Buffer
+	version, err := generateRustBindings(log.New(&logged, "", 0), dir, "bindgen 0.53.2", false)
+	if err != nil || version != "bindgen 0.69.1" {
+		t.Errorf("generateRustBindings with another expected version = %q, %v; want the installed version", version, err)
+	}
+	if !strings.Contains(logged.String(), `WARNING: unexpected version of bindgen: got "bindgen 0.69.1"; wanted "bindgen 0.53.2"`) {
+		t.Errorf("generateRustBindings with another expected version logged %q; want a warning", logged.String())
+	}
+	if got := ranWith(); got != "override=bindgen 0.69.1\n" {
+		t.Errorf("with another expected version, bindgen.sh ran with %q; want it told to accept the installed version", got)
+	}
+
+	_, err = generateRustBindings(log.New(ioutil.Discard, "", 0), dir, "bindgen 0.53.2", true)
+	var be *bindgenError
+	if !errors.As(err, &be) || !strings.Contains(err.Error(), "unexpected version of bindgen") {
+		t.Errorf("generateRustBindings with another expected version under --strict-bindgen-version = %v; want a bindgen error", err)
+	}
+	if got := ranWith(); got != "" {
+		t.Errorf("under --strict-bindgen-version, bindgen.sh ran with %q; want it not run", got)
+	}
+}
+
+func TestSubtreeOfBranch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "boringssl")
+	src := filepath.Join(dir, "src")
+	git := func(args ...string) {
+		t.Helper()
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com", "-C", src}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(files ...string) {
+		t.Helper()
+		for _, name := range files {
+			name = filepath.Join(src, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte("// "+name+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git("add", ".")
+		git("commit", "-q", "-m", "Add "+strings.Join(files, ", "))
+	}
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q", "-b", "main")
+	commit("crypto/a.c", "ssl/s.c")
+	git("checkout", "-q", "-b", "vendor")
+	git("rm", "-q", "-r", "ssl")
+	commit("crypto/vendor/v.c")
+	git("checkout", "-q", "main")
+	sha1, err := revParse(src, "vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = extractSources(dir, sha1, &rollOptions{commit: "vendor", subtree: "ssl"}, false)
+	if err == nil || !strings.Contains(err.Error(), `subtree "ssl" does not exist at vendor`) {
+		t.Errorf("extracting ssl, which only main has, of the vendor branch = %v; want an error naming the subtree and branch", err)
+	}
+
+	var archived [][]string
+	defer func(saved func(*exec.Cmd) error) { startCommand = saved }(startCommand)
+	startCommand = func(cmd *exec.Cmd) error {
+		if len(cmd.Args) > 3 && cmd.Args[3] == "archive" {
+			archived = append(archived, cmd.Args[3:])
+		}
+		return cmd.Start()
+	}
+	if _, err := extractSources(dir, sha1, &rollOptions{commit: "vendor", subtree: "crypto"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"archive", "--format=tar", "--worktree-attributes", string(sha1), "--", "crypto"}}; fmt.Sprint(archived) != fmt.Sprint(want) {
+		t.Errorf("extracting crypto of the vendor branch ran git %q; want %q", archived, want)
+	}
+	files, err := walkFiles(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		if !strings.HasPrefix(f, ".git/") {
+			got = append(got, f)
+		}
+	}
+	if strings.Join(got, " ") != "crypto/a.c crypto/vendor/v.c" {
+		t.Errorf("src holds %q after extracting crypto of the vendor branch; want its crypto directory", got)
+	}
+
+}
+
+func TestShallowFetch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+	git := func(args ...string) {
+		t.Helper()
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q", "-b", "main", upstream)
+	for i := 0; i < 3; i++ {
+		git("-C", upstream, "commit", "-q", "--allow-empty", "-m", fmt.Sprintf("Commit %d", i))
+	}
+	git("init", "-q", filepath.Join(dir, "src"))
+	tip, err := revParse(upstream, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched []string
+	defer func(saved func(*exec.Cmd) error) { startCommand = saved }(startCommand)
+	startCommand = func(cmd *exec.Cmd) error {
+		if len(cmd.Args) > 3 && cmd.Args[3] == "fetch" {
+			fetched = cmd.Args[4:]
+		}
+		return cmd.Start()
+	}
+	// A file URL, as git ignores --depth for local paths.
+	sha1, err := resolveCommit(dir, &rollOptions{upstreamURL: "file://" + upstream, commit: "main", shallow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha1 != tip {
+		t.Errorf("resolveCommit with --shallow = %s; want the tip of main, %s", sha1, tip)
+	}
+	if want := []string{"--depth=1", "--", "file://" + upstream, "main"}; fmt.Sprint(fetched) != fmt.Sprint(want) {
+		t.Errorf("resolveCommit with --shallow fetched with %q; want %q", fetched, want)
+	}
+	if out, err := output(exec.Command("git", "-C", filepath.Join(dir, "src"), "rev-list", "--count", string(sha1))); err != nil || string(out) != "1" {
+		t.Errorf("src has %q, %v commits of main after a shallow fetch; want 1", out, err)
+	}
+}
+
+// Runs |f| and returns what it wrote to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stdout = saved }(os.Stdout)
+	os.Stdout = w
+	read := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		read <- b
+	}()
+	f()
+	w.Close()
+	return string(<-read)
+}
+
+func TestPrintConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "roll.json")
+	if err := ioutil.WriteFile(config, []byte(`{"commit": "origin/config", "jobs": 4, "min-age": "48h", "exclude": ["fuzz", "third_party"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(commitEnv, os.Getenv(commitEnv))
+	os.Setenv(commitEnv, "origin/env")
+
+	var status int
+	var logged string
+	out := captureStdout(t, func() { status, logged = runRollMain("--config="+config, "--jobs=2", "--print-config") })
+	if status != 0 {
+		t.Fatalf("--print-config exited %d, logging %q", status, logged)
+	}
+	var settings map[string]struct {
+		Value  interface{} `json:"value"`
+		Source string      `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(out), &settings); err != nil {
+		t.Fatalf("--print-config printed %q, which is not JSON: %s", out, err)
+	}
+	for name, want := range map[string]string{
+		"commit":       "origin/env env",
+		"jobs":         "2 flag",
+		"min-age":      "48h0m0s config",
+		"exclude":      "[fuzz third_party] config",
+		"upstream-url": " default",
+		"config":       config + " flag",
+	} {
+		if got := fmt.Sprint(settings[name].Value) + " " + settings[name].Source; got != want {
+			t.Errorf("--print-config reports %s as %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestStrictSecurity(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+	git := func(args ...string) {
+		t.Helper()
+		if err := run(exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(upstream, "crypto", "a.c"), "int a;\n")
+	git("init", "-q", upstream)
+	git("-C", upstream, "add", ".")
+	git("-C", upstream, "commit", "-q", "-m", "Add a.c")
+	git("clone", "-q", upstream, filepath.Join(dir, "src"))
+	old, err := currentRevision(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readme := "Upstream revision:\nhttps://fuchsia.googlesource.com/third_party/boringssl/+/" + string(old) + "/\n"
+	write(filepath.Join(dir, readmeName), readme)
+	write(filepath.Join(upstream, "crypto", "b.c"), "int b;\n")
+	git("-C", upstream, "add", ".")
+	git("-C", upstream, "commit", "-q", "-m", "Add b.c")
+	write(filepath.Join(upstream, "crypto", "a.c"), "int a[2];\n")
+	git("-C", upstream, "commit", "-q", "-a", "-m", "Fix a buffer overflow in a.c")
+	git("-C", filepath.Join(dir, "src"), "fetch", "-q", "origin")
+	git("-C", filepath.Join(dir, "src"), "remote", "set-head", "origin", "--auto")
+
+	opts := func(strict bool) *rollOptions {
+		return &rollOptions{
+			commit:         "origin/HEAD",
+			buildFormats:   []string{"gn"},
+			generator:      defaultGenerator,
+			skip:           []string{"headers", "gn", "absolute-paths", "rust"},
+			strictSecurity: strict,
+		}
+	}
+	if _, err := roll(dir, opts(true)); err == nil || !strings.Contains(err.Error(), "the roll includes 1 security-relevant commits") || !strings.Contains(err.Error(), "aborting because of --strict-security") {
+		t.Fatalf("roll with --strict-security = %v, want it to abort on the security-relevant commit", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, readmeName)); err != nil || string(b) != readme {
+		t.Errorf("%s after the aborted roll = %q, %v; want it unchanged", readmeName, b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "crypto", "b.c")); !os.IsNotExist(err) {
+		t.Errorf("src/crypto/b.c exists after the aborted roll (%v); want src unchanged", err)
+	}
+
+	// Without --strict-security, the same roll only warns.
+	m, err := roll(dir, opts(false))
+	if err != nil {
+		t.Fatalf("roll without --strict-security failed: %s", err)
+	}
+	if now, err := currentRevision(dir); err != nil || string(now) != m.Revision || now == old {
+		t.Errorf("revision after the roll = %s, %v; want %s", now, err, m.Revision)
+	}
+}
+
+func TestMinAge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "roll_boringssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	upstream, dir := filepath.Join(tmp, "upstream"), filepath.Join(tmp, "boringssl")
+	now := time.Now()
+	// Runs git with the committer date |age| ago.
+	git := func(age time.Duration, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=roll", "-c", "user.email=roll@example.com"}, args...)...)
+		date := fmt.Sprintf("@%d +0000", now.Add(-age).Unix())
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date, "GIT_AUTHOR_DATE="+date)
+		if err := run(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := 24 * time.Hour
+	git(0, "init", "-q", "-b", "main", upstream)
+	git(10*day, "-C", upstream, "commit", "-q", "--allow-empty", "-m", "Ten days old")
+	git(0, "-C", upstream, "checkout", "-q", "-b", "side")
+	git(5*day, "-C", upstream, "commit", "-q", "--allow-empty", "-m", "Five days old, off the first-parent history")
+	git(0, "-C", upstream, "checkout", "-q", "main")
+	git(time.Hour, "-C", upstream, "commit", "-q", "--allow-empty", "-m", "An hour old")
+	git(0, "-C", upstream, "merge", "-q", "--no-ff", "-m", "Merge side", "side")
+	git(0, "init", "-q", filepath.Join(dir, "src"))
+	rev := func(name string) revision {
+		t.Helper()
+		sha1, err := revParse(upstream, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha1
+	}
+	tip, hourOld, tenDaysOld := rev("main"), rev("main^"), rev("main~2")
+
+	for _, test := range []struct {
+		minAge time.Duration
+		want   revision
+	}{
+		{0, tip},
+		{time.Minute, hourOld},
+		// The five days old commit on the side branch is not a candidate.
+		{3 * day, tenDaysOld},
+		{10*day - time.Minute, tenDaysOld},
+		{11 * day, ""},
+	} {
+		sha1, err := resolveCommit(dir, &rollOptions{upstreamURL: upstream, commit: "main", minAge: test.minAge})
+		if test.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "is at least "+test.minAge.String()+" old") {
+				t.Errorf("resolveCommit with --min-age=%s = %s, %v; want an error that no commit is old enough", test.minAge, sha1, err)
+			}
+		} else if err != nil || sha1 != test.want {
+			t.Errorf("resolveCommit with --min-age=%s = %s, %v; want %s", test.minAge, sha1, err, test.want)
+		}
+	}
+}
@@ -6,6 +6,10 @@
 
 set -e
 
+# Go to the directory this script lives in, which the paths below are relative to
+readonly SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR"
+
 # Hard-coded paths
 readonly LIBC="$FUCHSIA_DIR/zircon/third_party/ulib/musl"
 readonly BSSL="../../src"
@@ -26,6 +30,9 @@ fi
 # recent version of bindgen is available, "roll" bindgen by updating the
 # `BINDGEN_EXPECTED_VERSION` variable here.
 BINDGEN_EXPECTED_VERSION="bindgen 0.53.2"
+# roll_boringssl.go sets BINDGEN_EXPECTED_VERSION_OVERRIDE when asked to proceed
+# with a different version of bindgen than the one pinned here.
+BINDGEN_EXPECTED_VERSION="${BINDGEN_EXPECTED_VERSION_OVERRIDE:-$BINDGEN_EXPECTED_VERSION}"
 BINDGEN_GOT_VERSION="$(bindgen --version)"
 if [ "$BINDGEN_GOT_VERSION" != "$BINDGEN_EXPECTED_VERSION" ]; then
     echo "Unexpected version of bindgen: got $BINDGEN_GOT_VERSION; wanted $BINDGEN_EXPECTED_VERSION.
@@ -33,10 +40,6 @@ If a newer version is available, edit this script to pin to that version." >&2
     exit 1
 fi
 
-# Go to the directory this script lives in
-readonly SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
-cd "$SCRIPT_DIR"
-
 # Construct a header file which imports every BoringSSL header.
 for header in $(ls $BSSL/include/openssl/); do
     # Skip certain headers which contain platform-specific logic, and will not